@@ -46,6 +46,16 @@ func (m *Map) Get(name string) uint {
 	return cid
 }
 
+// Lookup returns the ID of the named node and whether it has one, without
+// assigning a new ID.
+func (m *Map) Lookup(name string) (uint, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	cid, ok := m.toCid[name]
+	return cid, ok
+}
+
 func (m *Map) Name(cid uint) string {
 	m.Lock()
 	defer m.Unlock()
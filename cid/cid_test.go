@@ -25,3 +25,22 @@ func TestGet(t *testing.T) {
 		t.Errorf("Unexpected id %d != %c", i, LocalID)
 	}
 }
+
+func TestLookup(t *testing.T) {
+	m := NewMap()
+
+	if _, ok := m.Lookup("foo"); ok {
+		t.Error("Unexpected ID for unknown name")
+	}
+	if names := m.Names(); len(names) != 1 {
+		t.Errorf("Lookup assigned an ID: %v", names)
+	}
+	m.Get("foo")
+	if i, ok := m.Lookup("foo"); !ok || i != 1 {
+		t.Errorf("Unexpected id %d, %v != 1, true", i, ok)
+	}
+	m.Clear("foo")
+	if _, ok := m.Lookup("foo"); ok {
+		t.Error("Unexpected ID after clear")
+	}
+}
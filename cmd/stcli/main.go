@@ -137,6 +137,15 @@ func (m Model) Request(nodeID, repo string, name string, offset int64, size int)
 	return nil, io.EOF
 }
 
+func (m Model) List(nodeID, repo, after string, max int) ([]protocol.FileInfo, int) {
+	log.Println("Received listing request")
+	return nil, 0
+}
+
+func (m Model) Availability(nodeID, repo, name string, version uint64, blocks []byte) {
+	log.Println("Received availability")
+}
+
 func (m Model) Close(nodeID string, err error) {
 	log.Println("Received close")
 }
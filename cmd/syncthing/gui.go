@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -84,6 +85,11 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	router.Get("/rest/version", restGetVersion)
 	router.Get("/rest/model", restGetModel)
 	router.Get("/rest/need", restGetNeed)
+	router.Get("/rest/compare", restGetCompare)
+	router.Get("/rest/audit", restGetAudit)
+	router.Get("/rest/debug", restGetDebug)
+	router.Get("/rest/metrics", restGetMetrics)
+	router.Get("/rest/rate", restGetRate)
 	router.Get("/rest/connections", restGetConnections)
 	router.Get("/rest/config", restGetConfig)
 	router.Get("/rest/config/sync", restGetConfigInSync)
@@ -99,6 +105,7 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	router.Post("/rest/error", restPostError)
 	router.Post("/rest/error/clear", restClearErrors)
 	router.Post("/rest/discovery/hint", restPostDiscoveryHint)
+	router.Post("/rest/hydrate", restPostHydrate)
 
 	mr := martini.New()
 	if len(cfg.User) > 0 && len(cfg.Password) > 0 {
@@ -155,6 +162,19 @@ func restGetModel(m *model.Model, w http.ResponseWriter, r *http.Request) {
 
 	res["state"] = m.State(repo)
 
+	if eta, err := m.ETA(repo); err == nil && needBytes > 0 {
+		res["eta"] = eta
+	}
+
+	// Until the first scan, show what was known before the restart
+	if s, err := m.Summary(repo); err == nil && s.Restored {
+		res["globalFiles"], res["globalBytes"] = s.GlobalFiles, s.GlobalBytes
+		res["needFiles"], res["needBytes"] = s.NeedFiles, s.NeedBytes
+		res["inSyncFiles"], res["inSyncBytes"] = s.InSyncFiles, s.InSyncBytes
+		res["state"] = s.State
+		res["restored"] = true
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(res)
 }
@@ -169,6 +189,72 @@ func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(files)
 }
 
+func restGetCompare(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	var offset, _ = strconv.Atoi(qs.Get("offset"))
+	var limit, _ = strconv.Atoi(qs.Get("limit"))
+
+	res, err := m.CompareRepos(repo, offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// restGetAudit writes the audit results as a stream of JSON objects, one per
+// file, as they become available.
+func restGetAudit(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	var enc = json.NewEncoder(w)
+	var flusher, _ = w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := m.AuditRepo(repo, func(res model.AuditResult) {
+		enc.Encode(res)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), 404)
+	}
+}
+
+func restGetDebug(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+
+	state, err := m.DebugState(repo)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func restGetRate(m *model.Model, w http.ResponseWriter) {
+	total, repos := m.TransferRate()
+	res := map[string]interface{}{
+		"total":        total,
+		"repositories": repos,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restGetMetrics(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	m.MetricsHandler().ServeHTTP(w, r)
+}
+
 func restGetConnections(m *model.Model, w http.ResponseWriter) {
 	var res = m.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json")
@@ -297,6 +383,16 @@ func restPostDiscoveryHint(r *http.Request) {
 	}
 }
 
+func restPostHydrate(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	var file = qs.Get("file")
+
+	if err := m.Hydrate(repo, file); err != nil {
+		http.Error(w, err.Error(), 404)
+	}
+}
+
 func restGetDiscovery(w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(discoverer.All())
 }
@@ -252,6 +252,7 @@ func main() {
 	}
 
 	m := model.NewModel(confDir, &cfg, "syncthing", Version)
+	m.SetNodeID(myID)
 
 	for _, repo := range cfg.Repositories {
 		if repo.Invalid != "" {
@@ -27,13 +27,45 @@ type Configuration struct {
 }
 
 type RepositoryConfiguration struct {
-	ID          string                  `xml:"id,attr"`
-	Directory   string                  `xml:"directory,attr"`
-	Nodes       []NodeConfiguration     `xml:"node"`
-	ReadOnly    bool                    `xml:"ro,attr"`
-	IgnorePerms bool                    `xml:"ignorePerms,attr"`
-	Invalid     string                  `xml:"-"` // Set at runtime when there is an error, not saved
-	Versioning  VersioningConfiguration `xml:"versioning"`
+	ID                 string                  `xml:"id,attr"`
+	Directory          string                  `xml:"directory,attr"`
+	Nodes              []NodeConfiguration     `xml:"node"`
+	ReadOnly           bool                    `xml:"ro,attr"`
+	IgnorePerms        bool                    `xml:"ignorePerms,attr"`
+	PermsMode          string                  `xml:"permsMode,attr,omitempty"`
+	SpecialPermBits    bool                    `xml:"specialPermBits,attr,omitempty"`
+	ChunkerType        string                  `xml:"chunker,attr,omitempty"`
+	MinConnectedPeers  int                     `xml:"minConnectedPeers,attr,omitempty"`
+	LastResortNodes    []string                `xml:"lastResortNode,omitempty"`
+	DeniedNodes        []string                `xml:"deniedNode,omitempty"`
+	InPlaceUpdate      bool                    `xml:"inPlaceUpdate,attr,omitempty"`
+	IncrementalVerify  bool                    `xml:"incrementalVerify,attr,omitempty"`
+	VerifyCopySource   bool                    `xml:"verifyCopySource,attr,omitempty"`
+	ReportDrift        bool                    `xml:"reportDrift,attr,omitempty"`
+	VerifyOnly         bool                    `xml:"verifyOnly,attr,omitempty"`
+	MaxTempBytes       int64                   `xml:"maxTempBytes,attr,omitempty"`
+	DirAtomic          bool                    `xml:"dirAtomic,attr,omitempty"`
+	CompressFiles      bool                    `xml:"compressFiles,attr,omitempty"`
+	MetadataOnly       bool                    `xml:"metadataOnly,attr,omitempty"`
+	IgnoreTempPatterns []string                `xml:"ignoreTempPattern,omitempty"`
+	PriorityPatterns   []string                `xml:"priorityPattern,omitempty"`
+	StaticPatterns     []string                `xml:"staticPattern,omitempty"`
+	PreserveHardlinks  bool                    `xml:"preserveHardlinks,attr,omitempty"`
+	DeleteGraceHours   int                     `xml:"deleteGraceHours,attr,omitempty"`
+	DeleteRetries      int                     `xml:"deleteRetries,attr,omitempty"`
+	DiskIndex          bool                    `xml:"diskIndex,attr,omitempty"`
+	ScanCache          bool                    `xml:"scanCache,attr,omitempty"`
+	KeepDeletedFiles   bool                    `xml:"keepDeletedFiles,attr,omitempty"`
+	TrashMaxAgeDays    int                     `xml:"trashMaxAgeDays,attr,omitempty"`
+	TrashMaxSizeMiB    int                     `xml:"trashMaxSizeMiB,attr,omitempty"`
+	FailedTempsMax     int                     `xml:"failedTempsMax,attr,omitempty"`
+	ConflictMaxAgeDays int                     `xml:"conflictMaxAgeDays,attr,omitempty"`
+	ConflictMaxCount   int                     `xml:"conflictMaxCount,attr,omitempty"`
+	IgnoreConflicts    bool                    `xml:"ignoreConflicts,attr,omitempty"`
+	AtomicSwap         bool                    `xml:"atomicSwap,attr,omitempty"`
+	ShareBlocks        bool                    `xml:"shareBlocks,attr,omitempty"`
+	Invalid            string                  `xml:"-"` // Set at runtime when there is an error, not saved
+	Versioning         VersioningConfiguration `xml:"versioning"`
 
 	nodeIDs []string
 }
@@ -79,6 +111,45 @@ func (c *VersioningConfiguration) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 	return nil
 }
 
+// DefaultIgnoreTempPatterns matches the temporary and partial files commonly
+// created by editors, office suites and download managers.
+var DefaultIgnoreTempPatterns = []string{
+	"*.part",
+	"*.crdownload",
+	"~$*",
+	".~lock.*#",
+	".*.swp",
+	".*.swx",
+}
+
+// TempPatterns returns the patterns for files that should never be scanned
+// because they are transient files belonging to other programs.
+func (r RepositoryConfiguration) TempPatterns() []string {
+	if r.IgnoreTempPatterns == nil {
+		return DefaultIgnoreTempPatterns
+	}
+	return r.IgnoreTempPatterns
+}
+
+// PermsModeIgnore makes the repository disregard permissions entirely: like
+// IgnorePerms, and in addition files and directories whose only difference
+// from the local copy is the permission bits are taken as in sync instead of
+// being pulled.
+const PermsModeIgnore = "ignore"
+
+// The chunker types that split files into blocks. An empty ChunkerType is
+// the same as ChunkerFixed.
+const (
+	ChunkerFixed = "fixed"
+	ChunkerCDC   = "cdc"
+)
+
+// IgnoresPerms returns true if permission bits are neither scanned nor
+// applied to files.
+func (r RepositoryConfiguration) IgnoresPerms() bool {
+	return r.IgnorePerms || r.PermsMode == PermsModeIgnore
+}
+
 func (r *RepositoryConfiguration) NodeIDs() []string {
 	if r.nodeIDs == nil {
 		for _, n := range r.Nodes {
@@ -107,6 +178,70 @@ type OptionsConfiguration struct {
 	MaxChangeKbps      int      `xml:"maxChangeKbps" default:"10000"`
 	StartBrowser       bool     `xml:"startBrowser" default:"true"`
 	UPnPEnabled        bool     `xml:"upnpEnabled" default:"true"`
+	// SourceRetries is how many times a block with no node to pull it from is retried.
+	SourceRetries int `xml:"sourceRetries" default:"6"`
+	// SourceRetryDelayS is the delay in seconds before each of those retries.
+	SourceRetryDelayS int `xml:"sourceRetryDelayS" default:"10"`
+	// WriteBufferKiB coalesces small block writes to temporary files; zero writes each directly.
+	WriteBufferKiB int `xml:"writeBufferKiB"`
+	// AbortStalePulls abandons a pull in progress when the global version of the file changes.
+	AbortStalePulls bool `xml:"abortStalePulls" default:"true"`
+	// MetadataRetries is how many times setting file metadata is retried after a transient error.
+	MetadataRetries int `xml:"metadataRetries" default:"3"`
+	// MaxBlockSizeKiB caps the size of the blocks that are requested or served.
+	MaxBlockSizeKiB int `xml:"maxBlockSizeKiB" default:"16384"`
+	// CheckSourceVersion restarts a pull when its source announces a new version mid-transfer.
+	CheckSourceVersion bool `xml:"checkSourceVersion" default:"true"`
+	// VerifyAfterSync checks pulled files on disk against the index after each sync cycle.
+	VerifyAfterSync bool `xml:"verifyAfterSync"`
+	// CopyWorkers is the number of goroutines copying blocks from existing local files.
+	CopyWorkers int `xml:"copyWorkers" default:"2"`
+	// MaxOpenSourceFiles limits the number of copy source files open at once.
+	MaxOpenSourceFiles int `xml:"maxOpenSourceFiles" default:"64"`
+	// StartupStaggerS is the longest in seconds the first scan and pull of a repository are delayed.
+	StartupStaggerS int `xml:"startupStaggerS" default:"10"`
+	// KeepFailedTemps keeps temporary files that fail verification for inspection.
+	KeepFailedTemps bool `xml:"keepFailedTemps"`
+	// MaxNewDirsPerCycle limits the directories created in each pull cycle; zero means no limit.
+	MaxNewDirsPerCycle int `xml:"maxNewDirsPerCycle"`
+	// AdaptiveDiskThrottle scales down requests while the repository's disk is busy (Linux only).
+	AdaptiveDiskThrottle bool `xml:"adaptiveDiskThrottle"`
+	// SmallFileBatch above one renames pulled files of up to one block into place in batches.
+	SmallFileBatch int `xml:"smallFileBatch"`
+	// CheckBlockLayout skips needed files whose blocks don't add up to their size.
+	CheckBlockLayout bool `xml:"checkBlockLayout" default:"true"`
+	// VerifyWorkers is the number of goroutines hashing a pulled file before it is renamed.
+	VerifyWorkers int `xml:"verifyWorkers"`
+	// ModTimeWindowS is how many seconds apart modification times may be and still be equal.
+	ModTimeWindowS int `xml:"modTimeWindowS" default:"2"`
+	// MaxWriteBacklogKiB holds back requests while this much pulled data waits to be written.
+	MaxWriteBacklogKiB int `xml:"maxWriteBacklogKiB"`
+	// CheckBlockHashes rejects received blocks that don't match the hash of the requested block.
+	CheckBlockHashes bool `xml:"checkBlockHashes" default:"true"`
+	// MmapHashMinMiB is the size from which files are hashed through a memory mapping.
+	MmapHashMinMiB int `xml:"mmapHashMinMiB"`
+	// MaxNeedAgeS is how long in seconds needed files may have no source before a rescan.
+	MaxNeedAgeS int `xml:"maxNeedAgeS"`
+	// RequestRampStart is how many requests a node is sent at first; more follow as blocks arrive.
+	RequestRampStart int `xml:"requestRampStart"`
+	// RestoreSummaries shows the saved state of each repository after a restart until it is scanned.
+	RestoreSummaries bool `xml:"restoreSummaries"`
+	// TrimOversizedBlocks drops the excess of oversized request results instead of rejecting them.
+	TrimOversizedBlocks bool `xml:"trimOversizedBlocks"`
+	// ScanRetries is how many times a scan that fails with a transient error is retried.
+	ScanRetries int `xml:"scanRetries" default:"3"`
+	// ConflictNodeID names conflict copies with the short ID of the node whose version they hold.
+	ConflictNodeID bool `xml:"conflictNodeID"`
+	// LANPreference is how many more outstanding requests a LAN node may have and still be preferred.
+	LANPreference int `xml:"lanPreference" default:"16"`
+	// FsyncFiles syncs pulled files to disk before they are recorded in the index.
+	FsyncFiles bool `xml:"fsyncFiles"`
+	// FsyncBatchFiles above one syncs that many renamed files together with their directories.
+	FsyncBatchFiles int `xml:"fsyncBatchFiles" default:"1"`
+	// FsyncIntervalS is the longest in seconds a batch of files waits to be synced.
+	FsyncIntervalS int `xml:"fsyncIntervalS" default:"5"`
+	// RequestBatchMax above one lets up to that many consecutive blocks be requested from a node at once.
+	RequestBatchMax int `xml:"requestBatchMax"`
 
 	Deprecated_ReadOnly   bool   `xml:"readOnly,omitempty" json:"-"`
 	Deprecated_GUIEnabled bool   `xml:"guiEnabled,omitempty" json:"-"`
@@ -231,10 +366,7 @@ func Load(rd io.Reader, myID string) (Configuration, error) {
 	// Sanitize node IDs
 	for i := range cfg.Nodes {
 		node := &cfg.Nodes[i]
-		// Strip spaces and dashes
-		node.NodeID = strings.Replace(node.NodeID, "-", "", -1)
-		node.NodeID = strings.Replace(node.NodeID, " ", "", -1)
-		node.NodeID = strings.ToUpper(node.NodeID)
+		node.NodeID = normalizeNodeID(node.NodeID)
 	}
 
 	// Check for missing, bad or duplicate repository ID:s
@@ -252,11 +384,25 @@ func Load(rd io.Reader, myID string) (Configuration, error) {
 			repo.ID = "default"
 		}
 
+		if repo.PermsMode != "" && repo.PermsMode != PermsModeIgnore {
+			repo.Invalid = fmt.Sprintf("unknown permissions mode %q", repo.PermsMode)
+		}
+
+		switch repo.ChunkerType {
+		case "", ChunkerFixed, ChunkerCDC:
+		default:
+			repo.Invalid = fmt.Sprintf("unknown chunker type %q", repo.ChunkerType)
+		}
+
 		for i := range repo.Nodes {
 			node := &repo.Nodes[i]
-			// Strip spaces and dashes
-			node.NodeID = strings.Replace(node.NodeID, "-", "", -1)
-			node.NodeID = strings.Replace(node.NodeID, " ", "", -1)
+			node.NodeID = normalizeNodeID(node.NodeID)
+		}
+		for i := range repo.LastResortNodes {
+			repo.LastResortNodes[i] = normalizeNodeID(repo.LastResortNodes[i])
+		}
+		for i := range repo.DeniedNodes {
+			repo.DeniedNodes[i] = normalizeNodeID(repo.DeniedNodes[i])
 		}
 
 		if seen, ok := seenRepos[repo.ID]; ok {
@@ -307,6 +453,14 @@ func Load(rd io.Reader, myID string) (Configuration, error) {
 	return cfg, err
 }
 
+// normalizeNodeID strips spaces and dashes from the node ID and converts it to
+// upper case.
+func normalizeNodeID(id string) string {
+	id = strings.Replace(id, "-", "", -1)
+	id = strings.Replace(id, " ", "", -1)
+	return strings.ToUpper(id)
+}
+
 func convertV1V2(cfg *Configuration) {
 	// Collect the list of nodes.
 	// Replace node configs inside repositories with only a reference to the nide ID.
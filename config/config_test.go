@@ -10,18 +10,49 @@ import (
 
 func TestDefaultValues(t *testing.T) {
 	expected := OptionsConfiguration{
-		ListenAddress:      []string{"0.0.0.0:22000"},
-		GlobalAnnServer:    "announce.syncthing.net:22025",
-		GlobalAnnEnabled:   true,
-		LocalAnnEnabled:    true,
-		LocalAnnPort:       21025,
-		ParallelRequests:   16,
-		MaxSendKbps:        0,
-		RescanIntervalS:    60,
-		ReconnectIntervalS: 60,
-		MaxChangeKbps:      10000,
-		StartBrowser:       true,
-		UPnPEnabled:        true,
+		ListenAddress:        []string{"0.0.0.0:22000"},
+		GlobalAnnServer:      "announce.syncthing.net:22025",
+		GlobalAnnEnabled:     true,
+		LocalAnnEnabled:      true,
+		LocalAnnPort:         21025,
+		ParallelRequests:     16,
+		MaxSendKbps:          0,
+		RescanIntervalS:      60,
+		ReconnectIntervalS:   60,
+		MaxChangeKbps:        10000,
+		StartBrowser:         true,
+		UPnPEnabled:          true,
+		SourceRetries:        6,
+		SourceRetryDelayS:    10,
+		WriteBufferKiB:       0,
+		AbortStalePulls:      true,
+		MetadataRetries:      3,
+		MaxBlockSizeKiB:      16384,
+		CheckSourceVersion:   true,
+		VerifyAfterSync:      false,
+		CopyWorkers:          2,
+		MaxOpenSourceFiles:   64,
+		StartupStaggerS:      10,
+		KeepFailedTemps:      false,
+		MaxNewDirsPerCycle:   0,
+		AdaptiveDiskThrottle: false,
+		SmallFileBatch:       0,
+		CheckBlockLayout:     true,
+		VerifyWorkers:        0,
+		ModTimeWindowS:       2,
+		MaxWriteBacklogKiB:   0,
+		CheckBlockHashes:     true,
+		MmapHashMinMiB:       0,
+		MaxNeedAgeS:          0,
+		RequestRampStart:     0,
+		RestoreSummaries:     false,
+		TrimOversizedBlocks:  false,
+		ScanRetries:          3,
+		ConflictNodeID:       false,
+		LANPreference:        16,
+		FsyncFiles:           false,
+		FsyncBatchFiles:      1,
+		FsyncIntervalS:       5,
 	}
 
 	cfg, err := Load(bytes.NewReader(nil), "nodeID")
@@ -154,23 +185,85 @@ func TestOverriddenValues(t *testing.T) {
         <maxChangeKbps>2345</maxChangeKbps>
         <startBrowser>false</startBrowser>
         <upnpEnabled>false</upnpEnabled>
+        <sourceRetries>3</sourceRetries>
+        <sourceRetryDelayS>30</sourceRetryDelayS>
+        <writeBufferKiB>1024</writeBufferKiB>
+        <abortStalePulls>false</abortStalePulls>
+        <metadataRetries>5</metadataRetries>
+        <maxBlockSizeKiB>4096</maxBlockSizeKiB>
+        <checkSourceVersion>false</checkSourceVersion>
+        <verifyAfterSync>true</verifyAfterSync>
+        <copyWorkers>4</copyWorkers>
+        <maxOpenSourceFiles>8</maxOpenSourceFiles>
+        <startupStaggerS>30</startupStaggerS>
+        <keepFailedTemps>true</keepFailedTemps>
+        <maxNewDirsPerCycle>500</maxNewDirsPerCycle>
+        <adaptiveDiskThrottle>true</adaptiveDiskThrottle>
+        <smallFileBatch>64</smallFileBatch>
+        <checkBlockLayout>false</checkBlockLayout>
+        <verifyWorkers>4</verifyWorkers>
+        <modTimeWindowS>1</modTimeWindowS>
+        <maxWriteBacklogKiB>4096</maxWriteBacklogKiB>
+        <checkBlockHashes>false</checkBlockHashes>
+        <mmapHashMinMiB>256</mmapHashMinMiB>
+        <maxNeedAgeS>1800</maxNeedAgeS>
+        <requestRampStart>2</requestRampStart>
+        <restoreSummaries>true</restoreSummaries>
+        <trimOversizedBlocks>true</trimOversizedBlocks>
+        <scanRetries>5</scanRetries>
+        <conflictNodeID>true</conflictNodeID>
+        <lanPreference>4</lanPreference>
+        <fsyncFiles>true</fsyncFiles>
+        <fsyncBatchFiles>100</fsyncBatchFiles>
+        <fsyncIntervalS>10</fsyncIntervalS>
     </options>
 </configuration>
 `)
 
 	expected := OptionsConfiguration{
-		ListenAddress:      []string{":23000"},
-		GlobalAnnServer:    "syncthing.nym.se:22025",
-		GlobalAnnEnabled:   false,
-		LocalAnnEnabled:    false,
-		LocalAnnPort:       42123,
-		ParallelRequests:   32,
-		MaxSendKbps:        1234,
-		RescanIntervalS:    600,
-		ReconnectIntervalS: 6000,
-		MaxChangeKbps:      2345,
-		StartBrowser:       false,
-		UPnPEnabled:        false,
+		ListenAddress:        []string{":23000"},
+		GlobalAnnServer:      "syncthing.nym.se:22025",
+		GlobalAnnEnabled:     false,
+		LocalAnnEnabled:      false,
+		LocalAnnPort:         42123,
+		ParallelRequests:     32,
+		MaxSendKbps:          1234,
+		RescanIntervalS:      600,
+		ReconnectIntervalS:   6000,
+		MaxChangeKbps:        2345,
+		StartBrowser:         false,
+		UPnPEnabled:          false,
+		SourceRetries:        3,
+		SourceRetryDelayS:    30,
+		WriteBufferKiB:       1024,
+		AbortStalePulls:      false,
+		MetadataRetries:      5,
+		MaxBlockSizeKiB:      4096,
+		CheckSourceVersion:   false,
+		VerifyAfterSync:      true,
+		CopyWorkers:          4,
+		MaxOpenSourceFiles:   8,
+		StartupStaggerS:      30,
+		KeepFailedTemps:      true,
+		MaxNewDirsPerCycle:   500,
+		AdaptiveDiskThrottle: true,
+		SmallFileBatch:       64,
+		CheckBlockLayout:     false,
+		VerifyWorkers:        4,
+		ModTimeWindowS:       1,
+		MaxWriteBacklogKiB:   4096,
+		CheckBlockHashes:     false,
+		MmapHashMinMiB:       256,
+		MaxNeedAgeS:          1800,
+		RequestRampStart:     2,
+		RestoreSummaries:     true,
+		TrimOversizedBlocks:  true,
+		ScanRetries:          5,
+		ConflictNodeID:       true,
+		LANPreference:        4,
+		FsyncFiles:           true,
+		FsyncBatchFiles:      100,
+		FsyncIntervalS:       10,
 	}
 
 	cfg, err := Load(bytes.NewReader(data), "nodeID")
@@ -243,7 +336,9 @@ func TestStripNodeIs(t *testing.T) {
     <repository directory="~/Sync">
         <node id="AAA ABBB-BCC CC" name=""></node>
         <node id="AA-AAB BBBD-DDD" name=""></node>
-        <node id="AAA AB-BBB EEE-E" name=""></node>
+        <node id="aaa ab-bbb eee-e" name=""></node>
+        <lastResortNode>aaaa-bbbb-dddd</lastResortNode>
+        <deniedNode>AAAA BBBB CCCC</deniedNode>
     </repository>
 </configuration>
 `)
@@ -276,4 +371,86 @@ func TestStripNodeIs(t *testing.T) {
 			t.Errorf("Repo nodes[%d] differ;\n  E: %#v\n  A: %#v", i, expected[i].NodeID, cfg.Repositories[0].Nodes[i].NodeID)
 		}
 	}
+	if id := cfg.Repositories[0].LastResortNodes[0]; id != expected[1].NodeID {
+		t.Errorf("Last resort node %q differs from %q", id, expected[1].NodeID)
+	}
+	if id := cfg.Repositories[0].DeniedNodes[0]; id != expected[0].NodeID {
+		t.Errorf("Denied node %q differs from %q", id, expected[0].NodeID)
+	}
+}
+
+func TestTempPatterns(t *testing.T) {
+	data := []byte(`
+<configuration version="2">
+    <repository id="default" directory="~/Sync">
+    </repository>
+    <repository id="custom" directory="~/Other">
+        <ignoreTempPattern>*.tmp</ignoreTempPattern>
+    </repository>
+</configuration>
+`)
+
+	cfg, err := Load(bytes.NewReader(data), "NODE1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := cfg.Repositories[0].TempPatterns(); !reflect.DeepEqual(p, DefaultIgnoreTempPatterns) {
+		t.Errorf("Incorrect default patterns %v", p)
+	}
+	if p := cfg.Repositories[1].TempPatterns(); !reflect.DeepEqual(p, []string{"*.tmp"}) {
+		t.Errorf("Incorrect configured patterns %v", p)
+	}
+}
+
+func TestPermsMode(t *testing.T) {
+	data := []byte(`
+<configuration version="2">
+    <repository id="default" directory="~/Sync">
+    </repository>
+    <repository id="ignore" directory="~/Other" permsMode="ignore">
+    </repository>
+    <repository id="bad" directory="~/Bad" permsMode="sometimes">
+    </repository>
+</configuration>
+`)
+
+	cfg, err := Load(bytes.NewReader(data), "NODE1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Repositories[0].IgnoresPerms() {
+		t.Error("Default repository should not ignore permissions")
+	}
+	if !cfg.Repositories[1].IgnoresPerms() {
+		t.Error("Repository with permsMode ignore should ignore permissions")
+	}
+	if cfg.Repositories[2].Invalid == "" {
+		t.Error("Repository with unknown permsMode should be invalid")
+	}
+}
+
+func TestChunkerType(t *testing.T) {
+	data := []byte(`
+<configuration version="2">
+    <repository id="default" directory="~/Sync">
+    </repository>
+    <repository id="cdc" directory="~/Other" chunker="cdc">
+    </repository>
+    <repository id="bad" directory="~/Bad" chunker="nonexistent">
+    </repository>
+</configuration>
+`)
+
+	cfg, err := Load(bytes.NewReader(data), "NODE1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, valid := range []bool{true, true, false} {
+		if inv := cfg.Repositories[i].Invalid; (inv == "") != valid {
+			t.Errorf("Repository %q: unexpected invalid reason %q", cfg.Repositories[i].ID, inv)
+		}
+	}
 }
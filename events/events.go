@@ -0,0 +1,198 @@
+// Package events provides a simple event log that other parts of syncthing
+// can publish to and that interested parties, such as the GUI, can
+// subscribe to.
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type EventType uint64
+
+const (
+	// ItemInUse is logged when a file cannot be updated because it is
+	// locked or in use by another process.
+	ItemInUse EventType = 1 << iota
+	// StateChanged is logged when a repository changes state, for example
+	// from syncing to idle.
+	StateChanged
+	// RepoInvalid is logged when a repository is stopped due to an error.
+	RepoInvalid
+	// IndexDiverged is logged when files on disk are found to differ from
+	// the local index after a sync cycle.
+	IndexDiverged
+	// InvalidFilename is logged when a file is not synced because its name
+	// cannot be used on this platform.
+	InvalidFilename
+	// PullVerifyFailed is logged when a pulled file does not match the
+	// hashes it was expected to have.
+	PullVerifyFailed
+	// LocalConflict is logged when a file is changed on disk while a new
+	// version of it is being pulled. The local copy is kept under another
+	// name.
+	LocalConflict
+	// InconsistentFile is logged when a needed file is not pulled because
+	// its blocks don't match its size.
+	InconsistentFile
+	// BadBlock is logged when a node sends a block that doesn't match the
+	// hash of the block requested.
+	BadBlock
+	// DeleteFailed is logged when a file deleted by another node can't be
+	// removed locally.
+	DeleteFailed
+	// StaleNeed is logged when needed files have had no source for so long
+	// that the repository is rescanned and its index sent again.
+	StaleNeed
+	// MetadataDrift is logged when the modification time or permissions of
+	// a file in a read only repository no longer match the index.
+	MetadataDrift
+
+	AllEvents = ^EventType(0)
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ItemInUse:
+		return "ItemInUse"
+	case StateChanged:
+		return "StateChanged"
+	case RepoInvalid:
+		return "RepoInvalid"
+	case IndexDiverged:
+		return "IndexDiverged"
+	case InvalidFilename:
+		return "InvalidFilename"
+	case PullVerifyFailed:
+		return "PullVerifyFailed"
+	case LocalConflict:
+		return "LocalConflict"
+	case InconsistentFile:
+		return "InconsistentFile"
+	case BadBlock:
+		return "BadBlock"
+	case DeleteFailed:
+		return "DeleteFailed"
+	case StaleNeed:
+		return "StaleNeed"
+	case MetadataDrift:
+		return "MetadataDrift"
+	default:
+		return "Unknown"
+	}
+}
+
+type Event struct {
+	ID   int
+	Time time.Time
+	Type EventType
+	Data interface{}
+}
+
+// The number of events buffered for each subscriber. When a subscriber falls
+// further behind than this, new events are dropped for it.
+const bufferSize = 64
+
+var (
+	ErrTimeout = errors.New("timeout")
+	ErrClosed  = errors.New("closed")
+)
+
+type Logger struct {
+	subs        map[int]*Subscription
+	nextEventID int
+	nextSubID   int
+	mut         sync.Mutex
+}
+
+type Subscription struct {
+	mask   EventType
+	filter func(Event) bool
+	id     int
+	events chan Event
+}
+
+var Default = NewLogger()
+
+func NewLogger() *Logger {
+	return &Logger{
+		subs: make(map[int]*Subscription),
+	}
+}
+
+// Log publishes an event of the given type to all subscribers interested in
+// it. It never blocks.
+func (l *Logger) Log(t EventType, data interface{}) {
+	l.mut.Lock()
+	l.nextEventID++
+	e := Event{
+		ID:   l.nextEventID,
+		Time: time.Now(),
+		Type: t,
+		Data: data,
+	}
+	for _, s := range l.subs {
+		if s.mask&t != 0 && (s.filter == nil || s.filter(e)) {
+			select {
+			case s.events <- e:
+			default:
+				// The subscriber is not keeping up
+			}
+		}
+	}
+	l.mut.Unlock()
+}
+
+// Subscribe returns a subscription to the event types included in mask.
+func (l *Logger) Subscribe(mask EventType) *Subscription {
+	return l.SubscribeFilter(mask, nil)
+}
+
+// SubscribeFilter returns a subscription to the events of the types included
+// in mask for which filter returns true. The filter is called with the
+// logger locked and must not log events itself.
+func (l *Logger) SubscribeFilter(mask EventType, filter func(Event) bool) *Subscription {
+	l.mut.Lock()
+	s := &Subscription{
+		mask:   mask,
+		filter: filter,
+		id:     l.nextSubID,
+		events: make(chan Event, bufferSize),
+	}
+	l.nextSubID++
+	l.subs[s.id] = s
+	l.mut.Unlock()
+	return s
+}
+
+// Unsubscribe removes the subscription. Subsequent calls to Poll on it return
+// ErrClosed once any buffered events have been consumed.
+func (l *Logger) Unsubscribe(s *Subscription) {
+	l.mut.Lock()
+	if _, ok := l.subs[s.id]; ok {
+		delete(l.subs, s.id)
+		close(s.events)
+	}
+	l.mut.Unlock()
+}
+
+// C returns the channel the subscription's events are delivered on. It is
+// closed by Unsubscribe.
+func (s *Subscription) C() <-chan Event {
+	return s.events
+}
+
+// Poll returns the next event for the subscription, waiting at most timeout
+// for one to arrive.
+func (s *Subscription) Poll(timeout time.Duration) (Event, error) {
+	select {
+	case e, ok := <-s.events:
+		if !ok {
+			return e, ErrClosed
+		}
+		return e, nil
+	case <-time.After(timeout):
+		return Event{}, ErrTimeout
+	}
+}
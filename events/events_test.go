@@ -0,0 +1,91 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+const timeout = 100 * time.Millisecond
+
+func TestSubscribe(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(ItemInUse)
+	defer l.Unsubscribe(s)
+
+	l.Log(ItemInUse, "foo")
+	e, err := s.Poll(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != ItemInUse || e.Data.(string) != "foo" {
+		t.Errorf("Unexpected event %v", e)
+	}
+}
+
+func TestSubscribeMask(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(AllEvents &^ ItemInUse)
+	defer l.Unsubscribe(s)
+
+	l.Log(ItemInUse, "foo")
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected error %v != %v", err, ErrTimeout)
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	l := NewLogger()
+	s := l.SubscribeFilter(AllEvents, func(e Event) bool { return e.Data.(string) == "foo" })
+	defer l.Unsubscribe(s)
+
+	l.Log(ItemInUse, "bar")
+	l.Log(ItemInUse, "foo")
+	select {
+	case e := <-s.C():
+		if e.Data.(string) != "foo" {
+			t.Errorf("Unexpected event %v", e)
+		}
+	case <-time.After(timeout):
+		t.Fatal("No event")
+	}
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected error %v != %v", err, ErrTimeout)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(AllEvents)
+	l.Log(ItemInUse, "foo")
+	l.Unsubscribe(s)
+	l.Log(ItemInUse, "bar")
+
+	if e, err := s.Poll(timeout); err != nil || e.Data.(string) != "foo" {
+		t.Errorf("Unexpected event %v, %v", e, err)
+	}
+	if _, err := s.Poll(timeout); err != ErrClosed {
+		t.Errorf("Unexpected error %v != %v", err, ErrClosed)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(AllEvents)
+	defer l.Unsubscribe(s)
+
+	for i := 0; i < 2*bufferSize; i++ {
+		l.Log(ItemInUse, i)
+	}
+	for i := 0; i < bufferSize; i++ {
+		e, err := s.Poll(timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Data.(int) != i {
+			t.Errorf("Unexpected event %d != %d", e.Data.(int), i)
+		}
+	}
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected error %v != %v", err, ErrTimeout)
+	}
+}
@@ -0,0 +1,431 @@
+package files
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A diskStore keeps the records in an append only log file, with only the
+// position of each record and the frequently changing usage counts and
+// flags in memory. This keeps the block lists, which make up most of the
+// size of an index, out of memory. Changes to the usage counts and flags and
+// removals are appended to the log as well, so that the records are read
+// back when the store is opened again. The log is compacted into a snapshot
+// holding only the current records when more than half of it is garbage.
+type diskStore struct {
+	fd      *os.File
+	path    string
+	entries map[Key]diskEntry
+	size    int64 // size of the log
+	garbage int64 // bytes used by deleted records and superseded changes
+	buf     []byte
+}
+
+type diskEntry struct {
+	offset int64 // of the encoded file within the log
+	length int32
+	usage  int
+	global bool
+	local  bool
+}
+
+// Each log entry is a type byte and a four byte length, followed by that
+// many bytes of data.
+const (
+	logSet    = 'S' // a new record; usage, flags and the encoded file
+	logUpdate = 'U' // the usage and flags of the record at an offset
+	logDelete = 'D' // removal of the record at an offset
+
+	logHeaderSize = 5
+	logFlagsSize  = 5 // usage and flags
+)
+
+const (
+	flagGlobal = 1 << iota
+	flagLocal
+)
+
+// Logs smaller than this are never compacted.
+const minCompactSize = 16 << 20
+
+var (
+	errShortRecord = errors.New("short record in index store")
+	errBadEntry    = errors.New("unknown entry in index store")
+)
+
+// NewDiskStore returns a Store keeping the records in a log file at path,
+// holding the records left in an existing log.
+func NewDiskStore(path string) (Store, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &diskStore{
+		fd:      fd,
+		path:    path,
+		entries: make(map[Key]diskEntry),
+	}
+	if err := s.replay(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay reads the records from the log. An incomplete entry at the end,
+// as left by a crash while writing it, is cut off.
+func (s *diskStore) replay() error {
+	keys := make(map[int64]Key) // offset of record -> key
+	r := bufio.NewReader(s.fd)
+	var hdr [logHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return s.fd.Truncate(s.size)
+		} else if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if cap(s.buf) < int(n) {
+			s.buf = make([]byte, n)
+		}
+		data := s.buf[:n]
+		if _, err := io.ReadFull(r, data); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return s.fd.Truncate(s.size)
+		} else if err != nil {
+			return err
+		}
+
+		entrySize := int64(logHeaderSize) + int64(n)
+		switch hdr[0] {
+		case logSet:
+			if len(data) < logFlagsSize {
+				return errShortRecord
+			}
+			f, err := decodeFile(data[logFlagsSize:])
+			if err != nil {
+				return err
+			}
+			e := diskEntry{offset: s.size + logHeaderSize + logFlagsSize, length: int32(len(data) - logFlagsSize)}
+			e.setFlags(data)
+			k := keyFor(f)
+			s.entries[k] = e
+			keys[e.offset] = k
+
+		case logUpdate, logDelete:
+			if len(data) < 8 {
+				return errShortRecord
+			}
+			offset := int64(binary.BigEndian.Uint64(data))
+			k, ok := keys[offset]
+			if !ok {
+				return errBadEntry
+			}
+			e := s.entries[k]
+			if hdr[0] == logDelete {
+				delete(s.entries, k)
+				delete(keys, offset)
+				s.garbage += int64(logHeaderSize+logFlagsSize) + int64(e.length)
+			} else {
+				if len(data) < 8+logFlagsSize {
+					return errShortRecord
+				}
+				e.setFlags(data[8:])
+				s.entries[k] = e
+			}
+			s.garbage += entrySize
+
+		default:
+			return errBadEntry
+		}
+		s.size += entrySize
+	}
+	if debug {
+		l.Debugf("index store %q: %d records, %d of %d bytes garbage", s.path, len(s.entries), s.garbage, s.size)
+	}
+	return nil
+}
+
+// setFlags sets the usage and flags from the start of data.
+func (e *diskEntry) setFlags(data []byte) {
+	e.usage = int(binary.BigEndian.Uint32(data))
+	e.global = data[4]&flagGlobal != 0
+	e.local = data[4]&flagLocal != 0
+}
+
+// appendFlags appends the usage and flags of the entry to buf.
+func (e diskEntry) appendFlags(buf []byte) []byte {
+	var tmp [logFlagsSize]byte
+	binary.BigEndian.PutUint32(tmp[:], uint32(e.usage))
+	if e.global {
+		tmp[4] |= flagGlobal
+	}
+	if e.local {
+		tmp[4] |= flagLocal
+	}
+	return append(buf, tmp[:]...)
+}
+
+func (s *diskStore) Get(k Key) (Record, bool, error) {
+	e, ok := s.entries[k]
+	if !ok {
+		return Record{}, false, nil
+	}
+	r, err := s.record(e)
+	if err != nil {
+		return Record{}, false, err
+	}
+	return r, true, nil
+}
+
+func (s *diskStore) Set(k Key, r Record) error {
+	e, ok := s.entries[k]
+	if !ok {
+		e.usage, e.global, e.local = r.Usage, r.Global, r.Local
+		ne, err := s.writeSet(r.File, e)
+		if err != nil {
+			return err
+		}
+		s.entries[k] = ne
+		return nil
+	}
+	if e.usage == r.Usage && e.global == r.Global && e.local == r.Local {
+		return nil
+	}
+	e.usage, e.global, e.local = r.Usage, r.Global, r.Local
+	n, err := s.writeRef(logUpdate, e)
+	if err != nil {
+		return err
+	}
+	s.entries[k] = e
+	s.garbage += n
+	return s.maybeCompact()
+}
+
+func (s *diskStore) Delete(k Key) error {
+	e, ok := s.entries[k]
+	if !ok {
+		return nil
+	}
+	n, err := s.writeRef(logDelete, e)
+	if err != nil {
+		return err
+	}
+	delete(s.entries, k)
+	s.garbage += n
+	s.garbage += int64(logHeaderSize+logFlagsSize) + int64(e.length)
+	return s.maybeCompact()
+}
+
+func (s *diskStore) Iterate(fn func(k Key, r Record) bool) error {
+	for k, e := range s.entries {
+		r, err := s.record(e)
+		if err != nil {
+			return err
+		}
+		if !fn(k, r) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *diskStore) Len() int {
+	return len(s.entries)
+}
+
+func (s *diskStore) record(e diskEntry) (Record, error) {
+	f, err := s.read(e)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{File: f, Usage: e.usage, Global: e.global, Local: e.local}, nil
+}
+
+func (s *diskStore) read(e diskEntry) (scanner.File, error) {
+	if cap(s.buf) < int(e.length) {
+		s.buf = make([]byte, e.length)
+	}
+	buf := s.buf[:e.length]
+	if _, err := s.fd.ReadAt(buf, e.offset); err != nil {
+		return scanner.File{}, err
+	}
+	return decodeFile(buf)
+}
+
+// writeSet appends a new record for f with the usage and flags of e, and
+// returns the entry pointing to it.
+func (s *diskStore) writeSet(f scanner.File, e diskEntry) (diskEntry, error) {
+	s.buf = append(s.buf[:0], logSet, 0, 0, 0, 0)
+	s.buf = e.appendFlags(s.buf)
+	s.buf = encodeFile(s.buf, f)
+	e.offset = s.size + logHeaderSize + logFlagsSize
+	e.length = int32(len(s.buf) - logHeaderSize - logFlagsSize)
+	return e, s.append()
+}
+
+// writeRef appends an entry of the given type referring to the record of e,
+// and returns its size.
+func (s *diskStore) writeRef(typ byte, e diskEntry) (int64, error) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], uint64(e.offset))
+	s.buf = append(s.buf[:0], typ, 0, 0, 0, 0)
+	s.buf = append(s.buf, tmp[:]...)
+	if typ == logUpdate {
+		s.buf = e.appendFlags(s.buf)
+	}
+	n := int64(len(s.buf))
+	return n, s.append()
+}
+
+// append writes the entry in buf, with its length filled in, to the end of
+// the log. An entry that was only partly written is cut off again.
+func (s *diskStore) append() error {
+	binary.BigEndian.PutUint32(s.buf[1:], uint32(len(s.buf)-logHeaderSize))
+	if _, err := s.fd.WriteAt(s.buf, s.size); err != nil {
+		s.fd.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(s.buf))
+	return nil
+}
+
+func (s *diskStore) maybeCompact() error {
+	if s.size > minCompactSize && s.garbage > s.size/2 {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log as a snapshot of the current records. The
+// snapshot is written to a temporary file and synced before it replaces the
+// log, so that a crash leaves either the old log or the complete snapshot.
+// The store is left as it was if the snapshot can't be written.
+func (s *diskStore) compact() error {
+	if debug {
+		l.Debugf("compacting index store %q; %d of %d bytes garbage", s.path, s.garbage, s.size)
+	}
+
+	tmp := s.path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	ns := &diskStore{fd: fd, path: s.path, entries: make(map[Key]diskEntry, len(s.entries))}
+	err = ns.writeSnapshot(s)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// The old log is gone; from here on only the snapshot can be used
+	s.fd.Close()
+	ns.fd, err = os.OpenFile(s.path, os.O_RDWR, 0600)
+	*s = *ns
+	return err
+}
+
+// writeSnapshot appends the current records of old to the log.
+func (s *diskStore) writeSnapshot(old *diskStore) error {
+	for k, e := range old.entries {
+		f, err := old.read(e)
+		if err != nil {
+			return err
+		}
+		ne, err := s.writeSet(f, e)
+		if err != nil {
+			return err
+		}
+		s.entries[k] = ne
+	}
+	return nil
+}
+
+func encodeFile(buf []byte, f scanner.File) []byte {
+	var tmp [8]byte
+
+	putUint := func(v uint64, n int) {
+		binary.BigEndian.PutUint64(tmp[:], v)
+		buf = append(buf, tmp[8-n:]...)
+	}
+	putBytes := func(bs []byte) {
+		putUint(uint64(len(bs)), 4)
+		buf = append(buf, bs...)
+	}
+
+	putBytes([]byte(f.Name))
+	putUint(uint64(f.Flags), 4)
+	putUint(uint64(f.Modified), 8)
+	putUint(f.Version, 8)
+	putUint(uint64(f.Size), 8)
+	if f.Suppressed {
+		putUint(1, 1)
+	} else {
+		putUint(0, 1)
+	}
+	putUint(uint64(len(f.Blocks)), 4)
+	for _, b := range f.Blocks {
+		putUint(uint64(b.Offset), 8)
+		putUint(uint64(b.Size), 4)
+		putBytes(b.Hash)
+	}
+	return buf
+}
+
+func decodeFile(buf []byte) (scanner.File, error) {
+	var f scanner.File
+	var err error
+
+	getUint := func(n int) uint64 {
+		if err != nil || len(buf) < n {
+			err = errShortRecord
+			return 0
+		}
+		var tmp [8]byte
+		copy(tmp[8-n:], buf[:n])
+		buf = buf[n:]
+		return binary.BigEndian.Uint64(tmp[:])
+	}
+	getBytes := func() []byte {
+		n := int(getUint(4))
+		if err != nil || len(buf) < n {
+			err = errShortRecord
+			return nil
+		}
+		bs := make([]byte, n)
+		copy(bs, buf)
+		buf = buf[n:]
+		return bs
+	}
+
+	f.Name = string(getBytes())
+	f.Flags = uint32(getUint(4))
+	f.Modified = int64(getUint(8))
+	f.Version = getUint(8)
+	f.Size = int64(getUint(8))
+	f.Suppressed = getUint(1) != 0
+	if n := int(getUint(4)); err == nil && n > 0 {
+		f.Blocks = make([]scanner.Block, n)
+		for i := range f.Blocks {
+			f.Blocks[i].Offset = int64(getUint(8))
+			f.Blocks[i].Size = uint32(getUint(4))
+			f.Blocks[i].Hash = getBytes()
+		}
+	}
+	return f, err
+}
@@ -10,28 +10,67 @@ import (
 	"github.com/calmh/syncthing/scanner"
 )
 
-type fileRecord struct {
+// A Record is a version of a file, along with the number of nodes that have
+// it, whether it is the global version and whether the local node has it.
+type Record struct {
 	File   scanner.File
 	Usage  int
 	Global bool
+	Local  bool
 }
 
 type bitset uint64
 
 type Set struct {
 	sync.Mutex
-	files              map[key]fileRecord
-	remoteKey          [64]map[string]key
+	files              Store
+	remoteKey          [64]map[string]Key
 	changes            [64]uint64
 	globalAvailability map[string]bitset
-	globalKey          map[string]key
+	globalKey          map[string]Key
+	err                error // the first error from the store
 }
 
+// NewSet returns a new Set keeping all records in memory.
 func NewSet() *Set {
+	return NewSetWithStore(NewMemoryStore())
+}
+
+// NewSetWithStore returns a new Set keeping its records in the given store.
+// Of the records already in the store, those of the local node are kept as
+// its files. The others are dropped, as the connection IDs of the nodes
+// that had them are not known; the nodes send their indexes again when they
+// connect.
+func NewSetWithStore(s Store) *Set {
 	var m = Set{
-		files:              make(map[key]fileRecord),
+		files:              s,
 		globalAvailability: make(map[string]bitset),
-		globalKey:          make(map[string]key),
+		globalKey:          make(map[string]Key),
+	}
+
+	var local, other []Key
+	m.storeErr(s.Iterate(func(k Key, r Record) bool {
+		if r.Local {
+			local = append(local, k)
+		} else {
+			other = append(other, k)
+		}
+		return true
+	}))
+	for _, k := range other {
+		m.delete(k)
+	}
+	if len(local) > 0 {
+		m.remoteKey[cid.LocalID] = make(map[string]Key, len(local))
+		m.changes[cid.LocalID]++
+	}
+	for _, k := range local {
+		r := m.get(k)
+		r.Usage, r.Global = 1, true
+		m.set(k, r)
+		m.remoteKey[cid.LocalID][k.Name] = k
+		m.globalKey[k.Name] = k
+		m.globalAvailability[k.Name] = 1 << cid.LocalID
 	}
 	return &m
 }
@@ -64,7 +103,7 @@ func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
 	if len(fs) == 0 || !m.equals(id, fs) {
 		m.changes[id]++
 
-		var nf = make(map[string]key, len(fs))
+		var nf = make(map[string]Key, len(fs))
 		for _, f := range fs {
 			nf[f.Name] = keyFor(f)
 		}
@@ -75,7 +114,7 @@ func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
 
 		for _, ck := range m.remoteKey[cid.LocalID] {
 			if _, ok := nf[ck.Name]; !ok {
-				cf := m.files[ck].File
+				cf := m.get(ck).File
 				if !protocol.IsDeleted(cf.Flags) {
 					cf.Flags |= protocol.FlagDeleted
 					cf.Blocks = nil
@@ -111,12 +150,11 @@ func (m *Set) Need(id uint) []scanner.File {
 	m.Lock()
 	var fs = make([]scanner.File, 0, len(m.globalKey)/2) // Just a guess, but avoids too many reallocations
 	rkID := m.remoteKey[id]
-	for gk, gf := range m.files {
-		if !gf.Global || gf.File.Suppressed {
+	for name, gk := range m.globalKey {
+		if !gk.newerThan(rkID[name]) {
 			continue
 		}
-
-		if gk.newerThan(rkID[gk.Name]) {
+		if gf := m.get(gk); !gf.File.Suppressed {
 			fs = append(fs, gf.File)
 		}
 	}
@@ -131,7 +169,7 @@ func (m *Set) Have(id uint) []scanner.File {
 	var fs = make([]scanner.File, 0, len(m.remoteKey[id]))
 	m.Lock()
 	for _, rk := range m.remoteKey[id] {
-		fs = append(fs, m.files[rk].File)
+		fs = append(fs, m.get(rk).File)
 	}
 	m.Unlock()
 	return fs
@@ -143,11 +181,12 @@ func (m *Set) Global() []scanner.File {
 	}
 	m.Lock()
 	var fs = make([]scanner.File, 0, len(m.globalKey))
-	for _, file := range m.files {
-		if file.Global {
-			fs = append(fs, file.File)
+	m.storeErr(m.files.Iterate(func(_ Key, r Record) bool {
+		if r.Global {
+			fs = append(fs, r.File)
 		}
-	}
+		return true
+	}))
 	m.Unlock()
 	return fs
 }
@@ -158,7 +197,7 @@ func (m *Set) Get(id uint, file string) scanner.File {
 	if debug {
 		l.Debugf("Get(%d, %q)", id, file)
 	}
-	return m.files[m.remoteKey[id][file]].File
+	return m.get(m.remoteKey[id][file]).File
 }
 
 func (m *Set) GetGlobal(file string) scanner.File {
@@ -167,7 +206,7 @@ func (m *Set) GetGlobal(file string) scanner.File {
 	if debug {
 		l.Debugf("GetGlobal(%q)", file)
 	}
-	return m.files[m.globalKey[file]].File
+	return m.get(m.globalKey[file]).File
 }
 
 func (m *Set) Availability(name string) bitset {
@@ -189,10 +228,47 @@ func (m *Set) Changes(id uint) uint64 {
 	return m.changes[id]
 }
 
+// Err returns the first error reading or writing the store. The set may
+// have lost changes since then and should no longer be relied on.
+func (m *Set) Err() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.err
+}
+
+// storeErr records err if it is the first error from the store.
+func (m *Set) storeErr(err error) {
+	if err != nil && m.err == nil {
+		l.Warnln("index store:", err)
+		m.err = err
+	}
+}
+
+// get returns the record for k, or the zero record if there is none.
+func (m *Set) get(k Key) Record {
+	r, _ := m.lookup(k)
+	return r
+}
+
+// lookup returns the record for k, and whether there was one.
+func (m *Set) lookup(k Key) (Record, bool) {
+	r, ok, err := m.files.Get(k)
+	m.storeErr(err)
+	return r, ok
+}
+
+func (m *Set) set(k Key, r Record) {
+	m.storeErr(m.files.Set(k, r))
+}
+
+func (m *Set) delete(k Key) {
+	m.storeErr(m.files.Delete(k))
+}
+
 func (m *Set) equals(id uint, fs []scanner.File) bool {
-	curWithoutDeleted := make(map[string]key)
+	curWithoutDeleted := make(map[string]Key)
 	for _, k := range m.remoteKey[id] {
-		f := m.files[k].File
+		f := m.get(k).File
 		if !protocol.IsDeleted(f.Flags) {
 			curWithoutDeleted[f.Name] = k
 		}
@@ -208,31 +284,41 @@ func (m *Set) equals(id uint, fs []scanner.File) bool {
 	return true
 }
 
-func (m *Set) update(cid uint, fs []scanner.File) {
-	remFiles := m.remoteKey[cid]
+func (m *Set) update(id uint, fs []scanner.File) {
+	remFiles := m.remoteKey[id]
 	if remFiles == nil {
-		l.Fatalln("update before replace for cid", cid)
+		l.Fatalln("update before replace for cid", id)
 	}
+	local := id == cid.LocalID
 	for _, f := range fs {
 		n := f.Name
 		fk := keyFor(f)
 
-		if ck, ok := remFiles[n]; ok && ck == fk {
+		ck, ok := remFiles[n]
+		if ok && ck == fk {
 			// The remote already has exactly this file, skip it
 			continue
 		}
+		if ok && local {
+			if cr, ok := m.lookup(ck); ok {
+				cr.Local = false
+				m.set(ck, cr)
+			}
+		}
 
 		remFiles[n] = fk
 
 		// Keep the block list or increment the usage
-		if br, ok := m.files[fk]; !ok {
-			m.files[fk] = fileRecord{
+		if br, ok := m.lookup(fk); !ok {
+			m.set(fk, Record{
 				Usage: 1,
 				File:  f,
-			}
+				Local: local,
+			})
 		} else {
 			br.Usage++
-			m.files[fk] = br
+			br.Local = br.Local || local
+			m.set(fk, br)
 		}
 
 		// Update global view
@@ -240,43 +326,44 @@ func (m *Set) update(cid uint, fs []scanner.File) {
 		switch {
 		case ok && fk == gk:
 			av := m.globalAvailability[n]
-			av |= 1 << cid
+			av |= 1 << id
 			m.globalAvailability[n] = av
 		case fk.newerThan(gk):
 			if ok {
-				f := m.files[gk]
+				f := m.get(gk)
 				f.Global = false
-				m.files[gk] = f
+				m.set(gk, f)
 			}
-			f := m.files[fk]
+			f := m.get(fk)
 			f.Global = true
-			m.files[fk] = f
+			m.set(fk, f)
 			m.globalKey[n] = fk
-			m.globalAvailability[n] = 1 << cid
+			m.globalAvailability[n] = 1 << id
 		}
 	}
 }
 
-func (m *Set) replace(cid uint, fs []scanner.File) {
+func (m *Set) replace(id uint, fs []scanner.File) {
 	// Decrement usage for all files belonging to this remote, and remove
 	// those that are no longer needed.
-	for _, fk := range m.remoteKey[cid] {
-		br, ok := m.files[fk]
+	for _, fk := range m.remoteKey[id] {
+		br, ok := m.lookup(fk)
 		switch {
 		case ok && br.Usage == 1:
-			delete(m.files, fk)
+			m.delete(fk)
 		case ok && br.Usage > 1:
 			br.Usage--
-			m.files[fk] = br
+			br.Local = br.Local && id != cid.LocalID
+			m.set(fk, br)
 		}
 	}
 
 	// Clear existing remote remoteKey
-	m.remoteKey[cid] = make(map[string]key)
+	m.remoteKey[id] = make(map[string]Key)
 
 	// Recalculate global based on all remaining remoteKey
 	for n := range m.globalKey {
-		var nk key    // newest key
+		var nk Key    // newest key
 		var na bitset // newest availability
 
 		for i, rem := range m.remoteKey {
@@ -303,5 +390,5 @@ func (m *Set) replace(cid uint, fs []scanner.File) {
 	}
 
 	// Add new remote remoteKey to the mix
-	m.update(cid, fs)
+	m.update(id, fs)
 }
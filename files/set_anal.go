@@ -8,19 +8,20 @@ import (
 	"github.com/calmh/syncthing/scanner"
 )
 
-type key struct {
+// A Key identifies a version of a file.
+type Key struct {
 	Name     string
 	Version  uint64
 	Modified int64
 	Hash     [md5.Size]byte
 }
 
-func keyFor(f scanner.File) key {
+func keyFor(f scanner.File) Key {
 	h := md5.New()
 	for _, b := range f.Blocks {
 		h.Write(b.Hash)
 	}
-	return key{
+	return Key{
 		Name:     f.Name,
 		Version:  f.Version,
 		Modified: f.Modified,
@@ -28,7 +29,7 @@ func keyFor(f scanner.File) key {
 	}
 }
 
-func (a key) newerThan(b key) bool {
+func (a Key) newerThan(b Key) bool {
 	if a.Version != b.Version {
 		return a.Version > b.Version
 	}
@@ -4,18 +4,19 @@ package files
 
 import "github.com/calmh/syncthing/scanner"
 
-type key struct {
+// A Key identifies a version of a file.
+type Key struct {
 	Name    string
 	Version uint64
 }
 
-func keyFor(f scanner.File) key {
-	return key{
+func keyFor(f scanner.File) Key {
+	return Key{
 		Name:    f.Name,
 		Version: f.Version,
 	}
 }
 
-func (a key) newerThan(b key) bool {
+func (a Key) newerThan(b Key) bool {
 	return a.Version > b.Version
 }
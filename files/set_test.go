@@ -63,7 +63,7 @@ func TestGlobalSet(t *testing.T) {
 		t.Errorf("Global incorrect;\n A: %v !=\n E: %v", g, expectedGlobal)
 	}
 
-	if lb := len(m.files); lb != 7 {
+	if lb := m.files.Len(); lb != 7 {
 		t.Errorf("Num files incorrect %d != 7\n%v", lb, m.files)
 	}
 }
@@ -302,7 +302,7 @@ func TestGlobalReset(t *testing.T) {
 		scanner.File{Name: "e", Version: 1000},
 	}
 
-	expectedGlobalKey := map[string]key{
+	expectedGlobalKey := map[string]Key{
 		"a": keyFor(local[0]),
 		"b": keyFor(local[1]),
 		"c": keyFor(local[2]),
@@ -317,7 +317,7 @@ func TestGlobalReset(t *testing.T) {
 		t.Errorf("Global incorrect;\n%v !=\n%v", m.globalKey, expectedGlobalKey)
 	}
 
-	if lb := len(m.files); lb != 4 {
+	if lb := m.files.Len(); lb != 4 {
 		t.Errorf("Num files incorrect %d != 4\n%v", lb, m.files)
 	}
 }
@@ -0,0 +1,55 @@
+package files
+
+// A Store holds the file records of a Set. The Set serializes all calls, so
+// implementations need not be safe for concurrent use. The record for a
+// given key always holds the same file; only the usage count and global flag
+// change when it is set again. A change that fails with an error is not
+// made.
+type Store interface {
+	// Get returns the record for k, and whether there was one.
+	Get(k Key) (Record, bool, error)
+	// Set adds or replaces the record for k.
+	Set(k Key, r Record) error
+	// Delete removes the record for k, if there is one.
+	Delete(k Key) error
+	// Iterate calls fn for each record, in no particular order, until fn
+	// returns false.
+	Iterate(fn func(k Key, r Record) bool) error
+	// Len returns the number of records.
+	Len() int
+}
+
+type memoryStore map[Key]Record
+
+// NewMemoryStore returns a Store keeping all records in memory.
+func NewMemoryStore() Store {
+	return make(memoryStore)
+}
+
+func (s memoryStore) Get(k Key) (Record, bool, error) {
+	r, ok := s[k]
+	return r, ok, nil
+}
+
+func (s memoryStore) Set(k Key, r Record) error {
+	s[k] = r
+	return nil
+}
+
+func (s memoryStore) Delete(k Key) error {
+	delete(s, k)
+	return nil
+}
+
+func (s memoryStore) Iterate(fn func(k Key, r Record) bool) error {
+	for k, r := range s {
+		if !fn(k, r) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s memoryStore) Len() int {
+	return len(s)
+}
@@ -0,0 +1,356 @@
+package files
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func tempDiskStore(t testing.TB) (Store, func()) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDiskStore(filepath.Join(dir, "store"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.(*diskStore).fd.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	fs := []scanner.File{
+		{},
+		{Name: "a/b", Flags: protocol.FlagDeleted | 0644, Modified: -1, Version: 1 << 40, Size: 1 << 33, Suppressed: true},
+		{Name: "c", Size: 20, Blocks: []scanner.Block{
+			{Offset: 0, Size: 10, Hash: []byte("some hash bytes")},
+			{Offset: 10, Size: 10, Hash: []byte("more hash bytes")},
+		}},
+	}
+	for i, f := range fs {
+		buf := encodeFile(nil, f)
+		d, err := decodeFile(buf)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(d, f) {
+			t.Errorf("%d: Incorrect decoded file\n  A: %v\n  E: %v", i, d, f)
+		}
+		if _, err := decodeFile(buf[:len(buf)-1]); err != errShortRecord {
+			t.Errorf("%d: Unexpected error %v for truncated record", i, err)
+		}
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	s, done := tempDiskStore(t)
+	defer done()
+
+	f := scanner.File{Name: "a", Version: 1, Blocks: []scanner.Block{{Size: 10, Hash: []byte("hash")}}}
+	k := keyFor(f)
+	if _, ok, _ := s.Get(k); ok {
+		t.Error("Unexpected record in empty store")
+	}
+
+	s.Set(k, Record{File: f, Usage: 1})
+	s.Set(k, Record{File: f, Usage: 2, Global: true})
+	if r, ok, _ := s.Get(k); !ok || r.Usage != 2 || !r.Global || !reflect.DeepEqual(r.File, f) {
+		t.Errorf("Incorrect record %v", r)
+	}
+
+	for i := 0; i < 100; i++ {
+		g := scanner.File{Name: fmt.Sprintf("f%d", i), Version: 1}
+		s.Set(keyFor(g), Record{File: g, Usage: 1})
+	}
+	for i := 0; i < 100; i += 2 {
+		s.Delete(keyFor(scanner.File{Name: fmt.Sprintf("f%d", i), Version: 1}))
+	}
+	s.(*diskStore).compact()
+
+	if l := s.Len(); l != 51 {
+		t.Errorf("Incorrect length %d != 51", l)
+	}
+	n := 0
+	s.Iterate(func(k Key, r Record) bool {
+		if k != keyFor(r.File) {
+			t.Errorf("Record %v stored under %v", r.File, k)
+		}
+		n++
+		return true
+	})
+	if n != 51 {
+		t.Errorf("Incorrect number of iterated records %d != 51", n)
+	}
+	if r, ok, _ := s.Get(k); !ok || r.Usage != 2 || !r.Global || !reflect.DeepEqual(r.File, f) {
+		t.Errorf("Incorrect record after compaction %v", r)
+	}
+}
+
+func TestDiskStoreSet(t *testing.T) {
+	s, done := tempDiskStore(t)
+	defer done()
+
+	sets := []*Set{NewSet(), NewSetWithStore(s)}
+	for _, m := range sets {
+		m.ReplaceWithDelete(cid.LocalID, []scanner.File{
+			{Name: "a", Version: 1000},
+			{Name: "b", Version: 1000},
+			{Name: "c", Version: 1000},
+		})
+		m.Replace(1, []scanner.File{
+			{Name: "a", Version: 1000},
+			{Name: "b", Version: 1001},
+			{Name: "d", Version: 1000},
+		})
+		m.ReplaceWithDelete(cid.LocalID, []scanner.File{
+			{Name: "a", Version: 1000},
+			{Name: "b", Version: 1000},
+		})
+	}
+
+	for _, fn := range []func(m *Set) []scanner.File{
+		func(m *Set) []scanner.File { return m.Global() },
+		func(m *Set) []scanner.File { return m.Need(cid.LocalID) },
+		func(m *Set) []scanner.File { return m.Have(cid.LocalID) },
+		func(m *Set) []scanner.File { return m.Have(1) },
+	} {
+		a, b := fn(sets[0]), fn(sets[1])
+		sort.Sort(fileList(a))
+		sort.Sort(fileList(b))
+		for _, fs := range [][]scanner.File{a, b} {
+			for i := range fs {
+				if protocol.IsDeleted(fs[i].Flags) {
+					// Deletes get versions from the shared clock
+					fs[i].Version = 0
+				}
+			}
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("Memory and disk sets differ\n  M: %v\n  D: %v", a, b)
+		}
+	}
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+
+	s, err := NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := scanner.File{Name: "a", Version: 1, Blocks: []scanner.Block{{Size: 10, Hash: []byte("hash")}}}
+	s.Set(keyFor(f), Record{File: f, Usage: 1, Local: true})
+	s.Set(keyFor(f), Record{File: f, Usage: 2, Global: true, Local: true})
+	for i := 0; i < 10; i++ {
+		g := scanner.File{Name: fmt.Sprintf("f%d", i), Version: 1}
+		s.Set(keyFor(g), Record{File: g, Usage: 1})
+	}
+	for i := 0; i < 10; i += 2 {
+		s.Delete(keyFor(scanner.File{Name: fmt.Sprintf("f%d", i), Version: 1}))
+	}
+
+	reopen := func() {
+		s.(*diskStore).fd.Close()
+		s, err = NewDiskStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := s.Len(); l != 6 {
+			t.Errorf("Incorrect length %d != 6 after reopening", l)
+		}
+		if r, ok, _ := s.Get(keyFor(f)); !ok || r.Usage != 2 || !r.Global || !r.Local || !reflect.DeepEqual(r.File, f) {
+			t.Errorf("Incorrect record %v after reopening", r)
+		}
+		if _, ok, _ := s.Get(keyFor(scanner.File{Name: "f2", Version: 1})); ok {
+			t.Error("Deleted record found after reopening")
+		}
+		if r, ok, _ := s.Get(keyFor(scanner.File{Name: "f3", Version: 1})); !ok || r.Usage != 1 || r.Global {
+			t.Errorf("Incorrect record %v after reopening", r)
+		}
+	}
+	reopen()
+
+	// An entry cut short by a crash is dropped
+	fd, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	fd.Write([]byte{logSet, 0, 0, 1})
+	fd.Close()
+	reopen()
+
+	// So is a snapshot
+	if err := s.(*diskStore).compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Temporary snapshot left after compaction")
+	}
+	reopen()
+	s.(*diskStore).fd.Close()
+}
+
+func TestDiskStoreErrors(t *testing.T) {
+	s, done := tempDiskStore(t)
+	defer done()
+
+	f := scanner.File{Name: "a", Version: 1}
+	m := NewSetWithStore(s)
+	m.ReplaceWithDelete(cid.LocalID, []scanner.File{f})
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.(*diskStore).fd.Close()
+	if _, _, err := s.Get(keyFor(f)); err == nil {
+		t.Error("No error reading a closed store")
+	}
+	g := scanner.File{Name: "b", Version: 1}
+	if err := s.Set(keyFor(g), Record{File: g, Usage: 1}); err == nil {
+		t.Error("No error writing a closed store")
+	}
+	if l := s.Len(); l != 1 {
+		t.Errorf("Incorrect length %d != 1 after a failed write", l)
+	}
+
+	m.Update(cid.LocalID, []scanner.File{g})
+	if err := m.Err(); err == nil {
+		t.Error("Failed write not reported by the set")
+	}
+}
+
+func TestDiskStoreSetReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+
+	s, err := NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := []scanner.File{
+		{Name: "a", Version: 1000},
+		{Name: "b", Version: 1000},
+	}
+	m := NewSetWithStore(s)
+	m.ReplaceWithDelete(cid.LocalID, local)
+	m.Replace(1, []scanner.File{
+		{Name: "a", Version: 1000},
+		{Name: "b", Version: 1001},
+		{Name: "c", Version: 1000},
+	})
+	s.(*diskStore).fd.Close()
+
+	// The local files are there after a restart, those of the other node
+	// are not until it sends its index again
+	s, err = NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*diskStore).fd.Close()
+	m = NewSetWithStore(s)
+	have := m.Have(cid.LocalID)
+	sort.Sort(fileList(have))
+	if !reflect.DeepEqual(have, local) {
+		t.Errorf("Incorrect local files after reopening %v", have)
+	}
+	if fs := m.Have(1); len(fs) != 0 {
+		t.Errorf("Unexpected files of other node %v", fs)
+	}
+	if fs := m.Need(cid.LocalID); len(fs) != 0 {
+		t.Errorf("Unexpected need %v", fs)
+	}
+	if l := s.Len(); l != 2 {
+		t.Errorf("Incorrect number of records %d != 2", l)
+	}
+
+	m.Replace(1, []scanner.File{{Name: "b", Version: 1001}})
+	if fs := m.Need(cid.LocalID); len(fs) != 1 || fs[0].Name != "b" {
+		t.Errorf("Incorrect need %v after the index of the other node", fs)
+	}
+}
+
+// The 10M benchmarks show the cost of lookups in an index of the size of a
+// very large repository. Building the index takes a while and a few GB of
+// memory, so run them one at a time.
+
+var bench10M []scanner.File
+
+func files10M() []scanner.File {
+	if bench10M == nil {
+		bench10M = make([]scanner.File, 10000000)
+		for i := range bench10M {
+			bench10M[i] = scanner.File{
+				Name:    fmt.Sprintf("dir%d/file%d", i/1000, i),
+				Version: 1000,
+				Size:    128 << 10,
+				Blocks:  []scanner.Block{{Size: 128 << 10, Hash: make([]byte, 32)}},
+			}
+		}
+	}
+	return bench10M
+}
+
+func benchmark10MGet(b *testing.B, m *Set) {
+	fs := files10M()
+	m.ReplaceWithDelete(cid.LocalID, fs)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := fs[(i*7919)%len(fs)]
+		if g := m.Get(cid.LocalID, f.Name); g.Name != f.Name {
+			b.Fatalf("Incorrect file %q != %q", g.Name, f.Name)
+		}
+	}
+}
+
+func Benchmark10MGetMemory(b *testing.B) {
+	benchmark10MGet(b, NewSet())
+}
+
+func Benchmark10MGetDisk(b *testing.B) {
+	s, done := tempDiskStore(b)
+	defer done()
+	benchmark10MGet(b, NewSetWithStore(s))
+}
+
+func benchmark10MNeed(b *testing.B, m *Set) {
+	fs := files10M()
+	m.ReplaceWithDelete(cid.LocalID, fs)
+	m.Replace(1, fs[:len(fs)-1000])
+	m.Update(1, []scanner.File{{Name: "new", Version: 2000}})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if l := len(m.Need(cid.LocalID)); l != 1 {
+			b.Fatalf("Incorrect need %d != 1", l)
+		}
+	}
+}
+
+func Benchmark10MNeedMemory(b *testing.B) {
+	benchmark10MNeed(b, NewSet())
+}
+
+func Benchmark10MNeedDisk(b *testing.B) {
+	s, done := tempDiskStore(b)
+	defer done()
+	benchmark10MNeed(b, NewSetWithStore(s))
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// The outcome of auditing a file.
+const (
+	AuditMatching = "matching" // contents and metadata match the index
+	AuditMissing  = "missing"  // in the index but not on disk
+	AuditChanged  = "changed"  // the contents differ from the index
+	AuditDrifted  = "drifted"  // the contents match, but the modification time or permissions differ
+	AuditError    = "error"    // the file could not be checked
+)
+
+// AuditResult is the outcome of auditing a single file.
+type AuditResult struct {
+	Name   string
+	Status string
+	Detail string `json:",omitempty"` // what differs, or the error
+}
+
+// AuditRepo checks each file in the local index of the repository against the
+// file on disk, rehashing the contents, and calls fn with the result. Files
+// are audited in name order. Unlike a scan, the audit never changes the index
+// or the files, so that it can be used to find silent corruption as well as
+// changes that have not been scanned yet. Files matching the static patterns
+// of the repository are not rehashed.
+func (m *Model) AuditRepo(repo string, fn func(AuditResult)) error {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	rf := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+
+	// Only the names are kept; each file is looked up again when it is
+	// audited, so that the block lists are not all held at once.
+	var names []string
+	for _, f := range rf.Have(cid.LocalID) {
+		if !protocol.IsDeleted(f.Flags) && !f.Suppressed {
+			names = append(names, f.Name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := rf.Get(cid.LocalID, name)
+		if f.Name != name || protocol.IsDeleted(f.Flags) || f.Suppressed {
+			// Changed since we started
+			continue
+		}
+		var res AuditResult
+		if isStatic(cfg.StaticPatterns, name) && !protocol.IsDirectory(f.Flags) {
+			res = auditStaticFile(workDir(cfg), f, cfg.IgnoresPerms(), cfg.SpecialPermBits, m.modTimeWindow())
+		} else {
+			res = auditFile(workDir(cfg), f, cfg.ChunkerType, cfg.IgnoresPerms(), cfg.SpecialPermBits, m.modTimeWindow())
+		}
+		if debug && res.Status != AuditMatching {
+			l.Debugf("audit: %q / %q: %s %s", repo, name, res.Status, res.Detail)
+		}
+		fn(res)
+	}
+	return nil
+}
+
+func auditFile(dir string, f scanner.File, chunker string, ignorePerms, special bool, window time.Duration) AuditResult {
+	res := AuditResult{Name: f.Name, Status: AuditMatching}
+	path := filepath.Join(dir, f.Name)
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		res.Status = AuditMissing
+		return res
+	} else if err != nil {
+		res.Status = AuditError
+		res.Detail = err.Error()
+		return res
+	}
+
+	if isDir := protocol.IsDirectory(f.Flags); isDir != info.IsDir() {
+		res.Status = AuditChanged
+		if isDir {
+			res.Detail = "not a directory"
+		} else {
+			res.Detail = "is a directory"
+		}
+		return res
+	}
+
+	if !info.IsDir() {
+		match, err := verifyBlocks(path, f.Blocks, chunker)
+		if err != nil {
+			res.Status = AuditError
+			res.Detail = err.Error()
+			return res
+		}
+		if !match {
+			res.Status = AuditChanged
+			return res
+		}
+	}
+
+	if detail := metadataDrift(info, f, ignorePerms, special, window); detail != "" {
+		res.Status = AuditDrifted
+		res.Detail = detail
+	}
+	return res
+}
+
+// metadataDrift returns how the modification time and permissions of info
+// differ from those of f, or the empty string if they match.
+func metadataDrift(info os.FileInfo, f scanner.File, ignorePerms, special bool, window time.Duration) string {
+	var detail string
+	// Directory modification times change with their contents, so they are
+	// only compared for files.
+	if mt := info.ModTime().Unix(); !info.IsDir() && !scanner.ModTimeEqual(mt, f.Modified, window) {
+		detail = fmt.Sprintf("modified %d, index has %d", mt, f.Modified)
+	}
+	if !ignorePerms && protocol.HasPermissionBits(f.Flags) && !scanner.PermsEqual(f.Flags, scanner.PermBits(info.Mode(), special), special) {
+		if detail != "" {
+			detail += "; "
+		}
+		detail += fmt.Sprintf("mode %o, index has %o", scanner.PermBits(info.Mode(), special), f.Flags&07777)
+	}
+	return detail
+}
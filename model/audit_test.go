@@ -0,0 +1,105 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+)
+
+func TestAuditRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"changed", "drifted", "intact", "missing"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewModel(dir, &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	before := m.CurrentRepoFile("default", "changed")
+
+	// Change the files behind the scanner's back. The changed file keeps its
+	// size and modification time, as with silent corruption.
+	changed := filepath.Join(dir, "changed")
+	fi, _ := os.Stat(changed)
+	ioutil.WriteFile(changed, []byte("CONTENTS OF CHANGED"), 0644)
+	os.Chtimes(changed, fi.ModTime(), fi.ModTime())
+	t0 := time.Unix(1400000000, 0)
+	os.Chtimes(filepath.Join(dir, "drifted"), t0, t0)
+	os.Remove(filepath.Join(dir, "missing"))
+	ioutil.WriteFile(filepath.Join(dir, "unindexed"), []byte("new"), 0644)
+
+	var res []AuditResult
+	err = m.AuditRepo("default", func(r AuditResult) {
+		r.Detail = ""
+		res = append(res, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []AuditResult{
+		{Name: "changed", Status: AuditChanged},
+		{Name: "drifted", Status: AuditDrifted},
+		{Name: "intact", Status: AuditMatching},
+		{Name: "missing", Status: AuditMissing},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Incorrect audit;\n  E: %v\n  A: %v", expected, res)
+	}
+
+	// The audit does not touch the index
+	if after := m.CurrentRepoFile("default", "changed"); !after.Equals(before) || !blocksEqual(after.Blocks, before.Blocks) {
+		t.Errorf("Index changed by audit;\n  E: %v\n  A: %v", before, after)
+	}
+
+	if err := m.AuditRepo("nonexistent", func(AuditResult) {}); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
+
+func TestAuditPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(dir, &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(name, 0600)
+
+	var res []AuditResult
+	m.AuditRepo("default", func(r AuditResult) {
+		res = append(res, r)
+	})
+	if len(res) != 1 || res[0].Status != AuditDrifted || res[0].Detail != "mode 600, index has 644" {
+		t.Errorf("Incorrect audit %v", res)
+	}
+}
@@ -0,0 +1,59 @@
+package model
+
+import "sync"
+
+// A writeBacklog keeps count of the bytes requested from other nodes that
+// have yet to be written. Requests reserve room for their block before they
+// are sent, so that the download rate follows the write rate once the
+// backlog is full. A nil writeBacklog has no limit.
+type writeBacklog struct {
+	max   int64
+	bytes int64
+	mut   sync.Mutex
+	cond  *sync.Cond
+}
+
+func newWriteBacklog(maxKiB int) *writeBacklog {
+	if maxKiB <= 0 {
+		return nil
+	}
+	w := &writeBacklog{max: int64(maxKiB) * 1024}
+	w.cond = sync.NewCond(&w.mut)
+	return w
+}
+
+// reserve waits until n more bytes fit in the backlog and adds them. A block
+// larger than the whole backlog goes through once the backlog is empty.
+func (w *writeBacklog) reserve(n int64) {
+	if w == nil {
+		return
+	}
+	w.mut.Lock()
+	for w.bytes > 0 && w.bytes+n > w.max {
+		w.cond.Wait()
+	}
+	w.bytes += n
+	w.mut.Unlock()
+}
+
+// release removes n bytes that have been written, or given up on, from the
+// backlog.
+func (w *writeBacklog) release(n int64) {
+	if w == nil {
+		return
+	}
+	w.mut.Lock()
+	w.bytes -= n
+	w.mut.Unlock()
+	w.cond.Broadcast()
+}
+
+// size returns the number of bytes in the backlog.
+func (w *writeBacklog) size() int64 {
+	if w == nil {
+		return 0
+	}
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.bytes
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteBacklog(t *testing.T) {
+	if w := newWriteBacklog(0); w != nil {
+		t.Error("Backlog without a limit")
+	}
+	var unlimited *writeBacklog
+	unlimited.reserve(1 << 30)
+	unlimited.release(1 << 30)
+
+	w := newWriteBacklog(1)
+	w.reserve(4096) // larger than the limit, but the backlog is empty
+	reserved := make(chan struct{})
+	go func() {
+		w.reserve(512)
+		close(reserved)
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("Reserved beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.release(4096)
+	select {
+	case <-reserved:
+	case <-time.After(time.Second):
+		t.Fatal("Not reserved after release")
+	}
+	if s := w.size(); s != 512 {
+		t.Errorf("Incorrect backlog size %d", s)
+	}
+}
+
+func TestPullWriteBacklog(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: block}, &requests}
+	m.AddConnection(fc, fc)
+
+	// Room for two blocks
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.backlog = newWriteBacklog(2 * len(block) / 1024)
+	for i, b := range f.Blocks {
+		if p.handleBlock(bqBlock{file: f, block: b, last: i == len(f.Blocks)-1}) {
+			t.Fatal("Block handled without a request")
+		}
+	}
+
+	// Results are taken, and written, slowly; no more is requested than
+	// fits in the backlog meanwhile.
+	for handled := 0; handled < len(f.Blocks); handled++ {
+		time.Sleep(50 * time.Millisecond)
+		if n := atomic.LoadInt32(&requests); int(n) > handled+2 {
+			t.Errorf("%d requests with %d blocks written", n, handled)
+		}
+		if s := p.backlog.size(); s > int64(2*len(block)) {
+			t.Errorf("Backlog of %d bytes exceeds the limit", s)
+		}
+		handleResult(t, p)
+	}
+
+	if s := p.backlog.size(); s != 0 {
+		t.Errorf("%d bytes left in the backlog", s)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if !bytes.Equal(data, bytes.Repeat(block, len(f.Blocks))) {
+		t.Error("Incorrect contents of pulled file")
+	}
+}
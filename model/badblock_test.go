@@ -0,0 +1,169 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// offsetConnection serves the blocks of data at the requested offsets.
+type offsetConnection struct {
+	FakeConnection
+	data     []byte
+	requests *int32
+}
+
+func (c offsetConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	atomic.AddInt32(c.requests, 1)
+	return c.data[offset : offset+int64(size)], nil
+}
+
+func TestRejectBadBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{CheckBlockHashes: true}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.ReplaceLocal("default", nil)
+
+	data := append(bytes.Repeat([]byte("a"), scanner.StandardBlockSize), bytes.Repeat([]byte("b"), scanner.StandardBlockSize)...)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	f := scanner.File{Name: "foo", Version: 1, Size: int64(len(data)), Blocks: blocks}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+	m.repoFiles["default"].Replace(m.cm.Get("43"), []scanner.File{f})
+
+	// Node 42 answers every request with the second block, which is valid
+	// but belongs elsewhere.
+	var badRequests, goodRequests int32
+	bad := countingConnection{FakeConnection{id: "42", requestData: data[scanner.StandardBlockSize:]}, &badRequests}
+	good := offsetConnection{FakeConnection{id: "43"}, data, &goodRequests}
+	m.AddConnection(bad, bad)
+	m.AddConnection(good, good)
+
+	sub := events.Default.Subscribe(events.BadBlock)
+	defer events.Default.Unsubscribe(sub)
+
+	p := newTestPuller(m, repoCfg)
+	// The good node is busy, so the first block is requested from the bad one
+	p.oustandingPerNode["43"] = 5
+	p.handleBlock(bqBlock{file: f, block: blocks[0]})
+	handleResult(t, p)
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["node"] != "42" || data["item"] != "foo" || data["offset"] != "0" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	if of := p.openFiles["foo"]; of.err != nil || of.outstanding != 1 {
+		t.Fatalf("Incorrect open file state %v", of)
+	}
+	// The rest of the file no longer comes from the bad node
+	p.handleBlock(bqBlock{file: f, block: blocks[1], last: true})
+	handleResult(t, p)
+
+	queued := make(chan bqBlock)
+	go func() { queued <- p.bq.get() }()
+	select {
+	case b := <-queued:
+		if b.block.Offset != 0 {
+			t.Fatalf("Block at offset %d queued, expected the rejected one", b.block.Offset)
+		}
+		p.handleBlock(b)
+		handleResult(t, p)
+	case <-time.After(time.Second):
+		t.Fatal("Rejected block not queued again")
+	}
+
+	if n := atomic.LoadInt32(&badRequests); n != 1 {
+		t.Errorf("%d requests to the bad node, expected 1", n)
+	}
+	if n := atomic.LoadInt32(&goodRequests); n != 2 {
+		t.Errorf("%d requests to the good node, expected 2", n)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "foo")); !bytes.Equal(got, data) {
+		t.Errorf("Incorrect contents %q", got)
+	}
+	if lf := m.CurrentRepoFile("default", "foo"); lf.Version != f.Version {
+		t.Errorf("Local version %d, expected %d", lf.Version, f.Version)
+	}
+}
+
+// oversizedConnection serves the blocks of data at the requested offsets,
+// followed by junk.
+type oversizedConnection struct {
+	FakeConnection
+	data []byte
+}
+
+func (c oversizedConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	bs := append([]byte(nil), c.data[offset:offset+int64(size)]...)
+	return append(bs, "junk"...), nil
+}
+
+func TestOversizedResult(t *testing.T) {
+	for _, trim := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "syncthing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Without hash checks, only the size guards against the junk
+		cfg := &config.Configuration{Options: config.OptionsConfiguration{TrimOversizedBlocks: trim}}
+		repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+		m := NewModel("/tmp", cfg, "syncthing", "dev")
+		m.AddRepo(repoCfg)
+		m.ReplaceLocal("default", nil)
+
+		data := append(bytes.Repeat([]byte("a"), scanner.StandardBlockSize), bytes.Repeat([]byte("b"), scanner.StandardBlockSize)...)
+		blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+		f := scanner.File{Name: "foo", Version: 1, Size: int64(len(data)), Blocks: blocks}
+		m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+		fc := oversizedConnection{FakeConnection{id: "42"}, data}
+		m.AddConnection(fc, fc)
+
+		sub := events.Default.Subscribe(events.BadBlock)
+		defer events.Default.Unsubscribe(sub)
+
+		p := newTestPuller(m, repoCfg)
+		if !trim {
+			p.handleBlock(bqBlock{file: f, block: blocks[0]})
+			p.handleRequestResult(<-p.requestResults)
+			if _, err := sub.Poll(time.Second); err != nil {
+				t.Fatal("Oversized block not rejected:", err)
+			}
+			if of := p.openFiles["foo"]; of.err != nil || of.outstanding != 1 || of.badSources == 0 {
+				t.Errorf("Incorrect open file state %v", of)
+			}
+			continue
+		}
+
+		// The second block is written first, so that the excess of the
+		// first would overwrite it.
+		p.handleBlock(bqBlock{file: f, block: blocks[1]})
+		p.handleRequestResult(<-p.requestResults)
+		p.handleBlock(bqBlock{file: f, block: blocks[0], last: true})
+		p.handleRequestResult(<-p.requestResults)
+		if _, err := sub.Poll(50 * time.Millisecond); err != events.ErrTimeout {
+			t.Error("Trimmed block rejected")
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, "foo")); !bytes.Equal(got, data) {
+			t.Errorf("Incorrect contents of %d bytes, expected %d", len(got), len(data))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// With RequestBatchMax above one, blocks of a file that are queued one after
+// the other are requested from a node together, in a single request, saving
+// a round trip for each block but the first. How many blocks go in a
+// request is tuned per node from the throughput of the requests: it starts
+// at one and is doubled as long as that clearly pays off, and halved when
+// the throughput drops or a request fails. A node on a fast, close link thus
+// stays at small requests while a distant one gets large ones. The size
+// starts over when the node reconnects.
+type requestBatcher struct {
+	max   int
+	nodes map[string]nodeBatch
+	mut   sync.Mutex
+}
+
+type nodeBatch struct {
+	size int     // blocks per request
+	rate float64 // bytes per second of the last request of that size
+}
+
+const (
+	batchGain = 1.1  // the throughput ratio over the last request to double the size
+	batchLoss = 0.75 // the throughput ratio under which the size is halved
+)
+
+var errBatchSize = errors.New("batched request returned the wrong amount of data")
+
+// newRequestBatcher returns a batcher with up to max blocks per request, or
+// nil if max is not above one.
+func newRequestBatcher(max int) *requestBatcher {
+	if max <= 1 {
+		return nil
+	}
+	return &requestBatcher{max: max, nodes: make(map[string]nodeBatch)}
+}
+
+// size returns the number of blocks to request from the node at once.
+func (b *requestBatcher) size(node string) int {
+	if b == nil {
+		return 1
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if nb, ok := b.nodes[node]; ok {
+		return nb.size
+	}
+	return 1
+}
+
+// done adjusts the batch size for the node to the outcome of a request for
+// the given number of blocks and bytes, that took d. Only requests of the
+// current size tell how well it does; smaller ones, made when no more blocks
+// were queued, are not counted unless they fail.
+func (b *requestBatcher) done(node string, blocks, bytes int, d time.Duration, ok bool) {
+	if b == nil {
+		return
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	nb, known := b.nodes[node]
+	if !known {
+		nb.size = 1
+	}
+	switch {
+	case !ok:
+		if nb.size /= 2; nb.size < 1 {
+			nb.size = 1
+		}
+		nb.rate = 0
+
+	case blocks == nb.size && d > 0:
+		rate := float64(bytes) / d.Seconds()
+		switch {
+		case nb.rate == 0 || rate > nb.rate*batchGain:
+			if nb.size *= 2; nb.size > b.max {
+				nb.size = b.max
+			}
+		case rate < nb.rate*batchLoss:
+			if nb.size /= 2; nb.size < 1 {
+				nb.size = 1
+			}
+		}
+		nb.rate = rate
+	}
+	b.nodes[node] = nb
+}
+
+// forget has the node start over at one block per request.
+func (b *requestBatcher) forget(node string) {
+	if b == nil {
+		return
+	}
+	b.mut.Lock()
+	delete(b.nodes, node)
+	b.mut.Unlock()
+}
+
+// followingBlocks takes the blocks queued after b that can be requested from
+// the node along with it, as many as the batch size for the node allows.
+// The blocks must still be needed and not yet requested, and the request
+// may not exceed the maximum block size. Must be called from the run loop.
+func (p *puller) followingBlocks(of openFile, b bqBlock, node string, partial bool) []bqBlock {
+	n := p.model.batcher.size(node) - 1
+	if n <= 0 || partial {
+		// A partial source only has the blocks it has announced
+		return nil
+	}
+	f := b.file
+	size := int64(b.block.Size)
+	max := int64(p.model.maxBlockSize())
+	return p.bq.take(f, b.block.Offset+int64(b.block.Size), n, func(nb bqBlock) bool {
+		if max > 0 && size+int64(nb.block.Size) > max {
+			return false
+		}
+		if p.inFlight[blockKey{f.Name, nb.block.Offset}] || of.haveWritten(f.Blocks, nb.block.Offset) || scanner.IsZeroBlock(nb.block) {
+			return false
+		}
+		size += int64(nb.block.Size)
+		return true
+	})
+}
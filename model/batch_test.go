@@ -0,0 +1,116 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestBatcher(t *testing.T) {
+	if b := newRequestBatcher(1); b != nil {
+		t.Error("Unexpected batcher for one block per request")
+	}
+
+	b := newRequestBatcher(4)
+	if n := b.size("foo"); n != 1 {
+		t.Errorf("Incorrect initial size %d", n)
+	}
+
+	// Grows while the throughput goes up, up to the maximum
+	b.done("foo", 1, 1000, time.Second, true)
+	b.done("foo", 2, 2000, time.Second, true)
+	b.done("foo", 4, 4000, time.Second, true)
+	if n := b.size("foo"); n != 4 {
+		t.Errorf("Incorrect size %d after growing throughput", n)
+	}
+	if n := b.size("bar"); n != 1 {
+		t.Errorf("Size %d changed for another node", n)
+	}
+
+	// Requests smaller than the size tell nothing
+	b.done("foo", 1, 1, time.Second, true)
+	if n := b.size("foo"); n != 4 {
+		t.Errorf("Incorrect size %d after a smaller request", n)
+	}
+
+	// Stays while the throughput holds, and shrinks when it drops
+	b.done("foo", 4, 4000, time.Second, true)
+	if n := b.size("foo"); n != 4 {
+		t.Errorf("Incorrect size %d at the same throughput", n)
+	}
+	b.done("foo", 4, 2000, time.Second, true)
+	if n := b.size("foo"); n != 2 {
+		t.Errorf("Incorrect size %d after the throughput dropped", n)
+	}
+
+	b.done("foo", 2, 0, time.Second, false)
+	b.done("foo", 1, 0, time.Second, false)
+	if n := b.size("foo"); n != 1 {
+		t.Errorf("Incorrect size %d after failures", n)
+	}
+
+	b.done("foo", 1, 1000, time.Second, true)
+	b.forget("foo")
+	if n := b.size("foo"); n != 1 {
+		t.Errorf("Size %d not reset by forget", n)
+	}
+}
+
+// batchConnection serves requests for any number of the blocks of a
+// setupPull file, recording the sizes requested.
+type batchConnection struct {
+	FakeConnection
+	sizes *[]int
+	mut   *sync.Mutex
+}
+
+func (c batchConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	c.mut.Lock()
+	*c.sizes = append(*c.sizes, size)
+	c.mut.Unlock()
+	return bytes.Repeat(c.requestData, size/len(c.requestData)), nil
+}
+
+func TestBatchedPull(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	var sizes []int
+	fc := batchConnection{FakeConnection{id: "42", requestData: block}, &sizes, new(sync.Mutex)}
+	m.AddConnection(fc, fc)
+	m.batcher = newRequestBatcher(3)
+	m.batcher.nodes["42"] = nodeBatch{size: 3}
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.bq.put(bqAdd{file: f, need: f.Blocks})
+	for i := 0; i < 2; i++ {
+		b := p.bq.get()
+		if p.handleBlock(b) {
+			t.Fatal("Block not requested")
+		}
+		for n := 0; n < 3-2*i; n++ {
+			handleResult(t, p)
+		}
+	}
+
+	if len(sizes) != 2 || sizes[0] != 3*len(block) || sizes[1] != len(block) {
+		t.Errorf("Incorrect request sizes %v", sizes)
+	}
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after pull")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat(block, 4)) {
+		t.Error("Incorrect file contents after batched pull")
+	}
+	if ci := m.ConnectionStats()["42"]; ci.RequestBatch < 1 {
+		t.Errorf("Incorrect request batch %d in the connection stats", ci.RequestBatch)
+	}
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// checkBlockLayout returns an error describing how the blocks of f fail to
+// cover it, or nil if they follow each other from offset zero and add up to
+// the size of the file.
+func checkBlockLayout(f scanner.File) error {
+	var offset int64
+	for i, b := range f.Blocks {
+		if b.Offset != offset {
+			return fmt.Errorf("block %d at offset %d, expected %d", i, b.Offset, offset)
+		}
+		offset += int64(b.Size)
+	}
+	if offset != f.Size {
+		return fmt.Errorf("blocks add up to %d bytes, file size is %d", offset, f.Size)
+	}
+	return nil
+}
+
+// inconsistentBlocks returns true if f should not be queued because its
+// blocks don't match its size, as such a file could never be verified once
+// pulled. Each version of such a file is reported once.
+func (p *puller) inconsistentBlocks(f scanner.File) bool {
+	if !p.cfg.Options.CheckBlockLayout || protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) {
+		return false
+	}
+	if v, ok := p.badLayouts[f.Name]; ok && v == f.Version {
+		return true
+	}
+
+	err := checkBlockLayout(f)
+	if err == nil {
+		return false
+	}
+	if p.badLayouts == nil {
+		p.badLayouts = make(map[string]uint64)
+	}
+	p.badLayouts[f.Name] = f.Version
+
+	l.Warnf("Not syncing %q in repository %q: inconsistent file: %v", f.Name, p.repoCfg.ID, err)
+	events.Default.Log(events.InconsistentFile, map[string]string{
+		"repo":    p.repoCfg.ID,
+		"item":    f.Name,
+		"version": fmt.Sprint(f.Version),
+		"error":   err.Error(),
+	})
+	return true
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestCheckBlockLayout(t *testing.T) {
+	cases := []struct {
+		size   int64
+		blocks []scanner.Block
+		ok     bool
+	}{
+		{0, nil, true},
+		{0, []scanner.Block{{Offset: 0, Size: 0}}, true},
+		{300, []scanner.Block{{Offset: 0, Size: 100}, {Offset: 100, Size: 200}}, true},
+		{400, []scanner.Block{{Offset: 0, Size: 100}, {Offset: 100, Size: 200}}, false},
+		{200, []scanner.Block{{Offset: 0, Size: 100}, {Offset: 100, Size: 200}}, false},
+		{300, []scanner.Block{{Offset: 0, Size: 100}, {Offset: 200, Size: 200}}, false},
+		{300, []scanner.Block{{Offset: 100, Size: 200}, {Offset: 0, Size: 100}}, false},
+		{100, []scanner.Block{{Offset: 0, Size: 100}, {Offset: 0, Size: 100}}, false},
+	}
+
+	for i, tc := range cases {
+		err := checkBlockLayout(scanner.File{Name: "foo", Size: tc.size, Blocks: tc.blocks})
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestInconsistentFileNotQueued(t *testing.T) {
+	dir, m, f, _ := setupPull(t)
+	defer os.RemoveAll(dir)
+	m.cfg.Options.CheckBlockLayout = true
+
+	sub := events.Default.Subscribe(events.InconsistentFile)
+	defer events.Default.Unsubscribe(sub)
+
+	bad := f
+	bad.Version++
+	bad.Size++
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{bad})
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	for i := 0; i < 2; i++ {
+		p.queueNeededBlocks()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := p.bq.size(); s != 0 {
+		t.Errorf("Unexpected %d queued blocks for inconsistent file", s)
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["item"] != "foo" || data["repo"] != "default" || data["version"] != "4" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	if _, err := sub.Poll(50 * time.Millisecond); err != events.ErrTimeout {
+		t.Error("Inconsistent file reported twice")
+	}
+
+	// A new version with matching blocks is queued
+	f.Version = bad.Version + 1
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+	p.queueNeededBlocks()
+	time.Sleep(50 * time.Millisecond)
+	if s := p.bq.size(); s != len(f.Blocks) {
+		t.Errorf("%d blocks queued, expected %d", s, len(f.Blocks))
+	}
+}
@@ -2,28 +2,94 @@ package model
 
 import (
 	"sync"
+	"time"
 
 	"github.com/calmh/syncthing/scanner"
 )
 
 type bqAdd struct {
-	file scanner.File
-	have []scanner.Block
-	need []scanner.Block
+	file   scanner.File
+	have   []scanner.Block
+	need   []scanner.Block
+	shared []sharedCopy // needed blocks to copy from other local files
+
+	// If set, the blocks overlapping the byte range [from, to) are wanted
+	// by the deadline. When the file is already queued, only the deadline
+	// is applied to its queued blocks.
+	deadline  time.Time
+	from, to  int64
+	onlyQueue bool // apply the deadline to queued blocks, never add the file
+	repair    bool // queue the needed blocks again, even if others of the file are queued
+	priority  int  // blocks of higher priority are handed out first
+
+	again []bqBlock // blocks handed out before, queued again as they were
+
+	done chan struct{} // closed by the run loop once the addition is made
+}
+
+// overlaps returns true if b overlaps the byte range of the addition.
+func (a bqAdd) overlaps(b bqBlock) bool {
+	if len(b.copy) > 0 {
+		for _, cb := range b.copy {
+			if cb.Offset < a.to && cb.Offset+int64(cb.Size) > a.from {
+				return true
+			}
+		}
+		return false
+	}
+	return b.block.Size > 0 && b.block.Offset < a.to && b.block.Offset+int64(b.block.Size) > a.from
 }
 
 type bqBlock struct {
-	file  scanner.File
-	block scanner.Block   // get this block from the network
-	copy  []scanner.Block // copy these blocks from the old version of the file
-	last  bool
+	file     scanner.File
+	block    scanner.Block   // get this block from the network
+	copy     []scanner.Block // copy these blocks from the old version of the file
+	from     string          // or from this other local file, if set
+	last     bool
+	retries  int       // number of times we've failed to find a source node for this block
+	repair   bool      // queued again after the written block failed verification
+	rampWait bool      // waited for a source node to accept more requests
+	deadline time.Time // the block is wanted by this time, if set
+	priority int
+}
+
+// A bqTake asks for the blocks queued to be fetched after a block that is
+// being requested, to request them along with it.
+type bqTake struct {
+	file   scanner.File
+	offset int64              // where the requested range ends
+	max    int                // the number of blocks to take at most
+	ok     func(bqBlock) bool // whether a block may be taken
+	reply  chan []bqBlock
+}
+
+// size returns the number of bytes to fetch or copy for b.
+func (b bqBlock) size() int64 {
+	n := int64(b.block.Size)
+	for _, cb := range b.copy {
+		n += int64(cb.Size)
+	}
+	return n
 }
 
+// The blockQueue hands out blocks with a deadline first, earliest deadline
+// first, followed by the other blocks by priority and then in the order they
+// were added. A block
+// whose deadline passes before it is handed out loses its priority and goes
+// to the end of the queue, since getting it ahead of the others is no longer
+// of any use.
+//
+// Since blocks of a file may be reordered, the last flag is set when the
+// block is handed out, on the final queued block of the file.
 type blockQueue struct {
 	inbox  chan bqAdd
 	outbox chan bqBlock
+	takes  chan bqTake
 
 	queued []bqBlock
+	urgent int            // the number of blocks with a deadline, at the head of queued
+	files  map[string]int // the number of queued blocks per file
+	bytes  int64          // the size of the queued blocks, including those to copy
 
 	mut sync.Mutex
 }
@@ -32,6 +98,8 @@ func newBlockQueue() *blockQueue {
 	q := &blockQueue{
 		inbox:  make(chan bqAdd),
 		outbox: make(chan bqBlock),
+		takes:  make(chan bqTake),
+		files:  make(map[string]int),
 	}
 	go q.run()
 	return q
@@ -41,60 +109,273 @@ func (q *blockQueue) addBlock(a bqAdd) {
 	q.mut.Lock()
 	defer q.mut.Unlock()
 
-	// If we already have it queued, return
-	for _, b := range q.queued {
-		if b.file.Name == a.file.Name {
-			return
+	if len(a.again) > 0 {
+		for _, b := range a.again {
+			// Set again when handed out
+			b.last = false
+			q.bytes += b.size()
+			q.insert(b)
 		}
+		q.files[a.file.Name] += len(a.again)
+		return
 	}
+
+	if a.repair {
+		for _, b := range a.need {
+			q.insert(bqBlock{
+				file:     a.file,
+				block:    b,
+				repair:   true,
+				priority: a.priority,
+			})
+		}
+		q.files[a.file.Name] += len(a.need)
+		for _, b := range a.need {
+			q.bytes += int64(b.Size)
+		}
+		return
+	}
+
+	// If we already have it queued, at most update the deadlines
+	if q.files[a.file.Name] > 0 {
+		if !a.deadline.IsZero() {
+			q.promote(a)
+		}
+		return
+	}
+	if a.onlyQueue {
+		return
+	}
+
+	var bs []bqBlock
 	if len(a.have) > 0 {
 		// First queue a copy operation
-		q.queued = append(q.queued, bqBlock{
+		bs = append(bs, bqBlock{
 			file: a.file,
 			copy: a.have,
 		})
 	}
+	for _, sc := range a.shared {
+		bs = append(bs, bqBlock{
+			file: a.file,
+			copy: sc.blocks,
+			from: sc.from,
+		})
+	}
 	// Queue the needed blocks individually
-	l := len(a.need)
-	for i, b := range a.need {
-		q.queued = append(q.queued, bqBlock{
+	for _, b := range a.need {
+		bs = append(bs, bqBlock{
 			file:  a.file,
 			block: b,
-			last:  i == l-1,
 		})
 	}
 
-	if l == 0 {
-		// If we didn't have anything to fetch, queue an empty block with the "last" flag set to close the file.
-		q.queued = append(q.queued, bqBlock{
+	if len(a.need) == 0 {
+		// If we didn't have anything to fetch, queue an empty block to close the file.
+		bs = append(bs, bqBlock{
 			file: a.file,
-			last: true,
 		})
 	}
+
+	for _, b := range bs {
+		q.bytes += b.size()
+		b.priority = a.priority
+		if !a.deadline.IsZero() && a.overlaps(b) {
+			b.deadline = a.deadline
+			q.insertUrgent(b)
+		} else {
+			q.insert(b)
+		}
+	}
+	q.files[a.file.Name] += len(bs)
+}
+
+// promote moves the queued blocks of the file that overlap the range of a to
+// the urgent part of the queue, unless they already have an earlier
+// deadline. Must be called with mut held.
+func (q *blockQueue) promote(a bqAdd) {
+	var moved []bqBlock
+	for i := 0; i < len(q.queued); i++ {
+		b := q.queued[i]
+		if b.file.Name != a.file.Name || !a.overlaps(b) {
+			continue
+		}
+		if !b.deadline.IsZero() && !b.deadline.After(a.deadline) {
+			continue
+		}
+		if i < q.urgent {
+			q.urgent--
+		}
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		i--
+		b.deadline = a.deadline
+		moved = append(moved, b)
+	}
+	for _, b := range moved {
+		q.insertUrgent(b)
+	}
+}
+
+// insertUrgent inserts b in deadline order among the urgent blocks, after
+// those with the same deadline. Must be called with mut held.
+func (q *blockQueue) insertUrgent(b bqBlock) {
+	i := 0
+	for i < q.urgent && !q.queued[i].deadline.After(b.deadline) {
+		i++
+	}
+	q.queued = append(q.queued, bqBlock{})
+	copy(q.queued[i+1:], q.queued[i:])
+	q.queued[i] = b
+	q.urgent++
+}
+
+// insert adds b to the non-urgent part of the queue, after the blocks of
+// the same or higher priority. Must be called with mut held.
+func (q *blockQueue) insert(b bqBlock) {
+	i := len(q.queued)
+	for i > q.urgent && q.queued[i-1].priority < b.priority {
+		i--
+	}
+	q.queued = append(q.queued, bqBlock{})
+	copy(q.queued[i+1:], q.queued[i:])
+	q.queued[i] = b
+}
+
+// next returns the block to hand out next. Urgent blocks whose deadline has
+// passed are first moved to the end of their priority in the queue. Must be
+// called with mut held and a non empty queue.
+func (q *blockQueue) next(now time.Time) bqBlock {
+	for q.urgent > 0 && q.queued[0].deadline.Before(now) {
+		b := q.queued[0]
+		if debug {
+			l.Debugf("bq: deadline passed for %q offset %d", b.file.Name, b.block.Offset)
+		}
+		b.deadline = time.Time{}
+		q.queued = q.queued[1:]
+		q.urgent--
+		q.insert(b)
+	}
+	b := q.queued[0]
+	b.last = q.files[b.file.Name] == 1
+	return b
+}
+
+// pop removes the first block in the queue. Must be called with mut held.
+func (q *blockQueue) pop() {
+	name := q.queued[0].file.Name
+	if q.files[name]--; q.files[name] == 0 {
+		delete(q.files, name)
+	}
+	q.bytes -= q.queued[0].size()
+	q.queued = q.queued[1:]
+	if q.urgent > 0 {
+		q.urgent--
+	}
 }
 
 func (q *blockQueue) run() {
+	// Fires when the deadline of the first block passes, to hand out the
+	// next one instead.
+	expiry := time.NewTimer(time.Hour)
+	expiry.Stop()
+
 	for {
-		if len(q.queued) == 0 {
-			q.addBlock(<-q.inbox)
-		} else {
-			q.mut.Lock()
-			next := q.queued[0]
-			q.mut.Unlock()
+		if q.empty() {
 			select {
 			case a := <-q.inbox:
 				q.addBlock(a)
-			case q.outbox <- next:
-				q.mut.Lock()
-				q.queued = q.queued[1:]
-				q.mut.Unlock()
+				close(a.done)
+			case t := <-q.takes:
+				t.reply <- nil
+			}
+			continue
+		}
+
+		q.mut.Lock()
+		next := q.next(time.Now())
+		q.mut.Unlock()
+
+		var expired <-chan time.Time
+		if !next.deadline.IsZero() {
+			expiry.Reset(next.deadline.Sub(time.Now()))
+			expired = expiry.C
+		}
+
+		select {
+		case a := <-q.inbox:
+			q.addBlock(a)
+			close(a.done)
+		case t := <-q.takes:
+			t.reply <- q.takeFollowing(t)
+		case q.outbox <- next:
+			q.mut.Lock()
+			q.pop()
+			q.mut.Unlock()
+		case <-expired:
+		}
+
+		if !expiry.Stop() && expired != nil {
+			select {
+			case <-expiry.C:
+			default:
 			}
 		}
 	}
 }
 
+// takeFollowing removes and returns the blocks of the file queued to be
+// fetched that continue the range ending at t.offset, one after the other,
+// stopping at the first that is missing or not ok. The last flag is set as
+// when the blocks are handed out.
+func (q *blockQueue) takeFollowing(t bqTake) []bqBlock {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	var taken []bqBlock
+	offset := t.offset
+	for len(taken) < t.max {
+		i := 0
+		for ; i < len(q.queued); i++ {
+			b := q.queued[i]
+			if b.file.Name == t.file.Name && b.file.Version == t.file.Version && len(b.copy) == 0 && b.block.Size > 0 && b.block.Offset == offset {
+				break
+			}
+		}
+		if i == len(q.queued) || !t.ok(q.queued[i]) {
+			break
+		}
+
+		b := q.queued[i]
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		if i < q.urgent {
+			q.urgent--
+		}
+		if q.files[b.file.Name]--; q.files[b.file.Name] == 0 {
+			delete(q.files, b.file.Name)
+		}
+		q.bytes -= b.size()
+		b.last = q.files[b.file.Name] == 0
+		taken = append(taken, b)
+		offset += int64(b.block.Size)
+	}
+	return taken
+}
+
+// take removes the blocks of f that are queued to be fetched after offset,
+// up to max of them, as long as ok returns true for each. See
+// takeFollowing.
+func (q *blockQueue) take(f scanner.File, offset int64, max int, ok func(bqBlock) bool) []bqBlock {
+	t := bqTake{file: f, offset: offset, max: max, ok: ok, reply: make(chan []bqBlock)}
+	q.takes <- t
+	return <-t.reply
+}
+
+// put adds to the queue, returning once the addition has been made so that
+// it is seen by whatever looks at the queue next.
 func (q *blockQueue) put(a bqAdd) {
+	a.done = make(chan struct{})
 	q.inbox <- a
+	<-a.done
 }
 
 func (q *blockQueue) get() bqBlock {
@@ -106,3 +387,59 @@ func (q *blockQueue) empty() bool {
 	defer q.mut.Unlock()
 	return len(q.queued) == 0
 }
+
+func (q *blockQueue) size() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return len(q.queued)
+}
+
+// summary returns the number of queued blocks, their total size and the
+// names of the files of the first blocks, at most n of them and in the order
+// the blocks are handed out, without changing the queue.
+func (q *blockQueue) summary(n int) (blocks int, bytes int64, next []string) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	seen := make(map[string]bool, n)
+	for _, b := range q.queued {
+		if len(next) == n {
+			break
+		}
+		if !seen[b.file.Name] {
+			seen[b.file.Name] = true
+			next = append(next, b.file.Name)
+		}
+	}
+	return len(q.queued), q.bytes, next
+}
+
+// fileNames returns the names of the files with queued blocks.
+func (q *blockQueue) fileNames() []string {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	names := make([]string, 0, len(q.files))
+	for name, n := range q.files {
+		if n > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// peek returns a copy of the first n queued blocks without removing them
+// from the queue.
+func (q *blockQueue) peek(n int) []bqBlock {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if n > len(q.queued) {
+		n = len(q.queued)
+	}
+	bs := make([]bqBlock, n)
+	copy(bs, q.queued)
+	seen := make(map[string]int)
+	for i, b := range bs {
+		seen[b.file.Name]++
+		bs[i].last = seen[b.file.Name] == q.files[b.file.Name]
+	}
+	return bs
+}
@@ -0,0 +1,317 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func testBlocks(n int) []scanner.Block {
+	bs := make([]scanner.Block, n)
+	for i := range bs {
+		bs[i] = scanner.Block{Offset: int64(i) * 100, Size: 100}
+	}
+	return bs
+}
+
+type queuedBlock struct {
+	name   string
+	offset int64
+	last   bool
+}
+
+func drain(q *blockQueue, n int) []queuedBlock {
+	var res []queuedBlock
+	for i := 0; i < n; i++ {
+		b := q.get()
+		res = append(res, queuedBlock{b.file.Name, b.block.Offset, b.last})
+	}
+	return res
+}
+
+func TestBlockQueueDeadlineOrder(t *testing.T) {
+	q := newBlockQueue()
+	now := time.Now()
+
+	q.put(bqAdd{file: scanner.File{Name: "a"}, need: testBlocks(3)})
+	q.put(bqAdd{file: scanner.File{Name: "b"}, need: testBlocks(3)})
+	q.put(bqAdd{file: scanner.File{Name: "b"}, deadline: now.Add(time.Hour), from: 250, to: 260})
+	q.put(bqAdd{file: scanner.File{Name: "a"}, deadline: now.Add(30 * time.Minute), from: 100, to: 200})
+	q.put(bqAdd{file: scanner.File{Name: "c"}, need: testBlocks(2), deadline: now.Add(45 * time.Minute), from: 0, to: 200})
+	// A later deadline does not demote a block
+	q.put(bqAdd{file: scanner.File{Name: "a"}, deadline: now.Add(2 * time.Hour), from: 0, to: 200})
+
+	expected := []queuedBlock{
+		{"a", 100, false},
+		{"c", 0, false},
+		{"c", 100, true},
+		{"b", 200, false},
+		{"a", 0, false},
+		{"a", 200, true},
+		{"b", 0, false},
+		{"b", 100, true},
+	}
+	if s := q.size(); s != len(expected) {
+		t.Fatalf("Incorrect queue size %d != %d", s, len(expected))
+	}
+	res := drain(q, len(expected))
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Incorrect block %d: %v != %v", i, res[i], expected[i])
+		}
+	}
+}
+
+func TestBlockQueueDeadlinePassed(t *testing.T) {
+	q := newBlockQueue()
+	now := time.Now()
+
+	q.put(bqAdd{file: scanner.File{Name: "a"}, need: testBlocks(2)})
+	q.put(bqAdd{file: scanner.File{Name: "b"}, need: testBlocks(2), deadline: now.Add(-time.Second), from: 0, to: 100})
+	q.put(bqAdd{file: scanner.File{Name: "c"}, need: testBlocks(1), deadline: now.Add(50 * time.Millisecond), from: 0, to: 100})
+
+	// The expired block goes to the end of the queue
+	if b := q.peek(1)[0]; b.file.Name != "c" {
+		t.Errorf("Incorrect first block %q", b.file.Name)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	expected := []queuedBlock{
+		{"a", 0, false},
+		{"a", 100, true},
+		{"b", 100, false},
+		{"b", 0, true},
+		{"c", 0, true},
+	}
+	res := drain(q, len(expected))
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Incorrect block %d: %v != %v", i, res[i], expected[i])
+		}
+	}
+}
+
+func TestBlockQueueDeadlineContention(t *testing.T) {
+	q := newBlockQueue()
+	now := time.Now()
+
+	const producers = 8
+	const files = 25
+	const blocks = 4
+
+	// Ongoing pulls hand out blocks while the deadline requests arrive.
+	stop := make(chan struct{})
+	var handed []queuedBlock
+	var consumer sync.WaitGroup
+	consumer.Add(1)
+	go func() {
+		defer consumer.Done()
+		for {
+			select {
+			case b := <-q.outbox:
+				handed = append(handed, queuedBlock{b.file.Name, b.block.Offset, b.last})
+			case <-stop:
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < files; j++ {
+				name := fmt.Sprintf("%d-%d", i, j)
+				q.put(bqAdd{file: scanner.File{Name: name}, need: testBlocks(blocks)})
+				// The last block of each file is wanted soon, at a deadline
+				// unique to the file.
+				d := now.Add(time.Hour + time.Duration((j*producers+i)*blocks)*time.Second)
+				q.put(bqAdd{file: scanner.File{Name: name}, deadline: d, from: (blocks - 1) * 100, to: blocks * 100})
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	consumer.Wait()
+
+	// Once all requests are in, the urgent blocks are handed out first in
+	// deadline order, then the rest.
+	rest := q.size()
+	queued := q.peek(rest)
+	res := drain(q, rest)
+
+	var lastDeadline time.Time
+	var inUrgent = true
+	for i, b := range queued {
+		if b.deadline.IsZero() {
+			inUrgent = false
+			continue
+		}
+		if !inUrgent {
+			t.Fatalf("Urgent block %v after non urgent block", res[i])
+		}
+		if b.deadline.Before(lastDeadline) {
+			t.Fatalf("Block %v out of deadline order", res[i])
+		}
+		lastDeadline = b.deadline
+		if res[i].name != b.file.Name || res[i].offset != (blocks-1)*100 {
+			t.Errorf("Incorrect urgent block %v", res[i])
+		}
+	}
+
+	// Every block is handed out once, and the last one of each file is
+	// flagged.
+	seen := make(map[queuedBlock]bool)
+	lasts := make(map[string]int)
+	count := make(map[string]int)
+	for _, b := range append(handed, res...) {
+		k := queuedBlock{b.name, b.offset, false}
+		if seen[k] {
+			t.Errorf("Block %v handed out twice", b)
+		}
+		seen[k] = true
+		count[b.name]++
+		if b.last {
+			lasts[b.name]++
+			if count[b.name] != blocks {
+				t.Errorf("Block %v flagged last after %d blocks", b, count[b.name])
+			}
+		}
+	}
+	if len(seen) != producers*files*blocks {
+		t.Errorf("Incorrect number of blocks handed out %d != %d", len(seen), producers*files*blocks)
+	}
+	for name, n := range lasts {
+		if n != 1 {
+			t.Errorf("File %q flagged last %d times", name, n)
+		}
+	}
+	if len(lasts) != producers*files {
+		t.Errorf("Incorrect number of last blocks %d != %d", len(lasts), producers*files)
+	}
+}
+
+func TestBlockQueuePriority(t *testing.T) {
+	q := newBlockQueue()
+
+	// The first cycle queues files without priority, and one is started
+	q.put(bqAdd{file: scanner.File{Name: "a"}, need: testBlocks(2)})
+	q.put(bqAdd{file: scanner.File{Name: "b"}, need: testBlocks(1)})
+	if res := drain(q, 1); res[0] != (queuedBlock{"a", 0, false}) {
+		t.Fatalf("Incorrect first block %v", res[0])
+	}
+
+	// A later cycle adds files of different priorities, which go ahead of
+	// the earlier ones; within a priority, they keep the order they were
+	// added in.
+	q.put(bqAdd{file: scanner.File{Name: "c"}, need: testBlocks(1), priority: 1})
+	q.put(bqAdd{file: scanner.File{Name: "d"}, need: testBlocks(2), priority: 2})
+	q.put(bqAdd{file: scanner.File{Name: "e"}, need: testBlocks(1)})
+	q.put(bqAdd{file: scanner.File{Name: "f"}, need: testBlocks(1), priority: 2})
+
+	expected := []queuedBlock{
+		{"d", 0, false},
+		{"d", 100, true},
+		{"f", 0, true},
+		{"c", 0, true},
+		{"a", 100, true},
+		{"b", 0, true},
+		{"e", 0, true},
+	}
+	res := drain(q, len(expected))
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Incorrect block %d: %v != %v", i, res[i], expected[i])
+		}
+	}
+}
+
+func TestBlockQueueTake(t *testing.T) {
+	q := newBlockQueue()
+	any := func(bqBlock) bool { return true }
+
+	q.put(bqAdd{file: scanner.File{Name: "a"}, need: testBlocks(5)})
+	q.put(bqAdd{file: scanner.File{Name: "b"}, need: testBlocks(2)})
+	if res := drain(q, 1); res[0] != (queuedBlock{"a", 0, false}) {
+		t.Fatalf("Incorrect first block %v", res[0])
+	}
+
+	// Only the blocks following the offset are taken, up to the maximum
+	if bs := q.take(scanner.File{Name: "a"}, 150, 2, any); len(bs) != 0 {
+		t.Errorf("Took %d blocks not following the offset", len(bs))
+	}
+	bs := q.take(scanner.File{Name: "a"}, 100, 2, any)
+	if len(bs) != 2 || bs[0].block.Offset != 100 || bs[1].block.Offset != 200 || bs[1].last {
+		t.Fatalf("Incorrect blocks taken: %v", bs)
+	}
+
+	// Stops at the first block that is not ok, and flags the last one
+	bs = q.take(scanner.File{Name: "a"}, 300, 2, func(b bqBlock) bool { return b.block.Offset < 400 })
+	if len(bs) != 1 || bs[0].block.Offset != 300 || bs[0].last {
+		t.Fatalf("Incorrect blocks taken: %v", bs)
+	}
+	bs = q.take(scanner.File{Name: "a"}, 400, 2, any)
+	if len(bs) != 1 || !bs[0].last {
+		t.Fatalf("Incorrect blocks taken: %v", bs)
+	}
+
+	if q.size() != 2 {
+		t.Errorf("Incorrect queue size %d after taking", q.size())
+	}
+	expected := []queuedBlock{{"b", 0, false}, {"b", 100, true}}
+	res := drain(q, len(expected))
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Incorrect block %d: %v != %v", i, res[i], expected[i])
+		}
+	}
+}
+
+func TestPullQueue(t *testing.T) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+	if _, err := m.PullQueue("other"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+	if s, err := m.PullQueue("default"); err != nil || s.Blocks != 0 || len(s.Next) != 0 {
+		t.Errorf("Unexpected queue %+v, %v without a puller", s, err)
+	}
+
+	p := &puller{bq: newBlockQueue()}
+	m.pullers["default"] = p
+	for i := 0; i < 30; i++ {
+		p.bq.put(bqAdd{file: scanner.File{Name: fmt.Sprintf("f%02d", i)}, have: testBlocks(1), need: testBlocks(2)})
+	}
+	p.bq.put(bqAdd{file: scanner.File{Name: "urgent"}, need: testBlocks(2), deadline: time.Now().Add(time.Hour), to: 100})
+
+	s, err := m.PullQueue("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Blocks != 92 || s.Bytes != 30*300+200 {
+		t.Errorf("Incorrect queue size %d blocks, %d bytes", s.Blocks, s.Bytes)
+	}
+	if len(s.Next) != pullQueueNext || s.Next[0] != "urgent" || s.Next[1] != "f00" || s.Next[pullQueueNext-1] != fmt.Sprintf("f%02d", pullQueueNext-2) {
+		t.Errorf("Incorrect next files %v", s.Next)
+	}
+
+	// Looking doesn't change what is handed out
+	if b := p.bq.get(); b.file.Name != "urgent" {
+		t.Errorf("Incorrect first block %q", b.file.Name)
+	}
+	for i := 0; i < 100; i++ {
+		if n, _ := m.QueueLength("default"); n == 91 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s, _ := m.PullQueue("default"); s.Blocks != 91 || s.Bytes != 30*300+100 {
+		t.Errorf("Incorrect queue size %d blocks, %d bytes after handing out a block", s.Blocks, s.Bytes)
+	}
+}
@@ -0,0 +1,32 @@
+package model
+
+// BlockStats tells how the data of pulled files was obtained.
+type BlockStats struct {
+	CopiedBytes  int64   // copied from files already on disk
+	NetworkBytes int64   // fetched from other nodes
+	DedupRatio   float64 // the share of the bytes that was copied, from 0 to 1
+}
+
+func newBlockStats(copied, pulled int64) BlockStats {
+	s := BlockStats{CopiedBytes: copied, NetworkBytes: pulled}
+	if total := copied + pulled; total > 0 {
+		s.DedupRatio = float64(copied) / float64(total)
+	}
+	return s
+}
+
+// BlockStats returns the block statistics for the repo, for the current or
+// most recent sync cycle and since the repo was started.
+func (m *Model) BlockStats(repo string) (cycle, total BlockStats) {
+	m.rmut.RLock()
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if p == nil {
+		return
+	}
+
+	p.mut.Lock()
+	st := p.stats
+	p.mut.Unlock()
+	return newBlockStats(st.cycleCopied, st.cyclePulled), newBlockStats(st.bytesCopied, st.bytesPulled)
+}
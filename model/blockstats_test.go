@@ -0,0 +1,61 @@
+package model
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestBlockStats(t *testing.T) {
+	p, lf, orig := setupCopyWorkers(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+	p.model.pullers["default"] = p
+
+	// Two blocks are copied from the old version and one is fetched
+	data := append([]byte{}, orig...)
+	for i := 2 * scanner.StandardBlockSize; i < len(data); i++ {
+		data[i] = 42
+	}
+	f := lf
+	f.Version++
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+
+	fc := FakeConnection{id: "42", requestData: append([]byte{}, data[2*scanner.StandardBlockSize:]...)}
+	p.model.AddConnection(fc, fc)
+	p.model.repoFiles["default"].Replace(p.model.cm.Get("42"), []scanner.File{f})
+
+	p.handleBlock(bqBlock{file: f, copy: have})
+	p.handleBlock(bqBlock{file: f, block: need[0], last: true})
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-p.requestResults:
+			p.handleRequestResult(res)
+		case res := <-p.copyResults:
+			p.handleCopyResult(res, true)
+		case <-time.After(time.Second):
+			t.Fatal("No result")
+		}
+	}
+
+	cycle, total := p.model.BlockStats("default")
+	if cycle != total {
+		t.Errorf("Cycle %v differs from total %v after the first cycle", cycle, total)
+	}
+	if total.CopiedBytes != 2*scanner.StandardBlockSize || total.NetworkBytes != scanner.StandardBlockSize {
+		t.Errorf("Incorrect byte counts %v", total)
+	}
+	if total.CopiedBytes+total.NetworkBytes != int64(len(data)) {
+		t.Errorf("Byte counts %v don't add up to the file size %d", total, len(data))
+	}
+	if r := total.DedupRatio; r < 0.66 || r > 0.67 {
+		t.Errorf("Incorrect dedup ratio %f", r)
+	}
+
+	if cycle, total := p.model.BlockStats("nonexistent"); cycle != (BlockStats{}) || total != (BlockStats{}) {
+		t.Errorf("Unexpected stats %v, %v for unknown repo", cycle, total)
+	}
+}
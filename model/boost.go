@@ -0,0 +1,129 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+var errBoostDuration = errors.New("boost duration must not be negative")
+
+// A repoBoost is a repository given more request slots for a while.
+type repoBoost struct {
+	repo  string
+	timer *time.Timer // ends the boost
+}
+
+// Boost devotes more of the request slots to the repository for the given
+// duration, for when it is needed in a hurry. The slots are taken from the
+// other repositories, each giving up half of its own, so that the total
+// stays as configured. Only one repository is boosted at a time; boosting
+// another ends the current boost, while boosting the same repository again
+// sets the time left. A zero duration ends the boost of the repository.
+func (m *Model) Boost(repo string, d time.Duration) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return ErrNoSuchRepo
+	}
+	if p == nil || cap(p.requestSlots) == 0 {
+		return ErrReadOnly
+	}
+	select {
+	case <-p.stopped:
+		return ErrStopped
+	default:
+	}
+	if d < 0 {
+		return errBoostDuration
+	}
+
+	m.bmut.Lock()
+	defer m.bmut.Unlock()
+
+	cur := m.boost
+	if d == 0 {
+		if cur != nil && cur.repo == repo {
+			cur.timer.Stop()
+			m.boost = nil
+			m.shareSlots("")
+		}
+		return nil
+	}
+
+	if cur != nil {
+		cur.timer.Stop()
+	}
+	if cur == nil || cur.repo != repo {
+		m.shareSlots(repo)
+	}
+	b := &repoBoost{repo: repo}
+	// Runs regardless of what the pullers are doing, so the boost ends
+	// on time even if the repository is in sync long before.
+	b.timer = time.AfterFunc(d, func() { m.endBoost(b) })
+	m.boost = b
+	return nil
+}
+
+// endBoost returns the slots to the other repositories, unless b has been
+// replaced by another boost in the meantime.
+func (m *Model) endBoost(b *repoBoost) {
+	m.bmut.Lock()
+	defer m.bmut.Unlock()
+	if m.boost != b {
+		return
+	}
+	m.boost = nil
+	m.shareSlots("")
+}
+
+// shareSlots has the read/write pullers move slots to the boosted repo, or
+// back to where they were configured when repo is empty. Must be called with
+// bmut held.
+func (m *Model) shareSlots(repo string) {
+	m.rmut.RLock()
+	ps := make(map[string]*puller, len(m.pullers))
+	for id, p := range m.pullers {
+		if cap(p.requestSlots) > 0 {
+			ps[id] = p
+		}
+	}
+	m.rmut.RUnlock()
+
+	deltas := make(map[string]int, len(ps))
+	if b, ok := ps[repo]; ok {
+		var freed int
+		for id, p := range ps {
+			if id == repo {
+				continue
+			}
+			p.mut.Lock()
+			give := p.throttle.slots / 2
+			p.mut.Unlock()
+			deltas[id] = -give
+			freed += give
+		}
+
+		b.mut.Lock()
+		if room := cap(b.requestSlots) - b.throttle.slots; freed > room {
+			freed = room
+		}
+		b.mut.Unlock()
+		deltas[repo] = freed
+	}
+
+	for id, p := range ps {
+		if debug {
+			l.Debugf("%q: boosting slots by %d", id, deltas[id])
+		}
+		req := boostSlotsReq{delta: deltas[id], done: make(chan struct{})}
+		select {
+		case p.boostSlots <- req:
+			p.wait(req.done)
+		case <-p.stopped:
+			// Its slots are no longer used
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+)
+
+// setupBoost starts a read/write repository with the given number of slots
+// for each of repos.
+func setupBoost(t *testing.T, slots int, repos ...string) (*Model, []string) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	var dirs []string
+	for _, repo := range repos {
+		dir, err := ioutil.TempDir("", "syncthing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		m.AddRepo(config.RepositoryConfiguration{ID: repo, Directory: dir})
+		m.StartRepoRW(repo, slots)
+	}
+	return m, dirs
+}
+
+func repoSlots(m *Model, repo string) int {
+	m.rmut.RLock()
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.slots
+}
+
+func TestBoost(t *testing.T) {
+	m, dirs := setupBoost(t, 16, "a", "b", "c")
+	for _, dir := range dirs {
+		defer os.RemoveAll(dir)
+	}
+
+	if err := m.Boost("a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for repo, n := range map[string]int{"a": 32, "b": 8, "c": 8} {
+		if s := repoSlots(m, repo); s != n {
+			t.Errorf("%q has %d slots while boosted, expected %d", repo, s, n)
+		}
+	}
+
+	// Boosting another repository ends the first boost
+	if err := m.Boost("b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for repo, n := range map[string]int{"a": 8, "b": 32, "c": 8} {
+		if s := repoSlots(m, repo); s != n {
+			t.Errorf("%q has %d slots after switching the boost, expected %d", repo, s, n)
+		}
+	}
+
+	// A zero duration ends the boost of that repository only
+	m.Boost("a", 0)
+	if s := repoSlots(m, "b"); s != 32 {
+		t.Errorf("Boost of %q ended by another repository", "b")
+	}
+	m.Boost("b", 0)
+	for _, repo := range []string{"a", "b", "c"} {
+		if s := repoSlots(m, repo); s != 16 {
+			t.Errorf("%q has %d slots after the boost", repo, s)
+		}
+	}
+
+	if err := m.Boost("nonexistent", time.Hour); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := m.Boost("a", -time.Second); err != errBoostDuration {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestBoostExpires(t *testing.T) {
+	m, dirs := setupBoost(t, 4, "a", "b")
+	for _, dir := range dirs {
+		defer os.RemoveAll(dir)
+	}
+
+	m.Boost("a", 50*time.Millisecond)
+	if s := repoSlots(m, "a"); s != 6 {
+		t.Errorf("%d slots while boosted", s)
+	}
+	// Setting the time left again doesn't boost any further
+	m.Boost("a", 50*time.Millisecond)
+	if s := repoSlots(m, "a"); s != 6 {
+		t.Errorf("%d slots while boosted again", s)
+	}
+
+	// The pullers are idle meanwhile
+	time.Sleep(200 * time.Millisecond)
+	for _, repo := range []string{"a", "b"} {
+		if s := repoSlots(m, repo); s != 4 {
+			t.Errorf("%q has %d slots after the boost expired", repo, s)
+		}
+	}
+}
+
+func TestBoostLimit(t *testing.T) {
+	m, dirs := setupBoost(t, 200, "a", "b")
+	for _, dir := range dirs {
+		defer os.RemoveAll(dir)
+	}
+
+	m.Boost("a", time.Hour)
+	if s := repoSlots(m, "a"); s != maxRequestSlots {
+		t.Errorf("%d slots while boosted, expected the maximum of %d", s, maxRequestSlots)
+	}
+	if s := repoSlots(m, "b"); s != 100 {
+		t.Errorf("%d slots left to the other repository", s)
+	}
+}
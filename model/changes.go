@@ -0,0 +1,147 @@
+package model
+
+import (
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// The operations recorded as recent changes.
+const (
+	ChangeAdded      = "added"      // a new file was pulled
+	ChangeUpdated    = "updated"    // an existing file or directory was replaced or had its metadata changed
+	ChangeDeleted    = "deleted"    // a file was deleted
+	ChangeDirCreated = "dirCreated" // a directory was created
+	ChangeDirRemoved = "dirRemoved" // a directory was removed
+	ChangeConflict   = "conflict"   // a locally changed file was kept aside as a conflict copy
+)
+
+// A Change is an operation applied to the repository by the puller.
+type Change struct {
+	Time    time.Time
+	Repo    string
+	Name    string
+	Op      string
+	Version uint64
+	Node    string `json:",omitempty"` // a node that announced the version, if still known
+}
+
+// The number of recent changes kept per repository.
+var recentChangesMax = 1000
+
+// A changeRing holds the last changes made to a repository, overwriting the
+// oldest one once full.
+type changeRing struct {
+	changes []Change
+	next    int // where the next change goes
+}
+
+func (r *changeRing) add(c Change, max int) {
+	if len(r.changes) < max {
+		r.changes = append(r.changes, c)
+		r.next = len(r.changes) % max
+		return
+	}
+	r.changes[r.next] = c
+	r.next = (r.next + 1) % len(r.changes)
+}
+
+// newest returns up to limit changes, the most recent first.
+func (r *changeRing) newest(limit int) []Change {
+	n := len(r.changes)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	res := make([]Change, n)
+	for i := range res {
+		res[i] = r.changes[(r.next-1-i+2*len(r.changes))%len(r.changes)]
+	}
+	return res
+}
+
+// RecentChanges returns the last limit changes the puller applied to the
+// repository, the most recent first. A limit of zero returns all that are
+// kept. Unlike the event stream, the changes can be read at any time
+// after they happened, as long as they haven't been pushed out by newer
+// ones.
+func (m *Model) RecentChanges(repo string, limit int) ([]Change, error) {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return nil, ErrNoSuchRepo
+	}
+
+	m.chmut.Lock()
+	defer m.chmut.Unlock()
+	r, ok := m.changes[repo]
+	if !ok {
+		return nil, nil
+	}
+	return r.newest(limit), nil
+}
+
+// recordChange adds an operation on f to the recent changes of the repo.
+func (m *Model) recordChange(repo string, f scanner.File, op string) {
+	c := Change{
+		Time:    time.Now(),
+		Repo:    repo,
+		Name:    f.Name,
+		Op:      op,
+		Version: f.Version,
+		Node:    m.announcingNode(repo, f),
+	}
+
+	m.chmut.Lock()
+	r, ok := m.changes[repo]
+	if !ok {
+		r = &changeRing{}
+		m.changes[repo] = r
+	}
+	r.add(c, recentChangesMax)
+	m.chmut.Unlock()
+}
+
+// announcingNode returns the first, by ID, of the other nodes whose index
+// has the global version of f, or the empty string if there is none.
+func (m *Model) announcingNode(repo string, f scanner.File) string {
+	m.rmut.RLock()
+	rf := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	if rf == nil {
+		return ""
+	}
+	avail := uint64(rf.Availability(f.Name))
+	if avail == 0 {
+		return ""
+	}
+	names := m.cm.Names()
+	sort.Strings(names)
+	for _, node := range names {
+		if id, ok := m.cm.Lookup(node); ok && id != cid.LocalID && avail&(1<<id) != 0 {
+			return node
+		}
+	}
+	return ""
+}
+
+// changeOp returns the operation that replacing the local file lf with f
+// amounts to.
+func changeOp(lf, f scanner.File) string {
+	existed := lf.Name == f.Name && !protocol.IsDeleted(lf.Flags)
+	switch {
+	case protocol.IsDeleted(f.Flags) && protocol.IsDirectory(f.Flags):
+		return ChangeDirRemoved
+	case protocol.IsDeleted(f.Flags):
+		return ChangeDeleted
+	case existed:
+		return ChangeUpdated
+	case protocol.IsDirectory(f.Flags):
+		return ChangeDirCreated
+	default:
+		return ChangeAdded
+	}
+}
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestChangeRing(t *testing.T) {
+	var r changeRing
+	names := func(cs []Change) []string {
+		var ns []string
+		for _, c := range cs {
+			ns = append(ns, c.Name)
+		}
+		return ns
+	}
+
+	for i := 0; i < 2; i++ {
+		r.add(Change{Name: fmt.Sprint(i)}, 3)
+	}
+	if ns := names(r.newest(0)); !reflect.DeepEqual(ns, []string{"1", "0"}) {
+		t.Errorf("Incorrect changes %v", ns)
+	}
+
+	// The oldest changes make room for new ones
+	for i := 2; i < 7; i++ {
+		r.add(Change{Name: fmt.Sprint(i)}, 3)
+	}
+	if ns := names(r.newest(0)); !reflect.DeepEqual(ns, []string{"6", "5", "4"}) {
+		t.Errorf("Incorrect changes %v", ns)
+	}
+	if ns := names(r.newest(2)); !reflect.DeepEqual(ns, []string{"6", "5"}) {
+		t.Errorf("Incorrect limited changes %v", ns)
+	}
+}
+
+func TestRecentChanges(t *testing.T) {
+	dir, m, f, _ := setupPull(t)
+	defer os.RemoveAll(dir)
+	p := newTestPuller(m, m.repoCfgs["default"])
+
+	if cs, err := m.RecentChanges("default", 0); err != nil || len(cs) != 0 {
+		t.Fatalf("Unexpected changes %v, %v", cs, err)
+	}
+
+	d := scanner.File{Name: "dir", Version: 1, Flags: protocol.FlagDirectory | 0755}
+	updated := f
+	updated.Version++
+	deleted := updated
+	deleted.Version++
+	deleted.Flags |= protocol.FlagDeleted
+	removed := d
+	removed.Version++
+	removed.Flags |= protocol.FlagDeleted
+	for _, f := range []scanner.File{f, d, updated, deleted, removed} {
+		p.updateLocal(f)
+	}
+	path := filepath.Join(dir, "foo")
+	ioutil.WriteFile(path, []byte("changed"), 0644)
+	if err := p.keepConflict(f, path); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := m.RecentChanges("default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, c := range cs {
+		ops = append(ops, c.Op)
+	}
+	exp := []string{ChangeConflict, ChangeDirRemoved, ChangeDeleted, ChangeUpdated, ChangeDirCreated, ChangeAdded}
+	if !reflect.DeepEqual(ops, exp) {
+		t.Errorf("Incorrect operations %v, expected %v", ops, exp)
+	}
+	if c := cs[len(cs)-1]; c.Name != "foo" || c.Version != f.Version || c.Node != "42" || c.Repo != "default" {
+		t.Errorf("Incorrect change %+v", c)
+	}
+	if cs, _ := m.RecentChanges("default", 2); len(cs) != 2 || cs[0].Op != ChangeConflict {
+		t.Errorf("Incorrect limited changes %v", cs)
+	}
+
+	if _, err := m.RecentChanges("nonexistent", 0); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v for unknown repository", err)
+	}
+}
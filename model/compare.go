@@ -0,0 +1,119 @@
+package model
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A FileDiff describes a file that differs between the local and the global
+// index. Hashes summarize the block list of the respective version and are
+// empty when that version doesn't exist or is deleted.
+type FileDiff struct {
+	Name          string
+	LocalVersion  uint64
+	GlobalVersion uint64
+	LocalHash     string
+	GlobalHash    string
+}
+
+// RepoComparison is the result of CompareRepos.
+type RepoComparison struct {
+	LocalOnly  []FileDiff // files that no other node has the current version of
+	GlobalOnly []FileDiff // needed files that we don't have at all
+	Differing  []FileDiff // needed files that we have a different version of
+	Total      int        // total number of differing files, across all pages
+}
+
+type diffKind int
+
+const (
+	diffLocalOnly diffKind = iota
+	diffGlobalOnly
+	diffDiffering
+)
+
+// CompareRepos compares the local index of the repository to the global one.
+// The differing files are sorted by name and the page of at most limit files
+// starting at offset is returned. A limit of zero or less means no limit.
+func (m *Model) CompareRepos(repo string, offset, limit int) (RepoComparison, error) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+
+	rf, ok := m.repoFiles[repo]
+	if !ok {
+		return RepoComparison{}, ErrNoSuchRepo
+	}
+
+	// Only the names are kept until we know which page to return
+	var kinds = make(map[string]diffKind)
+	for _, f := range rf.Need(cid.LocalID) {
+		lf := rf.Get(cid.LocalID, f.Name)
+		if lf.Name != f.Name || protocol.IsDeleted(lf.Flags) {
+			kinds[f.Name] = diffGlobalOnly
+		} else {
+			kinds[f.Name] = diffDiffering
+		}
+	}
+	for _, f := range rf.Have(cid.LocalID) {
+		if protocol.IsDeleted(f.Flags) {
+			continue
+		}
+		if _, ok := kinds[f.Name]; !ok && rf.Availability(f.Name) == 1<<cid.LocalID {
+			kinds[f.Name] = diffLocalOnly
+		}
+	}
+
+	var names = make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := RepoComparison{Total: len(names)}
+	if offset > len(names) {
+		offset = len(names)
+	}
+	names = names[offset:]
+	if limit > 0 && limit < len(names) {
+		names = names[:limit]
+	}
+
+	for _, name := range names {
+		lf := rf.Get(cid.LocalID, name)
+		gf := rf.GetGlobal(name)
+		d := FileDiff{
+			Name:          name,
+			LocalVersion:  lf.Version,
+			GlobalVersion: gf.Version,
+			LocalHash:     blocksHash(lf),
+			GlobalHash:    blocksHash(gf),
+		}
+		switch kinds[name] {
+		case diffLocalOnly:
+			res.LocalOnly = append(res.LocalOnly, d)
+		case diffGlobalOnly:
+			res.GlobalOnly = append(res.GlobalOnly, d)
+		case diffDiffering:
+			res.Differing = append(res.Differing, d)
+		}
+	}
+
+	return res, nil
+}
+
+// blocksHash returns a short hash summarizing the block list of the file.
+func blocksHash(f scanner.File) string {
+	if f.Name == "" || protocol.IsDeleted(f.Flags) || len(f.Blocks) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, b := range f.Blocks {
+		h.Write(b.Hash)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:8])
+}
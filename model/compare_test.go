@@ -0,0 +1,60 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestCompareRepos(t *testing.T) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+
+	block := []scanner.Block{{Size: 1, Hash: []byte("hash")}}
+	m.ReplaceLocal("default", []scanner.File{
+		{Name: "both", Version: 10, Blocks: block},
+		{Name: "local", Version: 11, Blocks: block},
+		{Name: "older", Version: 12, Blocks: block},
+	})
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{
+		{Name: "both", Version: 10, Blocks: block},
+		{Name: "older", Version: 20, Blocks: block},
+		{Name: "remote1", Version: 21, Blocks: block},
+		{Name: "remote2", Version: 22, Blocks: block},
+	})
+
+	res, err := m.CompareRepos("default", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 4 {
+		t.Errorf("Incorrect total %d != 4", res.Total)
+	}
+	if len(res.LocalOnly) != 1 || res.LocalOnly[0].Name != "local" {
+		t.Errorf("Incorrect local only files %v", res.LocalOnly)
+	}
+	if len(res.GlobalOnly) != 2 || res.GlobalOnly[0].Name != "remote1" || res.GlobalOnly[0].LocalHash != "" {
+		t.Errorf("Incorrect global only files %v", res.GlobalOnly)
+	}
+	if len(res.Differing) != 1 {
+		t.Fatalf("Incorrect differing files %v", res.Differing)
+	}
+	if d := res.Differing[0]; d.Name != "older" || d.LocalVersion != 12 || d.GlobalVersion != 20 || d.LocalHash == "" {
+		t.Errorf("Incorrect differing file %v", d)
+	}
+
+	// Paging, in name order
+	res, _ = m.CompareRepos("default", 1, 2)
+	if res.Total != 4 || len(res.LocalOnly) != 0 || len(res.Differing) != 1 || len(res.GlobalOnly) != 1 || res.GlobalOnly[0].Name != "remote1" {
+		t.Errorf("Incorrect page %+v", res)
+	}
+	res, _ = m.CompareRepos("default", 10, 2)
+	if res.Total != 4 || len(res.LocalOnly)+len(res.GlobalOnly)+len(res.Differing) != 0 {
+		t.Errorf("Incorrect page past the end %+v", res)
+	}
+
+	if _, err := m.CompareRepos("nonexistent", 0, 0); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
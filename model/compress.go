@@ -0,0 +1,167 @@
+package model
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+// The temporary files of repositories with CompressFiles set start with this
+// header, followed by one record per block written: the offset of the block
+// in the file (8 bytes), its size (4 bytes), the size of the compressed data
+// (4 bytes) and the deflated data itself.
+var compressedMagic = []byte("STZ1")
+
+const compressedRecordHeader = 16
+
+var errNotCompressed = errors.New("not a compressed temporary file")
+
+// A compressedTemp stores the blocks written to a temporary file compressed,
+// in the order they arrive. The file is expanded into its final form by
+// expandTemp once all blocks have been written.
+type compressedTemp struct {
+	fd      *os.File
+	records map[int64]compressedRecord // offset in the expanded file -> record
+	end     int64                      // end of the last record in fd
+	mut     sync.Mutex
+}
+
+type compressedRecord struct {
+	pos   int64 // position of the compressed data in fd
+	size  uint32
+	csize uint32
+}
+
+// newCompressedTemp starts a compressed temporary file in the empty file fd.
+func newCompressedTemp(fd *os.File) (*compressedTemp, error) {
+	if _, err := fd.WriteAt(compressedMagic, 0); err != nil {
+		return nil, err
+	}
+	return &compressedTemp{
+		fd:      fd,
+		records: make(map[int64]compressedRecord),
+		end:     int64(len(compressedMagic)),
+	}, nil
+}
+
+// WriteAt compresses p and appends it to the file as the data at offset off.
+// It is safe for concurrent use.
+func (c *compressedTemp) WriteAt(p []byte, off int64) (int, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, compressedRecordHeader))
+	zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	zw.Write(p)
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	rec := buf.Bytes()
+	binary.BigEndian.PutUint64(rec, uint64(off))
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(p)))
+	binary.BigEndian.PutUint32(rec[12:], uint32(len(rec)-compressedRecordHeader))
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if _, err := c.fd.WriteAt(rec, c.end); err != nil {
+		return 0, err
+	}
+	c.records[off] = compressedRecord{
+		pos:   c.end + compressedRecordHeader,
+		size:  uint32(len(p)),
+		csize: uint32(len(rec) - compressedRecordHeader),
+	}
+	c.end += int64(len(rec))
+	return len(p), nil
+}
+
+// readCompressedRecords returns the records of the compressed temporary file
+// fd, or errNotCompressed if it is not one.
+func readCompressedRecords(fd *os.File) (map[int64]compressedRecord, error) {
+	magic := make([]byte, len(compressedMagic))
+	if _, err := fd.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, compressedMagic) {
+		return nil, errNotCompressed
+	}
+
+	records := make(map[int64]compressedRecord)
+	pos := int64(len(compressedMagic))
+	hdr := make([]byte, compressedRecordHeader)
+	for {
+		_, err := fd.ReadAt(hdr, pos)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		off := int64(binary.BigEndian.Uint64(hdr))
+		rec := compressedRecord{
+			pos:   pos + compressedRecordHeader,
+			size:  binary.BigEndian.Uint32(hdr[8:]),
+			csize: binary.BigEndian.Uint32(hdr[12:]),
+		}
+		records[off] = rec
+		pos = rec.pos + int64(rec.csize)
+	}
+}
+
+// expandTemp replaces the compressed temporary file at path with its
+// uncompressed contents, size bytes long, syncing them to disk first if sync
+// is true. Where a block was written more than once, the last write wins.
+func expandTemp(path string, size int64, sync bool) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	records, err := readCompressedRecords(src)
+	if err != nil {
+		return err
+	}
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	expanded := path + ".expanded"
+	dst, err := os.OpenFile(expanded, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	for off, rec := range records {
+		zr := flate.NewReader(io.NewSectionReader(src, rec.pos, int64(rec.csize)))
+		data, rerr := ioutil.ReadAll(zr)
+		zr.Close()
+		if rerr == nil && len(data) != int(rec.size) {
+			rerr = io.ErrUnexpectedEOF
+		}
+		if rerr == nil {
+			_, rerr = dst.WriteAt(data, off)
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	if err == nil {
+		err = dst.Truncate(size)
+	}
+	if err == nil && sync {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	src.Close()
+	if err != nil {
+		os.Remove(expanded)
+		return err
+	}
+	return osutil.Rename(expanded, path)
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestCompressedTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("a line of some log file\n"), 3*scanner.StandardBlockSize/24)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+
+	path := filepath.Join(dir, "temp")
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cz, err := newCompressedTemp(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks arrive in any order, and a block may be written again
+	garbage := bytes.Repeat([]byte{0xff}, int(blocks[1].Size))
+	if _, err := cz.WriteAt(garbage, blocks[1].Offset); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{2, 1, 0} {
+		b := blocks[i]
+		if _, err := cz.WriteAt(data[b.Offset:b.Offset+int64(b.Size)], b.Offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd.Close()
+
+	info, _ := os.Stat(path)
+	if info.Size() >= int64(len(data))/10 {
+		t.Errorf("Compressed temporary file too large, %d bytes", info.Size())
+	}
+
+	if err := expandTemp(path, int64(len(data)), false); err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expanded, data) {
+		t.Error("Incorrect contents after expansion")
+	}
+	if _, err := os.Stat(path + ".expanded"); !os.IsNotExist(err) {
+		t.Error("Intermediate file remains after expansion")
+	}
+
+	// A regular file is left alone
+	if err := expandTemp(path, int64(len(data)), false); err != errNotCompressed {
+		t.Errorf("Unexpected error %v != %v", err, errNotCompressed)
+	}
+}
+
+func TestPullCompressed(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	cfg := m.repoCfgs["default"]
+	cfg.CompressFiles = true
+	m.repoCfgs["default"] = cfg
+
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	for i, b := range f.Blocks {
+		if p.handleBlock(bqBlock{file: f, block: b, last: i == len(f.Blocks)-1}) {
+			continue
+		}
+		select {
+		case res := <-p.requestResults:
+			if i == 1 {
+				// Blocks are kept compressed until the file is complete
+				of := p.openFiles["foo"]
+				if info, err := os.Stat(of.temp); err != nil {
+					t.Error(err)
+				} else if info.Size() >= int64(len(block)) {
+					t.Errorf("Temporary file not compressed, %d bytes", info.Size())
+				}
+			}
+			p.handleRequestResult(res)
+		case <-time.After(time.Second):
+			t.Fatal("No request result")
+		}
+	}
+
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after pull")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat(block, 4)) {
+		t.Error("Incorrect file contents after compressed pull")
+	}
+	if lf := m.CurrentRepoFile("default", "foo"); lf.Version != f.Version {
+		t.Errorf("File not verified and taken into the index, version %d != %d", lf.Version, f.Version)
+	}
+}
@@ -0,0 +1,111 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+)
+
+// Conflict copies made by keepConflict are ordinary files to the scanner, so
+// they are synced like any other and accumulate on every node. With
+// ConflictMaxAgeDays or ConflictMaxCount they are pruned after each pull
+// cycle, along with the trash: those older than the age, and those beyond the
+// newest ConflictMaxCount copies of the same file. The time in the name, not
+// the modification time, tells how old a copy is. With IgnoreConflicts they
+// are treated like the temporary files of other programs, neither scanned
+// nor pulled, so that a conflict stays on the node it happened on.
+
+// conflictPattern matches the names of conflict copies.
+const conflictPattern = "*" + conflictMarker + "*"
+
+// tempPatterns returns the patterns of the files in the repository that are
+// never scanned.
+func tempPatterns(cfg config.RepositoryConfiguration) []string {
+	ps := cfg.TempPatterns()
+	if cfg.IgnoreConflicts {
+		// Not appended in place, as ps may be the defaults
+		ps = append(ps[:len(ps):len(ps)], conflictPattern)
+	}
+	return ps
+}
+
+// isConflictCopy returns true if the name is that of a conflict copy.
+func isConflictCopy(name string) bool {
+	match, _ := filepath.Match(conflictPattern, filepath.Base(name))
+	return match
+}
+
+type conflictCopy struct {
+	path string
+	made time.Time
+}
+
+type byMadeDesc []conflictCopy
+
+func (l byMadeDesc) Len() int           { return len(l) }
+func (l byMadeDesc) Less(a, b int) bool { return l[a].made.After(l[b].made) }
+func (l byMadeDesc) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+// pruneConflicts removes the conflict copies in the repository that are
+// older than ConflictMaxAgeDays or beyond the newest ConflictMaxCount of the
+// same file. It returns errFixupCancelled if cancelled before completing.
+func pruneConflicts(cfg config.RepositoryConfiguration, cancel <-chan struct{}) error {
+	if cfg.ConflictMaxAgeDays == 0 && cfg.ConflictMaxCount == 0 {
+		return nil
+	}
+
+	copies := make(map[string][]conflictCopy)
+	err := filepath.Walk(workDir(cfg), func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-cancel:
+			return errFixupCancelled
+		default:
+		}
+
+		if err != nil {
+			// Vanished or unreadable; nothing to prune
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == ".stversions" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || defTempNamer.IsTemporary(path) {
+			return nil
+		}
+		orig, made, _, ok := ParseConflictName(path)
+		if !ok {
+			return nil
+		}
+		copies[orig] = append(copies[orig], conflictCopy{path, made})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	maxAge := time.Duration(cfg.ConflictMaxAgeDays) * 24 * time.Hour
+	now := time.Now()
+	for _, cs := range copies {
+		sort.Sort(byMadeDesc(cs))
+		for i, c := range cs {
+			expired := maxAge > 0 && now.Sub(c.made) > maxAge
+			tooMany := cfg.ConflictMaxCount > 0 && i >= cfg.ConflictMaxCount
+			if !expired && !tooMany {
+				continue
+			}
+			if debug {
+				l.Debugf("%q: pruning conflict copy %q", cfg.ID, c.path)
+			}
+			if err := os.Remove(c.path); err != nil {
+				l.Warnln(err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestPruneConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	foo := filepath.Join(dir, "foo.txt")
+	bar := filepath.Join(dir, "sub", "bar")
+	names := []string{
+		conflictName(foo, now.Add(-3*time.Hour), ""),
+		conflictName(foo, now.Add(-1*time.Hour), "I6KAH76"),
+		conflictName(foo, now.Add(-2*time.Hour), ""),
+		conflictName(bar, now.Add(-40*24*time.Hour), ""),
+		conflictName(bar, now.Add(-1*time.Hour), ""),
+		// Not pruned: no conflict copies, or not in the repository proper
+		foo,
+		filepath.Join(dir, "foo.sync-conflict-of-sorts.txt"),
+		conflictName(filepath.Join(dir, ".stversions", "foo.txt"), now.Add(-40*24*time.Hour), ""),
+		filepath.Join(dir, defTempNamer.TempName(filepath.Base(conflictName(foo, now.Add(-4*time.Hour), "")))),
+	}
+	for _, name := range names {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	if err := pruneConflicts(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if left := countFiles(t, dir); left != len(names) {
+		t.Fatalf("%d files left without a limit, expected all %d", left, len(names))
+	}
+
+	cfg.ConflictMaxAgeDays = 30
+	cfg.ConflictMaxCount = 2
+	if err := pruneConflicts(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		_, err := os.Stat(name)
+		if pruned := i == 0 || i == 3; pruned != os.IsNotExist(err) {
+			t.Errorf("%q: pruned %v, expected %v (%v)", name, os.IsNotExist(err), pruned, err)
+		}
+	}
+}
+
+func countFiles(t *testing.T, dir string) int {
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestIgnoreConflicts(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	local := conflictName("f", time.Now(), "")
+	if err := ioutil.WriteFile(filepath.Join(dir, local), []byte("local edit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.IgnoreConflicts = true
+	m.repoCfgs["default"] = repoCfg
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if f := m.CurrentRepoFile("default", local); f.Name == local {
+		t.Errorf("Conflict copy %q scanned", local)
+	}
+
+	data := []byte("remote")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	remote := []scanner.File{
+		{Name: "g", Version: 1, Size: int64(len(data)), Modified: time.Now().Unix(), Blocks: blocks},
+		{Name: conflictName("g", time.Now(), "MFZWI3D"), Version: 1, Size: int64(len(data)), Modified: time.Now().Unix(), Blocks: blocks},
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), remote)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.queueNeededBlocks()
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	names := p.bq.fileNames()
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"g"}) {
+		t.Errorf("Incorrect queued files %v, expected no conflict copy", names)
+	}
+}
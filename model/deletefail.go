@@ -0,0 +1,146 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A file deleted by another node that can't be removed here stays in the
+// local index, leaving the nodes out of sync. Such deletes are retried after
+// an increasing delay and reported as they fail. When DeleteRetries is set
+// for the repository, the local file is announced again with a new version
+// once that many attempts have failed, so that it is restored on the other
+// nodes instead.
+
+// Failed deletes are retried after an exponentially increasing delay between
+// these limits. Files in use by another process are waited for like any
+// other file in use.
+const (
+	deleteRetryMin = time.Minute
+	deleteRetryMax = 30 * time.Minute
+)
+
+type failedDelete struct {
+	backoff
+	version  uint64 // version of the delete
+	attempts int
+	err      error // of the last attempt
+}
+
+// gone returns true if there is nothing at path.
+func gone(path string) bool {
+	_, err := os.Lstat(path)
+	return os.IsNotExist(err)
+}
+
+// deleteFailed records a failed attempt to carry out the delete f, giving up
+// and announcing the local file again if the configured number of attempts
+// has been reached. Must be called with p.mut held.
+func (p *puller) deleteFailed(f scanner.File, err error) {
+	if p.failedDeletes == nil {
+		p.failedDeletes = make(map[string]failedDelete)
+	}
+	fd, ok := p.failedDeletes[f.Name]
+	if !ok || fd.version != f.Version {
+		fd = failedDelete{version: f.Version}
+	}
+	fd.attempts++
+	fd.err = err
+
+	inUse := p.checkInUse(f, err)
+	if !inUse {
+		if fd.delay == 0 {
+			fd.delay = deleteRetryMin
+		} else if fd.delay *= 2; fd.delay > deleteRetryMax {
+			fd.delay = deleteRetryMax
+		}
+		fd.until = time.Now().Add(fd.delay)
+	}
+
+	events.Default.Log(events.DeleteFailed, map[string]string{
+		"repo":     p.repoCfg.ID,
+		"item":     f.Name,
+		"error":    err.Error(),
+		"attempts": fmt.Sprint(fd.attempts),
+	})
+
+	if max := p.repoCfg.DeleteRetries; max > 0 && fd.attempts >= max {
+		l.Warnf("Giving up deleting %q in repository %q after %d attempts: %v; announcing it again", f.Name, p.repoCfg.ID, fd.attempts, err)
+		delete(p.failedDeletes, f.Name)
+		delete(p.inUse, f.Name)
+		p.readvertise(f)
+		return
+	}
+	if fd.attempts == 1 && !inUse {
+		l.Warnf("Deleting %q in repository %q: %v; retrying in %v", f.Name, p.repoCfg.ID, err, fd.delay)
+	}
+	p.failedDeletes[f.Name] = fd
+}
+
+// readvertise gives the local file a version newer than the delete f, so
+// that it becomes the global version again.
+func (p *puller) readvertise(f scanner.File) {
+	lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+	if lf.Name != f.Name || protocol.IsDeleted(lf.Flags) {
+		return
+	}
+	lf.Version = lamport.Default.Tick(f.Version)
+	p.model.updateLocal(p.repoCfg.ID, lf)
+}
+
+// waitingDelete returns true if the delete f failed recently and should not
+// be retried yet.
+func (p *puller) waitingDelete(f scanner.File) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	fd, ok := p.failedDeletes[f.Name]
+	return ok && fd.version == f.Version && time.Now().Before(fd.until)
+}
+
+// pruneFailedDeletes forgets about failed deletes that are no longer needed,
+// i.e. that were superseded by a newer version of the file or carried out by
+// someone else.
+func (p *puller) pruneFailedDeletes(need []scanner.File) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if len(p.failedDeletes) == 0 {
+		return
+	}
+	deletes := make(map[string]uint64, len(need))
+	for _, f := range need {
+		if protocol.IsDeleted(f.Flags) {
+			deletes[f.Name] = f.Version
+		}
+	}
+	for name, fd := range p.failedDeletes {
+		if v, ok := deletes[name]; !ok || v != fd.version {
+			delete(p.failedDeletes, name)
+		}
+	}
+}
+
+// FailedDeletes returns the files in the repo that have been deleted by other
+// nodes but could not be removed locally, along with the last error.
+func (m *Model) FailedDeletes(repo string) map[string]string {
+	m.rmut.RLock()
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if p == nil {
+		return nil
+	}
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	res := make(map[string]string, len(p.failedDeletes))
+	for name, fd := range p.failedDeletes {
+		res[name] = fd.err.Error()
+	}
+	return res
+}
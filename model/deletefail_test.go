@@ -0,0 +1,120 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// setupDelete returns a puller for the repository set up by setupRescanRepo
+// and the delete of a/e by another node.
+func setupDelete(t *testing.T, retries int) (m *Model, dir string, p *puller, df scanner.File) {
+	m, dir = setupRescanRepo(t)
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.DeleteRetries = retries
+	p = newTestPuller(m, repoCfg)
+
+	name := filepath.Join("a", "e")
+	lf := m.CurrentRepoFile("default", name)
+	df = scanner.File{Name: name, Version: lf.Version + 1, Flags: protocol.FlagDeleted, Modified: lf.Modified}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{df})
+	return
+}
+
+func TestDeleteAlreadyGone(t *testing.T) {
+	m, dir, p, df := setupDelete(t, 0)
+	defer os.RemoveAll(dir)
+
+	os.Remove(filepath.Join(dir, df.Name))
+	p.handleBlock(bqBlock{file: df, last: true})
+	if f := m.CurrentRepoFile("default", df.Name); !protocol.IsDeleted(f.Flags) {
+		t.Errorf("File not deleted in index: %v", f)
+	}
+	if fds := m.FailedDeletes("default"); len(fds) != 0 {
+		t.Errorf("Unexpected failed deletes %v", fds)
+	}
+}
+
+func TestDeleteFailed(t *testing.T) {
+	m, dir, p, df := setupDelete(t, 0)
+	defer os.RemoveAll(dir)
+	m.pullers["default"] = p
+
+	// A non-empty directory took the place of the file
+	path := filepath.Join(dir, df.Name)
+	os.Remove(path)
+	os.Mkdir(path, 0755)
+	ioutil.WriteFile(filepath.Join(path, "x"), []byte("x"), 0644)
+
+	sub := events.Default.Subscribe(events.DeleteFailed)
+	defer events.Default.Unsubscribe(sub)
+
+	p.handleBlock(bqBlock{file: df, last: true})
+	if f := m.CurrentRepoFile("default", df.Name); protocol.IsDeleted(f.Flags) {
+		t.Error("File deleted in index")
+	}
+	if _, ok := m.FailedDeletes("default")[df.Name]; !ok {
+		t.Errorf("Delete not reported as failed")
+	}
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["item"] != df.Name || data["attempts"] != "1" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	if !p.waitingDelete(df) {
+		t.Error("Failed delete retried right away")
+	}
+
+	// The delete keeps failing without giving up
+	fd := p.failedDeletes[df.Name]
+	fd.until = time.Time{}
+	p.failedDeletes[df.Name] = fd
+	p.handleBlock(bqBlock{file: df, last: true})
+	if fd := p.failedDeletes[df.Name]; fd.attempts != 2 || fd.delay != 2*deleteRetryMin {
+		t.Errorf("Incorrect failed delete %+v", fd)
+	}
+
+	// Once carried out elsewhere, it is no longer needed
+	m.repoFiles["default"].Replace(m.cm.Get("42"), nil)
+	p.pruneFailedDeletes(m.NeedFilesRepo("default"))
+	if fds := m.FailedDeletes("default"); len(fds) != 0 {
+		t.Errorf("Unexpected failed deletes %v", fds)
+	}
+}
+
+func TestDeleteFailedReadvertise(t *testing.T) {
+	m, dir, p, df := setupDelete(t, 2)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, df.Name)
+	os.Remove(path)
+	os.Mkdir(path, 0755)
+	ioutil.WriteFile(filepath.Join(path, "x"), []byte("x"), 0644)
+
+	for i := 0; i < 2; i++ {
+		p.handleBlock(bqBlock{file: df, last: true})
+	}
+
+	// The local file is the global version again
+	lf := m.CurrentRepoFile("default", df.Name)
+	if protocol.IsDeleted(lf.Flags) || lf.Version <= df.Version {
+		t.Errorf("Local file not announced again: %v", lf)
+	}
+	m.rmut.RLock()
+	gf := m.repoFiles["default"].GetGlobal(df.Name)
+	m.rmut.RUnlock()
+	if gf.Version != lf.Version {
+		t.Errorf("Global version %v, expected %v", gf, lf)
+	}
+	if len(p.failedDeletes) != 0 {
+		t.Errorf("Unexpected failed deletes %v", p.failedDeletes)
+	}
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// When DeleteGraceHours is set for a repository, files deleted by other nodes
+// are kept for the grace period before they are removed locally. The delete
+// is only carried out if it is still the global version of the file once the
+// period is over, and may be undone until then.
+
+var ErrNoPendingDelete = errors.New("no pending delete for file")
+
+type pendingDelete struct {
+	version uint64 // version of the delete
+	since   time.Time
+}
+
+// deferDelete returns true if the delete of f should not be carried out yet.
+// The grace period starts when the delete is first seen, and starts over if
+// a newer delete arrives.
+func (p *puller) deferDelete(f scanner.File) bool {
+	if lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name); lf.Name != f.Name || protocol.IsDeleted(lf.Flags) {
+		// Nothing to delete
+		return false
+	}
+	grace := time.Duration(p.repoCfg.DeleteGraceHours) * time.Hour
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if p.pendingDeletes == nil {
+		p.pendingDeletes = make(map[string]pendingDelete)
+	}
+	pd, ok := p.pendingDeletes[f.Name]
+	if !ok || pd.version != f.Version {
+		l.Infof("Deleting %q in repository %q in %d hours unless undone", f.Name, p.repoCfg.ID, p.repoCfg.DeleteGraceHours)
+		pd = pendingDelete{version: f.Version, since: time.Now()}
+		p.pendingDeletes[f.Name] = pd
+	}
+	return time.Since(pd.since) < grace
+}
+
+// prunePendingDeletes forgets about deletes that are no longer needed, i.e.
+// that were superseded by a newer version of the file.
+func (p *puller) prunePendingDeletes(need []scanner.File) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if len(p.pendingDeletes) == 0 {
+		return
+	}
+	deletes := make(map[string]uint64, len(need))
+	for _, f := range need {
+		if protocol.IsDeleted(f.Flags) {
+			deletes[f.Name] = f.Version
+		}
+	}
+	for name, pd := range p.pendingDeletes {
+		if v, ok := deletes[name]; !ok || v != pd.version {
+			delete(p.pendingDeletes, name)
+		}
+	}
+}
+
+// PendingDeletes returns the names of the files in the repo that have been
+// deleted by other nodes and are waiting for the grace period to end.
+func (m *Model) PendingDeletes(repo string) []string {
+	m.rmut.RLock()
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if p == nil {
+		return nil
+	}
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	var names []string
+	for name := range p.pendingDeletes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// UndoDelete cancels the pending delete of the named file. The file is given
+// a new version, so that it is restored on the nodes where it has already
+// been deleted.
+func (m *Model) UndoDelete(repo, name string) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+	if p == nil {
+		return ErrNoPendingDelete
+	}
+
+	p.mut.Lock()
+	pd, ok := p.pendingDeletes[name]
+	delete(p.pendingDeletes, name)
+	p.mut.Unlock()
+	if !ok {
+		return ErrNoPendingDelete
+	}
+
+	m.rmut.RLock()
+	lf := m.repoFiles[repo].Get(cid.LocalID, name)
+	gf := m.repoFiles[repo].GetGlobal(name)
+	m.rmut.RUnlock()
+	if lf.Name != name || protocol.IsDeleted(lf.Flags) || !protocol.IsDeleted(gf.Flags) || gf.Version != pd.version {
+		return ErrNoPendingDelete
+	}
+
+	l.Infof("Undoing delete of %q in repository %q", name, repo)
+	lf.Version = lamport.Default.Tick(gf.Version)
+	m.updateLocal(repo, lf)
+	return nil
+}
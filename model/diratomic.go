@@ -0,0 +1,54 @@
+package model
+
+import (
+	"path/filepath"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// With DirAtomic, files that have been pulled and verified are not renamed
+// into place one by one. They are held in their temporary files until no
+// other file of the same directory is being pulled, queued or waiting, and
+// are then renamed into place together, so that the directory goes from its
+// old contents to the new in one go rather than file by file. A file that
+// fails doesn't hold back the rest of its directory.
+
+// holdForDir holds the verified file until the rest of its directory is
+// done.
+func (p *puller) holdForDir(f scanner.File, of openFile) {
+	p.dirHeld = append(p.dirHeld, pendingRename{f, of})
+}
+
+// promoteDirs renames the held files of each directory that is done into
+// place. Must be called with p.mut held.
+func (p *puller) promoteDirs() {
+	if len(p.dirHeld) == 0 {
+		return
+	}
+
+	busy := p.pullingDirs()
+	var held []pendingRename
+	for _, r := range p.dirHeld {
+		if busy[filepath.Dir(r.file.Name)] {
+			held = append(held, r)
+		} else {
+			p.renameBatch = append(p.renameBatch, r)
+		}
+	}
+	if len(held) == len(p.dirHeld) {
+		return
+	}
+	if debug {
+		l.Debugf("pull: %q: %d files held for their directories", p.repoCfg.ID, len(held))
+	}
+	p.dirHeld = held
+	p.flushRenameBatch()
+}
+
+// releaseDirs adds the held files to the rename batch, regardless of their
+// directories being done, for when everything pulled so far must be put in
+// place. Must be called with p.mut held.
+func (p *puller) releaseDirs() {
+	p.renameBatch = append(p.renameBatch, p.dirHeld...)
+	p.dirHeld = nil
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestDirAtomic(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.DirAtomic = true
+	m.repoCfgs["default"] = repoCfg
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	var fs []scanner.File
+	for _, name := range []string{filepath.Join("d", "x1"), filepath.Join("d", "x2"), "x3"} {
+		fs = append(fs, scanner.File{Name: name, Version: 1, Size: int64(len(data)), Blocks: blocks})
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), fs)
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	for _, f := range fs {
+		p.handleBlock(bqBlock{file: f, block: f.Blocks[0], last: true})
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	var inDir int
+	for range fs {
+		select {
+		case res := <-p.requestResults:
+			p.handleRequestResult(res)
+			p.promoteDirs()
+			if res.file.Name == "x3" {
+				if !exists("x3") {
+					t.Error("File in a directory of its own not in place")
+				}
+				continue
+			}
+			inDir++
+		case <-time.After(time.Second):
+			t.Fatal("No request result")
+		}
+
+		// The files of d appear together once both are done
+		for _, f := range fs[:2] {
+			if exists(f.Name) != (inDir == 2) {
+				t.Errorf("%q in place %v with %d of 2 files of the directory done", f.Name, exists(f.Name), inDir)
+			}
+		}
+	}
+
+	for _, f := range fs {
+		if lf := m.CurrentRepoFile("default", f.Name); lf.Version != f.Version {
+			t.Errorf("Local version of %q not updated", f.Name)
+		}
+	}
+	if len(p.dirHeld) != 0 {
+		t.Errorf("Files still held %v", p.dirHeld)
+	}
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A dirBudget counts the directories that need to be created for the files
+// queued during a pull cycle, so that a large new tree is created a part at
+// a time instead of all at once.
+type dirBudget struct {
+	root    string
+	limit   int
+	used    int
+	present map[string]bool // directories that exist or are to be created this cycle
+}
+
+func newDirBudget(root string, limit int) *dirBudget {
+	return &dirBudget{
+		root:    root,
+		limit:   limit,
+		present: make(map[string]bool),
+	}
+}
+
+// allow returns true if the directories missing for f, which for a
+// directory includes itself, fit in what is left of the budget, and takes
+// them from it. Files are expected in name order, so that a directory is
+// counted before the files in it. A file needing more directories than the
+// whole budget is let through if it is the first to need any, or it would
+// never be pulled.
+func (d *dirBudget) allow(f scanner.File) bool {
+	dir := filepath.Dir(f.Name)
+	if protocol.IsDirectory(f.Flags) {
+		dir = f.Name
+	}
+
+	var missing []string
+	for dir != "." && dir != string(filepath.Separator) && !d.present[dir] {
+		if _, err := os.Stat(filepath.Join(d.root, dir)); err == nil || !os.IsNotExist(err) {
+			d.present[dir] = true
+			break
+		}
+		missing = append(missing, dir)
+		dir = filepath.Dir(dir)
+	}
+	if len(missing) == 0 {
+		return true
+	}
+	if d.used > 0 && d.used+len(missing) > d.limit {
+		return false
+	}
+	for _, dir := range missing {
+		d.present[dir] = true
+	}
+	d.used += len(missing)
+	return true
+}
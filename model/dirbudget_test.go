@@ -0,0 +1,78 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestMaxNewDirsPerCycle(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	const limit = 5
+	m.cfg.Options.MaxNewDirsPerCycle = limit
+	p := newTestPuller(m, m.repoCfgs["default"])
+
+	// A new tree of ten directories with a file in each, and a file eight
+	// directories down whose directories aren't in the index at all.
+	fs := []scanner.File{{Name: "n", Version: 1, Flags: protocol.FlagDirectory | 0755}}
+	for i := 0; i < 9; i++ {
+		d := filepath.Join("n", fmt.Sprint(i))
+		fs = append(fs,
+			scanner.File{Name: d, Version: 1, Flags: protocol.FlagDirectory | 0755},
+			scanner.File{Name: filepath.Join(d, "f"), Version: 1, Flags: 0644})
+	}
+	deep := filepath.Join("x", "1", "2", "3", "4", "5", "6", "7", "f")
+	fs = append(fs, scanner.File{Name: deep, Version: 1, Flags: 0644})
+	m.repoFiles["default"].Replace(m.cm.Get("42"), fs)
+
+	countDirs := func() int {
+		n := 0
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+
+	cycles := 0
+	for {
+		need := len(m.NeedFilesRepo("default"))
+		if need == 0 {
+			break
+		}
+		if cycles++; cycles > 10 {
+			t.Fatalf("%d files still needed after 10 cycles", need)
+		}
+
+		before := countDirs()
+		p.queueNeededBlocks()
+		queued := need - int(p.stats.dirWaiting)
+		if queued == 0 {
+			t.Fatalf("Cycle %d: none of %d needed files queued", cycles, need)
+		}
+		for i := 0; i < queued; i++ {
+			p.handleBlock(p.bq.get())
+		}
+
+		// Only a file needing more directories than the limit on its own
+		// may go over it.
+		if created := countDirs() - before; created > limit && queued != 1 {
+			t.Errorf("Cycle %d: %d directories created, limit %d", cycles, created, limit)
+		}
+	}
+
+	if cycles != 3 {
+		t.Errorf("Tree created in %d cycles, expected 3", cycles)
+	}
+	if _, err := os.Stat(filepath.Join(dir, deep)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+// With AdaptiveDiskThrottle set, the request slots are halved while the disk
+// is busier than diskBusyHigh, down to a sixteenth, and doubled again while
+// it is less busy than diskBusyLow.
+const (
+	diskBusyHigh     = 0.8
+	diskBusyLow      = 0.5
+	maxThrottleLevel = 4
+)
+
+// A diskThrottle scales the number of request slots of a puller to how busy
+// the disk of the repository is.
+type diskThrottle struct {
+	slots       int           // configured number of request slots
+	boost       int           // slots added or taken away while a repository is boosted
+	level       int           // the slots are divided by 2^level
+	busy        time.Duration // busy time of the disk at the last sample
+	sampled     time.Time     // when the last sample was taken, zero if none
+	unsupported bool          // the disk can't be probed
+}
+
+// scaled returns the number of request slots to use at the current level,
+// including any boost, which is at least one.
+func (t diskThrottle) scaled() int {
+	if n := (t.slots + t.boost) >> uint(t.level); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// factor returns the share of the configured request slots in use.
+func (t diskThrottle) factor() float64 {
+	return 1 / float64(int(1)<<uint(t.level))
+}
+
+// update takes a sample of the disk's busy time and adjusts the level to the
+// utilization since the last one. Returns true if the level changed.
+func (t *diskThrottle) update(busy time.Duration, now time.Time) bool {
+	prevBusy, prev := t.busy, t.sampled
+	t.busy, t.sampled = busy, now
+	if prev.IsZero() || !now.After(prev) {
+		return false
+	}
+
+	util := float64(busy-prevBusy) / float64(now.Sub(prev))
+	switch {
+	case util > diskBusyHigh && t.level < maxThrottleLevel:
+		t.level++
+	case util < diskBusyLow && t.level > 0:
+		t.level--
+	default:
+		return false
+	}
+	return true
+}
+
+// sampleDisk checks how busy the disk of the repository is and scales the
+// request slots accordingly. On systems where that can't be found, the
+// slots are left as configured.
+func (p *puller) sampleDisk() {
+	if p.throttle.unsupported {
+		return
+	}
+	busy, err := osutil.DiskBusyTime(p.dir)
+	if err != nil {
+		if debug {
+			l.Debugf("%q: not throttling on disk utilization: %v", p.repoCfg.ID, err)
+		}
+		p.throttle.unsupported = err == osutil.ErrDiskBusyUnsupported
+		return
+	}
+
+	p.mut.Lock()
+	changed := p.throttle.update(busy, time.Now())
+	slots := p.throttle.scaled()
+	p.mut.Unlock()
+	if changed {
+		if debug {
+			l.Debugf("%q: disk throttle factor now %g, %d request slots", p.repoCfg.ID, p.throttle.factor(), slots)
+		}
+		p.setSlots(slots)
+	}
+}
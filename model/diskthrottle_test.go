@@ -0,0 +1,60 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiskThrottle(t *testing.T) {
+	th := diskThrottle{slots: 16}
+	now := time.Now()
+	var busy time.Duration
+
+	// sample advances the clock by five seconds during which the disk was
+	// busy the given share of the time.
+	sample := func(util float64) bool {
+		busy += time.Duration(util * float64(5*time.Second))
+		now = now.Add(5 * time.Second)
+		return th.update(busy, now)
+	}
+
+	if sample(1) {
+		t.Error("Level changed on the first sample")
+	}
+
+	cases := []struct {
+		util    float64
+		changed bool
+		slots   int
+		factor  float64
+	}{
+		{0.9, true, 8, 0.5},
+		{0.6, false, 8, 0.5},
+		{1, true, 4, 0.25},
+		{1, true, 2, 0.125},
+		{1, true, 1, 0.0625},
+		{1, false, 1, 0.0625},
+		{0.2, true, 2, 0.125},
+		{0, true, 4, 0.25},
+		{0, true, 8, 0.5},
+		{0, true, 16, 1},
+		{0, false, 16, 1},
+	}
+	for i, tc := range cases {
+		if changed := sample(tc.util); changed != tc.changed {
+			t.Errorf("%d: changed %v, expected %v", i, changed, tc.changed)
+		}
+		if s := th.scaled(); s != tc.slots {
+			t.Errorf("%d: %d slots, expected %d", i, s, tc.slots)
+		}
+		if f := th.factor(); f != tc.factor {
+			t.Errorf("%d: factor %g, expected %g", i, f, tc.factor)
+		}
+	}
+
+	// At least one slot is kept
+	th = diskThrottle{slots: 3, level: maxThrottleLevel}
+	if s := th.scaled(); s != 1 {
+		t.Errorf("%d slots, expected 1", s)
+	}
+}
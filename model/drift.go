@@ -0,0 +1,51 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// reportDrift compares the modification times and permissions of the files
+// in a read only repository with ReportDrift set to those in its local
+// index, logging a MetadataDrift event for each file that differs. Nothing
+// on disk is changed; the next scan announces the changes as usual. Files
+// that are missing or can't be read are left to the scan. Returns the number
+// of files that differ.
+func (m *Model) reportDrift(repo string) int {
+	m.rmut.RLock()
+	cfg := m.repoCfgs[repo]
+	rf := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	if !cfg.ReadOnly || !cfg.ReportDrift || rf == nil {
+		return 0
+	}
+
+	ignorePerms := cfg.IgnoresPerms()
+	window := m.modTimeWindow()
+	var drifted int
+	for _, f := range rf.Have(cid.LocalID) {
+		if protocol.IsDeleted(f.Flags) || f.Suppressed {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(workDir(cfg), f.Name))
+		if err != nil || info.IsDir() != protocol.IsDirectory(f.Flags) {
+			continue
+		}
+		detail := metadataDrift(info, f, ignorePerms, cfg.SpecialPermBits, window)
+		if detail == "" {
+			continue
+		}
+		l.Infof("Read only repository %q: %q differs from the index: %s", repo, f.Name, detail)
+		events.Default.Log(events.MetadataDrift, map[string]string{
+			"repo":   repo,
+			"item":   f.Name,
+			"detail": detail,
+		})
+		drifted++
+	}
+	return drifted
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+)
+
+func TestReportDrift(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	cfg := m.repoCfgs["default"]
+	cfg.ReadOnly = true
+	m.repoCfgs["default"] = cfg
+
+	path := filepath.Join(dir, "f")
+	os.Chmod(path, 0600)
+	if n := m.reportDrift("default"); n != 0 {
+		t.Errorf("%d files reported without reportDrift", n)
+	}
+
+	cfg.ReportDrift = true
+	m.repoCfgs["default"] = cfg
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "a", "e"), old, old)
+
+	sub := events.Default.Subscribe(events.MetadataDrift)
+	defer events.Default.Unsubscribe(sub)
+	if n := m.reportDrift("default"); n != 2 {
+		t.Errorf("%d files reported, expected 2", n)
+	}
+	details := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		ev, err := sub.Poll(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := ev.Data.(map[string]string)
+		details[data["item"]] = data["detail"]
+	}
+	if d := details["f"]; !strings.Contains(d, "mode 600, index has 644") {
+		t.Errorf("Incorrect detail %q for permission change", d)
+	}
+	if d := details[filepath.Join("a", "e")]; !strings.HasPrefix(d, "modified") {
+		t.Errorf("Incorrect detail %q for modification time change", d)
+	}
+
+	// Neither the file nor the index was changed
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("File mode changed: %v", info.Mode())
+	}
+	if f := m.CurrentRepoFile("default", "f"); f.Flags&0777 != 0644 {
+		t.Errorf("Index changed: %o", f.Flags&0777)
+	}
+}
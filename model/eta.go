@@ -0,0 +1,135 @@
+package model
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// The time constant of the smoothing applied to the estimated completion
+// time. It is longer than that of the rate average, so that the estimate
+// doesn't jump about with every burst of blocks.
+const etaTimeConstant = 20 * time.Second
+
+// Below this rate, in bytes per second, the pull is taken to be stalled and
+// no completion time is estimated.
+const etaMinRate = 1.0
+
+// An etaEstimate keeps an exponentially smoothed completion time.
+type etaEstimate struct {
+	at   time.Time // the smoothed completion time, zero when there is none
+	last time.Time // when at was last updated
+	mut  sync.Mutex
+}
+
+// update moves the smoothed completion time towards raw, as estimated at
+// the time now, and returns it.
+func (e *etaEstimate) update(raw, now time.Time) time.Time {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.at.IsZero() || now.Before(e.last) {
+		e.at = raw
+	} else {
+		w := 1 - math.Exp(-now.Sub(e.last).Seconds()/etaTimeConstant.Seconds())
+		e.at = e.at.Add(time.Duration(w * float64(raw.Sub(e.at))))
+	}
+	e.last = now
+	return e.at
+}
+
+// reset forgets the smoothed completion time, so that the next estimate
+// starts afresh.
+func (e *etaEstimate) reset() {
+	e.mut.Lock()
+	e.at = time.Time{}
+	e.mut.Unlock()
+}
+
+// ETA returns the estimated time at which the repository will be in sync,
+// from the bytes still to be received over the network and the current
+// download rate. It returns the current time when nothing is needed,
+// ErrNoSource when no connected node has any of the needed files and
+// ErrStalled when nothing has been received recently.
+func (m *Model) ETA(repo string) (time.Time, error) {
+	return m.etaAt(repo, time.Now())
+}
+
+func (m *Model) etaAt(repo string, now time.Time) (time.Time, error) {
+	m.rmut.RLock()
+	r, ok := m.repoRates[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return time.Time{}, ErrNoSuchRepo
+	}
+
+	var need []scanner.File
+	source := false
+	for _, f := range m.NeedFilesRepo(repo) {
+		if protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) {
+			continue
+		}
+		// Blocks we have in the current version are copied rather than
+		// received
+		lf := m.CurrentRepoFile(repo, f.Name)
+		_, nb := scanner.BlockDiff(lf.Blocks, f.Blocks)
+		if len(nb) == 0 {
+			continue
+		}
+		f.Blocks = nb
+		need = append(need, f)
+		if !source && m.haveSource(repo, f.Name) {
+			source = true
+		}
+	}
+	if len(need) == 0 {
+		r.eta.reset()
+		return now, nil
+	}
+	if !source {
+		r.eta.reset()
+		return time.Time{}, ErrNoSource
+	}
+
+	r.in.mut.Lock()
+	rate := r.in.decay(now)
+	r.in.mut.Unlock()
+	if rate < etaMinRate {
+		r.eta.reset()
+		return time.Time{}, ErrStalled
+	}
+
+	remaining := p.remainingBytes(need)
+	raw := now.Add(time.Duration(float64(remaining) / rate * float64(time.Second)))
+	return r.eta.update(raw, now), nil
+}
+
+// remainingBytes returns the size of the blocks of the needed files that
+// have not yet been written to their temporary files.
+func (p *puller) remainingBytes(need []scanner.File) int64 {
+	if p != nil {
+		p.mut.Lock()
+		defer p.mut.Unlock()
+	}
+
+	var n int64
+	for _, f := range need {
+		var of openFile
+		if p != nil {
+			of = p.openFiles[f.Name]
+		}
+		if of.version != f.Version {
+			of = openFile{}
+		}
+		for _, b := range f.Blocks {
+			if hasBlock(of.complete, blockIndex(of.blocks, b.Offset)) {
+				continue
+			}
+			n += int64(b.Size)
+		}
+	}
+	return n
+}
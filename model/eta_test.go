@@ -0,0 +1,59 @@
+package model
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestETA(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	// Node 42 has a new file of ten blocks, and a new version of f with
+	// the contents we already have
+	data := bytes.Repeat([]byte("x"), 10*scanner.StandardBlockSize)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	g := scanner.File{Name: "g", Version: 1, Size: int64(len(data)), Blocks: blocks}
+	f := m.CurrentRepoFile("default", "f")
+	f.Version += 100
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f, g})
+
+	now := time.Now()
+	if _, err := m.etaAt("default", now); err != ErrNoSource {
+		t.Errorf("Incorrect error %v without a source", err)
+	}
+
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	if _, err := m.etaAt("default", now); err != ErrStalled {
+		t.Errorf("Incorrect error %v without a rate", err)
+	}
+
+	// One block per second
+	m.repoRates["default"].in.addAt(5*scanner.StandardBlockSize, now)
+	eta, err := m.etaAt("default", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := eta.Sub(now); d < 9*time.Second || d > 11*time.Second {
+		t.Errorf("Incorrect time remaining %v, expected 10s", d)
+	}
+
+	// A sudden burst moves the estimate only part of the way
+	m.repoRates["default"].in.addAt(45*scanner.StandardBlockSize, now.Add(time.Second))
+	next, err := m.etaAt("default", now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := next.Sub(now); d < 5*time.Second || d >= eta.Sub(now) {
+		t.Errorf("Incorrect time remaining %v after a burst", d)
+	}
+
+	if _, err := m.ETA("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Incorrect error %v for unknown repository", err)
+	}
+}
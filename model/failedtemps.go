@@ -0,0 +1,135 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// With KeepFailedTemps, temporary files that failed to verify are kept in
+// .stversions/.failed, which the scanner skips along with the rest of
+// .stversions. The reason and time of each failure are recorded in an index
+// next to them, oldest first, so that the oldest are pruned first when the
+// repository keeps more than FailedTempsMax of them.
+
+// A FailedTransfer is a temporary file kept after pulling it failed.
+type FailedTransfer struct {
+	Name   string    // the file in the repository
+	Path   string    // where the temporary file is kept
+	Reason string    // why the pull failed
+	Time   time.Time // when the pull failed
+}
+
+const failedIndexName = "index.json"
+
+// failedDir returns the directory failed temporary files are kept in.
+func failedDir(repoDir string) string {
+	return filepath.Join(repoDir, ".stversions", ".failed")
+}
+
+func loadFailedIndex(dir string) ([]FailedTransfer, error) {
+	fd, err := os.Open(filepath.Join(dir, failedIndexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var fs []FailedTransfer
+	err = json.NewDecoder(fd).Decode(&fs)
+	return fs, err
+}
+
+func saveFailedIndex(dir string, fs []FailedTransfer) error {
+	name := filepath.Join(dir, failedIndexName)
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(fd).Encode(fs)
+	fd.Close()
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return osutil.Rename(name+".tmp", name)
+}
+
+// keepFailedTemp moves the temporary file of f to the failed directory,
+// records why, and prunes the oldest kept files beyond the limit of the
+// repository. Returns where the file was kept.
+func (p *puller) keepFailedTemp(f scanner.File, temp, reason string) (string, error) {
+	dir := failedDir(p.dir)
+	now := time.Now()
+	dst := filepath.Join(dir, f.Name+"~"+now.Format("20060102-150405"))
+	for i := 1; ; i++ {
+		// Several failures within the same second are all kept
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s~%s-%d", f.Name, now.Format("20060102-150405"), i))
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := osutil.Rename(temp, dst); err != nil {
+		return "", err
+	}
+	osutil.ShowFile(dst)
+
+	fs, err := loadFailedIndex(dir)
+	if err != nil {
+		l.Warnf("Reading index of failed transfers in repository %q: %v", p.repoCfg.ID, err)
+	}
+	rel, _ := filepath.Rel(dir, dst)
+	fs = append(fs, FailedTransfer{
+		Name:   f.Name,
+		Path:   rel,
+		Reason: reason,
+		Time:   now,
+	})
+	if max := p.repoCfg.FailedTempsMax; max > 0 && len(fs) > max {
+		for _, old := range fs[:len(fs)-max] {
+			if debug {
+				l.Debugf("%q: pruning failed transfer %q", p.repoCfg.ID, old.Path)
+			}
+			os.Remove(filepath.Join(dir, old.Path))
+		}
+		fs = fs[len(fs)-max:]
+	}
+	if err := saveFailedIndex(dir, fs); err != nil {
+		l.Warnf("Saving index of failed transfers in repository %q: %v", p.repoCfg.ID, err)
+	}
+	return dst, nil
+}
+
+// FailedTransfers returns the temporary files kept after failing to verify,
+// oldest first.
+func (m *Model) FailedTransfers(repo string) ([]FailedTransfer, error) {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return nil, ErrNoSuchRepo
+	}
+
+	dir := failedDir(workDir(cfg))
+	fs, err := loadFailedIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	var kept []FailedTransfer
+	for _, f := range fs {
+		f.Path = filepath.Join(dir, f.Path)
+		if _, err := os.Lstat(f.Path); err == nil {
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestFailedTempsMax(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.FailedTempsMax = 2
+	p := newTestPuller(m, repoCfg)
+
+	var kept []string
+	for i := 0; i < 3; i++ {
+		temp := filepath.Join(dir, "a", defTempNamer.TempName("e"))
+		ioutil.WriteFile(temp, []byte(fmt.Sprint(i)), 0644)
+		dst, err := p.keepFailedTemp(scanner.File{Name: filepath.Join("a", "e")}, temp, fmt.Sprint("failure ", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, dst)
+	}
+
+	// The oldest is pruned
+	if _, err := os.Stat(kept[0]); !os.IsNotExist(err) {
+		t.Errorf("Oldest failed temp not pruned: %v", err)
+	}
+	fs, err := m.FailedTransfers("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 {
+		t.Fatalf("Incorrect failed transfers %+v", fs)
+	}
+	for i, f := range fs {
+		if f.Name != filepath.Join("a", "e") || f.Path != kept[i+1] || f.Reason != fmt.Sprint("failure ", i+1) {
+			t.Errorf("%d: incorrect failed transfer %+v", i, f)
+		}
+		if data, _ := ioutil.ReadFile(f.Path); string(data) != fmt.Sprint(i+1) {
+			t.Errorf("%d: incorrect contents %q", i, data)
+		}
+	}
+
+	// The kept files are not scanned
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range m.haveFilesRepo("default") {
+		if strings.Contains(f.Name, ".stversions") {
+			t.Errorf("Kept file %q scanned", f.Name)
+		}
+	}
+
+	if _, err := m.FailedTransfers("other"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
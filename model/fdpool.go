@@ -0,0 +1,34 @@
+package model
+
+// An fdPool limits the number of files held open at once. Pullers take a
+// token while the existing file is open as a copy source, across all
+// repositories, so that many concurrent copies can't exhaust the process's
+// file descriptors. A nil pool sets no limit.
+//
+// Tokens are only held while a copy reads and writes files, never while
+// waiting on a channel, so a run loop blocking in acquire is always let in
+// by the copies in progress.
+type fdPool struct {
+	tokens chan struct{}
+}
+
+func newFDPool(n int) *fdPool {
+	if n <= 0 {
+		return nil
+	}
+	return &fdPool{tokens: make(chan struct{}, n)}
+}
+
+// acquire blocks until a file may be opened.
+func (p *fdPool) acquire() {
+	if p != nil {
+		p.tokens <- struct{}{}
+	}
+}
+
+// release returns the token taken by acquire, once the file is closed.
+func (p *fdPool) release() {
+	if p != nil {
+		<-p.tokens
+	}
+}
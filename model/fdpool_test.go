@@ -0,0 +1,85 @@
+package model
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFDPoolLimit(t *testing.T) {
+	p := newFDPool(3)
+
+	var open, max int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.acquire()
+			n := atomic.AddInt32(&open, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&open, -1)
+			p.release()
+		}()
+	}
+	wg.Wait()
+
+	if max > 3 {
+		t.Errorf("%d files open at once, limit 3", max)
+	}
+	if n := len(p.tokens); n != 0 {
+		t.Errorf("%d handles still in use", n)
+	}
+}
+
+func TestFDPoolUnlimited(t *testing.T) {
+	p := newFDPool(0)
+	for i := 0; i < 100; i++ {
+		p.acquire()
+	}
+	p.release()
+}
+
+func TestCopyWaitsForHandle(t *testing.T) {
+	p, lf, _ := setupCopyWorkers(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+	p.model.sourceFiles = newFDPool(1)
+
+	f := lf
+	f.Version++
+	f.Modified -= 3600
+
+	// All handles are taken elsewhere, so the copy waits on its worker
+	// without holding up the caller.
+	p.model.sourceFiles.acquire()
+	if p.handleBlock(bqBlock{file: f, copy: lf.Blocks}) {
+		t.Fatal("Copy handled synchronously with a free worker")
+	}
+	select {
+	case <-p.copyResults:
+		t.Fatal("Copy ran without a free handle")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.model.sourceFiles.release()
+	select {
+	case res := <-p.copyResults:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		p.handleCopyResult(res, true)
+	case <-time.After(time.Second):
+		t.Fatal("Copy didn't run after the handle was released")
+	}
+	if n := len(p.model.sourceFiles.tokens); n != 0 {
+		t.Errorf("%d handles still in use after copy", n)
+	}
+}
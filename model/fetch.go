@@ -0,0 +1,121 @@
+package model
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// The blocks of a file fetched on demand are queued with a deadline this far
+// ahead, which puts them before all blocks without one.
+const fetchDeadline = time.Minute
+
+type fetchKey struct {
+	repo, name string
+}
+
+// A fetch is a file being pulled for OnDemandFetch. Concurrent calls for the
+// same file wait for the same fetch. The done channel is closed once the
+// file has been pulled or failed to be, with err set in the latter case.
+type fetch struct {
+	version uint64
+	done    chan struct{}
+	err     error
+}
+
+// OnDemandFetch pulls the named file ahead of everything else that is
+// needed and returns its path once it is complete and verified. The path is
+// returned right away if the file is already up to date. ErrNoSource is
+// returned if no connected node can serve the file.
+func (m *Model) OnDemandFetch(repo, name string) (string, error) {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	var lf, gf scanner.File
+	var p *puller
+	if ok {
+		lf = m.repoFiles[repo].Get(cid.LocalID, name)
+		gf = m.repoFiles[repo].GetGlobal(name)
+		p = m.pullers[repo]
+	}
+	m.rmut.RUnlock()
+
+	if !ok {
+		return "", ErrNoSuchRepo
+	}
+	if gf.Name != name || protocol.IsDeleted(gf.Flags) || protocol.IsDirectory(gf.Flags) {
+		return "", ErrNoSuchFile
+	}
+	path := filepath.Join(workDir(cfg), name)
+	if lf.Name == name && lf.Version == gf.Version {
+		return path, nil
+	}
+	if p == nil || cap(p.requestSlots) == 0 {
+		return "", ErrReadOnly
+	}
+
+	key := fetchKey{repo, name}
+	m.fmut.Lock()
+	fe, ok := m.fetches[key]
+	if !ok {
+		if !m.haveSource(repo, name) {
+			m.fmut.Unlock()
+			return "", ErrNoSource
+		}
+		fe = &fetch{version: gf.Version, done: make(chan struct{})}
+		m.fetches[key] = fe
+	}
+	m.fmut.Unlock()
+
+	if !ok {
+		// A placeholder would otherwise be queued again without content
+		m.Hydrate(repo, name)
+
+		p.mut.Lock()
+		_, open := p.openFiles[name]
+		p.mut.Unlock()
+
+		have, need := scanner.BlockDiff(lf.Blocks, gf.Blocks)
+		if debug {
+			l.Debugf("fetch %q / %q version %d", repo, name, gf.Version)
+		}
+		p.bq.put(bqAdd{
+			file:      gf,
+			have:      have,
+			need:      need,
+			deadline:  time.Now().Add(fetchDeadline),
+			from:      0,
+			to:        gf.Size,
+			onlyQueue: open,
+			priority:  filePriority(cfg.PriorityPatterns, name),
+		})
+	}
+
+	<-fe.done
+	if fe.err != nil {
+		return "", fe.err
+	}
+	return path, nil
+}
+
+// fetched completes the fetch of the named file, if there is one, when the
+// given version of it has been recorded in the local index, or fails it with
+// err when pulling it failed.
+func (m *Model) fetched(repo, name string, version uint64, err error) {
+	key := fetchKey{repo, name}
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	fe, ok := m.fetches[key]
+	if !ok || err == nil && version < fe.version {
+		return
+	}
+	if err == errNoNode {
+		err = ErrNoSource
+	}
+	fe.err = err
+	delete(m.fetches, key)
+	close(fe.done)
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestOnDemandFetch(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := m.OnDemandFetch("nonexistent", "foo"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+	if _, err := m.OnDemandFetch("default", "bar"); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchFile)
+	}
+	if _, err := m.OnDemandFetch("default", "foo"); err != ErrReadOnly {
+		t.Errorf("Unexpected error %v != %v", err, ErrReadOnly)
+	}
+
+	// Once the puller has found nothing to do, the file is only pulled
+	// because it is fetched.
+	m.repoFiles["default"].Replace(m.cm.Get("42"), nil)
+	m.StartRepoRW("default", 1)
+	for i := 0; m.State("default") != "idle"; i++ {
+		if i == 100 {
+			t.Fatal("Puller not idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.ScanAndSync("default"); err != nil {
+		t.Fatal(err)
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+
+	if _, err := m.OnDemandFetch("default", "foo"); err != ErrNoSource {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSource)
+	}
+
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: block}, &requests}
+	m.AddConnection(fc, fc)
+
+	var wg sync.WaitGroup
+	paths := make([]string, 3)
+	errs := make([]error, len(paths))
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = m.OnDemandFetch("default", "foo")
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDemandFetch did not return")
+	}
+
+	for i := range paths {
+		if errs[i] != nil || paths[i] != filepath.Join(dir, "foo") {
+			t.Errorf("%d: unexpected result %q, %v", i, paths[i], errs[i])
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != int32(len(f.Blocks)) {
+		t.Errorf("%d requests for %d blocks", n, len(f.Blocks))
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if !bytes.Equal(data, bytes.Repeat(block, len(f.Blocks))) {
+		t.Error("Incorrect contents of fetched file")
+	}
+
+	// Up to date files are returned right away
+	if path, err := m.OnDemandFetch("default", "foo"); err != nil || path != filepath.Join(dir, "foo") {
+		t.Errorf("Unexpected result %q, %v", path, err)
+	}
+}
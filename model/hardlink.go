@@ -0,0 +1,114 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// Files that are hard linked to each other are flagged as such in the index,
+// but the index does not say which files belong together. Since links share
+// the same inode, they always have the same contents, modification time and
+// flags, so that is what we group them by.
+type linkKey struct {
+	hash     string
+	modified int64
+	flags    uint32
+}
+
+type linkGroups map[linkKey][]string
+
+func hardlinkKey(f scanner.File) linkKey {
+	return linkKey{blocksHash(f), f.Modified, f.Flags}
+}
+
+// hardlinkGroups returns the groups of hard linked files in the global index.
+func (m *Model) hardlinkGroups(repo string) linkGroups {
+	m.rmut.RLock()
+	fs := m.repoFiles[repo].Global()
+	m.rmut.RUnlock()
+
+	groups := make(linkGroups)
+	for _, f := range fs {
+		if protocol.IsHardlink(f.Flags) && !protocol.IsDeleted(f.Flags) {
+			k := hardlinkKey(f)
+			groups[k] = append(groups[k], f.Name)
+		}
+	}
+	return groups
+}
+
+// linkSource returns the name of an up to date local file that the needed
+// file f can be hard linked to. If there is none, defer is true when some
+// other file in the group is going to be pulled first, so that f should be
+// linked to it later instead of being pulled as well.
+func (p *puller) linkSource(f scanner.File, groups linkGroups, needed map[string]bool) (src string, deferred bool) {
+	for _, name := range groups[hardlinkKey(f)] {
+		if name == f.Name {
+			continue
+		}
+		lf := p.model.CurrentRepoFile(p.repoCfg.ID, name)
+		gf := p.model.CurrentGlobalFile(p.repoCfg.ID, name)
+		if lf.Name == name && lf.Version == gf.Version && !protocol.IsDeleted(lf.Flags) {
+			return name, false
+		}
+		// The group member with the lowest name is pulled and the others
+		// wait for it.
+		if needed[name] && name < f.Name {
+			deferred = true
+		}
+	}
+	return "", deferred
+}
+
+// linkFile creates f as a hard link to the local file src.
+func (p *puller) linkFile(f scanner.File, src string) error {
+	srcPath := filepath.Join(p.dir, src)
+	path := filepath.Join(p.dir, f.Name)
+	temp := filepath.Join(p.dir, defTempNamer.TempName(f.Name))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	os.Remove(temp)
+	if err := os.Link(srcPath, temp); err != nil {
+		return err
+	}
+	if err := osutil.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	p.mut.Lock()
+	p.renamed(f, path)
+	p.mut.Unlock()
+	return nil
+}
+
+// queueHardlink handles a needed file flagged as hard linked. It returns true
+// if the file was handled by linking it to another file, or is deferred until
+// some other file in the group has been pulled.
+func (p *puller) queueHardlink(f scanner.File, groups linkGroups, needed map[string]bool) bool {
+	src, deferred := p.linkSource(f, groups, needed)
+	if src == "" {
+		if debug && deferred {
+			l.Debugf("pull: %q / %q waits for another link to be pulled", p.repoCfg.ID, f.Name)
+		}
+		return deferred
+	}
+
+	if err := p.linkFile(f, src); err != nil {
+		// Pull the content instead
+		if debug {
+			l.Debugf("pull: link %q / %q to %q: %v", p.repoCfg.ID, f.Name, src, err)
+		}
+		return false
+	}
+	if debug {
+		l.Debugf("pull: linked %q / %q to %q", p.repoCfg.ID, f.Name, src)
+	}
+	return true
+}
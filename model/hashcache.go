@@ -0,0 +1,172 @@
+package model
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A hashCache remembers the blocks of the files hashed in a repository by
+// inode, modification time and size. It lets the scanner skip hashing files
+// the index doesn't match but whose contents are known, such as files that
+// have been renamed.
+type hashCache struct {
+	chunker string
+	entries map[scanner.HashKey][]scanner.Block
+	used    map[scanner.HashKey]bool // entries looked up or added since the last prune
+	mut     sync.Mutex
+}
+
+// The saved form of a hashCache.
+type savedHashCache struct {
+	Chunker string
+	Entries []hashCacheEntry
+}
+
+type hashCacheEntry struct {
+	Key    scanner.HashKey
+	Blocks []scanner.Block
+}
+
+func newHashCache(chunker string) *hashCache {
+	return &hashCache{
+		chunker: chunker,
+		entries: make(map[scanner.HashKey][]scanner.Block),
+		used:    make(map[scanner.HashKey]bool),
+	}
+}
+
+// Get implements the scanner.HashCache interface.
+func (c *hashCache) Get(key scanner.HashKey) ([]scanner.Block, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	blocks, ok := c.entries[key]
+	if ok {
+		c.used[key] = true
+	}
+	return blocks, ok
+}
+
+// Put implements the scanner.HashCache interface.
+func (c *hashCache) Put(key scanner.HashKey, blocks []scanner.Block) {
+	c.mut.Lock()
+	c.entries[key] = blocks
+	c.used[key] = true
+	c.mut.Unlock()
+}
+
+// prune drops the entries that haven't been used since the last prune. It is
+// called after a complete walk of the repository, so what remains are the
+// entries for the files that currently exist.
+func (c *hashCache) prune() {
+	c.mut.Lock()
+	for key := range c.entries {
+		if !c.used[key] {
+			delete(c.entries, key)
+		}
+	}
+	c.used = make(map[scanner.HashKey]bool)
+	c.mut.Unlock()
+}
+
+// reset drops all entries.
+func (c *hashCache) reset() {
+	c.mut.Lock()
+	c.entries = make(map[scanner.HashKey][]scanner.Block)
+	c.used = make(map[scanner.HashKey]bool)
+	c.mut.Unlock()
+}
+
+func (c *hashCache) save(name string) error {
+	c.mut.Lock()
+	cf := savedHashCache{Chunker: c.chunker, Entries: make([]hashCacheEntry, 0, len(c.entries))}
+	for key, blocks := range c.entries {
+		cf.Entries = append(cf.Entries, hashCacheEntry{key, blocks})
+	}
+	c.mut.Unlock()
+
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	gzw := gzip.NewWriter(fd)
+	err = json.NewEncoder(gzw).Encode(cf)
+	if err == nil {
+		err = gzw.Close()
+	}
+	fd.Close()
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return osutil.Rename(name+".tmp", name)
+}
+
+// load replaces the entries with the ones saved in the named file, unless
+// they were hashed with another chunker.
+func (c *hashCache) load(name string) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gzr, err := gzip.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	var cf savedHashCache
+	if err := json.NewDecoder(gzr).Decode(&cf); err != nil {
+		return err
+	}
+	if cf.Chunker != c.chunker {
+		return fmt.Errorf("hashed with chunker %q", cf.Chunker)
+	}
+
+	c.mut.Lock()
+	c.entries = make(map[scanner.HashKey][]scanner.Block, len(cf.Entries))
+	for _, e := range cf.Entries {
+		c.entries[e.Key] = e.Blocks
+	}
+	c.mut.Unlock()
+	return nil
+}
+
+// hashCacheFile returns the name of the file holding the hash cache for the
+// repo in the given directory. Must be called with rmut held.
+func (m *Model) hashCacheFile(repo, dir string) string {
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoCfgs[repo].Directory)))
+	return filepath.Join(dir, id+".hashes.gz")
+}
+
+// saveHashCache saves the hash cache of the repo, if it has one, next to the
+// index. Must be called with rmut held.
+func (m *Model) saveHashCache(repo, dir string) {
+	c, ok := m.hashCaches[repo]
+	if !ok {
+		return
+	}
+	if err := c.save(m.hashCacheFile(repo, dir)); err != nil && debug {
+		l.Debugf("save hash cache %q: %v", repo, err)
+	}
+}
+
+// loadHashCache loads the hash cache saved for the repo, if it has one. Must
+// be called with rmut held.
+func (m *Model) loadHashCache(repo, dir string) {
+	c, ok := m.hashCaches[repo]
+	if !ok {
+		return
+	}
+	if err := c.load(m.hashCacheFile(repo, dir)); err != nil && debug {
+		l.Debugf("load hash cache %q: %v", repo, err)
+	}
+}
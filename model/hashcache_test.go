@@ -0,0 +1,120 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestScanCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hash cache is not used on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idxDir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(idxDir)
+
+	mod := time.Now().Add(-time.Hour).Truncate(time.Second)
+	path := filepath.Join(dir, "f")
+	ioutil.WriteFile(path, []byte("contents"), 0644)
+	os.Chtimes(path, mod, mod)
+
+	// Don't suppress the quick changes made below
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{MaxChangeKbps: 1e6}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir, ScanCache: true}
+	m := NewModel(idxDir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.hashCaches["default"].entries); n != 1 {
+		t.Fatalf("Incorrect number of cache entries %d != 1", n)
+	}
+	m.SaveIndexes(idxDir)
+
+	// A new model picks up the cache saved with the index. Renaming the
+	// file keeps its inode, so the blocks are taken from the cache.
+	os.Rename(path, filepath.Join(dir, "g"))
+	m = NewModel(idxDir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.LoadIndexes(idxDir)
+	c := m.hashCaches["default"]
+	if len(c.entries) != 1 {
+		t.Fatalf("Incorrect number of cache entries loaded %d != 1", len(c.entries))
+	}
+	marker := []byte("cached")
+	for _, blocks := range c.entries {
+		blocks[0].Hash = marker
+	}
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	before := m.CurrentRepoFile("default", "g")
+	if len(before.Blocks) != 1 || !bytes.Equal(before.Blocks[0].Hash, marker) {
+		t.Error("Renamed file not taken from the cache")
+	}
+
+	// Changing the contents and modification time but not the size
+	// invalidates the entry
+	ioutil.WriteFile(filepath.Join(dir, "g"), []byte("CONTENTS"), 0644)
+	os.Chtimes(filepath.Join(dir, "g"), mod.Add(time.Second), mod.Add(time.Second))
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	after := m.CurrentRepoFile("default", "g")
+	expected, _ := scanner.Blocks(bytes.NewReader([]byte("CONTENTS")), scanner.StandardBlockSize)
+	if !reflect.DeepEqual(after.Blocks, expected) {
+		t.Error("Incorrect blocks after change of contents")
+	}
+	if after.Version == before.Version {
+		t.Error("Version not updated after change of contents")
+	}
+	if n := len(c.entries); n != 1 {
+		t.Errorf("Stale entry not pruned, %d entries", n)
+	}
+}
+
+func TestHashCacheChunker(t *testing.T) {
+	fd, err := ioutil.TempFile("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	defer os.Remove(fd.Name())
+
+	c := newHashCache("")
+	c.Put(scanner.HashKey{Ino: 1, Size: 1}, []scanner.Block{{Size: 1, Hash: []byte{1, 2, 3}}})
+	if err := c.save(fd.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newHashCache("")
+	if err := loaded.load(fd.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.entries, c.entries) {
+		t.Errorf("Incorrect entries loaded: %v != %v", loaded.entries, c.entries)
+	}
+
+	// Blocks hashed with another chunker are of no use
+	other := newHashCache("cdc")
+	if err := other.load(fd.Name()); err == nil || len(other.entries) != 0 {
+		t.Error("Cache loaded despite chunker mismatch")
+	}
+}
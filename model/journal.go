@@ -0,0 +1,188 @@
+package model
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A journal records the original contents of the regions of a file that are
+// overwritten during an in-place update, so that the file can be restored if
+// the update fails or is interrupted by a crash. Each region is written and
+// synced to the journal before the file itself is modified.
+//
+// The journal starts with a header holding the original size and name of the
+// file, followed by one record (offset, length, data) per saved region.
+type journal struct {
+	fd       *os.File
+	origSize int64
+}
+
+const (
+	journalMagic  = 0x53544a31 // "STJ1"
+	journalSuffix = ".journal"
+)
+
+var errJournalCorrupt = errors.New("corrupt journal")
+
+// journalName returns the journal file name for the given file.
+func journalName(path string) string {
+	return defTempNamer.TempName(path) + journalSuffix
+}
+
+func createJournal(path string, origSize int64) (*journal, error) {
+	fd, err := os.OpenFile(journalName(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(path)
+	var hdr = make([]byte, 14+len(name))
+	binary.BigEndian.PutUint32(hdr[0:], journalMagic)
+	binary.BigEndian.PutUint64(hdr[4:], uint64(origSize))
+	binary.BigEndian.PutUint16(hdr[12:], uint16(len(name)))
+	copy(hdr[14:], name)
+
+	if _, err := fd.Write(hdr); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, err
+	}
+	return &journal{fd: fd, origSize: origSize}, nil
+}
+
+// save records the current contents of the given region of target. Only the
+// part of the region within the original size of the file is saved, as
+// anything beyond it is removed by the rollback anyway.
+func (j *journal) save(target *os.File, offset int64, length int64) error {
+	if offset+length > j.origSize {
+		length = j.origSize - offset
+	}
+	if length <= 0 {
+		return nil
+	}
+
+	var rec = make([]byte, 12+length)
+	binary.BigEndian.PutUint64(rec[0:], uint64(offset))
+	binary.BigEndian.PutUint32(rec[8:], uint32(length))
+	if _, err := target.ReadAt(rec[12:], offset); err != nil {
+		return err
+	}
+
+	if _, err := j.fd.Write(rec); err != nil {
+		return err
+	}
+	return j.fd.Sync()
+}
+
+// remove discards the journal, once the update is complete.
+func (j *journal) remove() error {
+	j.fd.Close()
+	return os.Remove(j.fd.Name())
+}
+
+// rollback restores the file to its state before the update and removes the
+// journal.
+func (j *journal) rollback() error {
+	j.fd.Close()
+	return rollbackJournal(j.fd.Name())
+}
+
+// rollbackJournal restores the file described by the journal at jpath to its
+// original contents and size, then removes the journal. A trailing record
+// that was only partially written is ignored, since the file is not modified
+// before the record is complete.
+func rollbackJournal(jpath string) error {
+	jfd, err := os.Open(jpath)
+	if err != nil {
+		return err
+	}
+	defer jfd.Close()
+	br := bufio.NewReader(jfd)
+
+	var hdr [14]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		// The header is written before the file is touched
+		jfd.Close()
+		return os.Remove(jpath)
+	}
+	if binary.BigEndian.Uint32(hdr[0:]) != journalMagic {
+		return errJournalCorrupt
+	}
+	origSize := int64(binary.BigEndian.Uint64(hdr[4:]))
+	name := make([]byte, binary.BigEndian.Uint16(hdr[12:]))
+	if _, err := io.ReadFull(br, name); err != nil {
+		jfd.Close()
+		return os.Remove(jpath)
+	}
+
+	type record struct {
+		offset int64
+		data   []byte
+	}
+	var recs []record
+	for {
+		var rh [12]byte
+		if _, err := io.ReadFull(br, rh[:]); err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(rh[8:]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			break
+		}
+		recs = append(recs, record{int64(binary.BigEndian.Uint64(rh[0:])), data})
+	}
+
+	target := filepath.Join(filepath.Dir(jpath), string(name))
+	fd, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	// Apply in reverse order, so that the oldest saved data for any
+	// region wins.
+	for i := len(recs) - 1; i >= 0; i-- {
+		if _, err := fd.WriteAt(recs[i].data, recs[i].offset); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	if err := fd.Truncate(origSize); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	fd.Close()
+
+	jfd.Close()
+	return os.Remove(jpath)
+}
+
+// recoverJournals rolls back any in-place updates in dir that were
+// interrupted, as indicated by remaining journal files.
+func recoverJournals(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() && defTempNamer.IsTemporary(path) && strings.HasSuffix(path, journalSuffix) {
+			l.Infof("Rolling back interrupted update using %q", path)
+			if err := rollbackJournal(path); err != nil {
+				l.Warnf("Rollback %q: %v", path, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orig := bytes.Repeat([]byte("0123456789"), 10)
+	name := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(name, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := createJournal(name, int64(len(orig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite a region in the middle and extend the file
+	if err := j.save(fd, 5, 20); err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt(bytes.Repeat([]byte("x"), 20), 5)
+	if err := j.save(fd, 95, 20); err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt(bytes.Repeat([]byte("y"), 20), 95)
+
+	// Overwrite the same region again
+	if err := j.save(fd, 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("zzzzz"), 10)
+
+	// A record that was being written when we crashed
+	j.fd.Write([]byte{0, 0, 0, 0, 0, 0, 0, 40, 0, 0})
+	j.fd.Close()
+	fd.Close()
+
+	recoverJournals(dir)
+
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(bs, orig) != 0 {
+		t.Errorf("File not restored:\n%q\n%q", bs, orig)
+	}
+	if _, err := os.Stat(journalName(name)); !os.IsNotExist(err) {
+		t.Error("Unexpected journal remaining after recovery")
+	}
+}
+
+func TestJournalRecoveryEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A crash while the header was being written leaves the file untouched
+	name := filepath.Join(dir, "foo")
+	ioutil.WriteFile(name, []byte("data"), 0644)
+	ioutil.WriteFile(journalName(name), []byte{0x53, 0x54}, 0644)
+
+	recoverJournals(dir)
+
+	if bs, _ := ioutil.ReadFile(name); string(bs) != "data" {
+		t.Errorf("Unexpected file contents %q", bs)
+	}
+	if _, err := os.Stat(journalName(name)); !os.IsNotExist(err) {
+		t.Error("Unexpected journal remaining after recovery")
+	}
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"net"
+)
+
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+// Private, link local and loopback networks. Connections from these are
+// considered local even when they are not on a directly attached network.
+var lanNets []*net.IPNet
+
+func init() {
+	for _, s := range []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+		"127.0.0.0/8",
+		"fc00::/7",
+		"fe80::/10",
+		"::1/128",
+	} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		lanNets = append(lanNets, n)
+	}
+}
+
+// isLANAddr returns true if addr is on the local network, i.e. on a private
+// network or on one of the networks our interfaces are attached to.
+func isLANAddr(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLAN returns true if the node is connected over the local network.
+func (m *Model) isLAN(node string) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return m.nodeLAN[node]
+}
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsLANAddr(t *testing.T) {
+	var tcs = []struct {
+		addr net.Addr
+		lan  bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 22000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("172.20.0.1"), Port: 22000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 22000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::1234"), Port: 22000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("172.32.0.1"), Port: 22000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 22000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:4860:4860::8888"), Port: 22000}, false},
+	}
+
+	for _, tc := range tcs {
+		if lan := isLANAddr(tc.addr); lan != tc.lan {
+			t.Errorf("isLANAddr(%v): %v != %v", tc.addr, lan, tc.lan)
+		}
+	}
+}
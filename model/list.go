@@ -0,0 +1,134 @@
+package model
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+var (
+	ErrNotConnected    = errors.New("node is not connected")
+	ErrNotShared       = errors.New("repository is not shared with the node")
+	ErrListUnsupported = errors.New("node does not answer listing requests")
+)
+
+// Nodes that answer listing requests announce this option in their cluster
+// config. Older nodes drop the connection on receiving a message type they
+// don't know, so they are never asked.
+const listOption = "list"
+
+func hasOption(cm protocol.ClusterConfigMessage, key string) bool {
+	for _, opt := range cm.Options {
+		if opt.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns a page of the files we have in the repo, sorted by name and
+// starting after the named file, for a node that shares the repo. Deleted
+// and invalid files are left out.
+// Implements the protocol.Model interface.
+func (m *Model) List(nodeID, repo, after string, max int) ([]protocol.FileInfo, int) {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	shared := ok && m.sharedWith(repo, nodeID)
+	m.rmut.RUnlock()
+
+	if !shared {
+		l.Warnf("Listing request from %s for unshared repo %q", nodeID, repo)
+		return nil, 0
+	}
+
+	var fs []scanner.File
+	for _, f := range rf.Have(cid.LocalID) {
+		if !protocol.IsDeleted(f.Flags) && !f.Suppressed {
+			fs = append(fs, f)
+		}
+	}
+	sort.Sort(byName(fs))
+
+	start := sort.Search(len(fs), func(i int) bool {
+		return fs[i].Name > after
+	})
+	end := start + max
+	if end > len(fs) {
+		end = len(fs)
+	}
+
+	if debug {
+		l.Debugf("LIST(in): %s: %q after %q: %d of %d files", nodeID, repo, after, end-start, len(fs)-start)
+	}
+
+	page := make([]protocol.FileInfo, 0, end-start)
+	for _, f := range fs[start:end] {
+		page = append(page, fileInfoFromFile(f))
+	}
+	return page, len(fs) - end
+}
+
+// RemoteList asks the node for a page of its files in the repo, sorted by
+// name and starting after the named file, at most max of them. The number of
+// files remaining after the page is returned as well; to get the next page,
+// pass the name of the last file. The listing is not added to any index, so
+// nothing is synced because of it.
+func (m *Model) RemoteList(node, repo, after string, max int) ([]scanner.File, int, error) {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	shared := ok && m.sharedWith(repo, node)
+	m.rmut.RUnlock()
+
+	if !ok {
+		return nil, 0, ErrNoSuchRepo
+	}
+	if !shared {
+		return nil, 0, ErrNotShared
+	}
+
+	m.pmut.RLock()
+	nc, connected := m.protoConn[node]
+	lists := m.nodeList[node]
+	m.pmut.RUnlock()
+
+	if !connected {
+		return nil, 0, ErrNotConnected
+	}
+	if !lists {
+		return nil, 0, ErrListUnsupported
+	}
+
+	if debug {
+		l.Debugf("LIST(out): %s: %q after %q max %d", node, repo, after, max)
+	}
+
+	fs, remaining, err := nc.List(repo, after, max)
+	if err != nil {
+		return nil, 0, err
+	}
+	files := make([]scanner.File, len(fs))
+	for i := range fs {
+		files[i] = fileFromFileInfo(fs[i])
+	}
+	return files, remaining, nil
+}
+
+// sharedWith returns true if the repo is shared with the node. Must be
+// called with rmut held.
+func (m *Model) sharedWith(repo, node string) bool {
+	for _, n := range m.repoNodes[repo] {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+type byName []scanner.File
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
+func (s byName) Less(a, b int) bool { return s[a].Name < s[b].Name }
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/protocol"
+)
+
+func setupListRepo(t *testing.T) *Model {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.NodeConfiguration{{NodeID: "42"}},
+	})
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestList(t *testing.T) {
+	m := setupListRepo(t)
+
+	var names []string
+	var after string
+	for {
+		fs, remaining := m.List("42", "default", after, 3)
+		for _, f := range fs {
+			names = append(names, f.Name)
+		}
+		if remaining == 0 {
+			break
+		}
+		if len(fs) != 3 {
+			t.Fatalf("Short page of %d files with %d remaining", len(fs), remaining)
+		}
+		after = fs[len(fs)-1].Name
+	}
+	expected := []string{"bar", "baz", "empty", "foo"}
+	if len(names) != len(expected) {
+		t.Fatalf("Incorrect listing %v", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Incorrect listing %v != %v", names, expected)
+			break
+		}
+	}
+
+	if fs, _ := m.List("43", "default", "", 10); len(fs) != 0 {
+		t.Error("Files listed for a node the repo isn't shared with")
+	}
+}
+
+func TestRemoteList(t *testing.T) {
+	m := setupListRepo(t)
+	fc := FakeConnection{id: "42", files: []protocol.FileInfo{
+		{Name: "a", Version: 1},
+		{Name: "b/c", Blocks: []protocol.BlockInfo{{Size: 10}, {Size: 5}}},
+	}}
+	m.AddConnection(fc, fc)
+
+	if _, _, err := m.RemoteList("42", "default", "", 10); err != ErrListUnsupported {
+		t.Errorf("Unexpected error %v != %v before cluster config", err, ErrListUnsupported)
+	}
+	m.ClusterConfig("42", m.clusterConfig("42"))
+
+	before := len(m.NeedFilesRepo("default"))
+	fs, remaining, err := m.RemoteList("42", "default", "a", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 || remaining != 0 || fs[0].Size != 15 {
+		t.Errorf("Incorrect listing %v, %d remaining", fs, remaining)
+	}
+	if n := len(m.NeedFilesRepo("default")); n != before {
+		t.Errorf("Listing changed the needed files, %d != %d", n, before)
+	}
+
+	if _, _, err := m.RemoteList("43", "default", "", 10); err != ErrNotShared {
+		t.Errorf("Unexpected error %v != %v", err, ErrNotShared)
+	}
+	if _, _, err := m.RemoteList("42", "nonexistent", "", 10); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
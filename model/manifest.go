@@ -0,0 +1,147 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// ManifestReport is the result of verifying a repository against a manifest.
+type ManifestReport struct {
+	Matching   []string // present with the expected contents; now considered in sync
+	Mismatched []string // present but with different contents
+	Missing    []string // not present at all
+}
+
+// ExportManifest writes the block hashes of all files in the local index of
+// the repository to w. The manifest uses the same format as the saved index
+// and can be verified against a copy of the repository using ImportVerify.
+func (m *Model) ExportManifest(repo string, w io.Writer) error {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+
+	var fs []protocol.FileInfo
+	for _, f := range rf.Have(cid.LocalID) {
+		if protocol.IsDeleted(f.Flags) || f.Suppressed {
+			continue
+		}
+		fs = append(fs, fileInfoFromFile(f))
+	}
+
+	gzw := gzip.NewWriter(w)
+	_, err := protocol.IndexMessage{
+		Repository: repo,
+		Files:      fs,
+	}.EncodeXDR(gzw)
+	if err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// ImportVerify hashes the files in the repository that are listed in the
+// manifest read from r and reports which of them match. Matching files get
+// the modification time and version from the manifest, so that they are
+// considered in sync instead of being pulled again.
+func (m *Model) ImportVerify(repo string, r io.Reader) (ManifestReport, error) {
+	var rep ManifestReport
+
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return rep, ErrNoSuchRepo
+	}
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return rep, err
+	}
+	defer gzr.Close()
+
+	var im protocol.IndexMessage
+	if err := im.DecodeXDR(gzr); err != nil {
+		return rep, err
+	}
+
+	var verified []scanner.File
+	for _, mf := range im.Files {
+		if protocol.IsDeleted(mf.Flags) || protocol.IsDirectory(mf.Flags) {
+			continue
+		}
+
+		f := fileFromFileInfo(mf)
+		path := filepath.Join(workDir(cfg), f.Name)
+
+		match, err := verifyBlocks(path, f.Blocks, cfg.ChunkerType)
+		switch {
+		case os.IsNotExist(err):
+			rep.Missing = append(rep.Missing, f.Name)
+			continue
+		case err != nil || !match:
+			if debug {
+				l.Debugf("manifest: %q / %q: mismatch (%v)", repo, f.Name, err)
+			}
+			rep.Mismatched = append(rep.Mismatched, f.Name)
+			continue
+		}
+
+		t := time.Unix(f.Modified, 0)
+		if err := os.Chtimes(path, t, t); err != nil {
+			rep.Mismatched = append(rep.Mismatched, f.Name)
+			continue
+		}
+		if !cfg.IgnoresPerms() && protocol.HasPermissionBits(f.Flags) {
+			os.Chmod(path, scanner.FileMode(f.Flags, cfg.SpecialPermBits))
+		}
+
+		lamport.Default.Tick(f.Version)
+		verified = append(verified, f)
+		rep.Matching = append(rep.Matching, f.Name)
+	}
+
+	if len(verified) > 0 {
+		m.rmut.RLock()
+		m.repoFiles[repo].Update(cid.LocalID, verified)
+		m.rmut.RUnlock()
+	}
+
+	return rep, nil
+}
+
+// verifyBlocks returns true if the file at path hashes to the given list of
+// blocks.
+func verifyBlocks(path string, blocks []scanner.Block, chunker string) (bool, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	hb, err := scanner.BlocksWith(fd, scanner.StandardBlockSize, chunker)
+	if err != nil {
+		return false, err
+	}
+
+	if len(hb) != len(blocks) {
+		return false, nil
+	}
+	for i := range hb {
+		if bytes.Compare(hb[i].Hash, blocks[i].Hash) != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
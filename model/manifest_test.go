@@ -0,0 +1,56 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+)
+
+func TestManifestRoundtrip(t *testing.T) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+	m.ScanRepo("default")
+
+	var buf bytes.Buffer
+	if err := m.ExportManifest("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "foo" is an intact copy, "bar" is corrupt and "empty" is missing.
+	ioutil.WriteFile(filepath.Join(dir, "foo"), []byte("foobar\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bar"), []byte("corrupted!"), 0644)
+
+	m2 := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m2.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	m2.ScanRepo("default")
+
+	rep, err := m2.ImportVerify("default", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ManifestReport{
+		Matching:   []string{"foo"},
+		Mismatched: []string{"bar"},
+		Missing:    []string{"empty"},
+	}
+	if !reflect.DeepEqual(rep, expected) {
+		t.Errorf("Incorrect report;\n  E: %#v\n  A: %#v", expected, rep)
+	}
+
+	// The verified file should now be identical to the original.
+	if f0, f1 := m.CurrentRepoFile("default", "foo"), m2.CurrentRepoFile("default", "foo"); !f0.Equals(f1) {
+		t.Errorf("Verified file differs;\n  E: %v\n  A: %v", f0, f1)
+	}
+}
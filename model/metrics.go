@@ -0,0 +1,126 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MetricsHandler returns a http.Handler that serves the model's statistics in
+// the Prometheus text exposition format.
+func (m *Model) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.writeMetrics(w)
+	})
+}
+
+type metric struct {
+	name   string
+	typ    string // "counter" or "gauge"
+	help   string
+	values []metricValue
+}
+
+type metricValue struct {
+	labels string
+	value  float64
+}
+
+func (m *Model) writeMetrics(w io.Writer) {
+	var (
+		pulled    = metric{name: "syncthing_repo_pulled_bytes_total", typ: "counter", help: "Bytes received from other nodes"}
+		copied    = metric{name: "syncthing_repo_copied_bytes_total", typ: "counter", help: "Bytes copied from files already on disk"}
+		sparse    = metric{name: "syncthing_repo_sparse_bytes_total", typ: "counter", help: "Bytes of zeros neither transferred nor copied"}
+		completed = metric{name: "syncthing_repo_files_completed_total", typ: "counter", help: "Files successfully synced"}
+		errors    = metric{name: "syncthing_repo_pull_errors_total", typ: "counter", help: "Files that failed to sync"}
+		queued    = metric{name: "syncthing_repo_queued_blocks", typ: "gauge", help: "Blocks waiting to be fetched or copied"}
+		slotsUsed = metric{name: "syncthing_repo_request_slots_used", typ: "gauge", help: "Request slots in use"}
+		slots     = metric{name: "syncthing_repo_request_slots", typ: "gauge", help: "Request slots available in total"}
+		throttle  = metric{name: "syncthing_repo_disk_throttle_factor", typ: "gauge", help: "Share of the request slots in use while the disk is busy"}
+		dirWait   = metric{name: "syncthing_repo_dir_waiting_files", typ: "gauge", help: "Needed files waiting for the directory creation limit"}
+		scanDur   = metric{name: "syncthing_repo_scan_duration_seconds", typ: "gauge", help: "Duration of the last completed scan"}
+		nodeIn    = metric{name: "syncthing_node_in_bytes_total", typ: "counter", help: "Bytes received from the node"}
+		nodeOut   = metric{name: "syncthing_node_out_bytes_total", typ: "counter", help: "Bytes sent to the node"}
+	)
+
+	m.rmut.RLock()
+	var repos = make([]string, 0, len(m.repoCfgs))
+	var pullers = make(map[string]*puller, len(m.pullers))
+	for repo := range m.repoCfgs {
+		repos = append(repos, repo)
+		if p, ok := m.pullers[repo]; ok {
+			pullers[repo] = p
+		}
+	}
+	m.rmut.RUnlock()
+	sort.Strings(repos)
+
+	// The puller locks are taken without holding rmut, as the pullers
+	// take rmut while holding their own lock.
+	for _, repo := range repos {
+		p, ok := pullers[repo]
+		if !ok {
+			continue
+		}
+		labels := fmt.Sprintf(`repo="%s"`, escapeLabel(repo))
+
+		p.mut.Lock()
+		st := p.stats
+		nslots, debt := p.slots, p.slotDebt
+		factor := p.throttle.factor()
+		p.mut.Unlock()
+
+		pulled.add(labels, float64(st.bytesPulled))
+		copied.add(labels, float64(st.bytesCopied))
+		sparse.add(labels, float64(st.bytesSparse))
+		completed.add(labels, float64(st.filesCompleted))
+		errors.add(labels, float64(st.pullErrors))
+		queued.add(labels, float64(p.bq.size()))
+		slotsUsed.add(labels, float64(nslots+debt-len(p.requestSlots)))
+		slots.add(labels, float64(nslots))
+		dirWait.add(labels, float64(st.dirWaiting))
+		throttle.add(labels, factor)
+	}
+
+	m.smut.RLock()
+	for _, repo := range repos {
+		if d, ok := m.repoScanDur[repo]; ok {
+			scanDur.add(fmt.Sprintf(`repo="%s"`, escapeLabel(repo)), d.Seconds())
+		}
+	}
+	m.smut.RUnlock()
+
+	m.pmut.RLock()
+	var nodes = make([]string, 0, len(m.protoConn))
+	for node := range m.protoConn {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		st := m.protoConn[node].Statistics()
+		labels := fmt.Sprintf(`node="%s"`, escapeLabel(node))
+		nodeIn.add(labels, float64(st.InBytesTotal))
+		nodeOut.add(labels, float64(st.OutBytesTotal))
+	}
+	m.pmut.RUnlock()
+
+	for _, mt := range []metric{pulled, copied, sparse, completed, errors, queued, slotsUsed, slots, dirWait, throttle, scanDur, nodeIn, nodeOut} {
+		fmt.Fprintf(w, "# HELP %s %s.\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.typ)
+		for _, v := range mt.values {
+			fmt.Fprintf(w, "%s{%s} %g\n", mt.name, v.labels, v.value)
+		}
+	}
+}
+
+func (mt *metric) add(labels string, value float64) {
+	mt.values = append(mt.values, metricValue{labels, value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
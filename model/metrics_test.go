@@ -0,0 +1,54 @@
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+	m.ScanRepo("default")
+
+	p := &puller{bq: newBlockQueue(), requestSlots: make(chan bool, 4), slots: 4}
+	p.requestSlots <- true
+	p.stats.bytesPulled = 1234
+	p.stats.bytesCopied = 5678
+	p.stats.bytesSparse = 9012
+	p.stats.pullErrors = 2
+	m.pullers["default"] = p
+
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+
+	var buf bytes.Buffer
+	m.writeMetrics(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE syncthing_repo_pulled_bytes_total counter",
+		`syncthing_repo_pulled_bytes_total{repo="default"} 1234`,
+		`syncthing_repo_copied_bytes_total{repo="default"} 5678`,
+		`syncthing_repo_sparse_bytes_total{repo="default"} 9012`,
+		`syncthing_repo_pull_errors_total{repo="default"} 2`,
+		`syncthing_repo_request_slots_used{repo="default"} 3`,
+		`syncthing_repo_request_slots{repo="default"} 4`,
+		`syncthing_node_in_bytes_total{node="42"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing %q in metrics output", line)
+		}
+	}
+	if !strings.Contains(out, `syncthing_repo_scan_duration_seconds{repo="default"} `) {
+		t.Error("Missing scan duration in metrics output")
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if e := escapeLabel("a\"b\\c\nd"); e != `a\"b\\c\nd` {
+		t.Errorf("Incorrect escaping %q", e)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
 	"sync"
@@ -15,6 +14,7 @@ import (
 	"github.com/calmh/syncthing/buffers"
 	"github.com/calmh/syncthing/cid"
 	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/files"
 	"github.com/calmh/syncthing/lamport"
 	"github.com/calmh/syncthing/osutil"
@@ -29,6 +29,8 @@ const (
 	RepoScanning
 	RepoSyncing
 	RepoCleaning
+	RepoWaiting
+	RepoSuspended
 )
 
 // Somewhat arbitrary amount of bytes that we choose to let represent the size
@@ -43,33 +45,72 @@ type Model struct {
 
 	clientName    string
 	clientVersion string
+	nodeID        string // our own, for naming conflict copies
 
 	repoCfgs   map[string]config.RepositoryConfiguration // repo -> cfg
 	repoFiles  map[string]*files.Set                     // repo -> files
 	repoNodes  map[string][]string                       // repo -> nodeIDs
 	nodeRepos  map[string][]string                       // nodeID -> repos
 	suppressor map[string]*suppressor                    // repo -> suppressor
+	pullers    map[string]*puller                        // repo -> puller
+	unstarted  map[string]int                            // repo -> request slots of a puller that couldn't be started
+	repoRates  map[string]*repoRate                      // repo -> transfer rates
+	moving     map[string]bool                           // repo -> directory being moved
+	hashCaches map[string]*hashCache                     // repo -> blocks of scanned files, if enabled
+	suspended  bool                                      // pullers are suspended until Resume
 	rmut       sync.RWMutex                              // protects the above
 
-	repoState map[string]repoState // repo -> state
-	smut      sync.RWMutex
+	repoState    map[string]repoState     // repo -> state
+	repoScanTime map[string]time.Time     // repo -> time of last completed scan
+	repoScanDur  map[string]time.Duration // repo -> duration of last completed scan
+	summaries    map[string]RepoSummary   // repo -> summary saved by the previous run
+	smut         sync.RWMutex             // protects the above and the Invalid field of the repository configurations
 
 	cm *cid.Map
 
-	protoConn map[string]protocol.Connection
-	rawConn   map[string]io.Closer
-	nodeVer   map[string]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn   map[string]protocol.Connection
+	rawConn     map[string]io.Closer
+	nodeVer     map[string]string
+	nodeLAN     map[string]bool // node -> connected over the local network
+	nodeList    map[string]bool // node -> answers listing requests
+	nodePartial map[string]bool // node -> sends and accepts availability announcements
+	pmut        sync.RWMutex    // protects protoConn and rawConn
+
+	placeholders map[string]map[string]placeholder // repo -> name -> placeholder
+	phmut        sync.Mutex
+
+	partials map[string]map[string]map[string]partialFile // repo -> name -> node -> blocks held while pulling
+	pamut    sync.RWMutex
+
+	fetches map[fetchKey]*fetch // files waited for by OnDemandFetch
+	fmut    sync.Mutex
+
+	changes map[string]*changeRing // repo -> operations recently applied by the puller
+	chmut   sync.Mutex
+
+	boost *repoBoost // the repository boosted, if any
+	bmut  sync.Mutex // serializes changes to the boost
+
+	totalRate repoRate
 
 	sup suppressor
 
+	sourceFiles *fdPool         // limits the existing files open as copy sources
+	batcher     *requestBatcher // blocks per request for each node; nil without batching
+
 	addedRepo bool
 	started   bool
 }
 
 var (
 	ErrNoSuchFile = errors.New("no such file")
+	ErrNoSuchRepo = errors.New("no such repository")
 	ErrInvalid    = errors.New("file is invalid")
+	ErrReadOnly   = errors.New("repository is read only")
+	ErrNoSource   = errors.New("no connected node has the file")
+	ErrStalled    = errors.New("nothing has been received recently")
+	ErrTooLarge   = errors.New("block size exceeds the configured maximum")
+	ErrStopped    = errors.New("repository is no longer running")
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
@@ -86,32 +127,92 @@ func NewModel(indexDir string, cfg *config.Configuration, clientName, clientVers
 		repoNodes:     make(map[string][]string),
 		nodeRepos:     make(map[string][]string),
 		repoState:     make(map[string]repoState),
+		repoScanTime:  make(map[string]time.Time),
+		repoScanDur:   make(map[string]time.Duration),
+		summaries:     make(map[string]RepoSummary),
 		suppressor:    make(map[string]*suppressor),
+		pullers:       make(map[string]*puller),
+		unstarted:     make(map[string]int),
+		repoRates:     make(map[string]*repoRate),
+		moving:        make(map[string]bool),
+		hashCaches:    make(map[string]*hashCache),
 		cm:            cid.NewMap(),
 		protoConn:     make(map[string]protocol.Connection),
 		rawConn:       make(map[string]io.Closer),
 		nodeVer:       make(map[string]string),
+		nodeLAN:       make(map[string]bool),
+		nodeList:      make(map[string]bool),
+		nodePartial:   make(map[string]bool),
+		partials:      make(map[string]map[string]map[string]partialFile),
+		placeholders:  make(map[string]map[string]placeholder),
+		fetches:       make(map[fetchKey]*fetch),
+		changes:       make(map[string]*changeRing),
 		sup:           suppressor{threshold: int64(cfg.Options.MaxChangeKbps)},
+		sourceFiles:   newFDPool(cfg.Options.MaxOpenSourceFiles),
+		batcher:       newRequestBatcher(cfg.Options.RequestBatchMax),
 	}
 
 	go m.broadcastIndexLoop()
 	return m
 }
 
+// SetNodeID sets the ID of this node. It must be called before the
+// repositories are started.
+func (m *Model) SetNodeID(id string) {
+	m.nodeID = id
+}
+
 // StartRW starts read/write processing on the current model. When in
 // read/write mode the model will attempt to keep in sync with the cluster by
 // pulling needed files from peer nodes.
+//
+// A repository whose puller can't be started due to an error in its
+// configuration is marked invalid, leaving the other repositories running.
+// It is started once the configuration has been corrected through
+// SetVersioner or UpdateRepoConfig.
 func (m *Model) StartRepoRW(repo string, threads int) {
-	m.rmut.RLock()
-	defer m.rmut.RUnlock()
-
-	if cfg, ok := m.repoCfgs[repo]; !ok {
+	m.rmut.Lock()
+	cfg, ok := m.repoCfgs[repo]
+	if !ok {
+		m.rmut.Unlock()
 		panic("cannot start without repo")
+	}
+	p, err := newPuller(cfg, m, threads, m.cfg)
+	if err != nil {
+		m.unstarted[repo] = threads
 	} else {
-		newPuller(cfg, m, threads, m.cfg)
+		delete(m.unstarted, repo)
+		m.pullers[repo] = p
+	}
+	m.rmut.Unlock()
+
+	if err != nil {
+		l.Warnf("Repository %q not started: %v", repo, err)
+		m.invalidateRepo(repo, err)
 	}
 }
 
+// startUnstarted starts the puller of a repository that couldn't be started
+// before, after a change to its configuration. Returns true if the puller
+// was started.
+func (m *Model) startUnstarted(repo string) bool {
+	m.rmut.RLock()
+	threads, ok := m.unstarted[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return false
+	}
+
+	m.StartRepoRW(repo, threads)
+	m.rmut.RLock()
+	_, ok = m.pullers[repo]
+	m.rmut.RUnlock()
+	if ok {
+		m.clearInvalid(repo)
+	}
+	return ok
+}
+
 // StartRO starts read only processing on the current model. When in
 // read only mode the model will announce files to the cluster but not
 // pull in any external changes.
@@ -119,19 +220,112 @@ func (m *Model) StartRepoRO(repo string) {
 	m.StartRepoRW(repo, 0) // zero threads => read only
 }
 
+// SetIgnorePerms changes the IgnorePerms setting of a running repository.
+// When permissions are no longer ignored, existing files and directories get
+// their permissions restored to match the index. The change is not saved to
+// the configuration.
+func (m *Model) SetIgnorePerms(repo string, ignore bool) error {
+	m.rmut.Lock()
+	cfg, ok := m.repoCfgs[repo]
+	if !ok {
+		m.rmut.Unlock()
+		return ErrNoSuchRepo
+	}
+	cfg.IgnorePerms = ignore
+	m.repoCfgs[repo] = cfg
+	p := m.pullers[repo]
+	m.rmut.Unlock()
+
+	if p != nil && cap(p.requestSlots) > 0 {
+		// Let the run loop apply the change
+		req := ignorePermsReq{ignore: ignore, done: make(chan struct{})}
+		select {
+		case p.ignorePerms <- req:
+		case <-p.stopped:
+			return ErrStopped
+		}
+		return p.wait(req.done)
+	}
+	return nil
+}
+
+// SetVersioner changes the versioning of a running repository. An empty
+// type turns versioning off. The change applies to the files replaced or
+// deleted from then on and is not saved to the configuration.
+func (m *Model) SetVersioner(repo, typ string, params map[string]string) error {
+	cfg := config.VersioningConfiguration{Type: typ, Params: params}
+	v, err := newVersioner(cfg)
+	if err != nil {
+		return err
+	}
+
+	m.rmut.Lock()
+	repoCfg, ok := m.repoCfgs[repo]
+	if !ok {
+		m.rmut.Unlock()
+		return ErrNoSuchRepo
+	}
+	repoCfg.Versioning = cfg
+	m.repoCfgs[repo] = repoCfg
+	p := m.pullers[repo]
+	m.rmut.Unlock()
+
+	if m.startUnstarted(repo) {
+		// Started with the new versioning
+		return nil
+	}
+	if p != nil && cap(p.requestSlots) > 0 {
+		// Let the run loop apply the change
+		req := setVersionerReq{cfg: cfg, versioner: v, done: make(chan struct{})}
+		select {
+		case p.versionerReqs <- req:
+		case <-p.stopped:
+			return ErrStopped
+		}
+		return p.wait(req.done)
+	}
+	return nil
+}
+
+// SetRequestSlots changes the number of concurrent block requests of a
+// running repository.
+func (m *Model) SetRequestSlots(repo string, n int) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return ErrNoSuchRepo
+	}
+	if p == nil || cap(p.requestSlots) == 0 {
+		return ErrReadOnly
+	}
+	if n < 1 || n > cap(p.requestSlots) {
+		return fmt.Errorf("number of request slots must be between 1 and %d", cap(p.requestSlots))
+	}
+
+	// Let the run loop apply the change
+	req := resizeSlotsReq{slots: n, done: make(chan struct{})}
+	select {
+	case p.resizeSlots <- req:
+	case <-p.stopped:
+		return ErrStopped
+	}
+	return p.wait(req.done)
+}
+
 type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
 	ClientVersion string
 	Completion    int
+	LAN           bool // the node is on the local network
+	RequestBatch  int  // the number of blocks requested from the node at once
 }
 
 // ConnectionStats returns a map with connection statistics for each connected node.
 func (m *Model) ConnectionStats() map[string]ConnectionInfo {
-	type remoteAddrer interface {
-		RemoteAddr() net.Addr
-	}
-
 	m.pmut.RLock()
 	m.rmut.RLock()
 
@@ -140,6 +334,8 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 		ci := ConnectionInfo{
 			Statistics:    conn.Statistics(),
 			ClientVersion: m.nodeVer[node],
+			LAN:           m.nodeLAN[node],
+			RequestBatch:  m.batcher.size(node),
 		}
 		if nc, ok := m.rawConn[node].(remoteAddrer); ok {
 			ci.Address = nc.RemoteAddr().String()
@@ -249,6 +445,16 @@ func (m *Model) NeedFilesRepo(repo string) []scanner.File {
 	return nil
 }
 
+// haveFilesRepo returns the list of files in the local index.
+func (m *Model) haveFilesRepo(repo string) []scanner.File {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if rf, ok := m.repoFiles[repo]; ok {
+		return rf.Have(cid.LocalID)
+	}
+	return nil
+}
+
 // Index is called when a new node is connected and we receive their full index.
 // Implements the protocol.Model interface.
 func (m *Model) Index(nodeID string, repo string, fs []protocol.FileInfo) {
@@ -269,15 +475,21 @@ func (m *Model) Index(nodeID string, repo string, fs []protocol.FileInfo) {
 		}
 		files[i] = fileFromFileInfo(f)
 	}
+	m.invalidateOversized(nodeID, repo, files)
 
 	id := m.cm.Get(nodeID)
 	m.rmut.RLock()
+	var err error
 	if r, ok := m.repoFiles[repo]; ok {
 		r.Replace(id, files)
+		err = r.Err()
 	} else {
 		l.Warnf("Index from %s for nonexistant repo %q; dropping", nodeID, repo)
 	}
 	m.rmut.RUnlock()
+	if err != nil {
+		m.invalidateRepo(repo, err)
+	}
 }
 
 // IndexUpdate is called for incremental updates to connected nodes' indexes.
@@ -300,15 +512,22 @@ func (m *Model) IndexUpdate(nodeID string, repo string, fs []protocol.FileInfo)
 		}
 		files[i] = fileFromFileInfo(f)
 	}
+	m.invalidateOversized(nodeID, repo, files)
+	m.dropPartials(nodeID, repo, files)
 
 	id := m.cm.Get(nodeID)
 	m.rmut.RLock()
+	var err error
 	if r, ok := m.repoFiles[repo]; ok {
 		r.Update(id, files)
+		err = r.Err()
 	} else {
 		l.Warnf("Index update from %s for nonexistant repo %q; dropping", nodeID, repo)
 	}
 	m.rmut.RUnlock()
+	if err != nil {
+		m.invalidateRepo(repo, err)
+	}
 }
 
 func (m *Model) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
@@ -329,6 +548,8 @@ func (m *Model) ClusterConfig(nodeID string, config protocol.ClusterConfigMessag
 	} else {
 		m.nodeVer[nodeID] = config.ClientName + " " + config.ClientVersion
 	}
+	m.nodeList[nodeID] = hasOption(config, listOption)
+	m.nodePartial[nodeID] = hasOption(config, partialOption)
 	m.pmut.Unlock()
 }
 
@@ -350,6 +571,11 @@ func (m *Model) Close(node string, err error) {
 	for _, repo := range m.nodeRepos[node] {
 		m.repoFiles[repo].Replace(cid, nil)
 	}
+	for _, p := range m.pullers {
+		// Ramped up again once reconnected
+		p.ramp.forget(node)
+	}
+	m.batcher.forget(node)
 	m.rmut.RUnlock()
 	m.cm.Clear(node)
 
@@ -361,7 +587,12 @@ func (m *Model) Close(node string, err error) {
 	delete(m.protoConn, node)
 	delete(m.rawConn, node)
 	delete(m.nodeVer, node)
+	delete(m.nodeLAN, node)
+	delete(m.nodeList, node)
+	delete(m.nodePartial, node)
 	m.pmut.Unlock()
+
+	m.dropNodePartials(node)
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -377,6 +608,15 @@ func (m *Model) Request(nodeID, repo, name string, offset int64, size int) ([]by
 		return nil, ErrNoSuchFile
 	}
 
+	if data, ok := m.partialBlock(repo, name, offset, size); ok {
+		// We are pulling the file and already have the block
+		if debug {
+			l.Debugf("REQ(in; partial): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
+		}
+		m.recordOut(repo, size)
+		return data, nil
+	}
+
 	lf := r.Get(cid.LocalID, name)
 	if lf.Suppressed || protocol.IsDeleted(lf.Flags) {
 		if debug {
@@ -392,11 +632,16 @@ func (m *Model) Request(nodeID, repo, name string, offset int64, size int) ([]by
 		return nil, ErrNoSuchFile
 	}
 
+	if max := m.maxBlockSize(); max > 0 && size > max {
+		l.Warnf("Request from %s for %d bytes of %q in repository %q exceeds the maximum block size of %d bytes", nodeID, size, name, repo, max)
+		return nil, ErrTooLarge
+	}
+
 	if debug && nodeID != "<local>" {
 		l.Debugf("REQ(in): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
 	}
 	m.rmut.RLock()
-	fn := filepath.Join(m.repoCfgs[repo].Directory, name)
+	fn := filepath.Join(workDir(m.repoCfgs[repo]), name)
 	m.rmut.RUnlock()
 	fd, err := os.Open(fn) // XXX: Inefficient, should cache fd?
 	if err != nil {
@@ -409,6 +654,7 @@ func (m *Model) Request(nodeID, repo, name string, offset int64, size int) ([]by
 	if err != nil {
 		return nil, err
 	}
+	m.recordOut(repo, size)
 
 	return buf, nil
 }
@@ -420,6 +666,28 @@ func (m *Model) ReplaceLocal(repo string, fs []scanner.File) {
 	m.rmut.RUnlock()
 }
 
+// replaceLocalKeeping replaces the local index like ReplaceLocal, except that
+// currently indexed files at or below any of the keep paths are retained
+// as they are instead of being marked as deleted.
+func (m *Model) replaceLocalKeeping(repo string, fs []scanner.File, keep []string) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+
+	rf := m.repoFiles[repo]
+	if len(keep) > 0 {
+		seen := make(map[string]bool, len(fs))
+		for _, f := range fs {
+			seen[f.Name] = true
+		}
+		for _, f := range rf.Have(cid.LocalID) {
+			if !seen[f.Name] && underAny(f.Name, keep) {
+				fs = append(fs, f)
+			}
+		}
+	}
+	rf.ReplaceWithDelete(cid.LocalID, fs)
+}
+
 func (m *Model) SeedLocal(repo string, fs []protocol.FileInfo) {
 	var sfs = make([]scanner.File, len(fs))
 	for i := 0; i < len(fs); i++ {
@@ -465,6 +733,65 @@ func (m *Model) ConnectedTo(nodeID string) bool {
 	return ok
 }
 
+// A SharingNode describes a node that a repository is shared with.
+type SharingNode struct {
+	NodeID    string
+	Connected bool
+	Full      bool // the node has the current version of every file in the repository
+}
+
+// SharingNodes returns the nodes the repository is shared with, in the order
+// they are configured, along with whether each is connected and whether it
+// could serve every file in the repository. Nodes that are not connected have
+// no files.
+func (m *Model) SharingNodes(repo string) ([]SharingNode, error) {
+	m.rmut.RLock()
+	fs, ok := m.repoFiles[repo]
+	nodes := m.repoNodes[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return nil, ErrNoSuchRepo
+	}
+
+	res := make([]SharingNode, len(nodes))
+	for i, node := range nodes {
+		res[i].NodeID = node
+		res[i].Connected = m.ConnectedTo(node)
+
+		// Only nodes with an ID can be picked as a source by the puller
+		id, ok := m.cm.Lookup(node)
+		if !ok || id == cid.LocalID {
+			continue
+		}
+		res[i].Full = true
+		for _, f := range fs.Need(id) {
+			if !protocol.IsDeleted(f.Flags) {
+				res[i].Full = false
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// connectedPeers returns the number of currently connected nodes that share
+// the given repo.
+func (m *Model) connectedPeers(repo string) int {
+	m.rmut.RLock()
+	nodes := m.repoNodes[repo]
+	m.rmut.RUnlock()
+
+	var n int
+	m.pmut.RLock()
+	for _, node := range nodes {
+		if _, ok := m.protoConn[node]; ok {
+			n++
+		}
+	}
+	m.pmut.RUnlock()
+	return n
+}
+
 // AddConnection adds a new peer connection to the model. An initial index will
 // be sent to the connected peer, thereafter index updates whenever the local
 // repository changes.
@@ -479,6 +806,9 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 		panic("add existing node")
 	}
 	m.rawConn[nodeID] = rawConn
+	if nc, ok := rawConn.(remoteAddrer); ok {
+		m.nodeLAN[nodeID] = isLANAddr(nc.RemoteAddr())
+	}
 	m.pmut.Unlock()
 
 	cm := m.clusterConfig(nodeID)
@@ -527,6 +857,8 @@ func (m *Model) updateLocal(repo string, f scanner.File) {
 	m.rmut.RLock()
 	m.repoFiles[repo].Update(cid.LocalID, []scanner.File{f})
 	m.rmut.RUnlock()
+	m.hydrated(repo, f.Name)
+	m.fetched(repo, f.Name, f.Version, nil)
 }
 
 func (m *Model) requestGlobal(nodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
@@ -545,6 +877,48 @@ func (m *Model) requestGlobal(nodeID, repo, name string, offset int64, size int,
 	return nc.Request(repo, name, offset, size)
 }
 
+// nodeFileVersion returns the version of the named file in the index
+// announced by the node, or zero if the node does not have it.
+func (m *Model) nodeFileVersion(nodeID, repo, name string) uint64 {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if rf, ok := m.repoFiles[repo]; ok {
+		return rf.Get(m.cm.Get(nodeID), name).Version
+	}
+	return 0
+}
+
+// maxBlockSize returns the largest block, in bytes, that is requested from or
+// served to other nodes. Zero means no limit.
+func (m *Model) maxBlockSize() int {
+	return m.cfg.Options.MaxBlockSizeKiB * 1024
+}
+
+// modTimeWindow returns how far apart modification times may be and still be
+// considered equal. Some filesystems, such as FAT, only store them with two
+// second resolution, so a file copied to or from one would otherwise look
+// changed on every scan.
+func (m *Model) modTimeWindow() time.Duration {
+	return time.Duration(m.cfg.Options.ModTimeWindowS) * time.Second
+}
+
+// invalidateOversized marks the files that have a block larger than the
+// maximum block size as invalid, so that they are neither pulled nor served.
+// A node advertising such blocks is either broken or trying to make us
+// allocate huge buffers.
+func (m *Model) invalidateOversized(from, repo string, fs []scanner.File) {
+	max := m.maxBlockSize()
+	if max <= 0 {
+		return
+	}
+	for i := range fs {
+		if b, ok := oversizedBlock(fs[i], max); ok {
+			l.Warnf("File %q in repository %q from %s has a block of %d bytes, exceeding the maximum of %d bytes; ignoring it", fs[i].Name, repo, from, b.Size, max)
+			fs[i].Suppressed = true
+		}
+	}
+}
+
 func (m *Model) broadcastIndexLoop() {
 	var lastChange = map[string]uint64{}
 	for {
@@ -600,10 +974,37 @@ func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
 		panic("cannot add empty repo id")
 	}
 
+	m.rmut.RLock()
+	// Compared as it will be running
+	other := m.overlappingRepo(cfg.ID, workDir(cfg))
+	m.rmut.RUnlock()
+	if other != "" {
+		err := overlapError(cfg.Directory, other)
+		l.Warnf("Repository %q not added: %v", cfg.ID, err)
+		m.invalidateRepo(cfg.ID, err)
+		return
+	}
+
+	if cfg.AtomicSwap && !cfg.ReadOnly {
+		if _, err := prepareSwap(cfg.Directory); err != nil {
+			l.Warnf("Repository %q not added: %v", cfg.ID, err)
+			m.invalidateRepo(cfg.ID, err)
+			return
+		}
+	}
+
+	if len(cfg.StaticPatterns) > 0 {
+		l.Warnf("Repository %q: files matching %q are not rehashed while their modification time and size are unchanged; corruption of their contents will go unnoticed", cfg.ID, cfg.StaticPatterns)
+	}
+
 	m.rmut.Lock()
 	m.repoCfgs[cfg.ID] = cfg
-	m.repoFiles[cfg.ID] = files.NewSet()
+	m.repoFiles[cfg.ID] = m.newFileSet(cfg)
 	m.suppressor[cfg.ID] = &suppressor{threshold: int64(m.cfg.Options.MaxChangeKbps)}
+	m.repoRates[cfg.ID] = &repoRate{}
+	if cfg.ScanCache {
+		m.hashCaches[cfg.ID] = newHashCache(cfg.ChunkerType)
+	}
 
 	m.repoNodes[cfg.ID] = make([]string, len(cfg.Nodes))
 	for i, node := range cfg.Nodes {
@@ -615,6 +1016,27 @@ func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
 	m.rmut.Unlock()
 }
 
+// newFileSet returns the file set for the repo, keeping its records on disk
+// if configured to. The local files kept on disk are there again after a
+// restart.
+func (m *Model) newFileSet(cfg config.RepositoryConfiguration) *files.Set {
+	if !cfg.DiskIndex {
+		return files.NewSet()
+	}
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(cfg.Directory)))
+	s, err := files.NewDiskStore(filepath.Join(m.indexDir, id+".store"))
+	if err != nil {
+		l.Warnf("Repository %q: cannot keep index on disk, using memory: %v", cfg.ID, err)
+		return files.NewSet()
+	}
+	fs := files.NewSetWithStore(s)
+	if err := fs.Err(); err != nil {
+		l.Warnf("Repository %q: cannot keep index on disk, using memory: %v", cfg.ID, err)
+		return files.NewSet()
+	}
+	return fs
+}
+
 func (m *Model) ScanRepos() {
 	m.rmut.RLock()
 	var repos = make([]string, 0, len(m.repoCfgs))
@@ -639,7 +1061,7 @@ func (m *Model) CleanRepos() {
 	m.rmut.RLock()
 	var dirs = make([]string, 0, len(m.repoCfgs))
 	for _, cfg := range m.repoCfgs {
-		dirs = append(dirs, cfg.Directory)
+		dirs = append(dirs, workDir(cfg))
 	}
 	m.rmut.RUnlock()
 
@@ -649,8 +1071,13 @@ func (m *Model) CleanRepos() {
 		w := &scanner.Walker{
 			Dir:       dir,
 			TempNamer: defTempNamer,
+			KeepTemp:  keepResumable,
 		}
 		go func() {
+			// Interrupted in-place updates must be rolled back before
+			// their journals are removed along with the other temporary
+			// files.
+			recoverJournals(w.Dir)
 			w.CleanTempFiles()
 			wg.Done()
 		}()
@@ -658,33 +1085,263 @@ func (m *Model) CleanRepos() {
 	wg.Wait()
 }
 
+// ScanRepo rescans the repository and replaces the local index with the
+// result, marking files that are no longer present as deleted.
 func (m *Model) ScanRepo(repo string) error {
+	return m.Rescan(repo, true)
+}
+
+// ScanAndSync rescans the repository like ScanRepo and has the puller queue
+// the files that are needed now at once, rather than in its next cycle. It
+// returns when they have been queued, not when they have been pulled.
+func (m *Model) ScanAndSync(repo string) error {
+	if err := m.ScanRepo(repo); err != nil {
+		return err
+	}
+
 	m.rmut.RLock()
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if p == nil || cap(p.requestSlots) == 0 {
+		return nil
+	}
+
+	// Let the run loop do the queueing
+	req := syncNowReq{done: make(chan struct{})}
+	select {
+	case p.syncNow <- req:
+	case <-p.stopped:
+		return ErrStopped
+	}
+	return p.wait(req.done)
+}
+
+// repoWalker returns a walker for the repository that adds the names of the
+// entries it can't read to unreadable. Must be called with rmut held.
+func (m *Model) repoWalker(repo string, unreadable *[]string) *scanner.Walker {
 	w := &scanner.Walker{
-		Dir:          m.repoCfgs[repo].Directory,
-		IgnoreFile:   ".stignore",
-		BlockSize:    scanner.StandardBlockSize,
-		TempNamer:    defTempNamer,
-		Suppressor:   m.suppressor[repo],
-		CurrentFiler: cFiler{m, repo},
-		IgnorePerms:  m.repoCfgs[repo].IgnorePerms,
+		Dir:             workDir(m.repoCfgs[repo]),
+		IgnoreFile:      ".stignore",
+		BlockSize:       scanner.StandardBlockSize,
+		Chunker:         m.repoCfgs[repo].ChunkerType,
+		TempNamer:       defTempNamer,
+		IgnoreTemp:      tempPatterns(m.repoCfgs[repo]),
+		Suppressor:      m.suppressor[repo],
+		CurrentFiler:    cFiler{m, repo},
+		IgnorePerms:     m.repoCfgs[repo].IgnoresPerms(),
+		SpecialPermBits: m.repoCfgs[repo].SpecialPermBits,
+		Hardlinks:       m.repoCfgs[repo].PreserveHardlinks,
+		ModTimeWindow:   m.modTimeWindow(),
+		MmapMinSize:     int64(m.cfg.Options.MmapHashMinMiB) << 20,
+		Unreadable: func(name string, err error) {
+			l.Infof("Cannot read %q in repository %q: %v", name, repo, err)
+			*unreadable = append(*unreadable, name)
+		},
+		Placeholder: func(name string, info os.FileInfo) bool {
+			return m.isPlaceholder(repo, name, info)
+		},
+	}
+	if patterns := m.repoCfgs[repo].StaticPatterns; len(patterns) > 0 {
+		w.Static = func(name string) bool {
+			return isStatic(patterns, name)
+		}
 	}
+	if cache, ok := m.hashCaches[repo]; ok {
+		w.HashCache = cache
+	}
+	return w
+}
+
+// Rescan walks the repository and updates the local index with the files
+// found. If prune is true, indexed files that were not seen during the walk
+// are marked as deleted. Files under a directory that could not be read are
+// never marked as deleted, since they may still exist.
+func (m *Model) Rescan(repo string, prune bool) error {
+	var unreadable []string
+	m.rmut.RLock()
+	if _, ok := m.repoCfgs[repo]; !ok {
+		m.rmut.RUnlock()
+		return ErrNoSuchRepo
+	}
+	if m.moving[repo] {
+		m.rmut.RUnlock()
+		return ErrRepoMoving
+	}
+	w := m.repoWalker(repo, &unreadable)
+	cache, useCache := m.hashCaches[repo]
 	m.rmut.RUnlock()
 	m.setState(repo, RepoScanning)
+	t0 := time.Now()
 	fs, _, err := w.Walk()
 	if err != nil {
 		return err
 	}
-	m.ReplaceLocal(repo, fs)
+	m.invalidateOversized("the local scan", repo, fs)
+	if useCache && prune {
+		cache.prune()
+	}
+	if prune {
+		m.replaceLocalKeeping(repo, fs, unreadable)
+	} else {
+		m.rmut.RLock()
+		m.repoFiles[repo].Update(cid.LocalID, fs)
+		m.rmut.RUnlock()
+	}
+	m.rmut.RLock()
+	err = m.repoFiles[repo].Err()
+	m.rmut.RUnlock()
+	if err != nil {
+		// The index can't be kept any longer; the puller stops
+		return err
+	}
+	m.smut.Lock()
+	m.repoScanTime[repo] = time.Now()
+	m.repoScanDur[repo] = time.Since(t0)
+	m.smut.Unlock()
 	m.setState(repo, RepoIdle)
 	return nil
 }
 
+// RepairFile hashes the local copy of the named file and compares it to the
+// index, regardless of whether the modification time and size indicate a
+// change. If the contents differ, the file is queued for download of the
+// damaged blocks and true is returned. If the file is intact, false is
+// returned. ErrNoSource is returned if no connected node can currently serve
+// the file.
+func (m *Model) RepairFile(repo, name string) (bool, error) {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	var lf, gf scanner.File
+	var p *puller
+	if ok {
+		lf = m.repoFiles[repo].Get(cid.LocalID, name)
+		gf = m.repoFiles[repo].GetGlobal(name)
+		p = m.pullers[repo]
+	}
+	m.rmut.RUnlock()
+
+	if !ok {
+		return false, ErrNoSuchRepo
+	}
+	if lf.Name != name || protocol.IsDeleted(lf.Flags) || protocol.IsDirectory(lf.Flags) {
+		return false, ErrNoSuchFile
+	}
+	if p == nil || cap(p.requestSlots) == 0 {
+		return false, ErrReadOnly
+	}
+
+	var hb []scanner.Block
+	fd, err := os.Open(filepath.Join(workDir(cfg), name))
+	if err == nil {
+		hb, err = scanner.BlocksWith(fd, scanner.StandardBlockSize, cfg.ChunkerType)
+		fd.Close()
+		if err != nil {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if blocksEqual(hb, lf.Blocks) {
+		return false, nil
+	}
+
+	if gf.Version != lf.Version {
+		// We are already going to pull a newer version of the file.
+		return true, nil
+	}
+
+	if !m.haveSource(repo, name) {
+		return false, ErrNoSource
+	}
+
+	have, need := scanner.BlockDiff(hb, lf.Blocks)
+	if debug {
+		l.Debugf("repair %q / %q: have %d blocks, need %d blocks", repo, name, len(have), len(need))
+	}
+	p.bq.put(bqAdd{
+		file:     lf,
+		have:     have,
+		need:     need,
+		priority: filePriority(cfg.PriorityPatterns, name),
+	})
+	return true, nil
+}
+
+// haveSource returns true if a connected node announces the global version
+// of the named file.
+func (m *Model) haveSource(repo, name string) bool {
+	m.rmut.RLock()
+	av := m.repoFiles[repo].Availability(name)
+	m.rmut.RUnlock()
+	for i := uint(1); i < 64; i++ {
+		if av&(1<<i) != 0 && m.ConnectedTo(m.cm.Name(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestByDeadline asks for the byte range [offset, offset+size) of the
+// named file to be pulled before the deadline, ahead of other blocks. This
+// is meant for streaming a file that is still being synchronized; the data
+// is written to the temporary file as it arrives. Blocks that are not
+// received by the deadline are pulled along with the others. Nothing is
+// done if the file is already up to date.
+func (m *Model) RequestByDeadline(repo, name string, offset, size int64, deadline time.Time) error {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	var lf, gf scanner.File
+	var p *puller
+	if ok {
+		lf = m.repoFiles[repo].Get(cid.LocalID, name)
+		gf = m.repoFiles[repo].GetGlobal(name)
+		p = m.pullers[repo]
+	}
+	m.rmut.RUnlock()
+
+	if !ok {
+		return ErrNoSuchRepo
+	}
+	if gf.Name != name || protocol.IsDeleted(gf.Flags) || protocol.IsDirectory(gf.Flags) {
+		return ErrNoSuchFile
+	}
+	if p == nil || cap(p.requestSlots) == 0 {
+		return ErrReadOnly
+	}
+	if lf.Name == name && lf.Version == gf.Version {
+		return nil
+	}
+
+	// A file that is being pulled may have no blocks left in the queue, in
+	// which case it must not be queued again.
+	p.mut.Lock()
+	_, open := p.openFiles[name]
+	p.mut.Unlock()
+
+	have, need := scanner.BlockDiff(lf.Blocks, gf.Blocks)
+	if debug {
+		l.Debugf("request %q / %q offset %d size %d by %v", repo, name, offset, size, deadline)
+	}
+	p.bq.put(bqAdd{
+		file:      gf,
+		have:      have,
+		need:      need,
+		deadline:  deadline,
+		from:      offset,
+		to:        offset + size,
+		onlyQueue: open,
+		priority:  filePriority(cfg.PriorityPatterns, name),
+	})
+	return nil
+}
+
 func (m *Model) SaveIndexes(dir string) {
 	m.rmut.RLock()
 	for repo := range m.repoCfgs {
 		fs := m.protocolIndex(repo)
 		m.saveIndex(repo, dir, fs)
+		m.saveSummary(repo, dir)
 	}
 	m.rmut.RUnlock()
 }
@@ -694,6 +1351,9 @@ func (m *Model) LoadIndexes(dir string) {
 	for repo := range m.repoCfgs {
 		fs := m.loadIndex(repo, dir)
 		m.SeedLocal(repo, fs)
+		m.loadPlaceholders(repo, dir)
+		m.loadHashCache(repo, dir)
+		m.loadSummary(repo, dir)
 	}
 	m.rmut.RUnlock()
 }
@@ -718,6 +1378,7 @@ func (m *Model) saveIndex(repo string, dir string, fs []protocol.FileInfo) {
 	idxf.Close()
 
 	osutil.Rename(name+".tmp", name)
+	m.saveHashCache(repo, dir)
 }
 
 func (m *Model) loadIndex(repo string, dir string) []protocol.FileInfo {
@@ -766,22 +1427,151 @@ func (m *Model) clusterConfig(node string) protocol.ClusterConfigMessage {
 			})
 		}
 		cm.Repositories = append(cm.Repositories, cr)
+
+		// Only non default chunkers are announced, to remain compatible
+		// with nodes that don't know about chunker types.
+		if chunker := m.repoCfgs[repo].ChunkerType; chunker != "" && chunker != scanner.ChunkerFixed {
+			cm.Options = append(cm.Options, protocol.Option{
+				Key:   "chunker",
+				Value: repo + ":" + chunker,
+			})
+		}
 	}
 	m.rmut.RUnlock()
 
+	cm.Options = append(cm.Options, protocol.Option{
+		Key:   listOption,
+		Value: "1",
+	})
+	cm.Options = append(cm.Options, protocol.Option{
+		Key:   partialOption,
+		Value: "1",
+	})
+
 	return cm
 }
 
 func (m *Model) setState(repo string, state repoState) {
 	m.smut.Lock()
+	prev, ok := m.repoState[repo]
 	m.repoState[repo] = state
 	m.smut.Unlock()
+
+	if !ok || prev != state {
+		events.Default.Log(events.StateChanged, map[string]string{
+			"repo": repo,
+			"from": prev.String(),
+			"to":   state.String(),
+		})
+	}
 }
 
 func (m *Model) State(repo string) string {
 	m.smut.RLock()
 	state := m.repoState[repo]
 	m.smut.RUnlock()
+	return state.String()
+}
+
+// Synced repos are checked again at this interval while waiting for them, in
+// case the events telling of a change were missed.
+const syncRecheckInterval = time.Second
+
+var ErrSyncTimeout = errors.New("timeout waiting for repository to sync")
+
+// WaitForSync blocks until the repository is idle with nothing left to pull,
+// and returns nil. It returns ErrSyncTimeout if that does not happen within
+// the timeout, or an error as soon as the repository becomes invalid. It is
+// woken by state change events, so it may be called from any number of
+// goroutines at once.
+func (m *Model) WaitForSync(repo string, timeout time.Duration) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+
+	// Subscribe before the first check so that no change is missed in
+	// between.
+	sub := events.Default.Subscribe(events.StateChanged | events.RepoInvalid)
+	defer events.Default.Unsubscribe(sub)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if reason := m.invalidReason(repo); reason != "" {
+			return fmt.Errorf("repository %q is invalid: %s", repo, reason)
+		}
+		if m.synced(repo) {
+			return nil
+		}
+
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return ErrSyncTimeout
+		}
+		if wait > syncRecheckInterval {
+			wait = syncRecheckInterval
+		}
+		// Wake on any relevant event; the conditions are rechecked anyway.
+		sub.Poll(wait)
+	}
+}
+
+// synced returns true if the repository is idle and nothing is needed.
+func (m *Model) synced(repo string) bool {
+	m.smut.RLock()
+	state := m.repoState[repo]
+	m.smut.RUnlock()
+	return state == RepoIdle && len(m.NeedFilesRepo(repo)) == 0
+}
+
+// invalidateRepo marks the repository as invalid in the configuration, with
+// the error as the reason.
+func (m *Model) invalidateRepo(repo string, err error) {
+	m.smut.Lock()
+	for i := range m.cfg.Repositories {
+		if cr := &m.cfg.Repositories[i]; cr.ID == repo {
+			cr.Invalid = err.Error()
+		}
+	}
+	m.smut.Unlock()
+
+	events.Default.Log(events.RepoInvalid, map[string]string{
+		"repo":  repo,
+		"error": err.Error(),
+	})
+}
+
+// clearInvalid removes the invalid mark from the repository in the
+// configuration.
+func (m *Model) clearInvalid(repo string) {
+	m.smut.Lock()
+	for i := range m.cfg.Repositories {
+		if cr := &m.cfg.Repositories[i]; cr.ID == repo {
+			cr.Invalid = ""
+		}
+	}
+	m.smut.Unlock()
+}
+
+// invalidReason returns the reason the repository has been marked invalid,
+// or the empty string.
+func (m *Model) invalidReason(repo string) string {
+	if m.cfg == nil {
+		return ""
+	}
+	m.smut.RLock()
+	defer m.smut.RUnlock()
+	for _, cr := range m.cfg.Repositories {
+		if cr.ID == repo {
+			return cr.Invalid
+		}
+	}
+	return ""
+}
+
+func (state repoState) String() string {
 	switch state {
 	case RepoIdle:
 		return "idle"
@@ -791,7 +1581,112 @@ func (m *Model) State(repo string) string {
 		return "cleaning"
 	case RepoSyncing:
 		return "syncing"
+	case RepoWaiting:
+		return "waiting"
+	case RepoSuspended:
+		return "suspended"
 	default:
 		return "unknown"
 	}
 }
+
+// The maximum number of queued blocks to include in a debug state dump.
+const maxDebugQueued = 100
+
+// RepoDebugState is a snapshot of the puller of a repository, for debugging.
+type RepoDebugState struct {
+	State        string
+	Invalid      string
+	LastScan     time.Time
+	OpenFiles    []OpenFileState
+	QueueLength  int
+	Queued       []QueuedBlockState
+	NodeActivity map[string]int
+	RequestSlots int
+	DirWaiting   int     // needed files waiting for their directories to be created
+	DiskThrottle float64 // share of the request slots in use while the disk is busy, 1 when not throttled
+}
+
+// A PullQueueState describes the backlog of blocks waiting to be pulled in a
+// repository.
+type PullQueueState struct {
+	Blocks int      // the number of queued blocks
+	Bytes  int64    // the size of the queued blocks, to be fetched or copied
+	Next   []string // the files pulled next, in order
+}
+
+// The number of files listed in PullQueueState.Next
+const pullQueueNext = 20
+
+// QueueLength returns the number of blocks waiting to be pulled in the
+// repository.
+func (m *Model) QueueLength(repo string) (int, error) {
+	s, err := m.PullQueue(repo)
+	return s.Blocks, err
+}
+
+// PullQueue returns the size of the backlog of blocks waiting to be pulled in
+// the repository, and the files they are for that are pulled next. The queue
+// is left as it is. A read only repository has nothing queued.
+func (m *Model) PullQueue(repo string) (PullQueueState, error) {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return PullQueueState{}, ErrNoSuchRepo
+	}
+	var s PullQueueState
+	if p != nil && p.bq != nil {
+		s.Blocks, s.Bytes, s.Next = p.bq.summary(pullQueueNext)
+	}
+	return s, nil
+}
+
+// OpenFileState describes a file that is being pulled.
+type OpenFileState struct {
+	Name        string
+	Outstanding int
+	Done        bool
+	Error       string
+}
+
+// QueuedBlockState describes a block waiting in the block queue.
+type QueuedBlockState struct {
+	Name   string
+	Offset int64
+	Size   uint32
+	Copy   int
+	Last   bool
+}
+
+// DebugState returns a snapshot of the internal state for the given repo,
+// suitable for diagnosing stalled synchronization. File contents are never
+// included.
+func (m *Model) DebugState(repo string) (RepoDebugState, error) {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return RepoDebugState{}, ErrNoSuchRepo
+	}
+
+	s := RepoDebugState{
+		State: m.State(repo),
+	}
+
+	m.smut.RLock()
+	s.LastScan = m.repoScanTime[repo]
+	m.smut.RUnlock()
+
+	s.Invalid = m.invalidReason(repo)
+
+	if p != nil {
+		p.debugState(&s)
+	}
+
+	return s, nil
+}
@@ -2,15 +2,24 @@ package model
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/calmh/syncthing/cid"
 	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/versioner"
 )
 
 var testDataExpected = map[string]scanner.File{
@@ -151,6 +160,7 @@ func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 type FakeConnection struct {
 	id          string
 	requestData []byte
+	files       []protocol.FileInfo // served by List
 }
 
 func (FakeConnection) Close() error {
@@ -173,6 +183,21 @@ func (f FakeConnection) Request(repo, name string, offset int64, size int) ([]by
 
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
+func (f FakeConnection) List(repo, after string, max int) ([]protocol.FileInfo, int, error) {
+	var fs []protocol.FileInfo
+	for _, pf := range f.files {
+		if pf.Name > after {
+			fs = append(fs, pf)
+		}
+	}
+	if len(fs) > max {
+		return fs[:max], len(fs) - max, nil
+	}
+	return fs, 0, nil
+}
+
+func (FakeConnection) Availability(string, string, uint64, []byte) {}
+
 func (FakeConnection) Ping() bool {
 	return true
 }
@@ -228,16 +253,2367 @@ func TestActivityMap(t *testing.T) {
 	}
 
 	m := make(activityMap)
-	if node := m.leastBusyNode(1<<fooID, cm); node != "foo" {
+	if node := m.leastBusyNode(1<<fooID, cm, nodePrefs{}); node != "foo" {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
-	if node := m.leastBusyNode(1<<barID, cm); node != "bar" {
+	if node := m.leastBusyNode(1<<barID, cm, nodePrefs{}); node != "bar" {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
-	if node := m.leastBusyNode(1<<fooID|1<<barID, cm); node != "foo" {
+	if node := m.leastBusyNode(1<<fooID|1<<barID, cm, nodePrefs{}); node != "foo" {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
-	if node := m.leastBusyNode(1<<fooID|1<<barID, cm); node != "bar" {
+	if node := m.leastBusyNode(1<<fooID|1<<barID, cm, nodePrefs{}); node != "bar" {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
 }
+
+func TestActivityMapPrefs(t *testing.T) {
+	cm := cid.NewMap()
+	fooID := cm.Get("foo")
+	barID := cm.Get("bar")
+	bazID := cm.Get("baz")
+
+	prefs := newNodePrefs(config.RepositoryConfiguration{
+		LastResortNodes: []string{"bar"},
+		DeniedNodes:     []string{"baz"},
+	})
+
+	m := make(activityMap)
+	for i := 0; i < 3; i++ {
+		// foo is preferred even though it's getting busier
+		if node := m.leastBusyNode(1<<fooID|1<<barID|1<<bazID, cm, prefs); node != "foo" {
+			t.Errorf("Incorrect least busy node %q", node)
+		}
+	}
+	if node := m.leastBusyNode(1<<barID|1<<bazID, cm, prefs); node != "bar" {
+		t.Errorf("Incorrect least busy node %q, expected last resort node", node)
+	}
+	if node := m.leastBusyNode(1<<bazID, cm, prefs); node != "" {
+		t.Errorf("Incorrect least busy node %q, expected none", node)
+	}
+}
+
+func TestActivityMapLAN(t *testing.T) {
+	cm := cid.NewMap()
+	lanID := cm.Get("lan")
+	wanID := cm.Get("wan")
+
+	prefs := nodePrefs{
+		lanWeight: 2,
+		isLAN:     func(node string) bool { return node == "lan" },
+	}
+
+	m := make(activityMap)
+	for i := 0; i < 3; i++ {
+		// The LAN node is preferred while it is at most two requests busier
+		if node := m.leastBusyNode(1<<lanID|1<<wanID, cm, prefs); node != "lan" {
+			t.Errorf("Incorrect least busy node %q, expected LAN node", node)
+		}
+	}
+	if node := m.leastBusyNode(1<<lanID|1<<wanID, cm, prefs); node != "wan" {
+		t.Errorf("Incorrect least busy node %q, expected WAN node", node)
+	}
+	if node := m.leastBusyNode(1<<wanID, cm, prefs); node != "wan" {
+		t.Errorf("Incorrect least busy node %q, expected WAN node", node)
+	}
+
+	// Without a weight, nodes are treated equally
+	prefs.lanWeight = 0
+	m = make(activityMap)
+	m["lan"] = 1
+	if node := m.leastBusyNode(1<<lanID|1<<wanID, cm, prefs); node != "wan" {
+		t.Errorf("Incorrect least busy node %q, expected WAN node", node)
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+
+	if _, err := m.DebugState("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v for nonexistent repo", err)
+	}
+
+	s, err := m.DebugState("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.LastScan.IsZero() {
+		t.Error("Unexpected scan time before first scan")
+	}
+
+	m.ScanRepo("default")
+
+	s, err = m.DebugState("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.State != "idle" {
+		t.Errorf("Incorrect state %q", s.State)
+	}
+	if s.LastScan.IsZero() {
+		t.Error("Missing scan time after scan")
+	}
+	if len(s.OpenFiles) != 0 || s.QueueLength != 0 {
+		t.Errorf("Unexpected pull state %#v", s)
+	}
+}
+
+func TestMinConnectedPeers(t *testing.T) {
+	cfg := config.RepositoryConfiguration{
+		ID:                "default",
+		Directory:         "testdata",
+		Nodes:             []config.NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}},
+		MinConnectedPeers: 2,
+	}
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(cfg)
+
+	p := newTestPuller(m, cfg)
+
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	if p.checkPeers() {
+		t.Error("Unexpected ready with one of two peers connected")
+	}
+
+	fc = FakeConnection{id: "43"}
+	m.AddConnection(fc, fc)
+	if !p.checkPeers() {
+		t.Error("Unexpected not ready with two of two peers connected")
+	}
+
+	m = NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(cfg)
+	p = newTestPuller(m, cfg)
+	p.started = time.Now().Add(-minPeersTimeout - time.Second)
+	if !p.checkPeers() {
+		t.Error("Unexpected not ready after timeout")
+	}
+}
+
+func TestSourceRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{SourceRetries: 2}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+
+	p := newTestPuller(m, repoCfg)
+
+	blk := scanner.Block{Offset: 0, Size: 10, Hash: []byte("some hash bytes")}
+	b := bqBlock{
+		file:  scanner.File{Name: "foo", Size: 10, Blocks: []scanner.Block{blk}},
+		block: blk,
+		last:  true,
+	}
+
+	for i := 0; i < 2; i++ {
+		if p.handleBlock(b) {
+			t.Fatalf("%d: Unexpected handled block without source node", i)
+		}
+		if of := p.openFiles["foo"]; of.err != nil || of.outstanding != 1 {
+			t.Fatalf("%d: Incorrect open file state %v", i, of)
+		}
+
+		select {
+		case b = <-p.blocks:
+		case <-time.After(time.Second):
+			t.Fatalf("%d: Block was not retried", i)
+		}
+		if b.retries != i+1 {
+			t.Errorf("%d: Incorrect retry count %d", i, b.retries)
+		}
+	}
+
+	if !p.handleBlock(b) {
+		t.Fatal("Unexpected unhandled block after exhausting retries")
+	}
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Error("Unexpected open file after exhausting retries")
+	}
+	if _, err := os.Stat(filepath.Join(dir, defTempNamer.TempName("foo"))); !os.IsNotExist(err) {
+		t.Error("Unexpected temp file left after exhausting retries")
+	}
+}
+
+func setupRescanRepo(t *testing.T) (*Model, string) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	return m, dir
+}
+
+func TestRescanPruneDeletedSubtree(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	os.RemoveAll(filepath.Join(dir, "a", "b"))
+
+	if err := m.Rescan("default", false); err != nil {
+		t.Fatal(err)
+	}
+	if f := m.CurrentRepoFile("default", filepath.Join("a", "b", "c")); protocol.IsDeleted(f.Flags) {
+		t.Error("Unexpected deleted file without pruning")
+	}
+
+	if err := m.Rescan("default", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b", "a/b/c", "a/b/d"} {
+		if f := m.CurrentRepoFile("default", filepath.FromSlash(name)); !protocol.IsDeleted(f.Flags) {
+			t.Errorf("Expected %q to be deleted", name)
+		}
+	}
+	for _, name := range []string{"a", "a/e", "f"} {
+		if f := m.CurrentRepoFile("default", filepath.FromSlash(name)); protocol.IsDeleted(f.Flags) {
+			t.Errorf("Unexpected deleted %q", name)
+		}
+	}
+}
+
+func TestRescanPruneUnreadableSubtree(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "a", "b")
+	os.Chmod(sub, 0)
+	defer os.Chmod(sub, 0755)
+
+	if err := m.Rescan("default", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b/c", "a/b/d"} {
+		if f := m.CurrentRepoFile("default", filepath.FromSlash(name)); protocol.IsDeleted(f.Flags) {
+			t.Errorf("Unexpected deleted %q in unreadable directory", name)
+		}
+	}
+}
+
+func TestReplaceLocalKeeping(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	// Simulate a walk that could not read a/b
+	var fs []scanner.File
+	for _, f := range m.repoFiles["default"].Have(cid.LocalID) {
+		if !strings.HasPrefix(f.Name, filepath.Join("a", "b")+string(filepath.Separator)) {
+			fs = append(fs, f)
+		}
+	}
+	m.replaceLocalKeeping("default", fs, []string{filepath.Join("a", "b")})
+
+	for _, name := range []string{"a/b/c", "a/b/d"} {
+		if f := m.CurrentRepoFile("default", filepath.FromSlash(name)); protocol.IsDeleted(f.Flags) {
+			t.Errorf("Unexpected deleted %q in kept directory", name)
+		}
+	}
+
+	m.replaceLocalKeeping("default", fs, nil)
+	if f := m.CurrentRepoFile("default", filepath.Join("a", "b", "c")); !protocol.IsDeleted(f.Flags) {
+		t.Error("Expected a/b/c to be deleted")
+	}
+}
+
+func TestTempFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{SourceRetries: 1}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+
+	p := newTestPuller(m, repoCfg)
+	p.blocks = make(chan bqBlock, 1)
+
+	// A leftover temporary file with loose permissions
+	temp := filepath.Join(dir, defTempNamer.TempName("secret"))
+	if err := ioutil.WriteFile(temp, []byte("old data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(temp, 0666)
+
+	blk := scanner.Block{Offset: 0, Size: 10, Hash: []byte("some hash bytes")}
+	b := bqBlock{
+		file:  scanner.File{Name: "secret", Size: 10, Flags: 0600, Blocks: []scanner.Block{blk}},
+		block: blk,
+		last:  true,
+	}
+	p.handleBlock(b)
+	defer p.openFiles["secret"].file.Close()
+
+	if of := p.openFiles["secret"]; of.err != nil {
+		t.Fatal(of.err)
+	}
+	fi, err := os.Stat(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode() & os.ModePerm; perm != 0600 {
+		t.Errorf("Incorrect temporary file permissions %o != 0600", perm)
+	}
+}
+
+func TestRepairFile(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	p := &puller{bq: newBlockQueue(), requestSlots: make(chan bool, 1)}
+	m.pullers["default"] = p
+
+	if _, err := m.RepairFile("default", "nonexistent"); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchFile)
+	}
+
+	if repair, err := m.RepairFile("default", "f"); err != nil || repair {
+		t.Errorf("Unexpected repair of intact file (%v, %v)", repair, err)
+	}
+
+	// Corrupt the file without changing the size or modification time
+	name := filepath.Join(dir, "f")
+	fi, _ := os.Stat(name)
+	data, _ := ioutil.ReadFile(name)
+	data[0]++
+	ioutil.WriteFile(name, data, 0644)
+	os.Chtimes(name, fi.ModTime(), fi.ModTime())
+
+	if _, err := m.RepairFile("default", "f"); err != ErrNoSource {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSource)
+	}
+	if p.bq.size() != 0 {
+		t.Error("Unexpected queued blocks without a source")
+	}
+
+	lf := m.CurrentRepoFile("default", "f")
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{lf})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+
+	if repair, err := m.RepairFile("default", "f"); err != nil || !repair {
+		t.Errorf("Unexpected no repair of corrupt file (%v, %v)", repair, err)
+	}
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.bq.size() != len(lf.Blocks) {
+		t.Errorf("Incorrect number of queued blocks %d != %d", p.bq.size(), len(lf.Blocks))
+	}
+}
+
+type countingConnection struct {
+	FakeConnection
+	requests *int32
+}
+
+func (c countingConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	atomic.AddInt32(c.requests, 1)
+	return c.FakeConnection.Request(repo, name, offset, size)
+}
+
+func TestDuplicateBlockRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+
+	p := newTestPuller(m, repoCfg)
+
+	blk := scanner.Block{Offset: 0, Size: 10, Hash: []byte("some hash bytes")}
+	f := scanner.File{Name: "foo", Version: 1, Size: 10, Blocks: []scanner.Block{blk}}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: make([]byte, 10)}, &requests}
+	m.AddConnection(fc, fc)
+
+	if p.handleBlock(bqBlock{file: f, block: blk}) {
+		t.Fatal("Unexpected handled block with source node")
+	}
+	if !p.handleBlock(bqBlock{file: f, block: blk, last: true}) {
+		t.Fatal("Duplicate block was not handled synchronously")
+	}
+	if of := p.openFiles["foo"]; of.outstanding != 1 || !of.done {
+		t.Fatalf("Incorrect open file state %v", of)
+	}
+
+	handleResult(t, p)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Incorrect number of requests %d != 1", n)
+	}
+	if len(p.inFlight) != 0 {
+		t.Errorf("Unexpected in flight blocks %v", p.inFlight)
+	}
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Error("Unexpected open file after the last result")
+	}
+}
+
+func TestOversizedBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{MaxBlockSizeKiB: 1024}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.ReplaceLocal("default", []scanner.File{{Name: "local", Version: 1, Size: 10}})
+
+	m.Index("42", "default", []protocol.FileInfo{
+		{Name: "huge", Version: 1, Blocks: []protocol.BlockInfo{{Size: 1 << 20}, {Size: 32 << 20}}},
+		{Name: "normal", Version: 1, Blocks: []protocol.BlockInfo{{Size: 1 << 20}}},
+	})
+
+	// The file with the oversized block is invalid and not pulled
+	if gf := m.CurrentGlobalFile("default", "huge"); !gf.Suppressed {
+		t.Errorf("File with oversized block is not invalid: %v", gf)
+	}
+	if gf := m.CurrentGlobalFile("default", "normal"); gf.Suppressed {
+		t.Errorf("File without oversized block is invalid: %v", gf)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 1 || need[0].Name != "normal" {
+		t.Errorf("Incorrect needed files %v", need)
+	}
+
+	// Should such a block be queued anyway, it is refused without sending
+	// a request.
+	p := newTestPuller(m, repoCfg)
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: make([]byte, 10)}, &requests}
+	m.AddConnection(fc, fc)
+
+	f := scanner.File{Name: "huge", Version: 1, Size: 32 << 20, Blocks: []scanner.Block{{Size: 32 << 20}}}
+	if !p.handleBlock(bqBlock{file: f, block: f.Blocks[0], last: true}) {
+		t.Error("Oversized block was not handled synchronously")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("Unexpected %d requests for oversized block", n)
+	}
+	if _, ok := p.openFiles["huge"]; ok {
+		t.Error("Unexpected open file after oversized block")
+	}
+	if _, err := os.Stat(filepath.Join(dir, defTempNamer.TempName("huge"))); !os.IsNotExist(err) {
+		t.Error("Temporary file remains after oversized block")
+	}
+
+	// Nor do we serve requests for oversized blocks
+	if _, err := m.Request("42", "default", "local", 0, 2<<20); err != ErrTooLarge {
+		t.Errorf("Unexpected error %v != %v", err, ErrTooLarge)
+	}
+}
+
+func TestAbortStalePull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{SourceRetries: 1, AbortStalePulls: true}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+
+	p := newTestPuller(m, repoCfg)
+	p.blocks = make(chan bqBlock, 4)
+
+	blocks := []scanner.Block{
+		{Offset: 0, Size: 10, Hash: []byte("some hash bytes")},
+		{Offset: 10, Size: 10, Hash: []byte("more hash bytes")},
+	}
+	f := scanner.File{Name: "foo", Version: 10, Size: 20, Blocks: blocks}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+
+	p.handleBlock(bqBlock{file: f, block: blocks[0]})
+	of := p.openFiles["foo"]
+	if of.err != nil {
+		t.Fatal(of.err)
+	}
+	if _, err := os.Stat(of.temp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The global version changes while we are pulling
+	nf := f
+	nf.Version = 11
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{nf})
+
+	p.handleBlock(bqBlock{file: f, block: blocks[1]})
+	if of := p.openFiles["foo"]; of.err != errVersionChanged {
+		t.Errorf("Unexpected error %v != %v", of.err, errVersionChanged)
+	}
+	if _, err := os.Stat(of.temp); !os.IsNotExist(err) {
+		t.Error("Unexpected temporary file remaining after version change")
+	}
+
+	p.handleBlock(bqBlock{file: f, last: true})
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Error("Unexpected open file after the last block of an abandoned pull")
+	}
+}
+
+func TestMixedSourceVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{CheckSourceVersion: true}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.ReplaceLocal("default", nil)
+
+	p := newTestPuller(m, repoCfg)
+
+	blocks := []scanner.Block{
+		{Offset: 0, Size: 10, Hash: []byte("some hash bytes")},
+		{Offset: 10, Size: 10, Hash: []byte("more hash bytes")},
+	}
+	f := scanner.File{Name: "foo", Version: 10, Size: 20, Blocks: blocks}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+
+	fc := FakeConnection{id: "42", requestData: make([]byte, 10)}
+	m.AddConnection(fc, fc)
+
+	p.handleBlock(bqBlock{file: f, block: blocks[0]})
+	handleResult(t, p)
+	of := p.openFiles["foo"]
+	if of.err != nil {
+		t.Fatal(of.err)
+	}
+
+	// The source announces a new version before the second block arrives
+	nf := f
+	nf.Version = 11
+	nf.Blocks = []scanner.Block{blocks[0], {Offset: 10, Size: 10, Hash: []byte("changed hash")}}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{nf})
+
+	p.handleBlock(bqBlock{file: f, block: blocks[1], last: true})
+	handleResult(t, p)
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Error("Unexpected open file after mixed versions")
+	}
+	if _, err := os.Stat(of.temp); !os.IsNotExist(err) {
+		t.Error("Unexpected temporary file remaining after mixed versions")
+	}
+
+	// The new version is queued right away
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := p.bq.size(); s != len(nf.Blocks) {
+		t.Fatalf("Incorrect number of queued blocks %d != %d", s, len(nf.Blocks))
+	}
+	if b := p.bq.get(); b.file.Version != nf.Version {
+		t.Errorf("Incorrect version queued %d != %d", b.file.Version, nf.Version)
+	}
+}
+
+func setupCopyWorkers(t *testing.T) (*puller, scanner.File, []byte) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := make([]byte, 3*scanner.StandardBlockSize)
+	for i := range orig {
+		orig[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo"), orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{CopyWorkers: 1}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir, IgnorePerms: true}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPuller(m, repoCfg)
+	return p, m.CurrentRepoFile("default", "foo"), orig
+}
+
+func TestCopyWorkers(t *testing.T) {
+	p, lf, orig := setupCopyWorkers(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+
+	// The new version has a changed last block
+	data := make([]byte, len(orig))
+	copy(data, orig)
+	changed := data[2*scanner.StandardBlockSize:]
+	for i := range changed {
+		changed[i] = 42
+	}
+	f := lf
+	f.Version++
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+	if len(need) != 1 {
+		t.Fatalf("Unexpected need %v", need)
+	}
+
+	// The result is returned to the buffer pool once written, so it must
+	// not share memory with data
+	fc := FakeConnection{id: "42", requestData: append([]byte{}, changed...)}
+	p.model.AddConnection(fc, fc)
+	p.model.repoFiles["default"].Replace(p.model.cm.Get("42"), []scanner.File{f})
+
+	// Both the copy and the request are outstanding at once
+	if p.handleBlock(bqBlock{file: f, copy: have}) {
+		t.Fatal("Copy handled synchronously with a free worker")
+	}
+	if p.handleBlock(bqBlock{file: f, block: need[0], last: true}) {
+		t.Fatal("Request handled synchronously")
+	}
+	if of := p.openFiles["foo"]; of.outstanding != 2 {
+		t.Fatalf("Incorrect number of outstanding operations %d != 2", of.outstanding)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-p.requestResults:
+			p.handleRequestResult(res)
+		case res := <-p.copyResults:
+			p.handleCopyResult(res, true)
+		case <-time.After(time.Second):
+			t.Fatal("No result")
+		}
+	}
+
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after pull")
+	}
+	if p.copying != 0 {
+		t.Errorf("Incorrect number of running copies %d", p.copying)
+	}
+	res, err := ioutil.ReadFile(filepath.Join(p.repoCfg.Directory, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Error("Incorrect file contents after pull")
+	}
+}
+
+func TestCopyWorkersCloseEmpty(t *testing.T) {
+	p, lf, orig := setupCopyWorkers(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+
+	// Only the modification time changes, so there is nothing to fetch
+	f := lf
+	f.Version++
+	f.Modified -= 3600
+
+	// The final empty block waits for the copy
+	if p.handleBlock(bqBlock{file: f, copy: lf.Blocks}) {
+		t.Fatal("Copy handled synchronously with a free worker")
+	}
+	if !p.handleBlock(bqBlock{file: f, last: true}) {
+		t.Fatal("Empty block not handled")
+	}
+	if of, ok := p.openFiles["foo"]; !ok || !of.closeEmpty {
+		t.Fatal("File closed before the copy finished")
+	}
+
+	select {
+	case res := <-p.copyResults:
+		p.handleCopyResult(res, true)
+	case <-time.After(time.Second):
+		t.Fatal("No copy result")
+	}
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after copy")
+	}
+	info, err := os.Stat(filepath.Join(p.repoCfg.Directory, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Unix() != f.Modified || info.Size() != int64(len(orig)) {
+		t.Errorf("Incorrect file after copy: %v, %d", info.ModTime(), info.Size())
+	}
+}
+
+// setupCopySource returns a puller for pulling a new version of the file set
+// up by setupCopyWorkers, with its first two blocks to copy from the existing
+// file and the third to request, along with the data of the new version.
+func setupCopySource(t *testing.T) (p *puller, f scanner.File, have, need []scanner.Block, data []byte) {
+	p, lf, orig := setupCopyWorkers(t)
+	p.bq = newBlockQueue()
+
+	// Each block is found at its own offset only
+	for i := range orig {
+		orig[i] = byte(i/scanner.StandardBlockSize + i)
+	}
+	path := filepath.Join(p.repoCfg.Directory, "foo")
+	ioutil.WriteFile(path, orig, 0644)
+	lf.Version++
+	lf.Blocks, _ = scanner.Blocks(bytes.NewReader(orig), scanner.StandardBlockSize)
+	p.model.updateLocal("default", lf)
+
+	data = make([]byte, len(orig))
+	copy(data, orig)
+	changed := data[2*scanner.StandardBlockSize:]
+	for i := range changed {
+		changed[i] = 42
+	}
+	f = lf
+	f.Version++
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	have, need = scanner.BlockDiff(lf.Blocks, f.Blocks)
+
+	var requests int32
+	fc := offsetConnection{FakeConnection{id: "42"}, data, &requests}
+	p.model.AddConnection(fc, fc)
+	p.model.repoFiles["default"].Replace(p.model.cm.Get("42"), []scanner.File{f})
+	return
+}
+
+// pullCopySource pulls f, expecting the second block to be requested
+// instead of copied, and checks the result.
+func pullCopySource(t *testing.T, p *puller, f scanner.File, have, need []scanner.Block, data []byte) {
+	p.handleBlock(bqBlock{file: f, copy: have})
+	p.handleBlock(bqBlock{file: f, block: need[0], last: true})
+	queued := make(chan bqBlock)
+	go func() { queued <- p.bq.get() }()
+	// The copy, the request, the block that couldn't be copied and its request
+	requests := 0
+	for i := 0; i < 4; i++ {
+		select {
+		case res := <-p.requestResults:
+			p.handleRequestResult(res)
+			requests++
+		case res := <-p.copyResults:
+			p.handleCopyResult(res, true)
+		case b := <-queued:
+			if b.block.Offset != scanner.StandardBlockSize {
+				t.Fatalf("Block at offset %d queued instead of copied", b.block.Offset)
+			}
+			if p.handleBlock(b) {
+				t.Fatal("Block not requested")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No result")
+		}
+	}
+
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after pull")
+	}
+	if requests != 2 {
+		t.Errorf("%d requests, expected 2", requests)
+	}
+	res, err := ioutil.ReadFile(filepath.Join(p.repoCfg.Directory, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Error("Incorrect file contents after pull")
+	}
+}
+
+func TestCopyTruncatedSource(t *testing.T) {
+	p, f, have, need, data := setupCopySource(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+
+	// The existing file loses its second block before it is copied
+	os.Truncate(filepath.Join(p.repoCfg.Directory, "foo"), scanner.StandardBlockSize)
+
+	pullCopySource(t, p, f, have, need, data)
+}
+
+func TestCopyCorruptSource(t *testing.T) {
+	p, f, have, need, data := setupCopySource(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+	p.repoCfg.VerifyCopySource = true
+
+	// The second block of the existing file is damaged after it was scanned
+	fd, err := os.OpenFile(filepath.Join(p.repoCfg.Directory, "foo"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("damage"), scanner.StandardBlockSize+100)
+	fd.Close()
+
+	pullCopySource(t, p, f, have, need, data)
+}
+
+func TestSourceMatches(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), len(data))
+	b := blocks[0]
+
+	// Changes that keep the sums of the bytes and of their running sums
+	// leave the weak hash as it was
+	collision := append([]byte{}, data...)
+	collision[10]++
+	collision[11] -= 2
+	collision[12]++
+	if scanner.WeakHash(collision) != b.WeakHash {
+		t.Fatal("No weak hash collision")
+	}
+	changed := append([]byte{}, data...)
+	changed[10]++
+
+	for _, tc := range []struct {
+		data  []byte
+		weak  uint32
+		match bool
+	}{
+		{data, b.WeakHash, true},
+		{data, 0, true},
+		{changed, b.WeakHash, false},
+		{changed, 0, false},
+		{collision, b.WeakHash, false},
+	} {
+		if m := sourceMatches(tc.data, b, tc.weak); m != tc.match {
+			t.Errorf("Incorrect match %v for weak hash %x", m, tc.weak)
+		}
+	}
+}
+
+// benchmarkSourceChanged checks a block that has changed since it was
+// scanned, as copying from a file being written to does.
+func benchmarkSourceChanged(b *testing.B, weak bool) {
+	data := make([]byte, scanner.StandardBlockSize)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), len(data))
+	var w uint32
+	if weak {
+		w = blocks[0].WeakHash
+	}
+	data[100]++
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if sourceMatches(data, blocks[0], w) {
+			b.Fatal("Changed block matches")
+		}
+	}
+}
+
+func BenchmarkSourceChangedStrong(b *testing.B) {
+	benchmarkSourceChanged(b, false)
+}
+
+func BenchmarkSourceChangedWeak(b *testing.B) {
+	benchmarkSourceChanged(b, true)
+}
+
+func setupInPlace(t *testing.T) (*puller, scanner.File, []byte, []byte) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := make([]byte, 3*scanner.StandardBlockSize+100)
+	for i := range orig {
+		orig[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo"), orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Configuration{}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir, InPlaceUpdate: true}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new version has a changed second block and is shorter
+	data := make([]byte, 3*scanner.StandardBlockSize)
+	copy(data, orig)
+	data[scanner.StandardBlockSize+10]++
+	lf := m.CurrentRepoFile("default", "foo")
+	f := lf
+	f.Version++
+	f.Size = int64(len(data))
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+
+	p := newTestPuller(m, repoCfg)
+
+	have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+	if len(need) != 1 {
+		t.Fatalf("Unexpected need %v", need)
+	}
+	p.handleBlock(bqBlock{file: f, copy: have})
+
+	of, ok := p.openFiles["foo"]
+	if !ok || of.err != nil || of.journal == nil {
+		t.Fatalf("File not opened for in place update: %+v", of)
+	}
+	if _, err := os.Stat(journalName(of.filepath)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the request for the changed block was sent
+	of.done = true
+	of.outstanding = 1
+	p.openFiles["foo"] = of
+
+	return p, f, orig, data
+}
+
+func TestInPlaceUpdate(t *testing.T) {
+	p, f, _, data := setupInPlace(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+
+	b := f.Blocks[1]
+	p.handleRequestResult(requestResult{file: f, offset: b.Offset, block: b, data: data[b.Offset : b.Offset+int64(b.Size)]})
+
+	name := filepath.Join(p.repoCfg.Directory, "foo")
+	if bs, _ := ioutil.ReadFile(name); bytes.Compare(bs, data) != 0 {
+		t.Error("File not updated in place")
+	}
+	if _, err := os.Stat(journalName(name)); !os.IsNotExist(err) {
+		t.Error("Unexpected journal remaining after update")
+	}
+	if lf := p.model.CurrentRepoFile("default", "foo"); lf.Version != f.Version {
+		t.Errorf("Local version not updated, %d != %d", lf.Version, f.Version)
+	}
+}
+
+func TestInPlaceUpdateRollback(t *testing.T) {
+	p, f, orig, _ := setupInPlace(t)
+	defer os.RemoveAll(p.repoCfg.Directory)
+
+	b := f.Blocks[1]
+	p.handleRequestResult(requestResult{file: f, offset: b.Offset, block: b, data: make([]byte, b.Size)})
+
+	name := filepath.Join(p.repoCfg.Directory, "foo")
+	if bs, _ := ioutil.ReadFile(name); bytes.Compare(bs, orig) != 0 {
+		t.Error("File not rolled back after failed verification")
+	}
+	if _, err := os.Stat(journalName(name)); !os.IsNotExist(err) {
+		t.Error("Unexpected journal remaining after rollback")
+	}
+	if lf := p.model.CurrentRepoFile("default", "foo"); lf.Version == f.Version {
+		t.Error("Unexpected local version update after failed verification")
+	}
+}
+
+func TestSpecialPermBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+
+	for _, special := range []bool{false, true} {
+		m, dir := setupRescanRepo(t)
+		defer os.RemoveAll(dir)
+		repoCfg := m.repoCfgs["default"]
+		repoCfg.SpecialPermBits = special
+		m.repoCfgs["default"] = repoCfg
+		p := newTestPuller(m, repoCfg)
+
+		// A setuid file pulled from a node that has the bit
+		f := m.CurrentRepoFile("default", "f")
+		f.Version++
+		f.Flags = 04755
+		path := filepath.Join(dir, "f")
+		if err := p.setMetadata(f, path); err != nil {
+			t.Fatal(err)
+		}
+		p.updateLocal(f)
+
+		info, _ := os.Stat(path)
+		if setuid := info.Mode()&os.ModeSetuid != 0; setuid != special {
+			t.Errorf("Setuid bit %v with special bits %v", setuid, special)
+		}
+		if err := m.ScanRepo("default"); err != nil {
+			t.Fatal(err)
+		}
+		if cur := m.CurrentRepoFile("default", "f"); cur.Version != f.Version {
+			t.Errorf("File seen as changed after pull with special bits %v", special)
+		}
+	}
+}
+
+func TestSetIgnorePerms(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(name, 0644)
+
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	m.StartRepoRW("default", 1)
+
+	if err := m.SetIgnorePerms("default", true); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(name, 0600)
+
+	if err := m.SetIgnorePerms("default", false); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode() & os.ModePerm; perm != 0644 {
+		t.Errorf("Permissions not restored, %o != 0644", perm)
+	}
+
+	if err := m.SetIgnorePerms("nonexistent", false); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
+
+// The APIs that hand requests to the run loop of a puller, each called
+// after the run loop has returned, and the errors they return then.
+var stoppedPullerCalls = []struct {
+	name string
+	call func(m *Model) error
+	err  error
+}{
+	{"SetIgnorePerms", func(m *Model) error { return m.SetIgnorePerms("default", true) }, ErrStopped},
+	{"SetRequestSlots", func(m *Model) error { return m.SetRequestSlots("default", 1) }, ErrStopped},
+	{"MoveRepo", func(m *Model) error { return m.MoveRepo("default", m.repoCfgs["default"].Directory+".moved") }, ErrStopped},
+	{"SetVersioner", func(m *Model) error { return m.SetVersioner("default", "", nil) }, ErrStopped},
+	{"UpdateRepoConfig", func(m *Model) error { return m.UpdateRepoConfig(m.repoCfgs["default"]) }, ErrStopped},
+	{"PurgeRepo", func(m *Model) error { return m.PurgeRepo("default", false) }, ErrStopped},
+	{"ScanAndSync", func(m *Model) error { return m.ScanAndSync("default") }, ErrStopped},
+	{"Suspend", func(m *Model) error { m.Suspend(); return nil }, nil},
+	{"Resume", func(m *Model) error { m.Resume(); return nil }, nil},
+	{"Boost", func(m *Model) error { return m.Boost("default", time.Minute) }, ErrStopped},
+}
+
+func TestStoppedPuller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{RescanIntervalS: 1}}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	m.StartRepoRW("default", 1)
+	m.rmut.RLock()
+	p := m.pullers["default"]
+	m.rmut.RUnlock()
+
+	// The rescan at the end of the next cycle fails and the run loop returns
+	os.RemoveAll(dir)
+	time.Sleep(1100 * time.Millisecond)
+	p.syncNow <- syncNowReq{done: make(chan struct{})}
+	select {
+	case <-p.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Puller still running after a failed scan")
+	}
+	os.Mkdir(dir, 0755)
+
+	for _, c := range stoppedPullerCalls {
+		res := make(chan error, 1)
+		go func(call func(*Model) error) {
+			res <- call(m)
+		}(c.call)
+		select {
+		case err := <-res:
+			if err != c.err {
+				t.Errorf("%s: unexpected error %v != %v", c.name, err, c.err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s blocks on a stopped puller", c.name)
+		}
+	}
+}
+
+func TestFsyncBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{FsyncFiles: true, FsyncBatchFiles: 2}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.ReplaceLocal("default", nil)
+	p := newTestPuller(m, repoCfg)
+
+	var fs []scanner.File
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs = append(fs, scanner.File{Name: name, Version: 42, Size: 1})
+	}
+
+	p.renamed(fs[0], filepath.Join(dir, "a"))
+	if f := m.CurrentRepoFile("default", "a"); f.Version != 0 {
+		t.Error("Unexpected index update before the batch is synced")
+	}
+
+	p.renamed(fs[1], filepath.Join(dir, "b"))
+	for _, name := range []string{"a", "b"} {
+		if f := m.CurrentRepoFile("default", name); f.Version != 42 {
+			t.Errorf("Index not updated for %q after the batch was synced", name)
+		}
+	}
+	if len(p.syncBatch) != 0 {
+		t.Errorf("Unexpected %d files remaining in batch", len(p.syncBatch))
+	}
+}
+
+func TestFileInUse(t *testing.T) {
+	inUse := syscall.ETXTBSY
+	if runtime.GOOS == "windows" {
+		inUse = syscall.Errno(32) // ERROR_SHARING_VIOLATION
+	}
+	lockErr := &os.LinkError{Op: "rename", Old: ".syncthing.foo", New: "foo", Err: inUse}
+
+	sub := events.Default.Subscribe(events.ItemInUse)
+	defer events.Default.Unsubscribe(sub)
+
+	p := &puller{repoCfg: config.RepositoryConfiguration{ID: "default"}}
+	f := scanner.File{Name: "foo"}
+
+	if p.checkInUse(f, errors.New("some other error")) {
+		t.Error("Unexpected in use for unrelated error")
+	}
+	if p.waitingInUse("foo") {
+		t.Error("Unexpected wait for unrelated error")
+	}
+
+	if !p.checkInUse(f, lockErr) {
+		t.Fatal("Lock error not detected")
+	}
+	if !p.waitingInUse("foo") {
+		t.Error("Not waiting after lock error")
+	}
+	if p.waitingInUse("bar") {
+		t.Error("Unexpected wait for other file")
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["item"] != "foo" || data["repo"] != "default" {
+		t.Errorf("Unexpected event data %v", data)
+	}
+
+	p.checkInUse(f, lockErr)
+	if d := p.inUse["foo"].delay; d != 2*inUseBackoffMin {
+		t.Errorf("Incorrect backoff %v != %v", d, 2*inUseBackoffMin)
+	}
+
+	// The backoff has expired
+	b := p.inUse["foo"]
+	b.until = time.Now().Add(-time.Second)
+	p.inUse["foo"] = b
+	if p.waitingInUse("foo") {
+		t.Error("Unexpected wait after backoff expiry")
+	}
+}
+
+func TestMetadataOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idxDir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(idxDir)
+
+	cfg := &config.Configuration{}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir, MetadataOnly: true}
+	m := NewModel(idxDir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+
+	gf := scanner.File{
+		Name:     "foo",
+		Version:  1,
+		Flags:    0640,
+		Modified: 1400000000,
+		Size:     1234,
+		Blocks:   []scanner.Block{{Size: 1234, Hash: []byte("hash")}},
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{gf})
+
+	p := newTestPuller(m, repoCfg)
+	m.pullers["default"] = p
+
+	if err := m.Hydrate("default", "foo"); err != ErrNotPlaceholder {
+		t.Errorf("Unexpected error %v != %v", err, ErrNotPlaceholder)
+	}
+
+	p.queueNeededBlocks()
+
+	name := filepath.Join(dir, "foo")
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != gf.Size || fi.ModTime().Unix() != gf.Modified {
+		t.Errorf("Incorrect placeholder size %d or modtime %d", fi.Size(), fi.ModTime().Unix())
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Errorf("Incorrect placeholder mode %v", fi.Mode().Perm())
+	}
+	if p.bq.size() != 0 {
+		t.Error("Unexpected queued blocks for placeholder")
+	}
+	if _, err := os.Stat(m.placeholderFile("default", idxDir)); err != nil {
+		t.Error("Placeholders not saved:", err)
+	}
+
+	// The scanner must not pick up the placeholder as real content
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if lf := m.CurrentRepoFile("default", "foo"); lf.Name != "" {
+		t.Errorf("Placeholder scanned as %v", lf)
+	}
+
+	if err := m.Hydrate("default", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	p.queueNeededBlocks()
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.bq.size() != len(gf.Blocks) {
+		t.Errorf("Incorrect number of queued blocks %d != %d", p.bq.size(), len(gf.Blocks))
+	}
+
+	// Once recorded in the local index, the file is no longer a placeholder
+	m.updateLocal("default", gf)
+	if ok, _ := m.placeholderState("default", "foo"); ok {
+		t.Error("Placeholder remains after update")
+	}
+}
+
+func TestModifiedPlaceholderIsScanned(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "g")
+	if err := ioutil.WriteFile(name, make([]byte, 16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(name)
+	m.setPlaceholder("default", scanner.File{Name: "g", Modified: fi.ModTime().Unix(), Size: 16})
+
+	if err := m.Rescan("default", false); err != nil {
+		t.Fatal(err)
+	}
+	if lf := m.CurrentRepoFile("default", "g"); lf.Name != "" {
+		t.Errorf("Placeholder scanned as %v", lf)
+	}
+
+	if err := ioutil.WriteFile(name, []byte("real content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rescan("default", false); err != nil {
+		t.Fatal(err)
+	}
+	if lf := m.CurrentRepoFile("default", "g"); lf.Name != "g" {
+		t.Error("Modified placeholder not scanned")
+	}
+}
+
+func TestPreserveHardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir, PreserveHardlinks: true}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.ReplaceLocal("default", nil)
+
+	p := newTestPuller(m, repoCfg)
+
+	blocks := []scanner.Block{{Size: 6, Hash: []byte("some hash bytes")}}
+	var fs []scanner.File
+	for _, name := range []string{"a", "b", "c"} {
+		fs = append(fs, scanner.File{
+			Name:     name,
+			Version:  1,
+			Flags:    0644 | protocol.FlagHardlink,
+			Modified: 1400000000,
+			Size:     6,
+			Blocks:   blocks,
+		})
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), fs)
+
+	// Nothing is present yet, so only the first file is pulled and the
+	// others wait for it.
+	p.queueNeededBlocks()
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b := p.bq.get(); b.file.Name != "a" {
+		t.Errorf("Incorrect file pulled first %q", b.file.Name)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := p.bq.size(); s != 0 {
+		t.Errorf("Unexpected %d queued blocks for links", s)
+	}
+
+	// Once it has been pulled, the others are linked to it
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.updateLocal("default", fs[0])
+	p.queueNeededBlocks()
+
+	a, _ := os.Stat(filepath.Join(dir, "a"))
+	for _, name := range []string{"b", "c"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, fi) {
+			t.Errorf("%q is not linked to %q", name, "a")
+		}
+		if lf := m.CurrentRepoFile("default", name); lf.Version != 1 {
+			t.Errorf("%q not updated in the local index", name)
+		}
+	}
+	if n := len(m.NeedFilesRepo("default")); n != 0 {
+		t.Errorf("Unexpected %d needed files", n)
+	}
+}
+
+func TestDeleteGrace(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.DeleteGraceHours = 1
+	p := newTestPuller(m, repoCfg)
+	m.pullers["default"] = p
+
+	if err := m.UndoDelete("default", "f"); err != ErrNoPendingDelete {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoPendingDelete)
+	}
+
+	lf := m.CurrentRepoFile("default", "f")
+	df := scanner.File{Name: "f", Version: lf.Version + 1, Flags: protocol.FlagDeleted, Modified: lf.Modified}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{df})
+
+	p.queueNeededBlocks()
+	time.Sleep(50 * time.Millisecond)
+	if s := p.bq.size(); s != 0 {
+		t.Errorf("Delete was queued within the grace period")
+	}
+	if pd := m.PendingDeletes("default"); len(pd) != 1 || pd[0] != "f" {
+		t.Errorf("Incorrect pending deletes %v", pd)
+	}
+
+	if err := m.UndoDelete("default", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if nf := m.CurrentRepoFile("default", "f"); nf.Version <= df.Version || protocol.IsDeleted(nf.Flags) {
+		t.Errorf("Incorrect file after undo %v", nf)
+	}
+	if n := len(m.NeedFilesRepo("default")); n != 0 {
+		t.Errorf("Unexpected %d needed files after undo", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f")); err != nil {
+		t.Error(err)
+	}
+
+	// A later delete is carried out once the grace period is over
+	df.Version = m.CurrentRepoFile("default", "f").Version + 1
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{df})
+	p.queueNeededBlocks()
+	pd := p.pendingDeletes["f"]
+	pd.since = pd.since.Add(-2 * time.Hour)
+	p.pendingDeletes["f"] = pd
+	p.queueNeededBlocks()
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b := p.bq.get(); b.file.Name != "f" || !protocol.IsDeleted(b.file.Flags) {
+		t.Errorf("Incorrect queued block %v", b.file)
+	}
+}
+
+func TestMetadataRetries(t *testing.T) {
+	defer func(d time.Duration) {
+		metadataRetryDelay = d
+	}(metadataRetryDelay)
+	metadataRetryDelay = time.Millisecond
+
+	transient := errors.New("transient error")
+
+	var calls int
+	err := withRetries(3, func() error {
+		calls++
+		if calls == 1 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("Incorrect result after failing once; %v, %d calls", err, calls)
+	}
+
+	calls = 0
+	err = withRetries(3, func() error {
+		calls++
+		return transient
+	})
+	if err != transient || calls != 4 {
+		t.Errorf("Incorrect result when always failing; %v, %d calls", err, calls)
+	}
+
+	calls = 0
+	perm := &os.PathError{Op: "chmod", Path: "foo", Err: syscall.EPERM}
+	err = withRetries(3, func() error {
+		calls++
+		return perm
+	})
+	if err != perm || calls != 1 {
+		t.Errorf("Permanent error was retried; %v, %d calls", err, calls)
+	}
+}
+
+func TestSetRequestSlots(t *testing.T) {
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+
+	p := &puller{
+		bq:           newBlockQueue(),
+		requestSlots: make(chan bool, maxRequestSlots),
+		slots:        4,
+		resizeSlots:  make(chan resizeSlotsReq),
+	}
+	for i := 0; i < 4; i++ {
+		p.requestSlots <- true
+	}
+	m.pullers["default"] = p
+
+	if err := m.SetRequestSlots("nonexistent", 4); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+	if err := m.SetRequestSlots("default", 0); err == nil {
+		t.Error("Unexpected nil error for zero slots")
+	}
+
+	// Simulate the filler and the run loop, with requests taking a
+	// millisecond each.
+	done := make(chan struct{})
+	defer close(done)
+	freed := make(chan bool, maxRequestSlots)
+	var active int32
+	go func() {
+		for {
+			select {
+			case <-p.requestSlots:
+			case <-done:
+				return
+			}
+			atomic.AddInt32(&active, 1)
+			go func() {
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				freed <- true
+			}()
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-freed:
+				p.releaseSlot()
+			case req := <-p.resizeSlots:
+				p.setSlots(req.slots)
+				close(req.done)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if err := m.SetRequestSlots("default", 1+(i*7)%32); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+
+	if err := m.SetRequestSlots("default", 3); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var max int32
+	for i := 0; i < 100; i++ {
+		if a := atomic.LoadInt32(&active); a > max {
+			max = a
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	if max > 3 {
+		t.Errorf("Incorrect concurrency %d > 3", max)
+	}
+	if max < 1 {
+		t.Error("No requests after resizing")
+	}
+
+	if s, _ := m.DebugState("default"); s.RequestSlots != 3 {
+		t.Errorf("Incorrect reported slots %d != 3", s.RequestSlots)
+	}
+}
+
+func TestRequestByDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Configuration{}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel(dir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.ReplaceLocal("default", nil)
+
+	gf := scanner.File{
+		Name:    "movie",
+		Version: 1,
+		Size:    300,
+		Blocks: []scanner.Block{
+			{Offset: 0, Size: 100, Hash: []byte("h0")},
+			{Offset: 100, Size: 100, Hash: []byte("h1")},
+			{Offset: 200, Size: 100, Hash: []byte("h2")},
+		},
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{gf})
+
+	p := newTestPuller(m, repoCfg)
+	p.requestSlots = make(chan bool, 1)
+	m.pullers["default"] = p
+
+	if err := m.RequestByDeadline("default", "nonexistent", 0, 100, time.Now()); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchFile)
+	}
+
+	p.queueNeededBlocks()
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := m.RequestByDeadline("default", "movie", 250, 10, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.bq.size(); s != len(gf.Blocks) {
+		t.Errorf("Incorrect number of queued blocks %d != %d", s, len(gf.Blocks))
+	}
+	for _, offset := range []int64{200, 0, 100} {
+		if b := p.bq.get(); b.block.Offset != offset {
+			t.Errorf("Incorrect block offset %d != %d", b.block.Offset, offset)
+		}
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	cfg := &config.Configuration{
+		Repositories: []config.RepositoryConfiguration{{ID: "default", Directory: "testdata"}},
+	}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(cfg.Repositories[0])
+	m.ReplaceLocal("default", nil)
+
+	if err := m.WaitForSync("nonexistent", time.Second); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+	if err := m.WaitForSync("default", time.Second); err != nil {
+		t.Errorf("Unexpected error for synced repo: %v", err)
+	}
+
+	gf := scanner.File{Name: "foo", Version: 1, Modified: 1400000000}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{gf})
+	m.setState("default", RepoSyncing)
+
+	if err := m.WaitForSync("default", 50*time.Millisecond); err != ErrSyncTimeout {
+		t.Errorf("Unexpected error %v != %v", err, ErrSyncTimeout)
+	}
+
+	// Several waiters are all released once the file has been pulled
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			errs <- m.WaitForSync("default", 5*time.Second)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	t0 := time.Now()
+	m.updateLocal("default", gf)
+	m.setState("default", RepoIdle)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if d := time.Since(t0); d > syncRecheckInterval/2 {
+		t.Errorf("Waiters released after %v; not woken by the state change", d)
+	}
+
+	// An invalid repository fails the wait right away
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{{Name: "foo", Version: 2, Modified: 1400000001}})
+	go func() {
+		errs <- m.WaitForSync("default", 5*time.Second)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	t0 = time.Now()
+	m.invalidateRepo("default", errors.New("test error"))
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "test error") {
+		t.Errorf("Unexpected error %v", err)
+	} else if d := time.Since(t0); d > syncRecheckInterval/2 {
+		t.Errorf("Waiter released after %v; not woken by the invalidation", d)
+	}
+}
+
+func TestKeepDeletedFiles(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.KeepDeletedFiles = true
+	p := newTestPuller(m, repoCfg)
+	p.trash = versioner.NewTrash(dir, 0, 0)
+
+	name := filepath.Join("a", "e")
+	lf := m.CurrentRepoFile("default", name)
+	df := scanner.File{Name: name, Version: lf.Version + 1, Flags: protocol.FlagDeleted, Modified: lf.Modified}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{df})
+
+	if !p.handleBlock(bqBlock{file: df, last: true}) {
+		t.Fatal("Delete was not handled synchronously")
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+		t.Error("File remains after delete")
+	}
+	if f := m.CurrentRepoFile("default", name); !protocol.IsDeleted(f.Flags) {
+		t.Errorf("File not deleted in index: %v", f)
+	}
+
+	// The file is in the trash, and not picked up by the scanner
+	trashed, _ := filepath.Glob(filepath.Join(dir, ".stversions", ".trash", "a", "e~*"))
+	if len(trashed) != 1 {
+		t.Fatalf("Incorrect files in trash %v", trashed)
+	}
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range m.haveFilesRepo("default") {
+		if strings.Contains(f.Name, ".trash") {
+			t.Errorf("Trashed file scanned: %v", f)
+		}
+	}
+}
+
+func TestSetVersioner(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	if err := m.SetVersioner("default", "nonexistent", nil); err == nil {
+		t.Error("Unexpected nil error for unknown versioner type")
+	}
+	if err := m.SetVersioner("default", "simple", map[string]string{"keepVersions": "2"}); err == nil {
+		t.Error("Unexpected nil error for unknown versioner parameter")
+	}
+	if err := m.SetVersioner("nonexistent", "simple", nil); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v for unknown repo", err)
+	}
+
+	m.StartRepoRW("default", 1)
+	p := m.pullers["default"]
+
+	if err := m.SetVersioner("default", "simple", map[string]string{"keep": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.versioner.(versioner.Simple); !ok {
+		t.Errorf("Incorrect versioner %#v", p.versioner)
+	}
+	if typ := m.repoCfgs["default"].Versioning.Type; typ != "simple" {
+		t.Errorf("Incorrect versioning type %q in configuration", typ)
+	}
+
+	if err := m.SetVersioner("default", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if p.versioner != nil {
+		t.Errorf("Unexpected versioner %#v after turning versioning off", p.versioner)
+	}
+}
+
+func TestSetVersionerDelete(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.KeepDeletedFiles = true
+	p := newTestPuller(m, repoCfg)
+
+	// The trash is used without a versioner, and not with one
+	p.setVersioner(config.VersioningConfiguration{}, nil)
+	if p.trash == nil {
+		t.Fatal("No trash without versioner")
+	}
+	v, err := newVersioner(config.VersioningConfiguration{Type: "simple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setVersioner(config.VersioningConfiguration{Type: "simple"}, v)
+	if p.trash != nil {
+		t.Fatal("Unexpected trash with versioner")
+	}
+
+	name := filepath.Join("a", "e")
+	lf := m.CurrentRepoFile("default", name)
+	df := scanner.File{Name: name, Version: lf.Version + 1, Flags: protocol.FlagDeleted, Modified: lf.Modified}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{df})
+
+	if !p.handleBlock(bqBlock{file: df, last: true}) {
+		t.Fatal("Delete was not handled synchronously")
+	}
+	archived, _ := filepath.Glob(filepath.Join(dir, "a", ".stversions", "e~*"))
+	if len(archived) != 1 {
+		t.Errorf("Incorrect archived files %v", archived)
+	}
+}
+
+func TestFixupDirectoriesCancel(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a")
+	mod := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, mod, mod)
+	cfg := m.repoCfgs["default"]
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if fixupDirectories(m, cfg, false, nil, cancel) {
+		t.Error("Cancelled fixup reported as completed")
+	}
+	if info, _ := os.Stat(path); !info.ModTime().Equal(mod) {
+		t.Error("Directory changed by cancelled fixup")
+	}
+
+	p := newTestPuller(m, cfg)
+	p.startFixup()
+	<-p.fixup.done
+	if !p.fixupFinished() {
+		t.Error("Fixup not reported as finished")
+	}
+	if p.fixup != nil || p.fixupFinished() {
+		t.Error("Fixup reported as finished twice")
+	}
+	if info, _ := os.Stat(path); info.ModTime().Equal(mod) {
+		t.Error("Directory modification time not restored")
+	}
+}
+
+func TestFixupSkipsPendingDirs(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	// A file is being pulled into a/b, and another is queued for it
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.openFiles[filepath.Join("a", "b", "g")] = openFile{}
+	p.bq.put(bqAdd{file: scanner.File{Name: filepath.Join("a", "b", "h")}})
+	ioutil.WriteFile(filepath.Join(dir, "a", "b", defTempNamer.TempName("g")), nil, 0644)
+
+	mod := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, d := range []string{"a", filepath.Join("a", "b")} {
+		os.Chtimes(filepath.Join(dir, d), mod, mod)
+	}
+
+	p.startFixup()
+	<-p.fixup.done
+	p.fixupFinished()
+	if info, _ := os.Stat(filepath.Join(dir, "a")); info.ModTime().Equal(mod) {
+		t.Error("Modification time of settled directory not restored")
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "a", "b")); !info.ModTime().Equal(mod) {
+		t.Error("Modification time of pending directory restored")
+	}
+	if !p.fixupDeferred {
+		t.Error("Fixup of pending directory not deferred")
+	}
+
+	// Once the files are in place, the directory is fixed up too
+	delete(p.openFiles, filepath.Join("a", "b", "g"))
+	p.bq.get()
+	for i := 0; !p.bq.empty(); i++ {
+		if i == 100 {
+			t.Fatal("Block not taken from the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.startFixup()
+	<-p.fixup.done
+	if info, _ := os.Stat(filepath.Join(dir, "a", "b")); info.ModTime().Equal(mod) {
+		t.Error("Modification time of settled directory not restored")
+	}
+	if p.fixupDeferred {
+		t.Error("Fixup deferred without pending directories")
+	}
+}
+
+func TestPermsModeIgnore(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.PermsMode = config.PermsModeIgnore
+	m.repoCfgs["default"] = repoCfg
+	p := newTestPuller(m, repoCfg)
+
+	// The other node has the same file and directory with other permissions,
+	// as if they were synced through a filesystem without them.
+	lf := m.CurrentRepoFile("default", "f")
+	rf := lf
+	rf.Version++
+	rf.Flags = protocol.FlagNoPermBits | 0666
+	ld := m.CurrentRepoFile("default", "a")
+	rd := ld
+	rd.Version++
+	rd.Flags = protocol.FlagDirectory | 0700
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{rf, rd})
+
+	p.queueNeededBlocks()
+	time.Sleep(50 * time.Millisecond)
+	if s := p.bq.size(); s != 0 {
+		t.Errorf("Unexpected %d queued blocks for permission changes", s)
+	}
+	if n := len(m.NeedFilesRepo("default")); n != 0 {
+		t.Errorf("Unexpected %d needed files", n)
+	}
+
+	// Neither local permission changes nor the adopted versions cause
+	// changes to be announced.
+	os.Chmod(filepath.Join(dir, "f"), 0600)
+	os.Chmod(filepath.Join(dir, "a"), 0750)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []scanner.File{rf, rd} {
+		if f := m.CurrentRepoFile("default", exp.Name); f.Version != exp.Version {
+			t.Errorf("%q: incorrect version %d != %d after rescan", exp.Name, f.Version, exp.Version)
+		}
+	}
+	fixupDirectories(m, repoCfg, false, nil, nil)
+	if info, _ := os.Stat(filepath.Join(dir, "a")); info.Mode().Perm() != 0750 {
+		t.Errorf("Directory permissions changed to %o", info.Mode().Perm())
+	}
+
+	// Content changes are pulled as usual
+	rf.Version++
+	rf.Size++
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{rf, rd})
+	p.queueNeededBlocks()
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b := p.bq.get(); b.file.Name != "f" {
+		t.Errorf("Incorrect queued block %v", b.file)
+	}
+}
+
+func TestInvalidFilename(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	sub := events.Default.Subscribe(events.InvalidFilename)
+	defer events.Default.Unsubscribe(sub)
+
+	f := scanner.File{Name: "bad\x00name", Version: 1, Size: 1, Blocks: []scanner.Block{{Size: 1}}}
+	for i := 0; i < 2; i++ {
+		if !p.handleBlock(bqBlock{file: f, block: f.Blocks[0], last: true}) {
+			t.Fatal("Block with invalid name not handled")
+		}
+	}
+	if len(p.openFiles) != 0 {
+		t.Error("Unexpected open file for invalid name")
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["item"] != f.Name || data["repo"] != "default" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	if _, err := sub.Poll(50 * time.Millisecond); err != events.ErrTimeout {
+		t.Error("Invalid name reported twice")
+	}
+
+	// It is not queued again until there is a new version
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+	p.queueNeededBlocks()
+	time.Sleep(50 * time.Millisecond)
+	if s := p.bq.size(); s != 0 {
+		t.Errorf("Unexpected %d queued blocks for invalid name", s)
+	}
+}
+
+func TestScanAndSync(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+
+	if err := m.ScanAndSync("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+
+	// Once the puller has found nothing to do, it only looks for needed
+	// files again after its next tick.
+	m.repoFiles["default"].Replace(m.cm.Get("42"), nil)
+	m.StartRepoRW("default", 1)
+	for i := 0; m.State("default") != "idle"; i++ {
+		if i == 100 {
+			t.Fatal("Puller not idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.ScanAndSync("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+	if err := m.ScanAndSync("default"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; m.CurrentRepoFile("default", "foo").Version != f.Version; i++ {
+		if i == 200 {
+			t.Fatal("File not pulled after ScanAndSync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartupStagger(t *testing.T) {
+	defer func(f func(int64) int64) { staggerInt63n = f }(staggerInt63n)
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	staggerInt63n = func(n int64) int64 { return n / 2 }
+	delays := make(chan time.Duration, 1)
+	ready := make(chan time.Time)
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		delays <- d
+		return ready
+	}
+
+	if d := startupDelay(0); d != 0 {
+		t.Errorf("Unexpected delay %v without stagger", d)
+	}
+
+	dir, m, _, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: block}, &requests}
+	m.AddConnection(fc, fc)
+	m.cfg.Options.StartupStaggerS = 5
+
+	m.StartRepoRW("default", 1)
+	if d := <-delays; d != 2500*time.Millisecond {
+		t.Errorf("Incorrect startup delay %v", d)
+	}
+
+	// Nothing is pulled until the delay is over
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("%d requests during startup delay", n)
+	}
+	close(ready)
+	for i := 0; atomic.LoadInt32(&requests) == 0; i++ {
+		if i == 100 {
+			t.Fatal("No requests after startup delay")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBadVersioningType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bad := config.RepositoryConfiguration{ID: "bad", Directory: filepath.Join(dir, "bad"), Versioning: config.VersioningConfiguration{Type: "nonexistent"}}
+	good := config.RepositoryConfiguration{ID: "good", Directory: filepath.Join(dir, "good")}
+	cfg := &config.Configuration{Repositories: []config.RepositoryConfiguration{bad, good}}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(bad)
+	m.AddRepo(good)
+	m.StartRepoRW("bad", 1)
+	m.StartRepoRW("good", 1)
+
+	if m.pullers["bad"] != nil {
+		t.Error("Puller started despite unknown versioning type")
+	}
+	if reason := m.invalidReason("bad"); !strings.Contains(reason, "nonexistent") {
+		t.Errorf("Incorrect invalid reason %q", reason)
+	}
+	if m.pullers["good"] == nil || m.invalidReason("good") != "" {
+		t.Error("Other repository affected by unknown versioning type")
+	}
+
+	// Correcting the type starts the puller
+	if err := m.SetVersioner("bad", "simple", map[string]string{"keep": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.pullers["bad"]; p == nil || p.versioner == nil {
+		t.Error("Puller not started with corrected versioning")
+	}
+	if reason := m.invalidReason("bad"); reason != "" {
+		t.Errorf("Repository still invalid: %q", reason)
+	}
+}
+
+func TestSharingNodes(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	m.repoNodes["default"] = []string{"42", "43", "44"}
+
+	// 42 has everything we have, 43 is missing a file and 44 is not
+	// connected
+	local := m.repoFiles["default"].Have(cid.LocalID)
+	for _, node := range []string{"42", "43"} {
+		fc := FakeConnection{id: node}
+		m.AddConnection(fc, fc)
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), local)
+	m.repoFiles["default"].Replace(m.cm.Get("43"), local[1:])
+
+	nodes, err := m.SharingNodes("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SharingNode{
+		{NodeID: "42", Connected: true, Full: true},
+		{NodeID: "43", Connected: true, Full: false},
+		{NodeID: "44", Connected: false, Full: false},
+	}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Incorrect number of nodes %d != %d", len(nodes), len(expected))
+	}
+	for i := range expected {
+		if nodes[i] != expected[i] {
+			t.Errorf("Incorrect sharing node %+v != %+v", nodes[i], expected[i])
+		}
+	}
+	if _, ok := m.cm.Lookup("44"); ok {
+		t.Error("ID assigned to unconnected node")
+	}
+
+	if _, err := m.SharingNodes("other"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
+
+func TestKeepFailedTemps(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	m.cfg.Options.KeepFailedTemps = true
+
+	bad := append([]byte{}, block...)
+	bad[0]++
+	fc := FakeConnection{id: "42", requestData: bad}
+	m.AddConnection(fc, fc)
+
+	sub := events.Default.Subscribe(events.PullVerifyFailed)
+	defer events.Default.Unsubscribe(sub)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	pullFile(t, p, f)
+
+	if _, err := os.Stat(filepath.Join(dir, "foo")); !os.IsNotExist(err) {
+		t.Error("Corrupt file renamed into place")
+	}
+	kept, _ := filepath.Glob(filepath.Join(dir, ".stversions", ".failed", "foo~*"))
+	if len(kept) != 1 {
+		t.Fatalf("Failed temporary file not kept: %v", kept)
+	}
+	data, _ := ioutil.ReadFile(kept[0])
+	if !bytes.Equal(data, bytes.Repeat(bad, 4)) {
+		t.Error("Incorrect contents of kept file")
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := ev.Data.(map[string]interface{})
+	if details["item"] != "foo" || details["block"] != 0 || details["kept"] != kept[0] {
+		t.Errorf("Incorrect event details %v", details)
+	}
+
+	fs, err := m.FailedTransfers("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 || fs[0].Name != "foo" || fs[0].Path != kept[0] || fs[0].Reason != "block 0 does not match its hash" {
+		t.Errorf("Incorrect failed transfers %+v", fs)
+	}
+}
+
+func TestVerifyWorkers(t *testing.T) {
+	for _, corrupt := range []bool{false, true} {
+		dir, m, f, block := setupPull(t)
+		defer os.RemoveAll(dir)
+		m.cfg.Options.VerifyWorkers = 3
+
+		data := block
+		if corrupt {
+			data = append([]byte{}, block...)
+			data[len(data)-1]++
+		}
+		fc := FakeConnection{id: "42", requestData: data}
+		m.AddConnection(fc, fc)
+
+		p := newTestPuller(m, m.repoCfgs["default"])
+		pullFile(t, p, f)
+
+		_, err := os.Stat(filepath.Join(dir, "foo"))
+		if corrupt && !os.IsNotExist(err) {
+			t.Error("Corrupt file renamed into place")
+		}
+		if !corrupt && err != nil {
+			t.Error(err)
+		}
+		if lf := m.CurrentRepoFile("default", "foo"); (lf.Version == f.Version) == corrupt {
+			t.Errorf("Unexpected local version %d, corrupt %v", lf.Version, corrupt)
+		}
+	}
+}
+
+func TestChangedDuringPull(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+
+	sub := events.Default.Subscribe(events.LocalConflict)
+	defer events.Default.Unsubscribe(sub)
+
+	target := filepath.Join(dir, "foo")
+	old := time.Now().Add(-time.Hour)
+	pull := func(edit func()) {
+		p := newTestPuller(m, m.repoCfgs["default"])
+		for i, b := range f.Blocks {
+			if i == 2 {
+				edit()
+			}
+			if p.handleBlock(bqBlock{file: f, block: b, last: i == len(f.Blocks)-1}) {
+				continue
+			}
+			handleResult(t, p)
+		}
+		data, _ := ioutil.ReadFile(target)
+		if !bytes.Equal(data, bytes.Repeat(block, 4)) {
+			t.Error("Pulled file not in place")
+		}
+	}
+
+	// An untouched file is replaced as usual
+	ioutil.WriteFile(target, []byte("old"), 0644)
+	os.Chtimes(target, old, old)
+	pull(func() {})
+	if kept, _ := filepath.Glob(target + ".sync-conflict-*"); len(kept) != 0 {
+		t.Errorf("Unexpected conflict copies %v", kept)
+	}
+
+	// An edit made while the next version is being pulled is kept
+	os.Chtimes(target, old, old)
+	pull(func() {
+		ioutil.WriteFile(target, []byte("edited"), 0644)
+	})
+	kept, _ := filepath.Glob(target + ".sync-conflict-*")
+	if len(kept) != 1 {
+		t.Fatalf("Incorrect conflict copies %v", kept)
+	}
+	if data, _ := ioutil.ReadFile(kept[0]); string(data) != "edited" {
+		t.Errorf("Incorrect contents %q of conflict copy", data)
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details := ev.Data.(map[string]interface{}); details["item"] != "foo" || details["kept"] != kept[0] {
+		t.Errorf("Incorrect event details %v", details)
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	now := time.Date(2014, 5, 1, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct{ in, out string }{
+		{"foo", "foo.sync-conflict-20140501-123000"},
+		{"dir/report.txt", "dir/report.sync-conflict-20140501-123000.txt"},
+	} {
+		if name := conflictName(tc.in, now, ""); name != tc.out {
+			t.Errorf("Incorrect conflict name %q != %q", name, tc.out)
+		}
+	}
+}
+
+func TestConflictNameNode(t *testing.T) {
+	now := time.Date(2014, 5, 1, 12, 30, 0, 0, time.Local)
+	for _, tc := range []struct{ in, node, out string }{
+		{"foo", "I6KAH76-66SLLLB-5PFXSOA", "foo.sync-conflict-20140501-123000-I6KAH76"},
+		{"dir/report.txt", "AB/c:d", "dir/report.sync-conflict-20140501-123000-ABCD.txt"},
+		{"archive.tar.gz", "MFZWI3D", "archive.tar.sync-conflict-20140501-123000-MFZWI3D.gz"},
+	} {
+		name := conflictName(tc.in, now, tc.node)
+		if name != tc.out {
+			t.Errorf("Incorrect conflict name %q != %q", name, tc.out)
+		}
+		orig, ts, node, ok := ParseConflictName(name)
+		if !ok || orig != tc.in || !ts.Equal(now) || node != shortNodeID(tc.node) {
+			t.Errorf("%q parsed as %q, %v, %q, %v", name, orig, ts, node, ok)
+		}
+	}
+
+	// Names without a node ID parse as well
+	if orig, _, node, ok := ParseConflictName("dir/report.sync-conflict-20140501-123000.txt"); !ok || orig != "dir/report.txt" || node != "" {
+		t.Errorf("Incorrectly parsed name without node ID: %q, %q, %v", orig, node, ok)
+	}
+	for _, name := range []string{"report.txt", "report.sync-conflict-2014.txt", "report.sync-conflict-20140501-123000-ab.txt", "report.sync-conflict-20140501-123000x"} {
+		if _, _, _, ok := ParseConflictName(name); ok {
+			t.Errorf("%q parsed as a conflict copy", name)
+		}
+	}
+}
+
+func TestPriorityPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir, PriorityPatterns: []string{"etc/*", "*.conf"}}
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+
+	file := func(name string, version uint64) scanner.File {
+		return scanner.File{Name: filepath.FromSlash(name), Version: version, Size: 100, Blocks: testBlocks(1)}
+	}
+	remote := []scanner.File{file("media1", 1), file("a.conf", 1), file("media2", 1)}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), remote)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	order := func() []string {
+		var names []string
+		for _, b := range p.bq.peek(p.bq.size()) {
+			names = append(names, filepath.ToSlash(b.file.Name))
+		}
+		return names
+	}
+
+	// The order of the needed files within a priority is not defined, so
+	// only the priorities are checked
+	tiers := func(names []string) string {
+		var ts []string
+		for _, name := range names {
+			switch {
+			case strings.HasPrefix(name, "etc/"):
+				ts = append(ts, "etc")
+			case strings.HasSuffix(name, ".conf"):
+				ts = append(ts, "conf")
+			default:
+				ts = append(ts, "other")
+			}
+		}
+		return strings.Join(ts, " ")
+	}
+
+	p.queueNeededBlocks()
+	if o := tiers(order()); o != "conf other other" {
+		t.Errorf("Incorrect order after first cycle: %s", o)
+	}
+
+	// Files found to be needed in a later cycle still go first if they
+	// match, the first pattern before the second
+	remote = append(remote, file("media3", 1), file("b.conf", 1), file("etc/x", 1))
+	m.repoFiles["default"].Replace(m.cm.Get("42"), remote)
+	p.queueNeededBlocks()
+	if o := tiers(order()); o != "etc conf conf other other other" {
+		t.Errorf("Incorrect order after second cycle: %s", o)
+	}
+}
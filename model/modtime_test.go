@@ -0,0 +1,54 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestModTimeWindow(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo")
+	ioutil.WriteFile(path, bytes.Repeat(block, len(f.Blocks)), 0644)
+	mod := time.Unix(f.Modified, 0)
+	os.Chtimes(path, mod, mod)
+	m.ReplaceLocal("default", []scanner.File{f})
+
+	// The other node has the same file with a modification time rounded
+	// by its filesystem.
+	remote := f
+	remote.Version++
+	remote.Modified++
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{remote})
+
+	for _, window := range []int{0, 2} {
+		m.cfg.Options.ModTimeWindowS = window
+		p := newTestPuller(m, m.repoCfgs["default"])
+		p.queueNeededBlocks()
+		time.Sleep(50 * time.Millisecond)
+
+		lf := m.repoFiles["default"].Get(cid.LocalID, "foo")
+		if window == 0 && lf.Version != f.Version {
+			t.Errorf("File with a different modification time taken without a window")
+		}
+		if window == 2 && lf.Version != remote.Version {
+			t.Errorf("Local version %d, expected %d without pulling", lf.Version, remote.Version)
+		}
+	}
+
+	// Nor does the difference show up as a change when scanning
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if lf := m.CurrentRepoFile("default", "foo"); lf.Version != remote.Version || lf.Modified != remote.Modified {
+		t.Errorf("File within the window rescanned: %v", lf)
+	}
+}
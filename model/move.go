@@ -0,0 +1,341 @@
+package model
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/versioner"
+)
+
+var ErrRepoMoving = errors.New("repository is being moved")
+
+// A moveRepoReq moves the repository directory from outside the run loop. The
+// result of the move is sent on done.
+type moveRepoReq struct {
+	dir  string
+	done chan error
+}
+
+// MoveRepo moves the contents of the repository directory to newDir, which
+// must not exist or be empty, and continues with the repository at the new
+// location. The files keep their modification times, so they match the index
+// without being pulled or rehashed. Moves across filesystems are done by
+// copying, syncing and verifying each file before the original directory is
+// removed; if anything fails, the copy is removed and the repository stays
+// where it was. Files being pulled when the move starts are abandoned and
+// pulled again later. The change is not saved to the configuration file. A
+// repository with AtomicSwap can't be moved, nor can a repository be moved
+// into, or around, the directory of another.
+func (m *Model) MoveRepo(repo, newDir string) error {
+	m.rmut.Lock()
+	cfg, ok := m.repoCfgs[repo]
+	if !ok {
+		m.rmut.Unlock()
+		return ErrNoSuchRepo
+	}
+	if m.moving[repo] {
+		m.rmut.Unlock()
+		return ErrRepoMoving
+	}
+	if cfg.AtomicSwap {
+		m.rmut.Unlock()
+		return errSwapMove
+	}
+	newDir = filepath.Clean(newDir)
+	if other := m.overlappingRepo(repo, newDir); other != "" {
+		m.rmut.Unlock()
+		return overlapError(newDir, other)
+	}
+	m.moving[repo] = true
+	p := m.pullers[repo]
+	m.rmut.Unlock()
+
+	defer func() {
+		m.rmut.Lock()
+		delete(m.moving, repo)
+		m.rmut.Unlock()
+	}()
+
+	if p != nil && cap(p.requestSlots) > 0 {
+		// Let the run loop do the move, so that nothing is pulled
+		// meanwhile
+		req := moveRepoReq{dir: newDir, done: make(chan error)}
+		select {
+		case p.moveRepo <- req:
+		case <-p.stopped:
+			return ErrStopped
+		}
+		return <-req.done
+	}
+	return m.relocateRepo(repo, cfg.Directory, newDir)
+}
+
+// relocateRepo moves the repository directory and points the repository at
+// the new location.
+func (m *Model) relocateRepo(repo, oldDir, newDir string) error {
+	l.Infof("Moving repository %q from %q to %q", repo, oldDir, newDir)
+	if err := moveDir(oldDir, newDir); err != nil {
+		l.Warnf("Moving repository %q: %v", repo, err)
+		return err
+	}
+
+	m.rmut.Lock()
+	oldIndex := filepath.Join(m.indexDir, fmt.Sprintf("%x.idx.gz", sha1.Sum([]byte(oldDir))))
+	oldPlaceholders := m.placeholderFile(repo, m.indexDir)
+	oldHashCache := m.hashCacheFile(repo, m.indexDir)
+	cfg := m.repoCfgs[repo]
+	cfg.Directory = newDir
+	m.repoCfgs[repo] = cfg
+	m.rmut.Unlock()
+
+	m.smut.Lock()
+	for i := range m.cfg.Repositories {
+		if cr := &m.cfg.Repositories[i]; cr.ID == repo {
+			cr.Directory = newDir
+		}
+	}
+	m.smut.Unlock()
+
+	// The index, hash cache and placeholders are stored by directory, so save them
+	// under the new name to avoid a rescan from scratch after a restart.
+	m.rmut.RLock()
+	m.saveIndex(repo, m.indexDir, m.protocolIndex(repo))
+	m.rmut.RUnlock()
+	m.savePlaceholders(repo)
+	os.Remove(oldIndex)
+	os.Remove(oldPlaceholders)
+	os.Remove(oldHashCache)
+	return nil
+}
+
+// moveRepoDir carries out a move request in the run loop. Open files are
+// abandoned first, since their paths are about to change.
+func (p *puller) moveRepoDir(dir string) error {
+	p.mut.Lock()
+	p.abandonOpenFiles(ErrRepoMoving)
+	p.mut.Unlock()
+
+	if err := p.model.relocateRepo(p.repoCfg.ID, p.dir, dir); err != nil {
+		return err
+	}
+
+	p.repoCfg.Directory = dir
+	p.dir = dir
+	if p.trash != nil {
+		p.trash = versioner.NewTrash(dir, p.repoCfg.TrashMaxAgeDays, p.repoCfg.TrashMaxSizeMiB)
+	}
+	return nil
+}
+
+// abandonOpenFiles closes the files being pulled and fails them with err,
+// rolling back any in-place updates. Verified files waiting to be renamed
+// are renamed into place and, like those already renamed, recorded in the
+// index first. Must be called with p.mut held.
+func (p *puller) abandonOpenFiles(err error) {
+	p.releaseDirs()
+	if len(p.renameBatch) > 0 {
+		p.flushRenameBatch()
+	}
+	if len(p.syncBatch) > 0 {
+		p.flushSyncBatch()
+	}
+	for name, of := range p.openFiles {
+		if of.err != nil {
+			continue
+		}
+		if of.file != nil {
+			of.flush()
+			of.file.Close()
+			of.file = nil
+		}
+		of.bitmap.close()
+		if of.journal != nil {
+			if err := of.journal.rollback(); err != nil {
+				l.Warnf("Rollback %q: %v", of.filepath, err)
+			}
+			of.journal = nil
+		}
+		of.err = err
+		p.openFiles[name] = of
+	}
+}
+
+// moveDir moves the directory src to dst. If they are on different
+// filesystems, the contents are copied and verified before src is removed.
+func moveDir(src, dst string) error {
+	if fi, err := os.Stat(src); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", src)
+	}
+	if err := removeEmptyDir(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	if err := copyDir(src, dst, nil); err != nil {
+		// Roll back; the original is untouched
+		os.RemoveAll(dst)
+		return err
+	}
+	if err := os.RemoveAll(src); err != nil {
+		// The data is safe at the new location, so go on
+		l.Warnf("Removing %q after copying it to %q: %v", src, dst, err)
+	}
+	return nil
+}
+
+// removeEmptyDir removes dir if it is an empty directory, so that something
+// can be moved in its place. It fails if dir exists and is not empty.
+func removeEmptyDir(dir string) error {
+	fd, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	names, err := fd.Readdirnames(1)
+	fd.Close()
+	if err != io.EOF {
+		if err == nil && len(names) > 0 {
+			err = fmt.Errorf("%s: directory not empty", dir)
+		}
+		return err
+	}
+	return os.Remove(dir)
+}
+
+func isCrossDevice(err error) bool {
+	le, ok := err.(*os.LinkError)
+	return ok && le.Err == syscall.EXDEV
+}
+
+// copyDir copies the tree at src to dst, keeping modes and modification
+// times. Each file is synced and compared to the original after copying.
+// Entries for which skip returns true are left out, along with their
+// contents.
+func copyDir(src, dst string, skip func(rel string, info os.FileInfo) bool) error {
+	type dirTime struct {
+		path string
+		mod  time.Time
+	}
+	var dirs []dirTime
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if skip != nil && rel != "." && skip(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()|0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{target, info.ModTime()})
+			return nil
+
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info)
+
+		default:
+			// Devices, sockets and the like are not synced anyway
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directory times change as their contents are created, so they are
+	// set last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mod, dirs[i].mod)
+		if err := osutil.SyncDir(dirs[i].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to dst and verifies the copy.
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	srcHash := sha256.New()
+	_, err = io.Copy(out, io.TeeReader(in, srcHash))
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := verifyCopy(dst, srcHash); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// verifyCopy reads back the copy at path and compares it to the hash of the
+// original.
+func verifyCopy(path string, srcHash hash.Hash) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	dstHash := sha256.New()
+	if _, err := io.Copy(dstHash, fd); err != nil {
+		return err
+	}
+	if !bytes.Equal(srcHash.Sum(nil), dstHash.Sum(nil)) {
+		return fmt.Errorf("%s: copy does not match the original", path)
+	}
+	return nil
+}
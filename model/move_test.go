@@ -0,0 +1,129 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMoveRepo(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	newDir := dir + "-moved"
+	defer os.RemoveAll(newDir)
+
+	before := m.CurrentRepoFile("default", "f")
+	if err := m.MoveRepo("default", newDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Old directory remains after move")
+	}
+	if _, err := os.Stat(filepath.Join(newDir, "a", "b", "c")); err != nil {
+		t.Error(err)
+	}
+	if d := m.repoCfgs["default"].Directory; d != newDir {
+		t.Errorf("Incorrect directory %q != %q", d, newDir)
+	}
+
+	// The moved files match the index
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if after := m.CurrentRepoFile("default", "f"); after.Version != before.Version {
+		t.Errorf("File changed by move, version %d != %d", after.Version, before.Version)
+	}
+}
+
+func TestMoveRepoNotEmpty(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	newDir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(newDir)
+	ioutil.WriteFile(filepath.Join(newDir, "other"), []byte("other"), 0644)
+
+	if err := m.MoveRepo("default", newDir); err == nil {
+		t.Fatal("Unexpected nil error moving to a non-empty directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f")); err != nil {
+		t.Error(err)
+	}
+	if d := m.repoCfgs["default"].Directory; d != dir {
+		t.Errorf("Directory changed after failed move, %q != %q", d, dir)
+	}
+}
+
+func TestMoveRepoRunning(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	newDir := dir + "-moved"
+	defer os.RemoveAll(newDir)
+
+	m.StartRepoRW("default", 1)
+	if err := m.MoveRepo("default", newDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(newDir, "f")); err != nil {
+		t.Error(err)
+	}
+	if err := m.ScanRepo("default"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst := src + "-copy"
+	defer os.RemoveAll(dst)
+
+	mod := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.MkdirAll(filepath.Join(src, "a", "b"), 0755)
+	for _, name := range []string{"f", "a/g", "a/b/h"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(path, []byte(name), 0640); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mod, mod)
+	}
+	os.Chtimes(filepath.Join(src, "a"), mod, mod)
+
+	if err := copyDir(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"f", "a/g", "a/b/h"} {
+		path := filepath.Join(dst, filepath.FromSlash(name))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != name {
+			t.Errorf("Incorrect contents of %q: %q", name, data)
+		}
+		info, _ := os.Stat(path)
+		if !info.ModTime().Equal(mod) {
+			t.Errorf("Incorrect modification time of %q: %v != %v", name, info.ModTime(), mod)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Errorf("Incorrect mode of %q: %o", name, info.Mode().Perm())
+		}
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "a")); !info.ModTime().Equal(mod) {
+		t.Errorf("Incorrect directory modification time: %v != %v", info.ModTime(), mod)
+	}
+
+	// Copying onto an existing tree fails
+	if err := copyDir(src, dst, nil); err == nil {
+		t.Error("Unexpected nil error copying to an existing directory")
+	}
+}
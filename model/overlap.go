@@ -0,0 +1,73 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Two repositories in the same directory, or one within the other, each see
+// the changes the other makes as local changes and keep syncing them back
+// and forth. A repository is not added, or moved, where it would overlap
+// with another.
+
+// overlapError returns the error for the repository directory dir
+// overlapping with the repository other.
+func overlapError(dir, other string) error {
+	return fmt.Errorf("directory %q overlaps with that of repository %q", dir, other)
+}
+
+// overlappingRepo returns the ID of a repository other than repo whose
+// directory is the same as dir, contains it or is contained by it, or the
+// empty string if there is none. Must be called with rmut held.
+func (m *Model) overlappingRepo(repo, dir string) string {
+	ids := make([]string, 0, len(m.repoCfgs))
+	for id := range m.repoCfgs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	dir = realDir(dir)
+	for _, id := range ids {
+		if id != repo && dirsOverlap(dir, realDir(workDir(m.repoCfgs[id]))) {
+			return id
+		}
+	}
+	return ""
+}
+
+// realDir returns the absolute path of dir with symbolic links resolved, as
+// far as it exists.
+func realDir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	var rest []string
+	for d := dir; ; {
+		if real, err := filepath.EvalSymlinks(d); err == nil {
+			return filepath.Join(append([]string{real}, rest...)...)
+		} else if !os.IsNotExist(err) {
+			return dir
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		rest = append([]string{filepath.Base(d)}, rest...)
+		d = parent
+	}
+}
+
+// dirsOverlap returns true if the clean paths a and b are the same directory
+// or one is within the other.
+func dirsOverlap(a, b string) bool {
+	return a == b || within(a, b) || within(b, a)
+}
+
+// within returns true if path is below dir.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+)
+
+func TestDirsOverlap(t *testing.T) {
+	sep := string(filepath.Separator)
+	var cases = []struct {
+		a, b    string
+		overlap bool
+	}{
+		{sep + "a", sep + "a", true},
+		{sep + "a", filepath.Join(sep, "a", "b"), true},
+		{filepath.Join(sep, "a", "b", "c"), sep + "a", true},
+		{sep + "a", sep + "ab", false},
+		{filepath.Join(sep, "a", "b"), filepath.Join(sep, "a", "c"), false},
+		{filepath.Join(sep, "a", "..b"), filepath.Join(sep, "a"), true},
+	}
+	for i, tc := range cases {
+		if o := dirsOverlap(tc.a, tc.b); o != tc.overlap {
+			t.Errorf("%d: dirsOverlap(%q, %q) = %v", i, tc.a, tc.b, o)
+		}
+	}
+}
+
+// setupOverlap returns a model with the repository "default" in a temporary
+// directory, which is also returned.
+func setupOverlap(t *testing.T) (*Model, string) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Configuration{Repositories: []config.RepositoryConfiguration{
+		{ID: "default", Directory: filepath.Join(dir, "repo")},
+		{ID: "other"},
+	}}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(cfg.Repositories[0])
+	return m, dir
+}
+
+func TestAddRepoOverlap(t *testing.T) {
+	m, dir := setupOverlap(t)
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "repo"), 0755)
+	os.Symlink("repo", filepath.Join(dir, "link"))
+
+	for _, other := range []string{
+		filepath.Join(dir, "repo"),
+		filepath.Join(dir, "repo") + string(filepath.Separator),
+		filepath.Join(dir, "repo", "sub"),
+		dir,
+		filepath.Join(dir, "link"),
+		filepath.Join(dir, "link", "sub"),
+	} {
+		m.cfg.Repositories[1].Invalid = ""
+		m.AddRepo(config.RepositoryConfiguration{ID: "other", Directory: other})
+		if _, ok := m.repoCfgs["other"]; ok {
+			t.Fatalf("Repository in %q added", other)
+		}
+		if m.cfg.Repositories[1].Invalid == "" {
+			t.Errorf("Repository in %q not marked invalid", other)
+		}
+	}
+
+	m.AddRepo(config.RepositoryConfiguration{ID: "other", Directory: filepath.Join(dir, "repo2")})
+	if _, ok := m.repoCfgs["other"]; !ok {
+		t.Error("Repository next to the other not added")
+	}
+}
+
+func TestMoveRepoOverlap(t *testing.T) {
+	m, dir := setupOverlap(t)
+	defer os.RemoveAll(dir)
+	m.AddRepo(config.RepositoryConfiguration{ID: "other", Directory: filepath.Join(dir, "other")})
+	os.Mkdir(filepath.Join(dir, "repo"), 0755)
+
+	for _, newDir := range []string{filepath.Join(dir, "repo", "sub"), dir} {
+		if err := m.MoveRepo("other", newDir); err == nil {
+			t.Errorf("Unexpected nil error moving to %q", newDir)
+		}
+	}
+	cfg := m.repoCfgs["other"]
+	cfg.Directory = filepath.Join(dir, "repo", "sub")
+	if err := m.UpdateRepoConfig(cfg); err == nil {
+		t.Error("Unexpected nil error updating to an overlapping directory")
+	}
+	if d := m.repoCfgs["other"].Directory; d != filepath.Join(dir, "other") {
+		t.Errorf("Directory changed to %q", d)
+	}
+}
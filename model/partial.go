@@ -0,0 +1,219 @@
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// Nodes that send and accept availability announcements for files they are
+// still pulling announce this option in their cluster config.
+const partialOption = "partial"
+
+// The blocks held of a file being pulled are announced at most this often.
+var partialAnnounceInterval = 10 * time.Second
+
+// A partialFile holds the blocks a node has of a file it is still pulling.
+type partialFile struct {
+	version uint64
+	blocks  []byte // bitmap, one bit per block
+}
+
+func hasBlock(bits []byte, i int) bool {
+	return i >= 0 && i/8 < len(bits) && bits[i/8]&(1<<uint(i%8)) != 0
+}
+
+// Availability records which blocks of a file the node holds while it is
+// still pulling it. An empty bitmap withdraws an earlier announcement.
+// Implements the protocol.Model interface.
+func (m *Model) Availability(nodeID, repo, name string, version uint64, blocks []byte) {
+	m.rmut.RLock()
+	shared := m.sharedWith(repo, nodeID)
+	m.rmut.RUnlock()
+
+	if !shared {
+		l.Warnf("Availability from %s for unshared repo %q", nodeID, repo)
+		return
+	}
+
+	if debug {
+		l.Debugf("AVAIL(in): %s: %q / %q v=%d %d bytes", nodeID, repo, name, version, len(blocks))
+	}
+
+	m.pamut.Lock()
+	defer m.pamut.Unlock()
+
+	if len(blocks) == 0 {
+		m.forgetPartialLocked(nodeID, repo, name)
+		return
+	}
+	names, ok := m.partials[repo]
+	if !ok {
+		names = make(map[string]map[string]partialFile)
+		m.partials[repo] = names
+	}
+	nodes, ok := names[name]
+	if !ok {
+		nodes = make(map[string]partialFile)
+		names[name] = nodes
+	}
+	nodes[nodeID] = partialFile{version, blocks}
+}
+
+// partialAvailability returns the availability bitset of the nodes that have
+// announced block i of the given version of the file as held while pulling
+// it.
+func (m *Model) partialAvailability(repo, name string, version uint64, i int) uint64 {
+	m.pamut.RLock()
+	defer m.pamut.RUnlock()
+
+	var avail uint64
+	for node, pf := range m.partials[repo][name] {
+		if pf.version == version && hasBlock(pf.blocks, i) {
+			avail |= 1 << uint(m.cm.Get(node))
+		}
+	}
+	return avail
+}
+
+// forgetPartial drops the node's announcement for the file.
+func (m *Model) forgetPartial(node, repo, name string) {
+	m.pamut.Lock()
+	m.forgetPartialLocked(node, repo, name)
+	m.pamut.Unlock()
+}
+
+func (m *Model) forgetPartialLocked(node, repo, name string) {
+	nodes := m.partials[repo][name]
+	delete(nodes, node)
+	if len(nodes) == 0 {
+		delete(m.partials[repo], name)
+	}
+}
+
+// dropPartials drops the node's announcements for the files it now has in
+// its index.
+func (m *Model) dropPartials(node, repo string, fs []scanner.File) {
+	m.pamut.Lock()
+	if len(m.partials[repo]) > 0 {
+		for _, f := range fs {
+			m.forgetPartialLocked(node, repo, f.Name)
+		}
+	}
+	m.pamut.Unlock()
+}
+
+// dropNodePartials drops all announcements made by the node.
+func (m *Model) dropNodePartials(node string) {
+	m.pamut.Lock()
+	for repo, names := range m.partials {
+		for name := range names {
+			m.forgetPartialLocked(node, repo, name)
+		}
+	}
+	m.pamut.Unlock()
+}
+
+// announcePartial sends the bitmap of the blocks we hold of a file being
+// pulled to the connected nodes sharing the repo that accept it.
+func (m *Model) announcePartial(repo, name string, version uint64, blocks []byte) {
+	m.rmut.RLock()
+	nodes := m.repoNodes[repo]
+	m.rmut.RUnlock()
+
+	var conns []protocol.Connection
+	m.pmut.RLock()
+	for _, node := range nodes {
+		if nc, ok := m.protoConn[node]; ok && m.nodePartial[node] {
+			conns = append(conns, nc)
+		}
+	}
+	m.pmut.RUnlock()
+	if len(conns) == 0 {
+		return
+	}
+
+	if debug {
+		l.Debugf("AVAIL(out): %q / %q v=%d to %d nodes", repo, name, version, len(conns))
+	}
+	blocks = append([]byte(nil), blocks...)
+	for _, nc := range conns {
+		go nc.Availability(repo, name, version, blocks)
+	}
+}
+
+// partialBlock returns the requested block from the temporary file of a
+// file being pulled, if it has been written there.
+func (m *Model) partialBlock(repo, name string, offset int64, size int) ([]byte, bool) {
+	m.rmut.RLock()
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+	if p == nil {
+		return nil, false
+	}
+	return p.readPartial(name, offset, size)
+}
+
+// readPartial reads a block that has reached the temporary file of the named
+// file from it.
+func (p *puller) readPartial(name string, offset int64, size int) ([]byte, bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	of, ok := p.openFiles[name]
+	if !ok || of.err != nil || of.file == nil || of.bitmap == nil || of.blocks == nil {
+		return nil, false
+	}
+	i := blockIndex(of.blocks, offset)
+	if !of.bitmap.has(i) || int(of.blocks[i].Size) != size {
+		return nil, false
+	}
+	buf := make([]byte, size)
+	if _, err := of.file.ReadAt(buf, offset); err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+// announceWritten announces the blocks we hold of a file being pulled, if it
+// is large enough to keep a bitmap and the last announcement is old enough.
+func (p *puller) announceWritten(of *openFile, f scanner.File) {
+	if of.bitmap == nil || of.bitmap.fd == nil || time.Since(of.announced) < partialAnnounceInterval {
+		return
+	}
+	of.announced = time.Now()
+	p.model.announcePartial(p.repoCfg.ID, f.Name, f.Version, of.bitmap.bits)
+}
+
+// checkPartialBlock verifies a block received from a node that only had
+// part of the file. The hashes of those blocks haven't been checked by
+// anyone, so a bad one is caught here instead of when the file is closed,
+// and requested from another node. Returns true if the block was rejected.
+func (p *puller) checkPartialBlock(of *openFile, res requestResult) bool {
+	if of.err != nil || res.err != nil || !res.partial {
+		return false
+	}
+	i := blockIndex(res.file.Blocks, res.offset)
+	if i >= 0 {
+		if h := sha256.Sum256(res.data); bytes.Equal(h[:], res.file.Blocks[i].Hash) {
+			return false
+		}
+	}
+
+	if debug {
+		l.Debugf("pull: %q / %q offset %d from %q: bad block from partial source", p.repoCfg.ID, res.file.Name, res.offset, res.node)
+	}
+	p.model.forgetPartial(res.node, p.repoCfg.ID, res.file.Name)
+	p.rejectBlock(of, res)
+	return true
+}
+
+// isPartialSource returns true if the node was picked for the block on the
+// strength of an availability announcement rather than its index.
+func isPartialSource(of openFile, node string, cm *cid.Map) bool {
+	return of.availability&(1<<uint(cm.Get(node))) == 0
+}
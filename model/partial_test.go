@@ -0,0 +1,163 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// availConnection records the availability announcements sent to it.
+type availConnection struct {
+	FakeConnection
+	announced chan []byte
+}
+
+func (c availConnection) Availability(repo, name string, version uint64, blocks []byte) {
+	c.announced <- blocks
+}
+
+func TestPartialSource(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	// Node 42 is still pulling the file and has blocks 0 and 2
+	m.repoNodes["default"] = []string{"42"}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), nil)
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: block}, &requests}
+	m.AddConnection(fc, fc)
+	m.Availability("42", "default", "foo", f.Version, []byte{0x05})
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	if p.handleBlock(bqBlock{file: f, block: f.Blocks[0]}) {
+		t.Fatal("Block held by partial source not requested")
+	}
+	select {
+	case res := <-p.requestResults:
+		if res.node != "42" || !res.partial {
+			t.Errorf("Incorrect source %q, partial %v", res.node, res.partial)
+		}
+		p.handleRequestResult(res)
+	case <-time.After(time.Second):
+		t.Fatal("No request result")
+	}
+	if err := p.openFiles["foo"].err; err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody has block 1
+	p.handleBlock(bqBlock{file: f, block: f.Blocks[1]})
+	if requests != 1 {
+		t.Errorf("Incorrect number of requests %d != 1", requests)
+	}
+	if err := p.openFiles["foo"].err; err != errNoNode {
+		t.Errorf("Unexpected error %v != %v", err, errNoNode)
+	}
+
+	// Announcements for other versions are ignored
+	m.Availability("42", "default", "foo", f.Version-1, []byte{0x05})
+	if avail := m.partialAvailability("default", "foo", f.Version, 0); avail != 0 {
+		t.Errorf("Unexpected availability %b for other version", avail)
+	}
+}
+
+func TestPartialSourceMismatch(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	// Node 42 is still pulling the file and sends a bad block, 43 has all
+	// of it
+	m.repoNodes["default"] = []string{"42", "43"}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), nil)
+	m.repoFiles["default"].Replace(m.cm.Get("43"), []scanner.File{f})
+	bad := append([]byte{}, block...)
+	bad[0]++
+	fc := FakeConnection{id: "42", requestData: bad}
+	m.AddConnection(fc, fc)
+	good := FakeConnection{id: "43", requestData: block}
+	m.AddConnection(good, good)
+	m.Availability("42", "default", "foo", f.Version, []byte{0x01})
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	// The full holder is busy, so the block is requested from 42
+	p.oustandingPerNode["43"] = 5
+	p.handleBlock(bqBlock{file: f, block: f.Blocks[0]})
+	handleResult(t, p)
+	if err := p.openFiles["foo"].err; err != nil {
+		t.Fatalf("File failed after bad block: %v", err)
+	}
+	if avail := m.partialAvailability("default", "foo", f.Version, 0); avail != 0 {
+		t.Error("Announcement not forgotten after bad block")
+	}
+
+	// The rest of the file comes from the full holder, and so does the bad
+	// block when requested again
+	p.oustandingPerNode["43"] = 0
+	for i, b := range f.Blocks[1:] {
+		p.handleBlock(bqBlock{file: f, block: b, last: i == len(f.Blocks)-2})
+		handleResult(t, p)
+	}
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	b := p.bq.get()
+	if b.block.Offset != 0 || !b.repair {
+		t.Fatalf("Bad block not queued again: %v", b)
+	}
+	p.handleBlock(b)
+	handleResult(t, p)
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("File not closed")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "foo")); !bytes.Equal(data, bytes.Repeat(block, len(f.Blocks))) {
+		t.Error("Incorrect file contents after requesting the bad block again")
+	}
+}
+
+func TestServePartial(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	m.repoNodes["default"] = []string{"42"}
+	fc := availConnection{FakeConnection{id: "42", requestData: block}, make(chan []byte, 1)}
+	m.AddConnection(fc, fc)
+	m.ClusterConfig("42", m.clusterConfig("42"))
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	m.pullers["default"] = p
+	p.handleBlock(bqBlock{file: f, block: f.Blocks[0]})
+	handleResult(t, p)
+	of := p.openFiles["foo"]
+	defer of.file.Close()
+	defer of.bitmap.close()
+
+	select {
+	case bits := <-fc.announced:
+		if !bytes.Equal(bits, []byte{0x01}) {
+			t.Errorf("Incorrect bitmap %x announced", bits)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Written block not announced")
+	}
+
+	// The written block is served from the temporary file, the rest not
+	data, err := m.Request("43", "default", "foo", 0, len(block))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, block) {
+		t.Error("Incorrect data served from partial file")
+	}
+	if _, err := m.Request("43", "default", "foo", f.Blocks[1].Offset, len(block)); err == nil {
+		t.Error("Unexpected nil error for block not yet pulled")
+	}
+}
@@ -0,0 +1,245 @@
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// In metadata only repositories, files that we don't have are created as
+// placeholders: sparse files of the right size, modification time and
+// permissions, but without content. The content is pulled when requested by
+// Hydrate. Placeholders are not recorded in the local index, so the files
+// remain needed, and are skipped by the scanner as long as they are
+// untouched.
+
+// A placeholder records the metadata a placeholder file was created with.
+type placeholder struct {
+	Version  uint64
+	Modified int64
+	Size     int64
+	hydrate  bool // content has been requested
+}
+
+var ErrNotPlaceholder = errors.New("file is not a placeholder")
+
+// isPlaceholder returns true if the named file is an untouched placeholder.
+// A placeholder that has been modified since it was created is forgotten, so
+// that it is scanned as a regular file.
+func (m *Model) isPlaceholder(repo, name string, info os.FileInfo) bool {
+	m.phmut.Lock()
+	defer m.phmut.Unlock()
+
+	ph, ok := m.placeholders[repo][name]
+	if !ok {
+		return false
+	}
+	if !scanner.ModTimeEqual(info.ModTime().Unix(), ph.Modified, m.modTimeWindow()) || info.Size() != ph.Size {
+		delete(m.placeholders[repo], name)
+		return false
+	}
+	return true
+}
+
+// placeholderState returns whether the named file is a placeholder and
+// whether its content has been requested.
+func (m *Model) placeholderState(repo, name string) (ok, hydrate bool) {
+	m.phmut.Lock()
+	ph, ok := m.placeholders[repo][name]
+	m.phmut.Unlock()
+	return ok, ph.hydrate
+}
+
+func (m *Model) setPlaceholder(repo string, f scanner.File) {
+	m.phmut.Lock()
+	if m.placeholders[repo] == nil {
+		m.placeholders[repo] = make(map[string]placeholder)
+	}
+	m.placeholders[repo][f.Name] = placeholder{
+		Version:  f.Version,
+		Modified: f.Modified,
+		Size:     f.Size,
+	}
+	m.phmut.Unlock()
+}
+
+// hydrated forgets the placeholder for the named file, if there is one, once
+// the file has been recorded in the local index.
+func (m *Model) hydrated(repo, name string) {
+	m.phmut.Lock()
+	_, ok := m.placeholders[repo][name]
+	delete(m.placeholders[repo], name)
+	m.phmut.Unlock()
+
+	if ok {
+		m.savePlaceholders(repo)
+	}
+}
+
+// Hydrate requests the content of a placeholder file to be pulled.
+func (m *Model) Hydrate(repo, name string) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+
+	m.phmut.Lock()
+	ph, ok := m.placeholders[repo][name]
+	if ok {
+		ph.hydrate = true
+		m.placeholders[repo][name] = ph
+	}
+	m.phmut.Unlock()
+
+	if !ok {
+		return ErrNotPlaceholder
+	}
+	return nil
+}
+
+// placeholderFile returns the name of the file holding the placeholders for
+// the repo in the given directory. Must be called with rmut held.
+func (m *Model) placeholderFile(repo, dir string) string {
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoCfgs[repo].Directory)))
+	return filepath.Join(dir, id+".placeholders")
+}
+
+// savePlaceholders saves the set of placeholders for the repo next to the
+// index, so that they are still recognized as such after a restart.
+func (m *Model) savePlaceholders(repo string) {
+	m.rmut.RLock()
+	name := m.placeholderFile(repo, m.indexDir)
+	m.rmut.RUnlock()
+
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return
+	}
+	m.phmut.Lock()
+	err = json.NewEncoder(fd).Encode(m.placeholders[repo])
+	m.phmut.Unlock()
+	fd.Close()
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return
+	}
+	osutil.Rename(name+".tmp", name)
+}
+
+// loadPlaceholders loads the set of placeholders saved for the repo. Must be
+// called with rmut held.
+func (m *Model) loadPlaceholders(repo, dir string) {
+	fd, err := os.Open(m.placeholderFile(repo, dir))
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	var phs map[string]placeholder
+	if err := json.NewDecoder(fd).Decode(&phs); err != nil {
+		return
+	}
+	m.phmut.Lock()
+	m.placeholders[repo] = phs
+	m.phmut.Unlock()
+}
+
+// needsPlaceholder returns true if a placeholder should be created for the
+// needed file f instead of pulling its content. We never replace content we
+// already have with a placeholder.
+func (p *puller) needsPlaceholder(f scanner.File) bool {
+	if !p.repoCfg.MetadataOnly || protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) || f.Size == 0 {
+		return false
+	}
+	if ok, _ := p.model.placeholderState(p.repoCfg.ID, f.Name); ok {
+		return true
+	}
+	lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+	return lf.Name != f.Name || protocol.IsDeleted(lf.Flags)
+}
+
+// createPlaceholder creates a placeholder file with the metadata of f.
+func (p *puller) createPlaceholder(f scanner.File) error {
+	path := filepath.Join(p.dir, f.Name)
+	temp := filepath.Join(p.dir, defTempNamer.TempName(f.Name))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	os.Remove(temp)
+	fd, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, p.tempFileMode(f))
+	if err != nil {
+		return err
+	}
+	err = fd.Truncate(f.Size)
+	fd.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	t := time.Unix(f.Modified, 0)
+	if err := os.Chtimes(temp, t, t); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if !p.repoCfg.IgnoresPerms() && protocol.HasPermissionBits(f.Flags) {
+		if err := os.Chmod(temp, scanner.FileMode(f.Flags, p.repoCfg.SpecialPermBits)); err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+
+	if err := osutil.Rename(temp, path); err != nil {
+		return err
+	}
+	p.model.setPlaceholder(p.repoCfg.ID, f)
+	return nil
+}
+
+// queuePlaceholder handles a needed file in a metadata only repo. It returns
+// true if the content of the file was queued for pulling, because it has been
+// requested by Hydrate. Otherwise a placeholder is created or updated as
+// necessary.
+func (p *puller) queuePlaceholder(f scanner.File) bool {
+	ok, hydrate := p.model.placeholderState(p.repoCfg.ID, f.Name)
+	if hydrate {
+		// The placeholder has no content to copy from, so all the blocks
+		// are fetched.
+		p.bq.put(bqAdd{
+			file:     f,
+			need:     f.Blocks,
+			priority: filePriority(p.repoCfg.PriorityPatterns, f.Name),
+		})
+		return true
+	}
+
+	if ok {
+		info, err := os.Stat(filepath.Join(p.dir, f.Name))
+		if err == nil && info.Size() == f.Size && scanner.ModTimeEqual(info.ModTime().Unix(), f.Modified, p.model.modTimeWindow()) {
+			// Already up to date
+			p.model.setPlaceholder(p.repoCfg.ID, f)
+			return false
+		}
+	}
+
+	if err := p.createPlaceholder(f); err != nil {
+		if debug {
+			l.Debugf("pull: placeholder: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		}
+	} else if debug {
+		l.Debugf("pull: created placeholder for %q / %q", p.repoCfg.ID, f.Name)
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package model
+
+import "errors"
+
+var ErrNotPulling = errors.New("file is not being pulled")
+
+// A BlockProgress describes which blocks of a file being pulled are
+// complete, i.e. have been written out to the temporary file. The complete
+// blocks are given as runs of consecutive block indexes.
+type BlockProgress struct {
+	Version  uint64 // the version being pulled
+	Blocks   int    // the number of blocks in the file
+	Complete int    // the number of complete blocks
+	Ranges   []BlockRange
+	Error    string // why the pull of the file failed, if it did
+}
+
+// A BlockRange is Count consecutive blocks starting with block First.
+type BlockRange struct {
+	First int
+	Count int
+}
+
+// FileBlockProgress returns which blocks of the named file have been pulled
+// so far, if the file is being pulled.
+func (m *Model) FileBlockProgress(repo, name string) (BlockProgress, error) {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return BlockProgress{}, ErrNoSuchRepo
+	}
+	if p == nil {
+		return BlockProgress{}, ErrNotPulling
+	}
+	return p.blockProgress(name)
+}
+
+func (p *puller) blockProgress(name string) (BlockProgress, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	of, ok := p.openFiles[name]
+	if !ok || of.complete == nil {
+		return BlockProgress{}, ErrNotPulling
+	}
+	bp := BlockProgress{
+		Version: of.version,
+		Blocks:  len(of.blocks),
+		Ranges:  blockRanges(of.complete, len(of.blocks)),
+	}
+	for _, r := range bp.Ranges {
+		bp.Complete += r.Count
+	}
+	if of.err != nil {
+		bp.Error = of.err.Error()
+	}
+	return bp, nil
+}
+
+// blockRanges returns the runs of set bits among the first n bits.
+func blockRanges(bits []byte, n int) []BlockRange {
+	var rs []BlockRange
+	for i := 0; i < n; i++ {
+		if !hasBlock(bits, i) {
+			continue
+		}
+		if k := len(rs) - 1; k >= 0 && rs[k].First+rs[k].Count == i {
+			rs[k].Count++
+		} else {
+			rs = append(rs, BlockRange{First: i, Count: 1})
+		}
+	}
+	return rs
+}
+
+func setBlock(bits []byte, i int) {
+	if i >= 0 && i/8 < len(bits) {
+		bits[i/8] |= 1 << uint(i%8)
+	}
+}
+
+func clearBlock(bits []byte, i int) {
+	if i >= 0 && i/8 < len(bits) {
+		bits[i/8] &^= 1 << uint(i%8)
+	}
+}
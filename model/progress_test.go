@@ -0,0 +1,55 @@
+package model
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBlockRanges(t *testing.T) {
+	bits := []byte{0xb7, 0x81} // blocks 0-2, 4-5, 7-8 and 15
+	exp := []BlockRange{{0, 3}, {4, 2}, {7, 2}, {15, 1}}
+	if rs := blockRanges(bits, 16); !reflect.DeepEqual(rs, exp) {
+		t.Errorf("Incorrect ranges %v, expected %v", rs, exp)
+	}
+	if rs := blockRanges(bits, 7); !reflect.DeepEqual(rs, exp[:2]) {
+		t.Errorf("Incorrect ranges %v beyond the last block", rs)
+	}
+}
+
+func TestFileBlockProgress(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	m.pullers["default"] = p
+	if _, err := m.FileBlockProgress("default", "foo"); err != ErrNotPulling {
+		t.Errorf("Unexpected error %v before pulling", err)
+	}
+
+	for _, i := range []int{0, 1, 3} {
+		p.handleBlock(bqBlock{file: f, block: f.Blocks[i]})
+		handleResult(t, p)
+	}
+
+	bp, err := m.FileBlockProgress("default", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := BlockProgress{
+		Version:  f.Version,
+		Blocks:   len(f.Blocks),
+		Complete: 3,
+		Ranges:   []BlockRange{{0, 2}, {3, 1}},
+	}
+	if !reflect.DeepEqual(bp, exp) {
+		t.Errorf("Incorrect progress %+v, expected %+v", bp, exp)
+	}
+
+	if _, err := m.FileBlockProgress("nonexistent", "foo"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v for unknown repository", err)
+	}
+}
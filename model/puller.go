@@ -2,14 +2,22 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/calmh/syncthing/buffers"
 	"github.com/calmh/syncthing/cid"
 	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
@@ -21,39 +29,124 @@ type requestResult struct {
 	file     scanner.File
 	filepath string // full filepath name
 	offset   int64
+	block    scanner.Block // the block requested, which the data must hash to
 	data     []byte
 	err      error
+	version  uint64 // version of the file announced by the node when the data arrived
+	partial  bool   // the node only announced having this block of a file it is still pulling
+	reserved int64  // bytes reserved in the write backlog for the block
+	extra    bool   // requested along with another block, holding no request slot
 }
 
 type openFile struct {
-	filepath     string // full filepath name
-	temp         string // temporary filename
-	availability uint64 // availability bitset
+	filepath     string          // full filepath name
+	temp         string          // temporary filename
+	availability uint64          // availability bitset
+	version      uint64          // version of the file being pulled
+	blocks       []scanner.Block // blocks of the version being pulled
+	srcVersion   uint64          // version announced by the source of the first received block
+	badSources   uint64          // nodes that sent blocks not matching their hashes, not asked again
 	file         *os.File
-	err          error // error when opening or writing to file, all following operations are cancelled
-	outstanding  int   // number of requests we still have outstanding
-	done         bool  // we have sent all requests for this file
+	wb           *writeBuffer    // coalesces writes to file, if enabled
+	cz           *compressedTemp // compresses writes to file, if enabled
+	journal      *journal        // set when updating the existing file in place
+	bitmap       *blockBitmap    // blocks written to the temporary file, for resuming after a restart
+	complete     []byte          // blocks written to the temporary file or its write buffer, one bit per block
+	err          error           // error when opening or writing to file, all following operations are cancelled
+	outstanding  int             // number of requests and copies we still have outstanding
+	done         bool            // we have sent all requests for this file
+	closeEmpty   bool            // the final block had nothing to fetch and waits for the copies
+	announced    time.Time       // when the blocks we hold were last announced to other nodes
+	verified     time.Time       // when written blocks were last read back and checked
+	verifyNext   int             // the block to check next
+	targetMod    time.Time       // modification time of the file being replaced when the pull started, zero if there was none
+	targetSize   int64           // size of the file being replaced when the pull started
+	tempSize     int64           // size of the temporary file once complete, counted against MaxTempBytes
+}
+
+// writeAt writes to the temporary file, via the write buffer if there is one.
+func (of openFile) writeAt(p []byte, off int64) error {
+	var err error
+	if of.cz != nil {
+		_, err = of.cz.WriteAt(p, off)
+	} else if of.wb != nil {
+		_, err = of.wb.WriteAt(p, off)
+	} else {
+		_, err = of.file.WriteAt(p, off)
+	}
+	return err
+}
+
+// flush writes any buffered data to the temporary file.
+func (of openFile) flush() error {
+	if of.wb != nil {
+		return of.wb.Flush()
+	}
+	return nil
 }
 
 type activityMap map[string]int
 
-func (m activityMap) leastBusyNode(availability uint64, cm *cid.Map) string {
+// nodePrefs holds the source node preferences for a repository.
+type nodePrefs struct {
+	lastResort map[string]bool // only used when no other node has the block
+	denied     map[string]bool // never used
+	lanWeight  int             // outstanding requests by which LAN nodes are favoured
+	isLAN      func(node string) bool
+	ramp       *requestRamp // limits the outstanding requests per node, if set
+}
+
+func newNodePrefs(cfg config.RepositoryConfiguration) nodePrefs {
+	p := nodePrefs{
+		lastResort: make(map[string]bool, len(cfg.LastResortNodes)),
+		denied:     make(map[string]bool, len(cfg.DeniedNodes)),
+	}
+	for _, node := range cfg.LastResortNodes {
+		p.lastResort[node] = true
+	}
+	for _, node := range cfg.DeniedNodes {
+		p.denied[node] = true
+	}
+	return p
+}
+
+// leastBusyNode returns the least busy node among those in the availability
+// set, taking the node preferences into account. Last resort nodes are only
+// selected when no other node is available and denied nodes are never
+// selected. Nodes that are not on the LAN count as busier by the LAN weight.
+// Returns the empty string when there is no suitable node.
+func (m activityMap) leastBusyNode(availability uint64, cm *cid.Map, prefs nodePrefs) string {
 	var low int = 2<<30 - 1
 	var selected string
+	var lowLastResort int = 2<<30 - 1
+	var selectedLastResort string
 	for _, node := range cm.Names() {
 		id := cm.Get(node)
-		if id == cid.LocalID {
+		if id == cid.LocalID || prefs.denied[node] || prefs.ramp.full(node, m[node]) {
 			continue
 		}
 		usage := m[node]
+		if prefs.lanWeight > 0 && prefs.isLAN != nil && !prefs.isLAN(node) {
+			usage += prefs.lanWeight
+		}
 		if availability&(1<<id) != 0 {
-			if usage < low {
+			if prefs.lastResort[node] {
+				if usage < lowLastResort {
+					lowLastResort = usage
+					selectedLastResort = node
+				}
+			} else if usage < low {
 				low = usage
 				selected = node
 			}
 		}
 	}
-	m[selected]++
+	if selected == "" {
+		selected = selectedLastResort
+	}
+	if selected != "" {
+		m[selected]++
+	}
 	return selected
 }
 
@@ -61,42 +154,192 @@ func (m activityMap) decrease(node string) {
 	m[node]--
 }
 
-var errNoNode = errors.New("no available source node")
+var (
+	errNoNode         = errors.New("no available source node")
+	errVersionChanged = errors.New("global version changed during pull")
+	errMixedVersions  = errors.New("source version changed during pull")
+	errHashMismatch   = errors.New("hash mismatch")
+)
+
+// The maximum time to wait for the configured minimum number of peers to
+// connect before pulling from whoever is available.
+const minPeersTimeout = 2 * time.Minute
 
 type puller struct {
 	cfg               *config.Configuration
 	repoCfg           config.RepositoryConfiguration
+	dir               string // the directory pulled into, see workDir
 	bq                *blockQueue
 	model             *Model
 	oustandingPerNode activityMap
+	nodePrefs         nodePrefs
+	ramp              *requestRamp // per node request limits, also in nodePrefs; nil without a ramp
 	openFiles         map[string]openFile
-	requestSlots      chan bool
+	requestSlots      chan bool // holds a token for each free slot
+	slots             int       // number of slots
+	slotDebt          int       // slots to withhold as they are freed, after reducing the number of slots
+	resizeSlots       chan resizeSlotsReq
+	boostSlots        chan boostSlotsReq
 	blocks            chan bqBlock
 	requestResults    chan requestResult
+	copyResults       chan copyResult
+	ignorePerms       chan ignorePermsReq
+	versionerReqs     chan setVersionerReq
+	moveRepo          chan moveRepoReq
+	repoCfgReqs       chan setRepoCfgReq
+	purgeRepo         chan purgeRepoReq
+	syncNow           chan syncNowReq
+	suspendReqs       chan suspendReq
+	resumeReqs        chan resumeReq
+	stopped           chan struct{} // closed when the run loop has returned
 	versioner         versioner.Versioner
+	trash             *versioner.Trash // keeps deleted files when there is no versioner
+	started           time.Time
+	startDelay        time.Duration // wait before the first scan and pull
+	peersReady        bool          // the minimum number of peers has been reached or waited for
+	noClone           bool          // the filesystem doesn't support cloning file ranges
+	copying           int           // copies running on worker goroutines
+	stats             pullerStats
+	syncBatch         []pendingSync // renamed files waiting for a batched fsync
+	syncBatchStart    time.Time
+	renameBatch       []pendingRename          // verified small files waiting to be renamed into place
+	dirHeld           []pendingRename          // verified files held until the rest of their directory is done, with DirAtomic
+	inUse             map[string]backoff       // files that were in use by another process
+	invalidNames      map[string]uint64        // versions of files with names that can't be used here
+	badLayouts        map[string]uint64        // versions of files with blocks that don't match their size
+	inFlight          map[blockKey]bool        // blocks requested from the network and not yet received
+	pendingDeletes    map[string]pendingDelete // remote deletes within the grace period
+	failedDeletes     map[string]failedDelete  // remote deletes that could not be carried out
+	noSource          map[string]noSourceFile  // needed files that no node could be found to pull from
+	differing         map[string]uint64        // versions of needed files that existing files were found to differ from
+	tempWaiting       []tempWaitingFile        // files waiting for MaxTempBytes to allow their temporary files, in order
+	verifyPassDone    bool                     // the verify-only pass over the existing files has been made
+	verify            verifyState              // files to check against the disk after the cycle
+	fixup             *fixupRun                // directory fixup running in the background, if any
+	fixupDeferred     bool                     // the last fixup left directories with pending changes alone
+	throttle          diskThrottle             // scales the request slots to how busy the disk is
+	swapDue           bool                     // files have been pulled since the working tree was last swapped in
+	backlog           *writeBacklog            // requested data not yet written
+	suspended         bool                     // no new blocks are handled until resumed
+	sourceUsers       map[string]int           // queued copies from other local files, by source, with ShareBlocks
+	scratch           map[string]scratchFile   // deleted copy sources kept in the scratch area, by name
+	mut               sync.Mutex               // protects openFiles, oustandingPerNode, stats, pendingDeletes, failedDeletes and throttle
 }
 
-func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int, cfg *config.Configuration) *puller {
-	p := &puller{
-		repoCfg:           repoCfg,
-		cfg:               cfg,
-		bq:                newBlockQueue(),
-		model:             model,
-		oustandingPerNode: make(activityMap),
-		openFiles:         make(map[string]openFile),
-		requestSlots:      make(chan bool, slots),
-		blocks:            make(chan bqBlock),
-		requestResults:    make(chan requestResult),
+// A blockKey identifies a block of a file being pulled.
+type blockKey struct {
+	name   string
+	offset int64
+}
+
+// A setVersionerReq replaces the versioner from outside the run loop. The
+// done channel is closed once the change has been applied.
+type setVersionerReq struct {
+	cfg       config.VersioningConfiguration
+	versioner versioner.Versioner
+	done      chan struct{}
+}
+
+// An ignorePermsReq changes repoCfg.IgnorePerms from outside the run loop.
+// The done channel is closed once the change has been applied.
+type ignorePermsReq struct {
+	ignore bool
+	done   chan struct{}
+}
+
+// A syncNowReq has the run loop queue the needed files without waiting for
+// the current cycle to end. The done channel is closed once they have been
+// queued, or right away if files are still being pulled, in which case
+// they are queued when those are done.
+type syncNowReq struct {
+	done chan struct{}
+}
+
+// A resizeSlotsReq changes the number of request slots from outside the run
+// loop. The done channel is closed once the change has been applied.
+type resizeSlotsReq struct {
+	slots int
+	done  chan struct{}
+}
+
+// A boostSlotsReq changes the number of request slots the puller gains, or
+// gives up, while a repository is boosted. The done channel is closed once
+// the change has been applied.
+type boostSlotsReq struct {
+	delta int
+	done  chan struct{}
+}
+
+// The number of request slots can be raised up to this limit at runtime.
+const maxRequestSlots = 256
+
+// slotsCap returns the capacity of the request slot channel for a puller
+// starting with the given number of slots. Read only pullers have none.
+func slotsCap(slots int) int {
+	if slots > 0 && slots < maxRequestSlots {
+		return maxRequestSlots
 	}
+	return slots
+}
 
-	if len(repoCfg.Versioning.Type) > 0 {
-		factory, ok := versioner.Factories[repoCfg.Versioning.Type]
-		if !ok {
-			l.Fatalf("Requested versioning type %q that does not exist", repoCfg.Versioning.Type)
-		}
-		p.versioner = factory(repoCfg.Versioning.Params)
+// The startup delay is drawn and waited for using these, so that tests can
+// replace them.
+var (
+	staggerInt63n = rand.Int63n
+	timeAfter     = time.After
+)
+
+// startupDelay returns a random delay of less than maxS seconds. Pullers
+// started together wait this long before their first scan and pull, so that
+// a node with many repositories doesn't do them all at once.
+func startupDelay(maxS int) time.Duration {
+	if maxS <= 0 {
+		return 0
+	}
+	return time.Duration(staggerInt63n(int64(maxS) * int64(time.Second)))
+}
+
+// Files that are in use by another process are retried after an
+// exponentially increasing delay between these limits.
+const (
+	inUseBackoffMin = time.Minute
+	inUseBackoffMax = 30 * time.Minute
+)
+
+type backoff struct {
+	until time.Time
+	delay time.Duration
+}
+
+type pendingSync struct {
+	file scanner.File
+	path string
+}
+
+type pullerStats struct {
+	bytesPulled    int64 // bytes received from the network
+	bytesCopied    int64 // bytes copied from existing local files
+	bytesSparse    int64 // bytes of zeros neither received nor copied
+	filesCompleted int64
+	pullErrors     int64 // files that failed to sync
+	cyclePulled    int64 // bytesPulled during the current or last sync cycle
+	cycleCopied    int64 // bytesCopied during the current or last sync cycle
+	dirWaiting     int64 // needed files left for a later cycle by MaxNewDirsPerCycle
+}
+
+// newPuller creates and starts the puller for the repository. It fails if the
+// configured versioning type doesn't exist.
+func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int, cfg *config.Configuration) (*puller, error) {
+	v, err := newVersioner(repoCfg.Versioning)
+	if err != nil {
+		return nil, err
 	}
 
+	p := makePuller(repoCfg, model, slots, cfg)
+	// Called with rmut held by StartRepoRW
+	p.suspended = model.suspended
+	p.setVersioner(repoCfg.Versioning, v)
+
 	if slots > 0 {
 		// Read/write
 		for i := 0; i < slots; i++ {
@@ -113,10 +356,56 @@ func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int,
 		}
 		go p.runRO()
 	}
+	return p, nil
+}
+
+// makePuller returns a puller for the repository that has not been started.
+func makePuller(repoCfg config.RepositoryConfiguration, model *Model, slots int, cfg *config.Configuration) *puller {
+	p := &puller{
+		repoCfg:           repoCfg,
+		dir:               workDir(repoCfg),
+		cfg:               cfg,
+		bq:                newBlockQueue(),
+		model:             model,
+		oustandingPerNode: make(activityMap),
+		nodePrefs:         newNodePrefs(repoCfg),
+		openFiles:         make(map[string]openFile),
+		requestSlots:      make(chan bool, slotsCap(slots)),
+		slots:             slots,
+		blocks:            make(chan bqBlock),
+		requestResults:    make(chan requestResult),
+		copyResults:       make(chan copyResult),
+		ignorePerms:       make(chan ignorePermsReq),
+		versionerReqs:     make(chan setVersionerReq),
+		resizeSlots:       make(chan resizeSlotsReq),
+		boostSlots:        make(chan boostSlotsReq),
+		moveRepo:          make(chan moveRepoReq),
+		repoCfgReqs:       make(chan setRepoCfgReq),
+		purgeRepo:         make(chan purgeRepoReq),
+		syncNow:           make(chan syncNowReq),
+		suspendReqs:       make(chan suspendReq),
+		resumeReqs:        make(chan resumeReq),
+		stopped:           make(chan struct{}),
+		started:           time.Now(),
+		startDelay:        startupDelay(cfg.Options.StartupStaggerS),
+		throttle:          diskThrottle{slots: slots},
+		backlog:           newWriteBacklog(cfg.Options.MaxWriteBacklogKiB),
+	}
+	p.nodePrefs.lanWeight = cfg.Options.LANPreference
+	p.nodePrefs.isLAN = model.isLAN
+	p.ramp = newRequestRamp(cfg.Options.RequestRampStart, slotsCap(slots))
+	p.nodePrefs.ramp = p.ramp
+	// Whatever was pulled before a restart may not have been swapped in
+	p.swapDue = repoCfg.AtomicSwap
 	return p
 }
 
 func (p *puller) run() {
+	defer close(p.stopped)
+
+	// Left over if we crashed while copying from deleted files
+	os.RemoveAll(scratchDir(p.dir))
+
 	go func() {
 		// fill blocks queue when there are free slots
 		for {
@@ -129,35 +418,196 @@ func (p *puller) run() {
 		}
 	}()
 
-	walkTicker := time.Tick(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
+	// The rescan interval starts counting once the startup delay is over,
+	// so that the rescans stay spread out as well.
+	var walkTicker <-chan time.Time
+	ready := timeAfter(p.startDelay)
 	timeout := time.Tick(5 * time.Second)
 	changed := true
+	rescanDue := false
+	var syncNow []syncNowReq
+	var suspending []suspendReq // waiting for the requests in flight
 
 	for {
 		// Run the pulling loop as long as there are blocks to fetch
 	pull:
 		for {
+			if len(suspending) > 0 && p.quiesced() {
+				p.mut.Lock()
+				p.checkpoint()
+				p.mut.Unlock()
+				p.model.setState(p.repoCfg.ID, RepoSuspended)
+				for _, req := range suspending {
+					close(req.done)
+				}
+				suspending = nil
+			}
+			// No new blocks are handled while suspended; the filler
+			// holds on to the one it has.
+			blocks := p.blocks
+			if p.suspended {
+				blocks = nil
+			}
+
 			select {
 			case res := <-p.requestResults:
 				p.model.setState(p.repoCfg.ID, RepoSyncing)
 				changed = true
-				p.requestSlots <- true
+				if !res.extra {
+					p.releaseSlot()
+				}
+				p.mut.Lock()
 				p.handleRequestResult(res)
+				p.queueTempWaiting()
+				p.promoteDirs()
+				p.mut.Unlock()
 
-			case b := <-p.blocks:
+			case res := <-p.copyResults:
+				p.model.setState(p.repoCfg.ID, RepoSyncing)
+				changed = true
+				p.releaseSlot()
+				p.mut.Lock()
+				p.handleCopyResult(res, true)
+				p.queueTempWaiting()
+				p.promoteDirs()
+				p.mut.Unlock()
+
+			case b := <-blocks:
+				if !changed {
+					// A new sync cycle begins
+					p.mut.Lock()
+					p.stats.cyclePulled, p.stats.cycleCopied = 0, 0
+					p.mut.Unlock()
+				}
 				p.model.setState(p.repoCfg.ID, RepoSyncing)
 				changed = true
-				if p.handleBlock(b) {
+				// Directories may be created for the new files, so
+				// the fixup must not remove them underneath us. It is
+				// started over once pulling is done.
+				p.stopFixup()
+				p.mut.Lock()
+				handled := p.handleBlock(b)
+				p.queueTempWaiting()
+				p.promoteDirs()
+				p.mut.Unlock()
+				if handled {
 					// Block was fully handled, free up the slot
-					p.requestSlots <- true
+					p.releaseSlot()
+				}
+
+			case req := <-p.ignorePerms:
+				p.setIgnorePerms(req.ignore)
+				close(req.done)
+
+			case req := <-p.versionerReqs:
+				p.setVersioner(req.cfg, req.versioner)
+				close(req.done)
+
+			case req := <-p.resizeSlots:
+				p.mut.Lock()
+				p.throttle.slots = req.slots
+				slots := p.throttle.scaled()
+				p.mut.Unlock()
+				p.setSlots(slots)
+				close(req.done)
+
+			case req := <-p.boostSlots:
+				p.mut.Lock()
+				p.throttle.boost = req.delta
+				slots := p.throttle.scaled()
+				p.mut.Unlock()
+				p.setSlots(slots)
+				close(req.done)
+
+			case req := <-p.repoCfgReqs:
+				p.setRepoConfig(req.cfg)
+				close(req.done)
+
+			case req := <-p.moveRepo:
+				if p.fixup != nil {
+					// Start it over at the new location
+					changed = true
+					p.stopFixup()
+				}
+				req.done <- p.moveRepoDir(req.dir)
+
+			case req := <-p.purgeRepo:
+				changed = true
+				p.stopFixup()
+				p.mut.Lock()
+				p.abandonOpenFiles(errRepoPurged)
+				p.mut.Unlock()
+				req.done <- p.model.purgeLocal(p.repoCfg.ID, req.all)
+
+			case req := <-p.suspendReqs:
+				if !p.suspended {
+					p.suspended = true
+					// Started over once resumed
+					changed = true
+					p.stopFixup()
+				}
+				suspending = append(suspending, req)
+
+			case req := <-p.resumeReqs:
+				if p.suspended {
+					p.suspended = false
+					p.mut.Lock()
+					p.checkTemps()
+					p.mut.Unlock()
+				}
+				for _, req := range suspending {
+					close(req.done)
+				}
+				suspending = nil
+				close(req.done)
+
+			case req := <-p.syncNow:
+				p.mut.Lock()
+				idle := len(p.openFiles) == 0 && p.bq.empty()
+				p.mut.Unlock()
+				if !idle || p.suspended {
+					close(req.done)
+					break
+				}
+				syncNow = append(syncNow, req)
+				break pull
+
+			case <-ready:
+				if debug {
+					l.Debugf("%q: startup delay of %v over", p.repoCfg.ID, p.startDelay)
+				}
+				ready = nil
+				walkTicker = time.Tick(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
+				p.mut.Lock()
+				idle := len(p.openFiles) == 0 && p.bq.empty()
+				p.mut.Unlock()
+				if idle {
+					break pull
 				}
 
 			case <-timeout:
-				if len(p.openFiles) == 0 && p.bq.empty() {
+				if p.cfg.Options.AdaptiveDiskThrottle {
+					p.sampleDisk()
+				}
+				p.mut.Lock()
+				if len(p.renameBatch) > 0 {
+					p.flushRenameBatch()
+				}
+				idle := len(p.openFiles) == 0 && p.bq.empty()
+				if len(p.syncBatch) > 0 && (idle || time.Since(p.syncBatchStart) >= time.Duration(p.cfg.Options.FsyncIntervalS)*time.Second) {
+					p.flushSyncBatch()
+				}
+				p.persistBitmaps()
+				if idle {
+					p.clearScratch()
+				}
+				p.mut.Unlock()
+				if idle && ready == nil {
 					// Nothing more to do for the moment
 					break pull
 				}
 				if debug {
+					p.mut.Lock()
 					l.Debugf("%q: idle but have %d open files", p.repoCfg.ID, len(p.openFiles))
 					i := 5
 					for _, f := range p.openFiles {
@@ -167,63 +617,359 @@ func (p *puller) run() {
 							break
 						}
 					}
+					p.mut.Unlock()
 				}
 			}
 		}
 
-		if changed {
-			p.model.setState(p.repoCfg.ID, RepoCleaning)
-			p.fixupDirectories()
+		if p.suspended {
+			// Nothing is cleaned up, scanned or queued until resumed
+			continue
+		}
+
+		if changed || p.fixupDeferred && p.fixup == nil {
+			// Clean up in the background. A fixup still running from an
+			// earlier cycle is started over, to cover the latest changes.
+			p.startFixup()
 			changed = false
 		}
 
-		p.model.setState(p.repoCfg.ID, RepoIdle)
+		if p.fixupFinished() {
+			if p.cfg.Options.VerifyAfterSync {
+				p.verifyAfterSync()
+			}
+			if p.swapDue {
+				p.swapRepo()
+			}
+		}
+
+		if p.fixup != nil {
+			p.model.setState(p.repoCfg.ID, RepoCleaning)
+		} else {
+			p.model.setState(p.repoCfg.ID, RepoIdle)
+		}
 
-		// Do a rescan if it's time for it
+		// Do a rescan if it's time for it. The scan would see directories
+		// the fixup has yet to remove as new, so it waits for the fixup to
+		// finish.
 		select {
 		case <-walkTicker:
+			rescanDue = true
+		default:
+		}
+		if rescanDue && p.fixup == nil {
+			rescanDue = false
 			if debug {
 				l.Debugf("%q: time for rescan", p.repoCfg.ID)
 			}
-			err := p.model.ScanRepo(p.repoCfg.ID)
-			if err != nil {
-				invalidateRepo(p.cfg, p.repoCfg.ID, err)
+			err := p.scanRepo()
+			if err != nil && err != ErrRepoMoving {
+				p.model.invalidateRepo(p.repoCfg.ID, err)
 				return
 			}
+		}
+
+		// Queue more blocks to fetch, if any, unless we are still waiting for
+		// enough peers to connect.
+		if p.checkPeers() {
+			p.queueNeededBlocks()
+		} else {
+			p.model.setState(p.repoCfg.ID, RepoWaiting)
+		}
+		for _, req := range syncNow {
+			close(req.done)
+		}
+		syncNow = nil
+	}
+}
+
+// releaseSlot frees a request slot, unless it is withheld to reduce the
+// number of slots.
+func (p *puller) releaseSlot() {
+	p.mut.Lock()
+	if p.slotDebt > 0 {
+		p.slotDebt--
+		p.mut.Unlock()
+		return
+	}
+	p.mut.Unlock()
+	p.requestSlots <- true
+}
+
+// setSlots changes the number of request slots. New slots are available
+// immediately. When reducing the number, free slots are removed first and
+// the rest are withheld as the requests using them complete. The number is
+// limited to the capacity of the slot channel.
+func (p *puller) setSlots(n int) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if n > cap(p.requestSlots) {
+		n = cap(p.requestSlots)
+	}
+	diff := n - p.slots
+	p.slots = n
 
+	for ; diff > 0 && p.slotDebt > 0; diff-- {
+		p.slotDebt--
+	}
+	for ; diff > 0; diff-- {
+		p.requestSlots <- true
+	}
+	for ; diff < 0; diff++ {
+		select {
+		case <-p.requestSlots:
 		default:
+			p.slotDebt -= diff
+			return
 		}
+	}
+}
+
+// checkPeers returns true once the configured minimum number of peers for the
+// repo are connected, or when we've waited long enough for them.
+func (p *puller) checkPeers() bool {
+	if p.peersReady {
+		return true
+	}
 
-		// Queue more blocks to fetch, if any
-		p.queueNeededBlocks()
+	connected := p.model.connectedPeers(p.repoCfg.ID)
+	if connected >= p.repoCfg.MinConnectedPeers {
+		p.peersReady = true
+	} else if time.Since(p.started) > minPeersTimeout {
+		l.Infof("Repository %q: only %d of %d peers connected after %v; starting to pull", p.repoCfg.ID, connected, p.repoCfg.MinConnectedPeers, minPeersTimeout)
+		p.peersReady = true
+	} else if debug {
+		l.Debugf("%q: waiting for peers; %d of %d connected", p.repoCfg.ID, connected, p.repoCfg.MinConnectedPeers)
 	}
+
+	return p.peersReady
 }
 
 func (p *puller) runRO() {
+	defer close(p.stopped)
+
+	<-timeAfter(p.startDelay)
 	walkTicker := time.Tick(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
 
 	for _ = range walkTicker {
 		if debug {
 			l.Debugf("%q: time for rescan", p.repoCfg.ID)
 		}
-		err := p.model.ScanRepo(p.repoCfg.ID)
-		if err != nil {
-			invalidateRepo(p.cfg, p.repoCfg.ID, err)
+		// Drift is checked for before the scan takes the changes into
+		// the index
+		p.model.reportDrift(p.repoCfg.ID)
+		err := p.scanRepo()
+		if err != nil && err != ErrRepoMoving {
+			p.model.invalidateRepo(p.repoCfg.ID, err)
+			return
+		}
+	}
+}
+
+// wait waits for the run loop to close the done channel of a request it has
+// been sent. It returns ErrStopped if the run loop returns first, after a
+// failed scan, so that the request would never be applied.
+func (p *puller) wait(done chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-p.stopped:
+		return ErrStopped
+	}
+}
+
+// setIgnorePerms changes whether permissions are ignored for the repo. When
+// no longer ignoring permissions, the permissions of existing files and
+// directories are restored to match the index.
+func (p *puller) setIgnorePerms(v bool) {
+	if v == p.repoCfg.IgnorePerms {
+		return
+	}
+	p.repoCfg.IgnorePerms = v
+	if p.repoCfg.IgnoresPerms() {
+		return
+	}
+
+	p.stopFixup()
+	pending := p.pendingDirs()
+	fixupDirectories(p.model, p.repoCfg, p.versioner != nil, pending, nil)
+	p.fixupDeferred = len(pending) > 0
+
+	for _, f := range p.model.haveFilesRepo(p.repoCfg.ID) {
+		if protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) || !protocol.HasPermissionBits(f.Flags) {
+			continue
+		}
+		path := filepath.Join(p.dir, f.Name)
+		info, err := os.Lstat(path)
+		special := p.repoCfg.SpecialPermBits
+		if err != nil || !info.Mode().IsRegular() || scanner.PermsEqual(f.Flags, scanner.PermBits(info.Mode(), special), special) {
+			continue
+		}
+		if err := os.Chmod(path, scanner.FileMode(f.Flags, special)); err != nil {
+			l.Warnf("Restoring file flags: %q: %v", path, err)
+		} else if debug {
+			l.Debugf("restored file flags: %o -> %v", info.Mode()&os.ModePerm, f)
+		}
+	}
+}
+
+// newVersioner returns the versioner for the configuration, or nil if there
+// is no versioning.
+func newVersioner(cfg config.VersioningConfiguration) (versioner.Versioner, error) {
+	if len(cfg.Type) == 0 {
+		return nil, nil
+	}
+	factory, ok := versioner.Factories[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("requested versioning type %q that does not exist", cfg.Type)
+	}
+	if err := versioner.ValidateParams(cfg.Type, cfg.Params); err != nil {
+		return nil, err
+	}
+	return factory(cfg.Params), nil
+}
+
+// setVersioner changes the versioner used for replaced and deleted files.
+// Without a versioner, deleted files go to the trash if they are kept.
+func (p *puller) setVersioner(cfg config.VersioningConfiguration, v versioner.Versioner) {
+	p.repoCfg.Versioning = cfg
+	p.versioner = v
+	p.trash = nil
+	if v == nil && p.repoCfg.KeepDeletedFiles {
+		p.trash = versioner.NewTrash(p.dir, p.repoCfg.TrashMaxAgeDays, p.repoCfg.TrashMaxSizeMiB)
+	}
+}
+
+// A fixupRun is a directory fixup running in the background. Closing cancel
+// stops it early; done is closed when it has stopped.
+type fixupRun struct {
+	cancel    chan struct{}
+	done      chan struct{}
+	completed bool // set before done is closed
+}
+
+var errFixupCancelled = errors.New("directory fixup cancelled")
+
+// startFixup starts restoring directory metadata and pruning the trash and
+// conflict copies in the background, cancelling any fixup already running.
+func (p *puller) startFixup() {
+	p.stopFixup()
+
+	f := &fixupRun{
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	// The goroutine works on copies, so the run loop may change the
+	// configuration meanwhile.
+	cfg, versioned, trash := p.repoCfg, p.versioner != nil, p.trash
+	pending := p.pendingDirs()
+	p.fixupDeferred = len(pending) > 0
+	go func() {
+		defer close(f.done)
+		if !fixupDirectories(p.model, cfg, versioned, pending, f.cancel) {
+			return
+		}
+		if trash != nil {
+			if err := trash.Prune(); err != nil {
+				l.Warnf("Pruning deleted files in repository %q: %v", cfg.ID, err)
+			}
+		}
+		if err := pruneConflicts(cfg, f.cancel); err == errFixupCancelled {
 			return
+		} else if err != nil {
+			l.Warnf("Pruning conflict copies in repository %q: %v", cfg.ID, err)
+		}
+		f.completed = true
+	}()
+	p.fixup = f
+}
+
+// stopFixup cancels the running fixup, if any, and waits for it to stop.
+func (p *puller) stopFixup() {
+	if p.fixup == nil {
+		return
+	}
+	close(p.fixup.cancel)
+	<-p.fixup.done
+	p.fixup = nil
+}
+
+// fixupFinished returns true if the running fixup has completed since the
+// last call.
+func (p *puller) fixupFinished() bool {
+	if p.fixup == nil {
+		return false
+	}
+	select {
+	case <-p.fixup.done:
+		completed := p.fixup.completed
+		p.fixup = nil
+		return completed
+	default:
+		return false
+	}
+}
+
+// pendingDirs returns the directories, relative to the repository, that
+// files are still to be pulled or renamed into. Their modification times
+// change until those files are in place.
+func (p *puller) pendingDirs() map[string]bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	dirs := p.pullingDirs()
+	for _, r := range p.renameBatch {
+		dirs[filepath.Dir(r.file.Name)] = true
+	}
+	for _, r := range p.dirHeld {
+		dirs[filepath.Dir(r.file.Name)] = true
+	}
+	return dirs
+}
+
+// pullingDirs returns the directories, relative to the repository, that
+// files are being pulled into or are queued or waiting to be. Must be
+// called with p.mut held.
+func (p *puller) pullingDirs() map[string]bool {
+	dirs := make(map[string]bool)
+	for name := range p.openFiles {
+		dirs[filepath.Dir(name)] = true
+	}
+	for _, w := range p.tempWaiting {
+		dirs[filepath.Dir(w.name)] = true
+	}
+	if p.bq != nil {
+		for _, name := range p.bq.fileNames() {
+			dirs[filepath.Dir(name)] = true
 		}
 	}
+	return dirs
 }
 
-func (p *puller) fixupDirectories() {
+// fixupDirectories restores the permissions and modification times of the
+// directories in the repository to match the index, and removes those that
+// are deleted. The modification times of the pending directories are left
+// alone, since they would change again, and be restored again, with every
+// file added to them. It returns false if it was cancelled before
+// completing.
+func fixupDirectories(m *Model, cfg config.RepositoryConfiguration, versioned bool, pending map[string]bool, cancel <-chan struct{}) bool {
 	var deleteDirs []string
 	var changed = 0
 
 	var walkFn = func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
+		select {
+		case <-cancel:
+			return errFixupCancelled
+		default:
+		}
+
+		if err != nil || !info.IsDir() {
+			// Vanished or unreadable; nothing to fix up
 			return nil
 		}
 
-		rn, err := filepath.Rel(p.repoCfg.Directory, path)
+		rn, err := filepath.Rel(workDir(cfg), path)
 		if err != nil {
 			return nil
 		}
@@ -236,7 +982,7 @@ func (p *puller) fixupDirectories() {
 			return nil
 		}
 
-		cur := p.model.CurrentRepoFile(p.repoCfg.ID, rn)
+		cur := m.CurrentRepoFile(cfg.ID, rn)
 		if cur.Name != rn {
 			// No matching dir in current list; weird
 			if debug {
@@ -258,8 +1004,9 @@ func (p *puller) fixupDirectories() {
 			return nil
 		}
 
-		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(cur.Flags) && !scanner.PermsEqual(cur.Flags, uint32(info.Mode())) {
-			err := os.Chmod(path, os.FileMode(cur.Flags)&os.ModePerm)
+		special := cfg.SpecialPermBits
+		if !cfg.IgnoresPerms() && protocol.HasPermissionBits(cur.Flags) && !scanner.PermsEqual(cur.Flags, scanner.PermBits(info.Mode(), special), special) {
+			err := os.Chmod(path, scanner.FileMode(cur.Flags, special))
 			if err != nil {
 				l.Warnf("Restoring folder flags: %q: %v", path, err)
 			} else {
@@ -270,7 +1017,7 @@ func (p *puller) fixupDirectories() {
 			}
 		}
 
-		if cur.Modified != info.ModTime().Unix() {
+		if !scanner.ModTimeEqual(cur.Modified, info.ModTime().Unix(), m.modTimeWindow()) && !pending[rn] {
 			t := time.Unix(cur.Modified, 0)
 			err := os.Chtimes(path, t, t)
 			if err != nil {
@@ -289,7 +1036,9 @@ func (p *puller) fixupDirectories() {
 	for {
 		deleteDirs = nil
 		changed = 0
-		filepath.Walk(p.repoCfg.Directory, walkFn)
+		if filepath.Walk(workDir(cfg), walkFn) == errFixupCancelled {
+			return false
+		}
 
 		var deleted = 0
 		// Delete any queued directories
@@ -301,7 +1050,7 @@ func (p *puller) fixupDirectories() {
 			err := os.Remove(dir)
 			if err == nil {
 				deleted++
-			} else if p.versioner == nil { // Failures are expected in the presence of versioning
+			} else if !versioned { // Failures are expected in the presence of versioning
 				l.Warnln(err)
 			}
 		}
@@ -311,22 +1060,68 @@ func (p *puller) fixupDirectories() {
 		}
 
 		if changed+deleted == 0 {
-			return
+			return true
 		}
 	}
 }
 
 func (p *puller) handleRequestResult(res requestResult) {
+	defer p.backlog.release(res.reserved)
 	p.oustandingPerNode.decrease(res.node)
+	p.ramp.done(res.node, res.err == nil)
 	f := res.file
+	delete(p.inFlight, blockKey{f.Name, res.offset})
 
 	of, ok := p.openFiles[f.Name]
-	if !ok || of.err != nil {
+	if !ok {
 		// no entry in openFiles means there was an error and we've cancelled the operation
 		return
 	}
+	p.checkVersion(&of, f)
+	p.checkSourceVersion(&of, res)
+	if of.err == nil && res.err != nil {
+		p.requestFailed(&of, res)
+		p.openFiles[f.Name] = of
+		return
+	}
+	if p.oversizedBlock(&of, &res) {
+		p.openFiles[f.Name] = of
+		return
+	}
+	if p.checkPartialBlock(&of, res) {
+		p.openFiles[f.Name] = of
+		return
+	}
+	if of.err == nil && res.err == nil && !res.partial && p.cfg.Options.CheckBlockHashes && !blockMatches(res) {
+		p.rejectBlock(&of, res)
+		p.openFiles[f.Name] = of
+		return
+	}
+	if of.err != nil {
+		// The file has already failed; forget about it once the last
+		// outstanding request is accounted for.
+		of.outstanding--
+		p.openFiles[f.Name] = of
+		if of.done && of.outstanding <= 0 {
+			p.forgetFailed(f.Name)
+		}
+		return
+	}
 
-	_, of.err = of.file.WriteAt(res.data, res.offset)
+	if of.journal != nil {
+		of.err = of.journal.save(of.file, res.offset, int64(len(res.data)))
+	}
+	if of.err == nil {
+		of.err = of.writeAt(res.data, res.offset)
+	}
+	if of.err == nil {
+		of.recordWritten(f.Blocks, res.offset)
+		p.announceWritten(&of, f)
+		p.verifyWritten(&of, f)
+	}
+	p.stats.bytesPulled += int64(len(res.data))
+	p.stats.cyclePulled += int64(len(res.data))
+	p.model.recordIn(p.repoCfg.ID, len(res.data))
 	buffers.Put(res.data)
 
 	of.outstanding--
@@ -347,11 +1142,15 @@ func (p *puller) handleRequestResult(res requestResult) {
 func (p *puller) handleBlock(b bqBlock) bool {
 	f := b.file
 
+	if !protocol.IsDeleted(f.Flags) && p.invalidFilename(f) {
+		return true
+	}
+
 	// For directories, making sure they exist is enough.
 	// Deleted directories we mark as handled and delete later.
 	if protocol.IsDirectory(f.Flags) {
 		if !protocol.IsDeleted(f.Flags) {
-			path := filepath.Join(p.repoCfg.Directory, f.Name)
+			path := filepath.Join(p.dir, f.Name)
 			_, err := os.Stat(path)
 			if err != nil && os.IsNotExist(err) {
 				if debug {
@@ -365,12 +1164,27 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		} else if debug {
 			l.Debugf("ignore delete dir: %v", f)
 		}
-		p.model.updateLocal(p.repoCfg.ID, f)
+		p.updateLocal(f)
 		return true
 	}
 
 	of, ok := p.openFiles[f.Name]
-	of.done = b.last
+	if b.retries > 0 || b.repair || b.rampWait {
+		if !ok {
+			// The file was abandoned while this block was waiting to be
+			// retried.
+			return true
+		}
+		// The pending retry is no longer outstanding.
+		of.outstanding--
+	}
+	if !ok && p.deferForTemp(b) {
+		// Queued again once there is room for the temporary file
+		return true
+	}
+	if b.last {
+		of.done = true
+	}
 
 	if !ok {
 		if debug {
@@ -378,8 +1192,14 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		}
 
 		of.availability = uint64(p.model.repoFiles[p.repoCfg.ID].Availability(f.Name))
-		of.filepath = filepath.Join(p.repoCfg.Directory, f.Name)
-		of.temp = filepath.Join(p.repoCfg.Directory, defTempNamer.TempName(f.Name))
+		of.version = f.Version
+		of.blocks = f.Blocks
+		of.filepath = filepath.Join(p.dir, f.Name)
+		of.temp = filepath.Join(p.dir, defTempNamer.TempName(f.Name))
+		if info, err := os.Lstat(of.filepath); err == nil {
+			of.targetMod = info.ModTime()
+			of.targetSize = info.Size()
+		}
 
 		dirName := filepath.Dir(of.filepath)
 		_, err := os.Stat(dirName)
@@ -390,17 +1210,56 @@ func (p *puller) handleBlock(b bqBlock) bool {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		}
 
-		of.file, of.err = os.Create(of.temp)
+		if p.canUpdateInPlace(b) {
+			p.openInPlace(&of)
+		} else if p.repoCfg.CompressFiles {
+			// Compressed temporary files are neither resumed nor served
+			// to other nodes, as the blocks aren't where the bitmap
+			// says they are.
+			of.removeTemp()
+			of.file, of.err = os.OpenFile(of.temp, os.O_RDWR|os.O_CREATE|os.O_EXCL, p.tempFileMode(f))
+			if of.err == nil {
+				of.cz, of.err = newCompressedTemp(of.file)
+			}
+		} else if !p.resumeTemp(&of, f) {
+			// Create the temporary file with the final permissions already
+			// in place, so that it never exists with looser permissions
+			// than intended. The umask can only remove bits from the mode.
+			// A leftover temporary file might have any permissions, so
+			// remove it first.
+			of.removeTemp()
+			of.file, of.err = os.OpenFile(of.temp, os.O_RDWR|os.O_CREATE|os.O_EXCL, p.tempFileMode(f))
+			if of.err == nil && len(f.Blocks) >= resumeMinBlocks {
+				var err error
+				if of.bitmap, err = createBitmap(of.temp, f); err != nil && debug {
+					l.Debugf("pull: %q / %q: bitmap: %v", p.repoCfg.ID, f.Name, err)
+				}
+			}
+		}
 		if of.err != nil {
 			if debug {
 				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
 			}
 			if !b.last {
 				p.openFiles[f.Name] = of
+			} else {
+				p.stats.pullErrors++
 			}
 			return true
 		}
-		osutil.HideFile(of.temp)
+		of.complete = make([]byte, (len(f.Blocks)+7)/8)
+		if of.bitmap != nil {
+			copy(of.complete, of.bitmap.bits)
+		}
+		if of.journal == nil {
+			of.tempSize = f.Size
+			osutil.HideFile(of.temp)
+			if kib := p.cfg.Options.WriteBufferKiB; kib > 0 && of.cz == nil {
+				of.wb = newWriteBuffer(of.file, kib*1024)
+			}
+		}
+	} else {
+		p.checkVersion(&of, f)
 	}
 
 	if of.err != nil {
@@ -408,9 +1267,12 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		if debug {
 			l.Debugf("pull: error: %q / %q has already failed: %v", p.repoCfg.ID, f.Name, of.err)
 		}
-		if b.last {
-			delete(p.openFiles, f.Name)
+		if b.last || of.done && of.outstanding <= 0 {
+			p.forgetFailed(f.Name)
+		} else {
+			p.openFiles[f.Name] = of
 		}
+		p.sourceDone(b.from)
 
 		return true
 	}
@@ -418,61 +1280,365 @@ func (p *puller) handleBlock(b bqBlock) bool {
 	p.openFiles[f.Name] = of
 
 	switch {
-	case len(b.copy) > 0:
-		p.handleCopyBlock(b)
+	case len(b.copy) > 0 && b.from != "" && of.journal != nil:
+		// Only the file itself is copied from in place
+		p.sourceDone(b.from)
+		p.copyFallback(&of, f, b.copy)
+		p.openFiles[f.Name] = of
+		return true
+
+	case len(b.copy) > 0:
+		if of.journal == nil {
+			return p.handleCopyBlock(b)
+		}
 		return true
 
 	case b.block.Size > 0:
 		return p.handleRequestBlock(b)
 
+	case b.last && of.outstanding > 0:
+		// Copies are still running; the file is closed once they are done
+		of.closeEmpty = true
+		p.openFiles[f.Name] = of
+		return true
+
 	default:
 		p.handleEmptyBlock(b)
 		return true
 	}
 }
 
-func (p *puller) handleCopyBlock(b bqBlock) {
-	// We have blocks to copy from the existing file
-	f := b.file
-	of := p.openFiles[f.Name]
+// writeZeros handles a block of f that holds only zeros without fetching
+// it. A new temporary file is left with a hole where the block goes, reading
+// as zeros and taking no space where the filesystem supports it; a file
+// updated in place or compressed gets the zeros written.
+func (p *puller) writeZeros(of *openFile, f scanner.File, b scanner.Block) {
+	if of.journal != nil {
+		of.err = of.journal.save(of.file, b.Offset, int64(b.Size))
+	}
+	if of.err == nil && (of.journal != nil || of.cz != nil) {
+		of.err = of.writeAt(make([]byte, b.Size), b.Offset)
+	}
+	if of.err == nil {
+		of.recordWritten(f.Blocks, b.Offset)
+		p.announceWritten(of, f)
+	}
+	p.stats.bytesSparse += int64(b.Size)
+}
 
-	if debug {
-		l.Debugf("pull: copying %d blocks for %q / %q", len(b.copy), p.repoCfg.ID, f.Name)
+// extendFile makes fd size bytes long if it is shorter, leaving a hole at
+// the end.
+func extendFile(fd *os.File, size int64) error {
+	info, err := fd.Stat()
+	if err != nil {
+		return err
 	}
+	if info.Size() < size {
+		return fd.Truncate(size)
+	}
+	return nil
+}
 
-	var exfd *os.File
-	exfd, of.err = os.Open(of.filepath)
-	if of.err != nil {
-		if debug {
-			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
+// handleCopyBlock copies the blocks of b from the existing version of the
+// file, or from the other local file b shares them with. The copy runs on a
+// worker goroutine when one is free, in which case false is returned and the
+// result arrives on copyResults; otherwise it is done right away. Returns
+// true if the block was fully handled, like handleBlock.
+func (p *puller) handleCopyBlock(b bqBlock) bool {
+	f := b.file
+	of := p.openFiles[f.Name]
+
+	var blocks []scanner.Block
+	for _, cb := range b.copy {
+		if of.haveWritten(f.Blocks, cb.Offset) {
+			continue
 		}
-		of.file.Close()
-		of.file = nil
+		if of.cz == nil && scanner.IsZeroBlock(cb) {
+			// Left as a hole in the temporary file
+			of.recordWritten(f.Blocks, cb.Offset)
+			continue
+		}
+		blocks = append(blocks, cb)
+	}
+	if len(blocks) == 0 {
+		p.sourceDone(b.from)
+		return true
+	}
 
+	// The repository configuration may change while the copy runs. Blocks
+	// shared with another file are always verified, as that file may be
+	// changing or going away.
+	repo, verify := p.repoCfg.ID, p.repoCfg.VerifyCopySource || b.from != ""
+	src := p.copySource(b, of)
+	if p.copying < p.cfg.Options.CopyWorkers {
+		p.copying++
+		of.outstanding++
 		p.openFiles[f.Name] = of
-		return
+		go func(noClone bool) {
+			res := p.copyBlocks(repo, f, of, src, blocks, verify, noClone)
+			res.from = b.from
+			p.copyResults <- res
+		}(p.noClone)
+		return false
+	}
+
+	res := p.copyBlocks(repo, f, of, src, blocks, verify, p.noClone)
+	res.from = b.from
+	p.handleCopyResult(res, false)
+	return true
+}
+
+// A copyResult is the outcome of copying blocks from the existing file.
+type copyResult struct {
+	file     scanner.File
+	from     string          // the other local file copied from, if any
+	blocks   []scanner.Block // the blocks that were copied
+	fallback []scanner.Block // blocks past the end of the existing file, to pull instead
+	damaged  []scanner.Block // blocks that don't match their hashes in the existing file, to pull instead
+	noClone  bool            // cloning turned out to be unsupported
+	err      error
+}
+
+// A copySource is the file blocks are copied from, with its blocks as last
+// scanned.
+type copySource struct {
+	path   string
+	blocks []scanner.Block
+	shared bool // another file than the one being pulled
+}
+
+// copyBlocks copies the blocks from the source file to the temporary file
+// of in the repository, reading each block back to check its hash if verify
+// is set. It uses nothing of the puller that the run loop changes, so that it
+// can run outside the run loop.
+func (p *puller) copyBlocks(repo string, f scanner.File, of openFile, src copySource, blocks []scanner.Block, verify, noClone bool) copyResult {
+	res := copyResult{file: f, noClone: noClone}
+
+	if debug {
+		l.Debugf("pull: copying %d blocks for %q / %q from %q", len(blocks), repo, f.Name, src.path)
+	}
+
+	// The handle is released after exfd is closed
+	p.model.sourceFiles.acquire()
+	defer p.model.sourceFiles.release()
+	exfd, err := os.Open(src.path)
+	if err != nil && src.shared {
+		// Gone since the copy was queued; the file being pulled is fine
+		res.fallback = blocks
+		return res
+	}
+	if err != nil {
+		res.err = err
+		return res
 	}
 	defer exfd.Close()
 
-	for _, b := range b.copy {
-		bs := buffers.Get(int(b.Size))
-		_, of.err = exfd.ReadAt(bs, b.Offset)
-		if of.err == nil {
-			_, of.err = of.file.WriteAt(bs, b.Offset)
+	// Blocks may have moved within the file, so look up where each block is
+	// found in the source.
+	srcOffsets := make(map[string]int64, len(src.blocks))
+	srcWeak := make(map[string]uint32, len(src.blocks))
+	for _, b := range src.blocks {
+		srcOffsets[string(b.Hash)] = b.Offset
+		srcWeak[string(b.Hash)] = b.WeakHash
+	}
+	if src.shared {
+		// Only the blocks another file still has can be copied from it
+		var found []scanner.Block
+		for _, b := range blocks {
+			if _, ok := srcOffsets[string(b.Hash)]; ok {
+				found = append(found, b)
+			} else {
+				res.fallback = append(res.fallback, b)
+			}
 		}
-		buffers.Put(bs)
-		if of.err != nil {
+		blocks = found
+	}
+
+	runs := copyRuns(blocks, srcOffsets)
+	for i, run := range runs {
+		// Without reading the data, there is nothing to verify
+		if !res.noClone && of.cz == nil && !verify {
+			// Try to share the storage with the existing file instead of
+			// copying the data.
+			last := run.blocks[len(run.blocks)-1]
+			size := last.Offset + int64(last.Size) - run.blocks[0].Offset
+			err := osutil.CloneRange(of.file, exfd, run.blocks[0].Offset, run.srcOffset, size)
+			if err == nil {
+				res.blocks = append(res.blocks, run.blocks...)
+				continue
+			}
+			if err == osutil.ErrCloneUnsupported {
+				if debug {
+					l.Debugf("pull: %q: cloning not supported", repo)
+				}
+				res.noClone = true
+			} else if debug {
+				l.Debugf("pull: clone %q / %q: %v", repo, f.Name, err)
+			}
+		}
+
+		srcOffset := run.srcOffset
+		for j, b := range run.blocks {
+			bs := buffers.Get(int(b.Size))
+			_, err := exfd.ReadAt(bs, srcOffset)
+			if err == io.EOF || err == io.ErrUnexpectedEOF || err != nil && src.shared {
+				// The source was cut short since it was scanned,
+				// maybe while we were copying from it, or another
+				// file can't be read
+				buffers.Put(bs)
+				res.fallback = append(res.fallback, run.blocks[j:]...)
+				for _, r := range runs[i+1:] {
+					res.fallback = append(res.fallback, r.blocks...)
+				}
+				return res
+			}
+			if err == nil && verify {
+				if !sourceMatches(bs, b, srcWeak[string(b.Hash)]) {
+					// Changed or damaged since it was scanned
+					buffers.Put(bs)
+					res.damaged = append(res.damaged, b)
+					srcOffset += int64(b.Size)
+					continue
+				}
+			}
+			if err == nil && of.cz != nil {
+				_, err = of.cz.WriteAt(bs, b.Offset)
+			} else if err == nil {
+				_, err = of.file.WriteAt(bs, b.Offset)
+			}
+			buffers.Put(bs)
+			if err != nil {
+				res.err = err
+				return res
+			}
+			res.blocks = append(res.blocks, b)
+			srcOffset += int64(b.Size)
+		}
+	}
+	return res
+}
+
+// sourceMatches returns true if data, read from the existing file, is the
+// block b. The weak hash of the block, if known from the scan, is checked
+// first, so that most changed blocks are found without computing the strong
+// hash. A block that passes it may still have changed, and is checked
+// against the strong hash as well.
+func sourceMatches(data []byte, b scanner.Block, weak uint32) bool {
+	if weak != 0 && scanner.WeakHash(data) != weak {
+		return false
+	}
+	h := sha256.Sum256(data)
+	return bytes.Equal(h[:], b.Hash)
+}
+
+// handleCopyResult records the outcome of a copy. For a copy that ran on a
+// worker, the file is closed if it was the last thing outstanding for it.
+func (p *puller) handleCopyResult(res copyResult, async bool) {
+	if async {
+		p.copying--
+	}
+	if res.noClone {
+		p.noClone = true
+	}
+	p.sourceDone(res.from)
+
+	f := res.file
+	of, ok := p.openFiles[f.Name]
+	if !ok {
+		// The file has failed and been forgotten meanwhile
+		return
+	}
+	if async {
+		of.outstanding--
+	}
+	if of.err == nil {
+		if res.err != nil {
 			if debug {
-				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
+				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, res.err)
 			}
-			exfd.Close()
+			of.err = res.err
 			of.file.Close()
 			of.file = nil
+		} else {
+			for _, b := range res.blocks {
+				of.recordWritten(f.Blocks, b.Offset)
+				p.stats.bytesCopied += int64(b.Size)
+				p.stats.cycleCopied += int64(b.Size)
+			}
+			p.announceWritten(&of, f)
+			switch {
+			case res.from != "":
+				// Another file is expected to change or go away now
+				// and then
+				if missed := append(res.fallback, res.damaged...); len(missed) > 0 {
+					if debug {
+						l.Debugf("pull: %q / %q: pulling %d blocks that could not be copied from %q", p.repoCfg.ID, f.Name, len(missed), res.from)
+					}
+					p.copyFallback(&of, f, missed)
+				}
+			default:
+				if len(res.fallback) > 0 {
+					l.Infof("Existing %q in repository %q is shorter than expected; pulling %d blocks instead of copying them", f.Name, p.repoCfg.ID, len(res.fallback))
+					p.copyFallback(&of, f, res.fallback)
+				}
+				if len(res.damaged) > 0 {
+					l.Warnf("Existing %q in repository %q does not match the index; pulling %d blocks instead of copying them", f.Name, p.repoCfg.ID, len(res.damaged))
+					p.copyFallback(&of, f, res.damaged)
+				}
+			}
+		}
+	}
+	p.openFiles[f.Name] = of
 
-			p.openFiles[f.Name] = of
-			return
+	if !async || !of.done || of.outstanding > 0 {
+		return
+	}
+	switch {
+	case of.err != nil:
+		p.forgetFailed(f.Name)
+	case of.closeEmpty:
+		p.handleEmptyBlock(bqBlock{file: f, last: true})
+	default:
+		p.closeFile(f)
+	}
+}
+
+// copyFallback queues the blocks that could not be copied, as the existing
+// file turned out to be shorter than expected or to hold other data, to be
+// pulled from the network instead. They are counted as outstanding, keeping
+// the file open until they have been handled.
+func (p *puller) copyFallback(of *openFile, f scanner.File, blocks []scanner.Block) {
+	of.outstanding += len(blocks)
+	p.bq.put(bqAdd{file: f, need: blocks, repair: true, priority: filePriority(p.repoCfg.PriorityPatterns, f.Name)})
+}
+
+// A copyRun is a sequence of blocks that are contiguous both in the file
+// being pulled and in the existing file, starting at srcOffset.
+type copyRun struct {
+	srcOffset int64
+	blocks    []scanner.Block
+}
+
+// copyRuns groups the blocks to copy into runs that can be copied as one
+// range. Blocks not found in srcOffsets are assumed to be at the same offset
+// in the existing file.
+func copyRuns(blocks []scanner.Block, srcOffsets map[string]int64) []copyRun {
+	var runs []copyRun
+	var nextSrc, nextDst int64
+	for _, b := range blocks {
+		srcOffset, ok := srcOffsets[string(b.Hash)]
+		if !ok {
+			srcOffset = b.Offset
+		}
+		if n := len(runs); n > 0 && srcOffset == nextSrc && b.Offset == nextDst {
+			runs[n-1].blocks = append(runs[n-1].blocks, b)
+		} else {
+			runs = append(runs, copyRun{srcOffset: srcOffset, blocks: []scanner.Block{b}})
 		}
+		nextSrc = srcOffset + int64(b.Size)
+		nextDst = b.Offset + int64(b.Size)
 	}
+	return runs
 }
 
 // handleRequestBlock tries to pull a block from the network. Returns true if
@@ -485,50 +1651,272 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 		panic("bug: request for non-open file")
 	}
 
-	node := p.oustandingPerNode.leastBusyNode(of.availability, p.model.cm)
-	if len(node) == 0 {
-		of.err = errNoNode
-		if of.file != nil {
-			of.file.Close()
-			of.file = nil
-			os.Remove(of.temp)
+	key := blockKey{f.Name, b.block.Offset}
+	if p.inFlight[key] {
+		// The same block was queued twice. The outstanding request
+		// writes it once the result arrives, so there is nothing to do.
+		if debug {
+			l.Debugf("pull: %q / %q offset %d already requested", p.repoCfg.ID, f.Name, b.block.Offset)
 		}
-		if b.last {
-			delete(p.openFiles, f.Name)
-		} else {
+		return true
+	}
+
+	if of.haveWritten(f.Blocks, b.block.Offset) {
+		// Written before the pull was interrupted
+		if of.done && of.outstanding == 0 {
+			p.closeFile(f)
+		}
+		return true
+	}
+
+	if scanner.IsZeroBlock(b.block) {
+		p.writeZeros(&of, f, b.block)
+		p.openFiles[f.Name] = of
+		if of.done && of.outstanding == 0 {
+			p.closeFile(f)
+		}
+		return true
+	}
+
+	if max := p.model.maxBlockSize(); max > 0 && int64(b.block.Size) > int64(max) {
+		// The index should not contain such blocks, but the limit may have
+		// been lowered since it was received.
+		l.Warnf("Cannot pull %q in repository %q: block of %d bytes at offset %d exceeds the maximum of %d bytes", f.Name, p.repoCfg.ID, b.block.Size, b.block.Offset, max)
+		p.failFile(b, of, ErrTooLarge)
+		return true
+	}
+
+	// Nodes still pulling the file may have announced holding this block
+	avail := of.availability | p.model.partialAvailability(p.repoCfg.ID, f.Name, f.Version, blockIndex(f.Blocks, b.block.Offset))
+	avail &^= of.badSources
+	node := p.oustandingPerNode.leastBusyNode(avail, p.model.cm, p.nodePrefs)
+	if len(node) == 0 && p.oustandingPerNode.rampHeld(avail, p.model.cm, p.nodePrefs) {
+		// A source is there but at its ramp limit. Like a retry, the
+		// block is counted as outstanding and keeps its slot while it
+		// waits, but it never fails the file.
+		b.rampWait = true
+		of.outstanding++
+		p.openFiles[f.Name] = of
+		time.AfterFunc(rampWaitDelay, func() {
+			p.blocks <- b
+		})
+		return false
+	}
+	if len(node) == 0 {
+		if b.retries < p.cfg.Options.SourceRetries {
+			// A source node may reconnect shortly, so try this block again
+			// after a while instead of failing the file. The retry is
+			// counted as outstanding to keep the file open and the slot
+			// stays occupied until the block is handled again.
+			b.retries++
+			of.outstanding++
 			p.openFiles[f.Name] = of
+			if debug {
+				l.Debugf("pull: no source for %q / %q offset %d; retry %d", p.repoCfg.ID, f.Name, b.block.Offset, b.retries)
+			}
+			time.AfterFunc(time.Duration(p.cfg.Options.SourceRetryDelayS)*time.Second, func() {
+				p.blocks <- b
+			})
+			return false
 		}
+
+		p.noSourceFailed(f)
+		p.failFile(b, of, errNoNode)
 		return true
 	}
 
-	of.outstanding++
+	partial := isPartialSource(of, node, p.model.cm)
+	extra := p.followingBlocks(of, b, node, partial)
+
+	of.outstanding += 1 + len(extra)
+	if p.inFlight == nil {
+		p.inFlight = make(map[blockKey]bool)
+	}
+	p.inFlight[key] = true
+	for _, eb := range extra {
+		if eb.last {
+			of.done = true
+		}
+		p.inFlight[blockKey{f.Name, eb.block.Offset}] = true
+		// Counted for the node as a request of its own
+		p.oustandingPerNode[node]++
+	}
 	p.openFiles[f.Name] = of
 
 	go func(node string, b bqBlock) {
+		size := int(b.block.Size)
+		for _, eb := range extra {
+			size += int(eb.block.Size)
+		}
+		// Waits while the disk is behind with writing earlier blocks
+		p.backlog.reserve(int64(size))
 		if debug {
-			l.Debugf("pull: requesting %q / %q offset %d size %d from %q outstanding %d", p.repoCfg.ID, f.Name, b.block.Offset, b.block.Size, node, of.outstanding)
+			l.Debugf("pull: requesting %q / %q offset %d size %d (%d blocks) from %q outstanding %d partial %v", p.repoCfg.ID, f.Name, b.block.Offset, size, 1+len(extra), node, of.outstanding, partial)
+		}
+
+		start := time.Now()
+		bs, err := p.model.requestGlobal(node, p.repoCfg.ID, f.Name, b.block.Offset, size, nil)
+		if err == nil && len(extra) > 0 && len(bs) != size {
+			err = errBatchSize
 		}
+		p.model.batcher.done(node, 1+len(extra), len(bs), time.Since(start), err == nil)
 
-		bs, err := p.model.requestGlobal(node, p.repoCfg.ID, f.Name, b.block.Offset, int(b.block.Size), nil)
-		p.requestResults <- requestResult{
+		res := requestResult{
 			node:     node,
 			file:     f,
 			filepath: of.filepath,
 			offset:   b.block.Offset,
+			block:    b.block,
 			data:     bs,
 			err:      err,
+			version:  p.model.nodeFileVersion(node, p.repoCfg.ID, f.Name),
+			partial:  partial,
+			reserved: int64(b.block.Size),
+		}
+		if partial {
+			// The index of the node still has the old version
+			res.version = f.Version
+		}
+		if len(extra) == 0 {
+			p.requestResults <- res
+			return
+		}
+		for _, res := range splitBatch(res, extra) {
+			p.requestResults <- res
 		}
 	}(node, b)
 
 	return false
 }
 
+// splitBatch splits the result of a batched request into the results of the
+// first block and of the extra blocks requested along with it. The results
+// of the extra blocks hold no request slot.
+func splitBatch(res requestResult, extra []bqBlock) []requestResult {
+	bs := res.data
+	res.data = nil
+	rs := make([]requestResult, 0, 1+len(extra))
+	blocks := append([]scanner.Block{res.block}, blockList(extra)...)
+	var pos int
+	for i, b := range blocks {
+		r := res
+		r.offset, r.block, r.reserved = b.Offset, b, int64(b.Size)
+		r.extra = i > 0
+		if r.err == nil {
+			r.data = buffers.Get(int(b.Size))
+			copy(r.data, bs[pos:])
+			pos += int(b.Size)
+		}
+		rs = append(rs, r)
+	}
+	if bs != nil {
+		buffers.Put(bs)
+	}
+	return rs
+}
+
+func blockList(bs []bqBlock) []scanner.Block {
+	blocks := make([]scanner.Block, len(bs))
+	for i, b := range bs {
+		blocks[i] = b.block
+	}
+	return blocks
+}
+
+// blockMatches returns true if the data of the result hashes to the block
+// that was requested. With CheckBlockHashes, a block that doesn't is
+// requested again from another node.
+func blockMatches(res requestResult) bool {
+	h := sha256.Sum256(res.data)
+	return len(res.data) == int(res.block.Size) && bytes.Equal(h[:], res.block.Hash)
+}
+
+// oversizedBlock deals with a result holding more data than the requested
+// block, which written as is would overwrite the start of the next block.
+// The excess is cut off with TrimOversizedBlocks, otherwise the block is
+// rejected. Returns true if it was rejected.
+func (p *puller) oversizedBlock(of *openFile, res *requestResult) bool {
+	if of.err != nil || res.err != nil || len(res.data) <= int(res.block.Size) {
+		return false
+	}
+	if !p.cfg.Options.TrimOversizedBlocks {
+		p.rejectBlock(of, *res)
+		return true
+	}
+	l.Warnf("Node %s sent %d bytes instead of %d for %q at offset %d in repository %q; ignoring the excess", res.node, len(res.data), res.block.Size, res.file.Name, res.offset, p.repoCfg.ID)
+	res.data = res.data[:res.block.Size]
+	return false
+}
+
+// rejectBlock discards a block that doesn't belong where it was requested
+// and queues it again.
+func (p *puller) rejectBlock(of *openFile, res requestResult) {
+	l.Warnf("Node %s sent a bad block for %q at offset %d in repository %q; requesting it elsewhere", res.node, res.file.Name, res.offset, p.repoCfg.ID)
+	events.Default.Log(events.BadBlock, map[string]string{
+		"repo":   p.repoCfg.ID,
+		"item":   res.file.Name,
+		"offset": fmt.Sprint(res.offset),
+		"node":   res.node,
+	})
+	buffers.Put(res.data)
+	p.requestElsewhere(of, res)
+}
+
+// requestFailed queues the block of a request that failed again, without
+// anything being written for it.
+func (p *puller) requestFailed(of *openFile, res requestResult) {
+	if debug {
+		l.Debugf("pull: error: %q / %q offset %d from %s: %v", p.repoCfg.ID, res.file.Name, res.offset, res.node, res.err)
+	}
+	p.requestElsewhere(of, res)
+}
+
+// requestElsewhere queues the block of res again. The node that sent it is
+// not asked for blocks of the file again, so the block comes from another
+// node or the file fails for lack of a source.
+func (p *puller) requestElsewhere(of *openFile, res requestResult) {
+	of.badSources |= 1 << uint(p.model.cm.Get(res.node))
+	// Still outstanding, now in the queue
+	p.bq.put(bqAdd{
+		file:     res.file,
+		need:     []scanner.Block{res.block},
+		repair:   true,
+		priority: filePriority(p.repoCfg.PriorityPatterns, res.file.Name),
+	})
+}
+
+// failFile fails the file of b with err, removing the temporary file. The
+// file is forgotten once no more requests for it are outstanding.
+func (p *puller) failFile(b bqBlock, of openFile, err error) {
+	of.err = err
+	if of.file != nil {
+		of.file.Close()
+		of.file = nil
+		of.removeTemp()
+	}
+	if b.last || of.done && of.outstanding == 0 {
+		p.forgetFailed(b.file.Name)
+	} else {
+		p.openFiles[b.file.Name] = of
+	}
+}
+
 func (p *puller) handleEmptyBlock(b bqBlock) {
 	f := b.file
 	of := p.openFiles[f.Name]
 
+	if b.last && of.err == nil && of.journal != nil {
+		// Nothing to fetch, but the size or metadata may still change
+		p.closeFile(f)
+		return
+	}
+
 	if b.last {
 		if of.err == nil {
+			of.flush()
+			if p.syncEachFile() {
+				of.file.Sync()
+			}
 			of.file.Close()
 		}
 	}
@@ -537,31 +1925,46 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 		if debug {
 			l.Debugf("pull: delete %q", f.Name)
 		}
-		os.Remove(of.temp)
+		of.removeTemp()
+		p.keepSource(f.Name, of.filepath)
 		os.Chmod(of.filepath, 0666)
+		var err error
 		if p.versioner != nil {
-			if err := p.versioner.Archive(of.filepath); err == nil {
-				p.model.updateLocal(p.repoCfg.ID, f)
-			}
-		} else if err := os.Remove(of.filepath); err == nil || os.IsNotExist(err) {
-			p.model.updateLocal(p.repoCfg.ID, f)
+			err = p.versioner.Archive(of.filepath)
+		} else if p.trash != nil {
+			err = p.trash.Archive(of.filepath)
+		} else {
+			err = os.Remove(of.filepath)
+		}
+		if err != nil && gone(of.filepath) {
+			// Removed by someone else meanwhile
+			err = nil
+		}
+		if err == nil {
+			delete(p.inUse, f.Name)
+			delete(p.pendingDeletes, f.Name)
+			delete(p.failedDeletes, f.Name)
+			p.updateLocal(f)
+		} else {
+			p.deleteFailed(f, err)
 		}
 	} else {
 		if debug {
 			l.Debugf("pull: no blocks to fetch and nothing to copy for %q / %q", p.repoCfg.ID, f.Name)
 		}
-		t := time.Unix(f.Modified, 0)
-		if os.Chtimes(of.temp, t, t) != nil {
-			delete(p.openFiles, f.Name)
-			return
-		}
-		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) && os.Chmod(of.temp, os.FileMode(f.Flags&0777)) != nil {
-			delete(p.openFiles, f.Name)
+		if err := p.setMetadata(f, of.temp); err != nil {
+			p.metadataFailed(f, err)
+			p.forgetFailed(f.Name)
 			return
 		}
 		osutil.ShowFile(of.temp)
-		if osutil.Rename(of.temp, of.filepath) == nil {
-			p.model.updateLocal(p.repoCfg.ID, f)
+		of.bitmap.remove()
+		if err := osutil.Rename(of.temp, of.filepath); err == nil {
+			p.renamed(f, of.filepath)
+			p.stats.filesCompleted++
+		} else {
+			p.checkInUse(f, err)
+			p.stats.pullErrors++
 		}
 	}
 	delete(p.openFiles, f.Name)
@@ -569,22 +1972,165 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 
 func (p *puller) queueNeededBlocks() {
 	queued := 0
-	for _, f := range p.model.NeedFilesRepo(p.repoCfg.ID) {
+	phChanged := false
+	var groups linkGroups
+	var needed map[string]bool
+	var srcs map[string]string // local files by the hashes of their blocks, with ShareBlocks
+	var busy map[string]bool   // files already queued
+	fs := p.model.NeedFilesRepo(p.repoCfg.ID)
+	if p.repoCfg.DeleteGraceHours > 0 {
+		p.prunePendingDeletes(fs)
+	}
+	p.pruneFailedDeletes(fs)
+	if p.checkStaleNeed(fs) {
+		fs = p.model.NeedFilesRepo(p.repoCfg.ID)
+	}
+	var dirs *dirBudget
+	var dirWaiting int
+	if limit := p.cfg.Options.MaxNewDirsPerCycle; limit > 0 {
+		dirs = newDirBudget(p.dir, limit)
+		sort.Sort(byName(fs))
+	}
+	for _, f := range fs {
+		if p.verifyExisting(f) {
+			continue
+		}
+		if p.repoCfg.IgnoreConflicts && isConflictCopy(f.Name) {
+			if debug {
+				l.Debugf("%q: %q is a conflict copy, skipping", p.repoCfg.ID, f.Name)
+			}
+			continue
+		}
+		if p.waitingInUse(f.Name) {
+			if debug {
+				l.Debugf("%q: %q is in use, skipping", p.repoCfg.ID, f.Name)
+			}
+			continue
+		}
+		if p.waitingDelete(f) {
+			continue
+		}
+		if v, ok := p.invalidNames[f.Name]; ok && v == f.Version {
+			// Already found to be impossible to create
+			continue
+		}
+		if p.inconsistentBlocks(f) {
+			continue
+		}
+		if p.repoCfg.DeleteGraceHours > 0 && protocol.IsDeleted(f.Flags) && !protocol.IsDirectory(f.Flags) && p.deferDelete(f) {
+			continue
+		}
+		if dirs != nil && !protocol.IsDeleted(f.Flags) && !dirs.allow(f) {
+			// Picked up in a later cycle, once the directories
+			// queued in this one have been created
+			dirWaiting++
+			continue
+		}
+		if p.needsPlaceholder(f) {
+			if p.queuePlaceholder(f) {
+				queued++
+			} else {
+				phChanged = true
+			}
+			continue
+		}
+		if p.repoCfg.PreserveHardlinks && protocol.IsHardlink(f.Flags) && !protocol.IsDeleted(f.Flags) {
+			if groups == nil {
+				groups = p.model.hardlinkGroups(p.repoCfg.ID)
+				needed = make(map[string]bool, len(fs))
+				for _, nf := range fs {
+					needed[nf.Name] = !p.waitingInUse(nf.Name)
+				}
+			}
+			if p.queueHardlink(f, groups, needed) {
+				continue
+			}
+		}
 		lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+		if sameExceptPerms(lf, f, p.model.modTimeWindow()) && (lf.Flags == f.Flags || p.repoCfg.PermsMode == config.PermsModeIgnore) {
+			// Nothing to pull; take the new version as is so that
+			// the difference isn't pulled, or announced, again.
+			if debug {
+				l.Debugf("%q: %q differs only in metadata", p.repoCfg.ID, f.Name)
+			}
+			p.updateLocal(f)
+			continue
+		}
 		have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+		var shared []sharedCopy
+		if p.repoCfg.ShareBlocks && len(need) > 0 {
+			if srcs == nil {
+				srcs = p.localBlocks()
+				busy = make(map[string]bool)
+				for _, name := range p.bq.fileNames() {
+					busy[name] = true
+				}
+			}
+			if !busy[f.Name] {
+				// The queue drops additions for files already queued
+				need, shared = p.shareBlocks(f, need, srcs)
+			}
+		}
 		if debug {
-			l.Debugf("need:\n  local: %v\n  global: %v\n  haveBlocks: %v\n  needBlocks: %v", lf, f, have, need)
+			l.Debugf("need:\n  local: %v\n  global: %v\n  haveBlocks: %v\n  needBlocks: %v\n  shared: %d files", lf, f, have, need, len(shared))
 		}
 		queued++
 		p.bq.put(bqAdd{
-			file: f,
-			have: have,
-			need: need,
+			file:     f,
+			have:     have,
+			need:     need,
+			shared:   shared,
+			priority: filePriority(p.repoCfg.PriorityPatterns, f.Name),
 		})
 	}
+	if phChanged {
+		p.model.savePlaceholders(p.repoCfg.ID)
+	}
+	p.finishVerifyPass()
+	p.mut.Lock()
+	p.stats.dirWaiting = int64(dirWaiting)
+	p.mut.Unlock()
 	if debug && queued > 0 {
 		l.Debugf("%q: queued %d blocks", p.repoCfg.ID, queued)
 	}
+	if debug && dirWaiting > 0 {
+		l.Debugf("%q: %d files wait for directories beyond the limit of %d", p.repoCfg.ID, dirWaiting, dirs.limit)
+	}
+}
+
+// filePriority returns the queue priority of the named file. Files matching
+// an earlier pattern come before those matching a later one, which come
+// before the files matching none. A pattern matches the path of the file
+// within the repository or its base name.
+func filePriority(patterns []string, name string) int {
+	for i, pattern := range patterns {
+		if ok, _ := filepath.Match(filepath.FromSlash(pattern), name); ok {
+			return len(patterns) - i
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(name)); ok {
+			return len(patterns) - i
+		}
+	}
+	return 0
+}
+
+// sameExceptPerms returns true if the local file lf and the needed file f
+// are the same apart from their versions and permission bits, with
+// modification times at most window apart.
+func sameExceptPerms(lf, f scanner.File, window time.Duration) bool {
+	const permBits = protocol.FlagNoPermBits | 07777
+	if lf.Name != f.Name || protocol.IsDeleted(lf.Flags) || lf.Flags&^permBits != f.Flags&^permBits {
+		return false
+	}
+	if !scanner.ModTimeEqual(lf.Modified, f.Modified, window) || lf.Size != f.Size || len(lf.Blocks) != len(f.Blocks) {
+		return false
+	}
+	for i := range lf.Blocks {
+		if lf.Blocks[i].Size != f.Blocks[i].Size || !bytes.Equal(lf.Blocks[i].Hash, f.Blocks[i].Hash) {
+			return false
+		}
+	}
+	return true
 }
 
 func (p *puller) closeFile(f scanner.File) {
@@ -593,75 +2139,761 @@ func (p *puller) closeFile(f scanner.File) {
 	}
 
 	of := p.openFiles[f.Name]
+	if of.journal != nil {
+		p.closeInPlace(f, of)
+		return
+	}
+
+	err := of.flush()
+	if err == nil && of.cz == nil {
+		// Blocks of zeros at the end were left out
+		err = extendFile(of.file, f.Size)
+	}
+	if err == nil && p.syncEachFile() {
+		err = of.file.Sync()
+	}
+	small := err == nil && p.batchesRename(f, of)
+	var hb []scanner.Block
+	if small {
+		// Small files are hashed through the still open temporary file,
+		// saving opening it again
+		hb, _ = scanner.BlocksWith(io.NewSectionReader(of.file, 0, f.Size), scanner.StandardBlockSize, p.repoCfg.ChunkerType)
+	}
 	of.file.Close()
-	defer os.Remove(of.temp)
+	if err == nil && of.cz != nil {
+		// The blocks are verified against the uncompressed contents
+		err = expandTemp(of.temp, f.Size, p.syncEachFile())
+	}
+
+	var completed, queued bool
+	defer func() {
+		switch {
+		case queued:
+			// Counted once renamed into place
+		case completed:
+			p.stats.filesCompleted++
+		default:
+			p.stats.pullErrors++
+		}
+		if !queued {
+			of.removeTemp()
+		}
+	}()
 
 	delete(p.openFiles, f.Name)
 
-	fd, err := os.Open(of.temp)
 	if err != nil {
 		if debug {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		}
 		return
 	}
-	hb, _ := scanner.Blocks(fd, scanner.StandardBlockSize)
-	fd.Close()
+
+	if !small {
+		fd, err := os.Open(of.temp)
+		if err != nil {
+			if debug {
+				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+			}
+			return
+		}
+		hb, _ = p.hashTemp(fd)
+		fd.Close()
+	}
 
 	if l0, l1 := len(hb), len(f.Blocks); l0 != l1 {
 		if debug {
 			l.Debugf("pull: %q / %q: nblocks %d != %d", p.repoCfg.ID, f.Name, l0, l1)
 		}
+		p.verifyFailed(f, of.temp, hb, -1)
 		return
 	}
 
 	for i := range hb {
 		if bytes.Compare(hb[i].Hash, f.Blocks[i].Hash) != 0 {
 			l.Debugf("pull: %q / %q: block %d hash mismatch", p.repoCfg.ID, f.Name, i)
+			p.verifyFailed(f, of.temp, hb, i)
 			return
 		}
 	}
 
-	t := time.Unix(f.Modified, 0)
-	err = os.Chtimes(of.temp, t, t)
-	if debug && err != nil {
-		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
-	}
-	if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) {
-		err = os.Chmod(of.temp, os.FileMode(f.Flags&0777))
-		if debug && err != nil {
-			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
-		}
+	if err := p.setMetadata(f, of.temp); err != nil {
+		p.metadataFailed(f, err)
+		return
 	}
 
 	osutil.ShowFile(of.temp)
 
+	if p.repoCfg.DirAtomic {
+		p.holdForDir(f, of)
+		queued = true
+		return
+	}
+	if small {
+		p.queueRename(f, of)
+		queued = true
+		return
+	}
+	if p.install(f, of) {
+		p.renamed(f, of.filepath)
+		completed = true
+	}
+}
+
+// hashTemp returns the blocks of the opened temporary file. With
+// VerifyWorkers above one, each worker hashes a consecutive part of it.
+// Content defined blocks are always hashed serially, since where each one
+// ends depends on those before it.
+func (p *puller) hashTemp(fd *os.File) ([]scanner.Block, error) {
+	workers := p.cfg.Options.VerifyWorkers
+	if workers <= 1 || p.repoCfg.ChunkerType == scanner.ChunkerCDC {
+		return scanner.BlocksWith(fd, scanner.StandardBlockSize, p.repoCfg.ChunkerType)
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return scanner.ParallelBlocks(fd, info.Size(), scanner.StandardBlockSize, workers)
+}
+
+// install renames the verified temporary file of f into place, keeping a
+// file changed during the pull as a conflict copy and archiving the file
+// replaced. Returns false if the file was left out.
+func (p *puller) install(f scanner.File, of openFile) bool {
+	if p.changedDuringPull(of) {
+		if err := p.keepConflict(f, of.filepath); err != nil {
+			l.Warnf("File %q in repository %q was changed during the pull and can't be kept: %v", f.Name, p.repoCfg.ID, err)
+			p.checkInUse(f, err)
+			return false
+		}
+	}
+
 	if p.versioner != nil {
 		err := p.versioner.Archive(of.filepath)
 		if err != nil {
 			if debug {
 				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 			}
-			return
+			p.checkInUse(f, err)
+			return false
 		}
 	}
 
 	if debug {
 		l.Debugf("pull: rename %q / %q: %q", p.repoCfg.ID, f.Name, of.filepath)
 	}
-	if err := osutil.Rename(of.temp, of.filepath); err == nil {
-		p.model.updateLocal(p.repoCfg.ID, f)
-	} else {
+	if err := osutil.Rename(of.temp, of.filepath); err != nil {
 		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		p.checkInUse(f, err)
+		return false
 	}
+	return true
 }
 
-func invalidateRepo(cfg *config.Configuration, repoID string, err error) {
-	for i := range cfg.Repositories {
-		repo := &cfg.Repositories[i]
-		if repo.ID == repoID {
-			repo.Invalid = err.Error()
-			return
+// verifyFailed reports that the temporary file of f didn't match the
+// expected blocks, the first mismatch being at block i, or the number of
+// blocks differing if i is negative. With KeepFailedTemps, the temporary file
+// is kept for inspection instead of being removed.
+func (p *puller) verifyFailed(f scanner.File, temp string, got []scanner.Block, i int) {
+	data := map[string]interface{}{
+		"repo":           p.repoCfg.ID,
+		"item":           f.Name,
+		"version":        f.Version,
+		"expectedBlocks": len(f.Blocks),
+		"blocks":         len(got),
+	}
+	if i >= 0 {
+		data["block"] = i
+		data["expectedHash"] = fmt.Sprintf("%x", f.Blocks[i].Hash)
+		data["hash"] = fmt.Sprintf("%x", got[i].Hash)
+	}
+
+	if p.cfg.Options.KeepFailedTemps {
+		reason := fmt.Sprintf("%d blocks, expected %d", len(got), len(f.Blocks))
+		if i >= 0 {
+			reason = fmt.Sprintf("block %d does not match its hash", i)
+		}
+		dst, err := p.keepFailedTemp(f, temp, reason)
+		if err == nil {
+			l.Warnf("Pulled file %q in repository %q does not match its hashes; kept as %q", f.Name, p.repoCfg.ID, dst)
+			data["kept"] = dst
+		} else {
+			l.Warnf("Pulled file %q in repository %q does not match its hashes and could not be kept: %v", f.Name, p.repoCfg.ID, err)
+		}
+	}
+
+	events.Default.Log(events.PullVerifyFailed, data)
+}
+
+// changedDuringPull returns true if the file about to be replaced by the
+// pulled one was created or modified on disk since the pull started. A
+// modification time within the window is only taken as a change if the size
+// changed as well.
+func (p *puller) changedDuringPull(of openFile) bool {
+	info, err := os.Lstat(of.filepath)
+	if err != nil {
+		return false
+	}
+	d := info.ModTime().Sub(of.targetMod)
+	if d < 0 {
+		d = -d
+	}
+	return d > p.model.modTimeWindow() || d != 0 && info.Size() != of.targetSize
+}
+
+// keepConflict moves the locally changed file at path aside to a conflict
+// copy, which is picked up by the next scan like any other new file unless
+// the repository ignores conflict copies. With ConflictNodeID, the copy is
+// named with our short ID, so that it is clear whose changes it holds.
+func (p *puller) keepConflict(f scanner.File, path string) error {
+	var node string
+	if p.cfg.Options.ConflictNodeID {
+		// The copy holds the changes made here
+		node = p.model.nodeID
+	}
+	dst := conflictName(path, time.Now(), node)
+	if err := osutil.Rename(path, dst); err != nil {
+		return err
+	}
+	l.Warnf("File %q in repository %q was changed during the pull; the local copy is kept as %q", f.Name, p.repoCfg.ID, dst)
+	events.Default.Log(events.LocalConflict, map[string]interface{}{
+		"repo":    p.repoCfg.ID,
+		"item":    f.Name,
+		"version": f.Version,
+		"kept":    dst,
+	})
+	p.model.recordChange(p.repoCfg.ID, f, ChangeConflict)
+	return nil
+}
+
+// The marker and time format of conflict copy names.
+const (
+	conflictMarker     = ".sync-conflict-"
+	conflictTimeFormat = "20060102-150405"
+)
+
+// The number of characters of a node ID kept in conflict copy names.
+const shortIDLen = 7
+
+// conflictName returns the name of the conflict copy of path made at t, with
+// the extension kept last so that the copy opens like the original. Unless
+// node is empty, its short ID follows the time.
+func conflictName(path string, t time.Time, node string) string {
+	ext := filepath.Ext(path)
+	name := path[:len(path)-len(ext)] + conflictMarker + t.Format(conflictTimeFormat)
+	if id := shortNodeID(node); id != "" {
+		name += "-" + id
+	}
+	return name + ext
+}
+
+// shortNodeID returns the first characters of the node ID, leaving out any
+// that are not letters or digits so that it is safe in file names.
+func shortNodeID(node string) string {
+	id := make([]byte, 0, shortIDLen)
+	for i := 0; i < len(node) && len(id) < shortIDLen; i++ {
+		switch c := node[i]; {
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			id = append(id, c)
+		case c >= 'a' && c <= 'z':
+			id = append(id, c-'a'+'A')
+		}
+	}
+	return string(id)
+}
+
+// ParseConflictName returns the name of the original file, the time and the
+// short ID of the node, if any, of the named conflict copy. ok is false if
+// the name is not that of a conflict copy.
+func ParseConflictName(name string) (orig string, t time.Time, node string, ok bool) {
+	dir, base := filepath.Split(name)
+	i := strings.LastIndex(base, conflictMarker)
+	if i < 0 {
+		return "", time.Time{}, "", false
+	}
+	rest := base[i+len(conflictMarker):]
+	if len(rest) < len(conflictTimeFormat) {
+		return "", time.Time{}, "", false
+	}
+	t, err := time.ParseInLocation(conflictTimeFormat, rest[:len(conflictTimeFormat)], time.Local)
+	if err != nil {
+		return "", time.Time{}, "", false
+	}
+	rest = rest[len(conflictTimeFormat):]
+	if strings.HasPrefix(rest, "-") {
+		end := strings.IndexByte(rest, '.')
+		if end < 0 {
+			end = len(rest)
+		}
+		node = rest[1:end]
+		if node == "" || shortNodeID(node) != node {
+			return "", time.Time{}, "", false
 		}
+		rest = rest[end:]
+	}
+	if rest != "" && !strings.HasPrefix(rest, ".") {
+		return "", time.Time{}, "", false
+	}
+	return dir + base[:i] + rest, t, node, true
+}
+
+// The delay before the first retry of a failed metadata operation; it is
+// doubled for each following attempt.
+var metadataRetryDelay = 100 * time.Millisecond
+
+// setMetadata sets the modification time and, unless ignored, the
+// permissions of f on the file at path. Operations that fail with what may be
+// a transient error, as is common on network filesystems, are retried a few
+// times.
+func (p *puller) setMetadata(f scanner.File, path string) error {
+	t := time.Unix(f.Modified, 0)
+	err := withRetries(p.cfg.Options.MetadataRetries, func() error {
+		return os.Chtimes(path, t, t)
+	})
+	if err != nil {
+		return err
+	}
+	if !p.repoCfg.IgnoresPerms() && protocol.HasPermissionBits(f.Flags) {
+		return withRetries(p.cfg.Options.MetadataRetries, func() error {
+			return os.Chmod(path, scanner.FileMode(f.Flags, p.repoCfg.SpecialPermBits))
+		})
+	}
+	return nil
+}
+
+// metadataFailed reports that the metadata of f could not be set. The file
+// is still needed, so it is pulled again later.
+func (p *puller) metadataFailed(f scanner.File, err error) {
+	l.Infof("Cannot set modification time or permissions of %q in repository %q, will retry later: %v", f.Name, p.repoCfg.ID, err)
+}
+
+// withRetries calls op until it succeeds, fails permanently or has been
+// retried the given number of times.
+func withRetries(retries int, op func() error) error {
+	delay := metadataRetryDelay
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i >= retries || os.IsPermission(err) || os.IsNotExist(err) {
+			return err
+		}
+		if debug {
+			l.Debugf("pull: retrying after %v: %v", delay, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// The first retry of a failed scan waits this long, and each further one
+// twice as long as the one before.
+var scanRetryDelay = 5 * time.Second
+
+// The puller scans through this, so that tests can replace it.
+var scanModelRepo = (*Model).ScanRepo
+
+// scanRepo scans the repository. A scan that failed with what looks like a
+// transient error is retried up to ScanRetries times.
+func (p *puller) scanRepo() error {
+	delay := scanRetryDelay
+	for i := 0; ; i++ {
+		err := scanModelRepo(p.model, p.repoCfg.ID)
+		if err == nil || i >= p.cfg.Options.ScanRetries || !transientScanError(err) {
+			return err
+		}
+		l.Infof("Scanning repository %q failed, retrying in %v: %v", p.repoCfg.ID, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// transientScanError returns true if the scan failed in a way that may well
+// go away by itself, such as an I/O error, rather than the repository
+// directory being missing, inaccessible or not a directory.
+func transientScanError(err error) bool {
+	_, ok := err.(*os.PathError)
+	return ok && !os.IsNotExist(err) && !os.IsPermission(err)
+}
+
+// checkInUse returns true if err indicates that f could not be updated
+// because it is in use by another process. The file is then skipped when
+// queueing needed files, for an increasing period of time on each attempt
+// until it can be updated.
+func (p *puller) checkInUse(f scanner.File, err error) bool {
+	if !osutil.IsInUse(err) {
+		return false
+	}
+
+	if p.inUse == nil {
+		p.inUse = make(map[string]backoff)
+	}
+	b, ok := p.inUse[f.Name]
+	if !ok {
+		l.Infof("File %q in repository %q is in use by another process; waiting for it to be released", f.Name, p.repoCfg.ID)
+		b.delay = inUseBackoffMin
+	} else if b.delay *= 2; b.delay > inUseBackoffMax {
+		b.delay = inUseBackoffMax
+	}
+	b.until = time.Now().Add(b.delay)
+	p.inUse[f.Name] = b
+
+	events.Default.Log(events.ItemInUse, map[string]string{
+		"repo":  p.repoCfg.ID,
+		"item":  f.Name,
+		"error": err.Error(),
+		"retry": b.until.Format(time.RFC3339),
+	})
+	return true
+}
+
+// waitingInUse returns true if the named file was recently found to be in
+// use and should not be retried yet.
+func (p *puller) waitingInUse(name string) bool {
+	b, ok := p.inUse[name]
+	return ok && time.Now().Before(b.until)
+}
+
+// invalidFilename returns true if f can't be created on this platform because
+// of its name. Each version of such a file is reported once, instead of
+// failing to be created over and over.
+func (p *puller) invalidFilename(f scanner.File) bool {
+	err := osutil.CheckFilename(f.Name)
+	if err == nil {
+		return false
+	}
+
+	if v, ok := p.invalidNames[f.Name]; ok && v == f.Version {
+		return true
+	}
+	if p.invalidNames == nil {
+		p.invalidNames = make(map[string]uint64)
+	}
+	p.invalidNames[f.Name] = f.Version
+
+	l.Warnf("Not syncing %q in repository %q: invalid filename for this platform: %v", f.Name, p.repoCfg.ID, err)
+	events.Default.Log(events.InvalidFilename, map[string]string{
+		"repo":  p.repoCfg.ID,
+		"item":  f.Name,
+		"error": err.Error(),
+	})
+	return true
+}
+
+// syncEachFile returns true if every file should be synced to disk before it
+// is renamed into place. With FsyncBatchFiles above one, files are instead
+// synced together once the batch is full or FsyncIntervalS has passed. That
+// is much faster for many small files; a crash may lose the contents of the
+// current batch, but those files are not in the index yet and are rehashed
+// by the next scan.
+func (p *puller) syncEachFile() bool {
+	return p.cfg.Options.FsyncFiles && p.cfg.Options.FsyncBatchFiles <= 1
+}
+
+// renamed is called when f has been renamed into place at path. The local
+// index is updated once the file is durable, which with batched syncing
+// happens when the batch is flushed.
+func (p *puller) renamed(f scanner.File, path string) {
+	delete(p.inUse, f.Name)
+
+	switch {
+	case !p.cfg.Options.FsyncFiles:
+		p.updateLocal(f)
+
+	case p.cfg.Options.FsyncBatchFiles <= 1:
+		if err := osutil.SyncDir(filepath.Dir(path)); err != nil && debug {
+			l.Debugf("pull: sync dir: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		}
+		p.updateLocal(f)
+
+	default:
+		if len(p.syncBatch) == 0 {
+			p.syncBatchStart = time.Now()
+		}
+		p.syncBatch = append(p.syncBatch, pendingSync{f, path})
+		if len(p.syncBatch) >= p.cfg.Options.FsyncBatchFiles {
+			p.flushSyncBatch()
+		}
+	}
+}
+
+// flushSyncBatch syncs the files in the current batch and their directories
+// to disk, then records them in the local index. Files that cannot be synced
+// are left out of the index, so that they are rehashed by the next scan.
+func (p *puller) flushSyncBatch() {
+	if debug {
+		l.Debugf("pull: %q: syncing %d files", p.repoCfg.ID, len(p.syncBatch))
+	}
+
+	dirs := make(map[string]bool)
+	var synced []scanner.File
+	for _, s := range p.syncBatch {
+		if err := osutil.SyncFile(s.path); err != nil {
+			if debug {
+				l.Debugf("pull: sync: %q / %q: %v", p.repoCfg.ID, s.file.Name, err)
+			}
+			continue
+		}
+		dirs[filepath.Dir(s.path)] = true
+		synced = append(synced, s.file)
+	}
+	for dir := range dirs {
+		if err := osutil.SyncDir(dir); err != nil && debug {
+			l.Debugf("pull: sync dir: %q / %q: %v", p.repoCfg.ID, dir, err)
+		}
+	}
+	for _, f := range synced {
+		p.updateLocal(f)
+	}
+	p.syncBatch = nil
+}
+
+// forgetFailed removes a file that failed to sync from the set of open files.
+// An in-place update is rolled back.
+func (p *puller) forgetFailed(name string) {
+	of := p.openFiles[name]
+	if of.journal != nil {
+		if of.file != nil {
+			of.file.Close()
+		}
+		if err := of.journal.rollback(); err != nil {
+			l.Warnf("Rollback %q: %v", of.filepath, err)
+		}
+	}
+	of.bitmap.close()
+	delete(p.openFiles, name)
+	p.stats.pullErrors++
+
+	if !of.announced.IsZero() {
+		// The blocks are gone with the temporary file
+		p.model.announcePartial(p.repoCfg.ID, name, of.version, nil)
+	}
+
+	if of.err == errMixedVersions || of.err == errTempChanged {
+		// Start over right away rather than waiting for the next round
+		p.requeue(name)
+	} else if of.err != nil {
+		p.model.fetched(p.repoCfg.ID, name, of.version, of.err)
+	}
+}
+
+// canUpdateInPlace returns true if the file of the first block b should be
+// updated in place, i.e. if that is enabled and all the blocks to copy
+// are already at the right offset in the existing file.
+func (p *puller) canUpdateInPlace(b bqBlock) bool {
+	if !p.repoCfg.InPlaceUpdate || p.versioner != nil || len(b.copy) == 0 {
+		return false
+	}
+
+	lf := p.model.CurrentRepoFile(p.repoCfg.ID, b.file.Name)
+	if protocol.IsDeleted(lf.Flags) || protocol.IsDirectory(lf.Flags) {
+		return false
+	}
+	existing := make(map[int64]string, len(lf.Blocks))
+	for _, lb := range lf.Blocks {
+		existing[lb.Offset] = string(lb.Hash)
+	}
+	for _, cb := range b.copy {
+		if existing[cb.Offset] != string(cb.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// openInPlace opens the existing file for writing, along with a journal to
+// roll back the changes.
+func (p *puller) openInPlace(of *openFile) {
+	of.file, of.err = os.OpenFile(of.filepath, os.O_RDWR, 0)
+	if of.err != nil {
+		return
+	}
+	var fi os.FileInfo
+	fi, of.err = of.file.Stat()
+	if of.err == nil {
+		of.journal, of.err = createJournal(of.filepath, fi.Size())
+	}
+	if of.err != nil {
+		of.file.Close()
+		of.file = nil
+		return
+	}
+	of.temp = ""
+	if debug {
+		l.Debugf("pull: %q / %q: updating in place", p.repoCfg.ID, of.filepath)
+	}
+}
+
+// closeInPlace completes an in-place update, or rolls it back if the result
+// does not verify.
+func (p *puller) closeInPlace(f scanner.File, of openFile) {
+	delete(p.openFiles, f.Name)
+
+	err := p.finishInPlace(f, of)
+	of.file.Close()
+	if err != nil {
+		if debug {
+			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		}
+		if err := of.journal.rollback(); err != nil {
+			l.Warnf("Rollback %q: %v", of.filepath, err)
+		}
+		p.stats.pullErrors++
+		return
+	}
+
+	of.journal.remove()
+	p.updateLocal(f)
+	p.stats.filesCompleted++
+}
+
+func (p *puller) finishInPlace(f scanner.File, of openFile) error {
+	if tail := of.journal.origSize - f.Size; tail > 0 {
+		if err := of.journal.save(of.file, f.Size, tail); err != nil {
+			return err
+		}
+	}
+	if err := of.file.Truncate(f.Size); err != nil {
+		return err
+	}
+	if err := of.file.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := of.file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	hb, err := scanner.BlocksWith(of.file, scanner.StandardBlockSize, p.repoCfg.ChunkerType)
+	if err != nil {
+		return err
+	}
+	if !blocksEqual(hb, f.Blocks) {
+		return errHashMismatch
+	}
+
+	t := time.Unix(f.Modified, 0)
+	err = os.Chtimes(of.filepath, t, t)
+	if debug && err != nil {
+		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+	}
+	if !p.repoCfg.IgnoresPerms() && protocol.HasPermissionBits(f.Flags) {
+		err = os.Chmod(of.filepath, scanner.FileMode(f.Flags, p.repoCfg.SpecialPermBits))
+		if debug && err != nil {
+			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkVersion abandons the pull of f if the global version of the file has
+// changed since we started pulling it. The temporary file is removed and the
+// remaining blocks are treated as failed; the new version is queued as
+// usual once the puller is idle.
+func (p *puller) checkVersion(of *openFile, f scanner.File) {
+	if of.err != nil || !p.cfg.Options.AbortStalePulls {
+		return
+	}
+	gf := p.model.CurrentGlobalFile(p.repoCfg.ID, f.Name)
+	if gf.Version == of.version {
+		return
+	}
+
+	if debug {
+		l.Debugf("pull: %q / %q: global version changed %d -> %d, abandoning", p.repoCfg.ID, f.Name, of.version, gf.Version)
+	}
+	of.err = errVersionChanged
+	of.file.Close()
+	of.file = nil
+	of.removeTemp()
+}
+
+// checkSourceVersion abandons the pull of a file if the result carries a
+// different source version than the earlier results for the file. The source
+// changed the file while we were pulling it, so the blocks received so far
+// are from different versions and the result would not verify. The file is
+// queued again once the outstanding requests for it are accounted for.
+func (p *puller) checkSourceVersion(of *openFile, res requestResult) {
+	if of.err != nil || !p.cfg.Options.CheckSourceVersion {
+		return
+	}
+	if of.srcVersion == 0 {
+		of.srcVersion = res.version
+		return
+	}
+	if res.version == of.srcVersion {
+		return
+	}
+
+	if debug {
+		l.Debugf("pull: %q / %q: source version changed %d -> %d, abandoning", p.repoCfg.ID, res.file.Name, of.srcVersion, res.version)
+	}
+	of.err = errMixedVersions
+	of.file.Close()
+	of.file = nil
+	of.removeTemp()
+}
+
+// requeue queues the current global version of the named file, if it is
+// still needed.
+func (p *puller) requeue(name string) {
+	gf := p.model.CurrentGlobalFile(p.repoCfg.ID, name)
+	lf := p.model.CurrentRepoFile(p.repoCfg.ID, name)
+	if gf.Name != name || gf.Suppressed || lf.Name == name && lf.Version == gf.Version {
+		return
+	}
+	if debug {
+		l.Debugf("pull: %q / %q: queueing version %d again", p.repoCfg.ID, name, gf.Version)
+	}
+	have, need := scanner.BlockDiff(lf.Blocks, gf.Blocks)
+	p.bq.put(bqAdd{
+		file:     gf,
+		have:     have,
+		need:     need,
+		priority: filePriority(p.repoCfg.PriorityPatterns, name),
+	})
+}
+
+// tempFileMode returns the mode to create the temporary file for f with. The
+// owner always gets read and write access, as we need to write the file and
+// read it back for verification; the exact permissions are set before the
+// temporary file is renamed into place.
+func (p *puller) tempFileMode(f scanner.File) os.FileMode {
+	if p.repoCfg.IgnoresPerms() || !protocol.HasPermissionBits(f.Flags) {
+		return 0666
+	}
+	return os.FileMode(f.Flags&0777) | 0600
+}
+
+// debugState fills in the puller specific parts of the debug state, i.e. the
+// currently open files, the head of the block queue and the node activity.
+func (p *puller) debugState(s *RepoDebugState) {
+	p.mut.Lock()
+	for name, of := range p.openFiles {
+		ofs := OpenFileState{
+			Name:        name,
+			Outstanding: of.outstanding,
+			Done:        of.done,
+		}
+		if of.err != nil {
+			ofs.Error = of.err.Error()
+		}
+		s.OpenFiles = append(s.OpenFiles, ofs)
+	}
+	s.NodeActivity = make(map[string]int, len(p.oustandingPerNode))
+	for node, usage := range p.oustandingPerNode {
+		s.NodeActivity[node] = usage
+	}
+	s.RequestSlots = p.slots
+	s.DirWaiting = int(p.stats.dirWaiting)
+	s.DiskThrottle = p.throttle.factor()
+	p.mut.Unlock()
+
+	s.QueueLength = p.bq.size()
+	for _, b := range p.bq.peek(maxDebugQueued) {
+		s.Queued = append(s.Queued, QueuedBlockState{
+			Name:   b.file.Name,
+			Offset: b.block.Offset,
+			Size:   b.block.Size,
+			Copy:   len(b.copy),
+			Last:   b.last,
+		})
 	}
 }
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// setupPull returns a model with a "default" repository in a new temporary
+// directory, where node 42 announces a four block file that is not present
+// locally. All blocks have the same contents, so that a FakeConnection can
+// serve any of them.
+func setupPull(t *testing.T) (dir string, m *Model, f scanner.File, block []byte) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block = bytes.Repeat([]byte("0123456789abcdef"), scanner.StandardBlockSize/16)
+	data := bytes.Repeat(block, 4)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	f = scanner.File{Name: "foo", Version: 3, Size: int64(len(data)), Modified: time.Now().Unix(), Blocks: blocks}
+
+	m = NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir, IgnorePerms: true})
+	m.ReplaceLocal("default", nil)
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+	return
+}
+
+// newTestPuller returns a puller for the repository that has not been
+// started, so that tests can drive it by hand.
+func newTestPuller(m *Model, repoCfg config.RepositoryConfiguration) *puller {
+	return makePuller(repoCfg, m, 0, m.cfg)
+}
+
+// handleResult waits for the result of a request sent by the puller and
+// handles it.
+func handleResult(t testing.TB, p *puller) {
+	select {
+	case res := <-p.requestResults:
+		p.handleRequestResult(res)
+	case <-time.After(time.Second):
+		t.Fatal("No request result")
+	}
+}
+
+// pullFile has the puller request all blocks of f and handles the results.
+func pullFile(t testing.TB, p *puller, f scanner.File) {
+	for i, b := range f.Blocks {
+		if !p.handleBlock(bqBlock{file: f, block: b, last: i == len(f.Blocks)-1}) {
+			handleResult(t, p)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/scanner"
+)
+
+var errRepoPurged = errors.New("repository index is being rebuilt")
+
+// A purgeRepoReq rebuilds the local index from outside the run loop. The
+// result is sent on done.
+type purgeRepoReq struct {
+	all  bool
+	done chan error
+}
+
+// PurgeRepo rebuilds the local index of the repository from the files on
+// disk, hashing every file instead of trusting what the index says about it.
+// Files that turn out to match the index or the global version keep their
+// version; others get a new one, as for a local change. Indexed files that no
+// longer exist are marked as deleted. If all is true, interrupted in-place
+// updates are rolled back, temporary files are removed and the scan cache is
+// emptied as well. Files being pulled are abandoned and pulled again
+// afterwards. The files in the repository are not touched otherwise.
+func (m *Model) PurgeRepo(repo string, all bool) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	moving := m.moving[repo]
+	p := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return ErrNoSuchRepo
+	}
+	if moving {
+		return ErrRepoMoving
+	}
+
+	if p != nil && cap(p.requestSlots) > 0 {
+		// Let the run loop do the purge, so that nothing is pulled
+		// meanwhile
+		req := purgeRepoReq{all: all, done: make(chan error)}
+		select {
+		case p.purgeRepo <- req:
+		case <-p.stopped:
+			return ErrStopped
+		}
+		return <-req.done
+	}
+	return m.purgeLocal(repo, all)
+}
+
+// purgeAll makes the scanner treat every file as changed.
+type purgeAll struct{}
+
+func (purgeAll) CurrentFile(name string) scanner.File {
+	return scanner.File{}
+}
+
+// purgeLocal carries out a purge. The puller, if any, must not be pulling.
+func (m *Model) purgeLocal(repo string, all bool) error {
+	var unreadable []string
+	m.rmut.RLock()
+	w := m.repoWalker(repo, &unreadable)
+	cache, useCache := m.hashCaches[repo]
+	m.rmut.RUnlock()
+
+	l.Infof("Rebuilding the index of repository %q", repo)
+	if all {
+		recoverJournals(w.Dir)
+		(&scanner.Walker{Dir: w.Dir, TempNamer: defTempNamer}).CleanTempFiles()
+		if useCache {
+			cache.reset()
+		}
+	}
+
+	w.CurrentFiler = purgeAll{}
+	w.Suppressor = nil
+	m.setState(repo, RepoScanning)
+	t0 := time.Now()
+	fs, _, err := w.Walk()
+	if err != nil {
+		m.setState(repo, RepoIdle)
+		return err
+	}
+	m.invalidateOversized("the local scan", repo, fs)
+	if useCache {
+		cache.prune()
+	}
+
+	m.rmut.RLock()
+	rf := m.repoFiles[repo]
+	for i, f := range fs {
+		if lf := rf.Get(cid.LocalID, f.Name); sameFile(lf, f) {
+			fs[i].Version = lf.Version
+		} else if gf := rf.GetGlobal(f.Name); sameFile(gf, f) {
+			fs[i].Version = gf.Version
+		}
+	}
+	m.rmut.RUnlock()
+
+	m.replaceLocalKeeping(repo, fs, unreadable)
+
+	m.rmut.RLock()
+	m.saveIndex(repo, m.indexDir, m.protocolIndex(repo))
+	m.rmut.RUnlock()
+
+	m.smut.Lock()
+	m.repoScanTime[repo] = time.Now()
+	m.repoScanDur[repo] = time.Since(t0)
+	m.smut.Unlock()
+	m.setState(repo, RepoIdle)
+	return nil
+}
+
+// sameFile returns true if a and b describe the same contents and metadata,
+// regardless of version.
+func sameFile(a, b scanner.File) bool {
+	return a.Flags == b.Flags && sameExceptPerms(a, b, 0)
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestPurgeRepo(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	// Damage the index: wrong blocks for f, a file that doesn't exist and
+	// a missing entry for a/e
+	rf := m.repoFiles["default"]
+	intact := rf.Get(cid.LocalID, filepath.Join("a", "b", "c"))
+	var damaged []scanner.File
+	for _, f := range rf.Have(cid.LocalID) {
+		switch f.Name {
+		case "f":
+			f.Blocks = []scanner.Block{{Size: uint32(f.Size), Hash: []byte("wrong")}}
+		case filepath.Join("a", "e"):
+			continue
+		}
+		damaged = append(damaged, f)
+	}
+	damaged = append(damaged, scanner.File{Name: "ghost", Version: 1, Size: 5, Modified: intact.Modified})
+	rf.Replace(cid.LocalID, damaged)
+	wrong := rf.Get(cid.LocalID, "f")
+
+	if err := m.PurgeRepo("default", false); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, _ := os.Open(filepath.Join(dir, "f"))
+	blocks, _ := scanner.Blocks(fd, scanner.StandardBlockSize)
+	fd.Close()
+	if f := m.CurrentRepoFile("default", "f"); !sameExceptPerms(f, scanner.File{Name: "f", Size: f.Size, Modified: f.Modified, Blocks: blocks}, 0) {
+		t.Error("Blocks of f not rebuilt")
+	} else if f.Version <= wrong.Version {
+		t.Error("Rebuilt f did not get a new version")
+	}
+	if f := m.CurrentRepoFile("default", filepath.Join("a", "e")); f.Name == "" || protocol.IsDeleted(f.Flags) {
+		t.Error("Missing file not added to the index")
+	}
+	if f := m.CurrentRepoFile("default", "ghost"); !protocol.IsDeleted(f.Flags) {
+		t.Error("Nonexistent file not marked as deleted")
+	}
+	if f := m.CurrentRepoFile("default", intact.Name); f.Version != intact.Version {
+		t.Errorf("Intact file changed version %d != %d", f.Version, intact.Version)
+	}
+	if f := m.CurrentRepoFile("default", "a"); f.Name != "a" || !protocol.IsDirectory(f.Flags) {
+		t.Error("Directory missing from rebuilt index")
+	}
+
+	if err := m.PurgeRepo("other", false); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
+
+func TestPurgeRepoRunning(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	m.StartRepoRW("default", 1)
+
+	temp := filepath.Join(dir, defTempNamer.TempName("f"))
+	ioutil.WriteFile(temp, []byte("partial"), 0644)
+	before := m.CurrentRepoFile("default", "f")
+
+	if err := m.PurgeRepo("default", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Error("Temporary file remains after purge")
+	}
+	if f := m.CurrentRepoFile("default", "f"); f.Version != before.Version {
+		t.Errorf("Unchanged file changed version %d != %d", f.Version, before.Version)
+	}
+
+	// The puller is still running
+	if err := m.PurgeRepo("default", false); err != nil {
+		t.Error(err)
+	}
+}
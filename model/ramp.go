@@ -0,0 +1,101 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+)
+
+// A block for which all sources are at their limit is handled again after
+// this delay.
+var rampWaitDelay = 100 * time.Millisecond
+
+// With RequestRampStart set, a node that starts serving blocks is at first
+// sent at most that many requests at a time. The limit grows by one for each
+// block received from the node and is halved, though never below the start,
+// for each request that fails. A slow node is thus not swamped with the
+// full number of request slots as soon as it connects, while a fast one is
+// soon used as before. The limit starts over when the node reconnects.
+type requestRamp struct {
+	start  int
+	max    int
+	limits map[string]int
+	mut    sync.Mutex
+}
+
+// newRequestRamp returns a ramp starting at start requests per node and
+// growing up to max, or nil if start is not positive.
+func newRequestRamp(start, max int) *requestRamp {
+	if start <= 0 {
+		return nil
+	}
+	if max < start {
+		max = start
+	}
+	return &requestRamp{start: start, max: max, limits: make(map[string]int)}
+}
+
+// limitLocked returns the current limit for the node. Must be called with
+// r.mut held.
+func (r *requestRamp) limitLocked(node string) int {
+	if n, ok := r.limits[node]; ok {
+		return n
+	}
+	return r.start
+}
+
+// full returns true if the node may not be sent more requests while it has
+// the given number outstanding.
+func (r *requestRamp) full(node string, outstanding int) bool {
+	if r == nil {
+		return false
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return outstanding >= r.limitLocked(node)
+}
+
+// done adjusts the limit for the node to the outcome of a request.
+func (r *requestRamp) done(node string, ok bool) {
+	if r == nil {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	n := r.limitLocked(node)
+	if ok && n < r.max {
+		n++
+	} else if !ok {
+		if n /= 2; n < r.start {
+			n = r.start
+		}
+	}
+	r.limits[node] = n
+}
+
+// forget has the node start over at the initial limit.
+func (r *requestRamp) forget(node string) {
+	if r == nil {
+		return
+	}
+	r.mut.Lock()
+	delete(r.limits, node)
+	r.mut.Unlock()
+}
+
+// rampHeld returns true if a node in the availability set that may be
+// asked for blocks is at its ramp limit, so that a block that found no
+// source only has to wait for one.
+func (m activityMap) rampHeld(availability uint64, cm *cid.Map, prefs nodePrefs) bool {
+	if prefs.ramp == nil {
+		return false
+	}
+	for _, node := range cm.Names() {
+		id := cm.Get(node)
+		if id != cid.LocalID && !prefs.denied[node] && availability&(1<<id) != 0 && prefs.ramp.full(node, m[node]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/cid"
+)
+
+func TestRequestRamp(t *testing.T) {
+	if r := newRequestRamp(0, 16); r != nil {
+		t.Error("Unexpected ramp without a start")
+	}
+
+	r := newRequestRamp(2, 4)
+	if r.full("foo", 1) || !r.full("foo", 2) {
+		t.Error("Incorrect initial limit")
+	}
+	for i := 0; i < 5; i++ {
+		r.done("foo", true)
+	}
+	if r.full("foo", 3) || !r.full("foo", 4) {
+		t.Errorf("Incorrect limit %d after successes, expected max", r.limits["foo"])
+	}
+	if !r.full("bar", 2) {
+		t.Error("Limit raised for another node")
+	}
+
+	r.done("foo", false)
+	if n := r.limits["foo"]; n != 2 {
+		t.Errorf("Incorrect limit %d after a failure", n)
+	}
+	r.done("foo", false)
+	if n := r.limits["foo"]; n != 2 {
+		t.Errorf("Incorrect limit %d, below the start", n)
+	}
+
+	r.done("foo", true)
+	r.forget("foo")
+	if !r.full("foo", 2) {
+		t.Error("Limit not reset by forget")
+	}
+}
+
+func TestActivityMapRamp(t *testing.T) {
+	cm := cid.NewMap()
+	fooID := cm.Get("foo")
+	barID := cm.Get("bar")
+
+	prefs := nodePrefs{ramp: newRequestRamp(1, 4)}
+	m := make(activityMap)
+	if node := m.leastBusyNode(1<<fooID|1<<barID, cm, prefs); node != "foo" {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+	if node := m.leastBusyNode(1<<fooID|1<<barID, cm, prefs); node != "bar" {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+	if node := m.leastBusyNode(1<<fooID, cm, prefs); node != "" {
+		t.Errorf("Incorrect least busy node %q, expected none at the limit", node)
+	}
+	if !m.rampHeld(1<<fooID, cm, prefs) {
+		t.Error("Node at its limit not reported")
+	}
+
+	prefs.ramp.done("foo", true)
+	if node := m.leastBusyNode(1<<fooID, cm, prefs); node != "foo" {
+		t.Errorf("Incorrect least busy node %q after ramping up", node)
+	}
+	if m.rampHeld(1<<fooID, cm, nodePrefs{}) {
+		t.Error("Node held without a ramp")
+	}
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The time constant of the transfer rate average. Older transfers are
+// weighted down exponentially, so that the rate follows changes within a few
+// seconds and decays towards zero when idle.
+const rateTimeConstant = 5 * time.Second
+
+// A rateMeter keeps an exponentially weighted moving average of a byte rate.
+// Each update and read is constant time.
+type rateMeter struct {
+	rate float64 // bytes per second, as of last
+	last time.Time
+	mut  sync.Mutex
+}
+
+// decay returns the rate decayed to the time now. Must be called with mut
+// held.
+func (r *rateMeter) decay(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	dt := now.Sub(r.last).Seconds()
+	return r.rate * math.Exp(-dt/rateTimeConstant.Seconds())
+}
+
+func (r *rateMeter) addAt(bytes int, now time.Time) {
+	r.mut.Lock()
+	r.rate = r.decay(now) + float64(bytes)/rateTimeConstant.Seconds()
+	r.last = now
+	r.mut.Unlock()
+}
+
+func (r *rateMeter) add(bytes int) {
+	r.addAt(bytes, time.Now())
+}
+
+// kbpsAt returns the rate in KiB per second at the time now.
+func (r *rateMeter) kbpsAt(now time.Time) float64 {
+	r.mut.Lock()
+	rate := r.decay(now)
+	r.mut.Unlock()
+	return rate / 1024
+}
+
+type repoRate struct {
+	in  rateMeter // bytes received from the network
+	out rateMeter // bytes served to other nodes
+	eta etaEstimate
+}
+
+type TransferRate struct {
+	InKBps  float64
+	OutKBps float64
+}
+
+// TransferRate returns the current transfer rates for each repository and the
+// total over all repositories.
+func (m *Model) TransferRate() (total TransferRate, repos map[string]TransferRate) {
+	now := time.Now()
+
+	m.rmut.RLock()
+	repos = make(map[string]TransferRate, len(m.repoRates))
+	for repo, r := range m.repoRates {
+		repos[repo] = TransferRate{
+			InKBps:  r.in.kbpsAt(now),
+			OutKBps: r.out.kbpsAt(now),
+		}
+	}
+	m.rmut.RUnlock()
+
+	total = TransferRate{
+		InKBps:  m.totalRate.in.kbpsAt(now),
+		OutKBps: m.totalRate.out.kbpsAt(now),
+	}
+	return total, repos
+}
+
+func (m *Model) recordIn(repo string, bytes int) {
+	m.rmut.RLock()
+	r, ok := m.repoRates[repo]
+	m.rmut.RUnlock()
+	if ok {
+		r.in.add(bytes)
+	}
+	m.totalRate.in.add(bytes)
+}
+
+func (m *Model) recordOut(repo string, bytes int) {
+	m.rmut.RLock()
+	r, ok := m.repoRates[repo]
+	m.rmut.RUnlock()
+	if ok {
+		r.out.add(bytes)
+	}
+	m.totalRate.out.add(bytes)
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	var r rateMeter
+	t0 := time.Now()
+
+	if k := r.kbpsAt(t0); k != 0 {
+		t.Errorf("Unexpected initial rate %f", k)
+	}
+
+	// A steady 100 KiB/s converges towards 100
+	for i := 0; i < 300; i++ {
+		r.addAt(10*1024, t0.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	now := t0.Add(299 * 100 * time.Millisecond)
+	if k := r.kbpsAt(now); math.Abs(k-100) > 10 {
+		t.Errorf("Incorrect steady rate %f != 100", k)
+	}
+
+	// It decays towards zero when idle
+	if k := r.kbpsAt(now.Add(time.Minute)); k > 0.1 {
+		t.Errorf("Rate did not decay; %f", k)
+	}
+}
+
+func TestTransferRate(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := m.Request("42", "default", "f", 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	m.recordIn("default", 1024)
+
+	total, repos := m.TransferRate()
+	if total.InKBps <= 0 || total.OutKBps <= 0 {
+		t.Errorf("Incorrect total rate %v", total)
+	}
+	if r := repos["default"]; r.InKBps <= 0 || r.OutKBps <= 0 {
+		t.Errorf("Incorrect repo rate %v", r)
+	}
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// Files of at most this size, a single block, are renamed into place in
+// batches when Options.SmallFileBatch is above one.
+const smallFileSize = scanner.StandardBlockSize
+
+// A pendingRename is a small file that has been verified and waits in its
+// temporary file to be renamed into place with the rest of the batch.
+type pendingRename struct {
+	file scanner.File
+	of   openFile
+}
+
+// batchesRename returns true if f is renamed into place as part of a batch.
+func (p *puller) batchesRename(f scanner.File, of openFile) bool {
+	return p.cfg.Options.SmallFileBatch > 1 && f.Size <= smallFileSize && of.cz == nil
+}
+
+// queueRename adds the verified file to the rename batch, flushing the batch
+// once it is full.
+func (p *puller) queueRename(f scanner.File, of openFile) {
+	p.renameBatch = append(p.renameBatch, pendingRename{f, of})
+	if len(p.renameBatch) >= p.cfg.Options.SmallFileBatch {
+		p.flushRenameBatch()
+	}
+}
+
+// flushRenameBatch renames the files in the batch into place one directory
+// at a time. Each rename is atomic on its own. When each file is to be
+// synced to disk, the directories are synced once for the whole batch
+// instead of once per file.
+func (p *puller) flushRenameBatch() {
+	batch := p.renameBatch
+	p.renameBatch = nil
+	if debug {
+		l.Debugf("pull: %q: renaming %d small files", p.repoCfg.ID, len(batch))
+	}
+	sort.Sort(byDir(batch))
+
+	var done []pendingRename
+	for _, r := range batch {
+		if p.install(r.file, r.of) {
+			done = append(done, r)
+			p.stats.filesCompleted++
+		} else {
+			p.stats.pullErrors++
+		}
+		r.of.removeTemp()
+	}
+
+	if !p.syncEachFile() {
+		for _, r := range done {
+			p.renamed(r.file, r.of.filepath)
+		}
+		return
+	}
+	for i, r := range done {
+		dir := filepath.Dir(r.of.filepath)
+		if i == 0 || dir != filepath.Dir(done[i-1].of.filepath) {
+			if err := osutil.SyncDir(dir); err != nil && debug {
+				l.Debugf("pull: sync dir: %q / %q: %v", p.repoCfg.ID, dir, err)
+			}
+		}
+	}
+	for _, r := range done {
+		delete(p.inUse, r.file.Name)
+		p.updateLocal(r.file)
+	}
+}
+
+type byDir []pendingRename
+
+func (s byDir) Len() int      { return len(s) }
+func (s byDir) Swap(a, b int) { s[a], s[b] = s[b], s[a] }
+func (s byDir) Less(a, b int) bool {
+	da, db := filepath.Dir(s[a].of.filepath), filepath.Dir(s[b].of.filepath)
+	if da != db {
+		return da < db
+	}
+	return s[a].of.filepath < s[b].of.filepath
+}
@@ -0,0 +1,108 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// setupSmallFiles returns a model where node 42 has n small files with the
+// same contents spread over two directories.
+func setupSmallFiles(t testing.TB, n int, opts config.OptionsConfiguration) (dir string, m *Model, fs []scanner.File) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("small file contents")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	for i := 0; i < n; i++ {
+		name := filepath.Join(fmt.Sprintf("d%d", i%2), fmt.Sprintf("f%d", i))
+		fs = append(fs, scanner.File{Name: name, Version: 1, Flags: 0644, Size: int64(len(data)), Modified: time.Now().Unix(), Blocks: blocks})
+	}
+
+	m = NewModel("/tmp", &config.Configuration{Options: opts}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	m.ReplaceLocal("default", nil)
+	m.repoFiles["default"].Replace(m.cm.Get("42"), fs)
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	return
+}
+
+func TestSmallFileBatch(t *testing.T) {
+	dir, m, fs := setupSmallFiles(t, 4, config.OptionsConfiguration{SmallFileBatch: 3})
+	defer os.RemoveAll(dir)
+	p := newTestPuller(m, m.repoCfgs["default"])
+
+	exists := func(f scanner.File) bool {
+		_, err := os.Stat(filepath.Join(dir, f.Name))
+		return err == nil
+	}
+
+	for _, f := range fs[:2] {
+		pullFile(t, p, f)
+		if exists(f) || m.CurrentRepoFile("default", f.Name).Version != 0 {
+			t.Errorf("%q renamed into place before the batch is full", f.Name)
+		}
+	}
+
+	// The third file fills the batch
+	pullFile(t, p, fs[2])
+	for _, f := range fs[:3] {
+		if !exists(f) || m.CurrentRepoFile("default", f.Name).Version != f.Version {
+			t.Errorf("%q not in place after the batch was full", f.Name)
+		}
+	}
+	if p.stats.filesCompleted != 3 {
+		t.Errorf("Incorrect number of completed files %d != 3", p.stats.filesCompleted)
+	}
+
+	pullFile(t, p, fs[3])
+	if exists(fs[3]) {
+		t.Error("Fourth file renamed into place before the batch is flushed")
+	}
+	p.abandonOpenFiles(ErrRepoMoving)
+	if !exists(fs[3]) || len(p.renameBatch) != 0 {
+		t.Error("Waiting file not renamed into place when abandoning open files")
+	}
+	temps, _ := filepath.Glob(filepath.Join(dir, "*", defTempNamer.TempName("*")))
+	if len(temps) != 0 {
+		t.Errorf("Temporary files left behind: %v", temps)
+	}
+}
+
+func benchmarkPullSmallFiles(b *testing.B, batch int) {
+	const n = 100
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, m, fs := setupSmallFiles(b, n, config.OptionsConfiguration{FsyncFiles: true, FsyncBatchFiles: 1, SmallFileBatch: batch})
+		p := newTestPuller(m, m.repoCfgs["default"])
+		b.StartTimer()
+
+		for _, f := range fs {
+			pullFile(b, p, f)
+		}
+		if len(p.renameBatch) > 0 {
+			p.flushRenameBatch()
+		}
+
+		b.StopTimer()
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkPullSmallFiles(b *testing.B) {
+	benchmarkPullSmallFiles(b, 0)
+}
+
+func BenchmarkPullSmallFilesBatched(b *testing.B) {
+	benchmarkPullSmallFiles(b, 50)
+}
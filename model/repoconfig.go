@@ -0,0 +1,223 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/versioner"
+)
+
+// A setRepoCfgReq replaces the repository configuration from outside the run
+// loop. The done channel is closed once the change has been applied.
+type setRepoCfgReq struct {
+	cfg  config.RepositoryConfiguration
+	done chan struct{}
+}
+
+// GetRepoConfig returns the configuration the repository is running with,
+// including any changes made since it was started.
+func (m *Model) GetRepoConfig(repo string) (config.RepositoryConfiguration, error) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	cfg, ok := m.repoCfgs[repo]
+	if !ok {
+		return config.RepositoryConfiguration{}, ErrNoSuchRepo
+	}
+	return cfg, nil
+}
+
+// UpdateRepoConfig validates cfg and applies it to the running repository
+// with the same ID. A changed directory moves the repository, as by
+// MoveRepo; the permission and versioning settings are changed as by
+// SetIgnorePerms and SetVersioner, and the remaining settings apply from the
+// next file pulled. The node list, the read only flag, the chunker, the disk
+// index, the scan cache and atomic swap can't be changed while running.
+// Nothing is changed if cfg is invalid. The change is not saved to the
+// configuration.
+func (m *Model) UpdateRepoConfig(cfg config.RepositoryConfiguration) error {
+	m.rmut.RLock()
+	cur, ok := m.repoCfgs[cfg.ID]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return ErrNoSuchRepo
+	}
+	if err := validateRepoConfig(cfg); err != nil {
+		return err
+	}
+	if err := checkFixedSettings(cur, cfg); err != nil {
+		return err
+	}
+
+	cfg.Directory = filepath.Clean(cfg.Directory)
+	if cfg.Directory != filepath.Clean(cur.Directory) {
+		if err := m.MoveRepo(cfg.ID, cfg.Directory); err != nil {
+			return err
+		}
+	}
+	if cfg.IgnorePerms != cur.IgnorePerms {
+		if err := m.SetIgnorePerms(cfg.ID, cfg.IgnorePerms); err != nil {
+			return err
+		}
+	}
+	if !reflect.DeepEqual(cfg.Versioning, cur.Versioning) {
+		if err := m.SetVersioner(cfg.ID, cfg.Versioning.Type, cfg.Versioning.Params); err != nil {
+			return err
+		}
+	}
+
+	cfg.Invalid = cur.Invalid
+	m.rmut.Lock()
+	m.repoCfgs[cfg.ID] = cfg
+	// The puller may have been started by the versioning change
+	p := m.pullers[cfg.ID]
+	m.rmut.Unlock()
+
+	if p != nil && cap(p.requestSlots) > 0 {
+		// Let the run loop apply the change
+		req := setRepoCfgReq{cfg: cfg, done: make(chan struct{})}
+		select {
+		case p.repoCfgReqs <- req:
+		case <-p.stopped:
+			return ErrStopped
+		}
+		return p.wait(req.done)
+	}
+	return nil
+}
+
+// validateRepoConfig returns a description of the first problem found with
+// cfg, or nil if it can be used.
+func validateRepoConfig(cfg config.RepositoryConfiguration) error {
+	if cfg.Directory == "" {
+		return errors.New("directory must be set")
+	}
+	if err := checkDirectory(cfg.Directory); err != nil {
+		return fmt.Errorf("directory %q can't be used: %v", cfg.Directory, err)
+	}
+	if cfg.PermsMode != "" && cfg.PermsMode != config.PermsModeIgnore {
+		return fmt.Errorf("unknown permissions mode %q", cfg.PermsMode)
+	}
+	if !scanner.ValidChunker(cfg.ChunkerType) {
+		return fmt.Errorf("unknown chunker type %q", cfg.ChunkerType)
+	}
+	if cfg.AtomicSwap && cfg.ReadOnly {
+		return errors.New("atomicSwap can't be used with a read only repository")
+	}
+	if err := versioner.ValidateParams(cfg.Versioning.Type, cfg.Versioning.Params); err != nil {
+		return err
+	}
+
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"minConnectedPeers", cfg.MinConnectedPeers},
+		{"deleteGraceHours", cfg.DeleteGraceHours},
+		{"deleteRetries", cfg.DeleteRetries},
+		{"trashMaxAgeDays", cfg.TrashMaxAgeDays},
+		{"trashMaxSizeMiB", cfg.TrashMaxSizeMiB},
+		{"failedTempsMax", cfg.FailedTempsMax},
+		{"conflictMaxAgeDays", cfg.ConflictMaxAgeDays},
+		{"conflictMaxCount", cfg.ConflictMaxCount},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %d", v.name, v.value)
+		}
+	}
+
+	for _, pattern := range cfg.IgnoreTempPatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ignoreTempPattern %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range cfg.PriorityPatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("priorityPattern %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range cfg.StaticPatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("staticPattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkDirectory returns an error unless dir is a directory or can be
+// created as one, i.e. the closest existing parent is a directory.
+func checkDirectory(dir string) error {
+	for d := filepath.Clean(dir); ; {
+		info, err := os.Stat(d)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s: not a directory", d)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return err
+		}
+		d = parent
+	}
+}
+
+// checkFixedSettings returns an error if cfg changes any of the settings of
+// the running repository that take a restart to change.
+func checkFixedSettings(cur, cfg config.RepositoryConfiguration) error {
+	var changed string
+	switch {
+	case !sameNodes(cur.Nodes, cfg.Nodes):
+		changed = "nodes"
+	case cfg.ReadOnly != cur.ReadOnly:
+		changed = "ro"
+	case cfg.ChunkerType != cur.ChunkerType:
+		changed = "chunker"
+	case cfg.DiskIndex != cur.DiskIndex:
+		changed = "diskIndex"
+	case cfg.ScanCache != cur.ScanCache:
+		changed = "scanCache"
+	case cfg.AtomicSwap != cur.AtomicSwap:
+		changed = "atomicSwap"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s can't be changed while the repository is running", changed)
+}
+
+func sameNodes(a, b []config.NodeConfiguration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].NodeID != b[i].NodeID {
+			return false
+		}
+	}
+	return true
+}
+
+// setRepoConfig switches the puller to a new configuration of the
+// repository. The directory, permissions and versioning have already been
+// changed through their own requests.
+func (p *puller) setRepoConfig(cfg config.RepositoryConfiguration) {
+	p.repoCfg = cfg
+
+	prefs := newNodePrefs(cfg)
+	prefs.lanWeight = p.nodePrefs.lanWeight
+	prefs.isLAN = p.nodePrefs.isLAN
+	prefs.ramp = p.ramp
+	p.nodePrefs = prefs
+
+	// Picks up changes to the trash settings
+	p.setVersioner(cfg.Versioning, p.versioner)
+}
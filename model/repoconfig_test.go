@@ -0,0 +1,145 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+)
+
+func TestUpdateRepoConfigValidation(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+
+	cases := []struct {
+		change func(*config.RepositoryConfiguration)
+		err    string
+	}{
+		{func(c *config.RepositoryConfiguration) { c.Directory = "" }, "directory must be set"},
+		{func(c *config.RepositoryConfiguration) { c.Directory = filepath.Join(dir, "file", "sub") }, "not a directory"},
+		{func(c *config.RepositoryConfiguration) { c.PermsMode = "sometimes" }, "unknown permissions mode"},
+		{func(c *config.RepositoryConfiguration) { c.ChunkerType = "nonexistent" }, "unknown chunker type"},
+		{func(c *config.RepositoryConfiguration) { c.Versioning.Type = "nonexistent" }, "unknown versioning type"},
+		{func(c *config.RepositoryConfiguration) {
+			c.Versioning = config.VersioningConfiguration{Type: "simple", Params: map[string]string{"keep": "-1"}}
+		}, `"keep" must be a non-negative integer`},
+		{func(c *config.RepositoryConfiguration) { c.MinConnectedPeers = -1 }, "minConnectedPeers must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.DeleteGraceHours = -1 }, "deleteGraceHours must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.DeleteRetries = -1 }, "deleteRetries must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.TrashMaxAgeDays = -1 }, "trashMaxAgeDays must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.TrashMaxSizeMiB = -1 }, "trashMaxSizeMiB must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.FailedTempsMax = -1 }, "failedTempsMax must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.ConflictMaxAgeDays = -1 }, "conflictMaxAgeDays must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.ConflictMaxCount = -1 }, "conflictMaxCount must not be negative"},
+		{func(c *config.RepositoryConfiguration) { c.IgnoreTempPatterns = []string{"*.tmp", "[a-"} }, "ignoreTempPattern"},
+		{func(c *config.RepositoryConfiguration) { c.PriorityPatterns = []string{"[a-"} }, "priorityPattern"},
+		{func(c *config.RepositoryConfiguration) { c.StaticPatterns = []string{"[a-"} }, "staticPattern"},
+		{func(c *config.RepositoryConfiguration) { c.AtomicSwap, c.ReadOnly = true, true }, "atomicSwap can't be used"},
+		{func(c *config.RepositoryConfiguration) {
+			c.Nodes = append(c.Nodes, config.NodeConfiguration{NodeID: "43"})
+		}, "nodes can't be changed"},
+		{func(c *config.RepositoryConfiguration) { c.ReadOnly = !c.ReadOnly }, "ro can't be changed"},
+		{func(c *config.RepositoryConfiguration) { c.ChunkerType = "cdc" }, "chunker can't be changed"},
+		{func(c *config.RepositoryConfiguration) { c.DiskIndex = !c.DiskIndex }, "diskIndex can't be changed"},
+		{func(c *config.RepositoryConfiguration) { c.ScanCache = !c.ScanCache }, "scanCache can't be changed"},
+		{func(c *config.RepositoryConfiguration) { c.AtomicSwap = true }, "atomicSwap can't be changed"},
+	}
+
+	orig, err := m.GetRepoConfig("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range cases {
+		cfg := orig
+		tc.change(&cfg)
+		err := m.UpdateRepoConfig(cfg)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%d: unexpected error %v, expected %q", i, err, tc.err)
+		}
+		if cur, _ := m.GetRepoConfig("default"); cur.Directory != orig.Directory || cur.MinConnectedPeers != orig.MinConnectedPeers {
+			t.Errorf("%d: configuration changed despite error", i)
+		}
+	}
+
+	if _, err := m.GetRepoConfig("other"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+	cfg := orig
+	cfg.ID = "other"
+	if err := m.UpdateRepoConfig(cfg); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+}
+
+func TestUpdateRepoConfig(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	m.StartRepoRW("default", 1)
+	p := m.pullers["default"]
+
+	cfg, _ := m.GetRepoConfig("default")
+	cfg.MinConnectedPeers = 2
+	cfg.DeniedNodes = []string{"43"}
+	cfg.Versioning = config.VersioningConfiguration{Type: "simple", Params: map[string]string{"keep": "2"}}
+	cfg.KeepDeletedFiles = true
+	if err := m.UpdateRepoConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cur, _ := m.GetRepoConfig("default"); cur.MinConnectedPeers != 2 || cur.Versioning.Type != "simple" {
+		t.Errorf("Configuration not updated: %+v", cur)
+	}
+	if p.repoCfg.MinConnectedPeers != 2 || !p.nodePrefs.denied["43"] {
+		t.Error("Configuration not applied to the puller")
+	}
+	if p.versioner == nil || p.trash != nil {
+		t.Error("Versioning not applied to the puller")
+	}
+
+	// Turning versioning off keeps deleted files in the trash instead
+	cfg.Versioning = config.VersioningConfiguration{}
+	if err := m.UpdateRepoConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if p.versioner != nil || p.trash == nil {
+		t.Error("Trash not set up after turning versioning off")
+	}
+}
+
+func TestRepoTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versioning := func(key, val string) config.VersioningConfiguration {
+		return config.VersioningConfiguration{Type: "simple", Params: map[string]string{key: val}}
+	}
+	cfg := &config.Configuration{Repositories: []config.RepositoryConfiguration{
+		{ID: "good", Versioning: versioning("keep", "10"), ChunkerType: "cdc"},
+		{ID: "typo", Versioning: versioning("keepVersions", "10")},
+		{ID: "malformed", Versioning: versioning("keep", "ten")},
+	}}
+	for i := range cfg.Repositories {
+		cfg.Repositories[i].Directory = filepath.Join(dir, cfg.Repositories[i].ID)
+	}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	for _, repo := range cfg.Repositories {
+		m.AddRepo(repo)
+	}
+	for id := range m.repoCfgs {
+		m.StartRepoRW(id, 1)
+	}
+
+	for i, expected := range []string{"", `unknown parameter "keepVersions"`, `"keep" must be a non-negative integer`} {
+		id := cfg.Repositories[i].ID
+		if inv := m.invalidReason(id); expected == "" && inv != "" || !strings.Contains(inv, expected) {
+			t.Errorf("Repository %q: unexpected invalid reason %q", id, inv)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A blockBitmap records which blocks of a file being pulled have been written
+// to the temporary file. It is kept in a file next to the temporary file, so
+// that a pull interrupted by a restart continues with the missing blocks
+// instead of starting over or hashing the whole partial file.
+//
+// The file holds a header with the version and number of blocks of the file
+// being pulled, followed by one bit per block. A bit is only written to the
+// bitmap file once the temporary file has been synced with the block in it,
+// so after a crash the bitmap may miss blocks, which are pulled again, but
+// never claims one that was lost. The result is verified when the file is
+// closed regardless.
+type blockBitmap struct {
+	fd       *os.File
+	bits     []byte
+	pending  []int // blocks written to the write buffer but not yet to the file
+	unsynced []int // blocks written to the file but not yet synced
+}
+
+const (
+	bitmapMagic   = 0x53544231 // "STB1"
+	bitmapSuffix  = ".bitmap"
+	bitmapHdrSize = 16
+)
+
+// Files with fewer blocks than this are pulled from scratch after a restart;
+// keeping track of them is not worth an extra file.
+var resumeMinBlocks = 64
+
+// Partial files left by an interrupted pull are kept at startup for this
+// long after they were last written to.
+const resumeMaxAge = 7 * 24 * time.Hour
+
+// bitmapName returns the bitmap file name for the given temporary file.
+func bitmapName(temp string) string {
+	return temp + bitmapSuffix
+}
+
+func bitmapHeader(f scanner.File) []byte {
+	var hdr = make([]byte, bitmapHdrSize)
+	binary.BigEndian.PutUint32(hdr[0:], bitmapMagic)
+	binary.BigEndian.PutUint64(hdr[4:], f.Version)
+	binary.BigEndian.PutUint32(hdr[12:], uint32(len(f.Blocks)))
+	return hdr
+}
+
+// createBitmap creates an empty bitmap for pulling f to temp.
+func createBitmap(temp string, f scanner.File) (*blockBitmap, error) {
+	fd, err := os.OpenFile(bitmapName(temp), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	bm := &blockBitmap{fd: fd, bits: make([]byte, (len(f.Blocks)+7)/8)}
+	if _, err := fd.Write(append(bitmapHeader(f), bm.bits...)); err != nil {
+		bm.remove()
+		return nil, err
+	}
+	return bm, nil
+}
+
+// openBitmap opens the existing bitmap for pulling f to temp. If the bitmap
+// was written for another version of the file, or is damaged, it is reset
+// and valid is false.
+func openBitmap(temp string, f scanner.File) (bm *blockBitmap, valid bool, err error) {
+	fd, err := os.OpenFile(bitmapName(temp), os.O_RDWR, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := ioutil.ReadAll(fd)
+	if err != nil {
+		fd.Close()
+		return nil, false, err
+	}
+
+	hdr := bitmapHeader(f)
+	bm = &blockBitmap{fd: fd, bits: make([]byte, (len(f.Blocks)+7)/8)}
+	if len(data) == len(hdr)+len(bm.bits) && bytes.Equal(data[:len(hdr)], hdr) {
+		copy(bm.bits, data[len(hdr):])
+		return bm, true, nil
+	}
+
+	if err := bm.rewrite(hdr); err != nil {
+		bm.remove()
+		return nil, false, err
+	}
+	return bm, false, nil
+}
+
+// rewrite replaces the contents of the bitmap file with the header and the
+// current bits.
+func (bm *blockBitmap) rewrite(hdr []byte) error {
+	if err := bm.fd.Truncate(0); err != nil {
+		return err
+	}
+	_, err := bm.fd.WriteAt(append(hdr, bm.bits...), 0)
+	return err
+}
+
+func (bm *blockBitmap) has(i int) bool {
+	return hasBlock(bm.bits, i)
+}
+
+// set marks block i as written. The bit is written to the bitmap file by
+// persist, once the block is known to be on disk.
+func (bm *blockBitmap) set(i int) {
+	bm.bits[i/8] |= 1 << uint(i%8)
+	bm.unsynced = append(bm.unsynced, i)
+}
+
+// clear marks block i as not written, so that it is pulled again.
+func (bm *blockBitmap) clear(i int) {
+	bm.bits[i/8] &^= 1 << uint(i%8)
+	bm.writeByte(i/8, bm.unsynced)
+}
+
+// persist syncs the temporary file and then writes the bits set since the
+// last time to the bitmap file. Errors writing the bits are ignored; the
+// blocks are pulled again after a restart if the bits did not make it to
+// disk.
+func (bm *blockBitmap) persist(data *os.File) error {
+	if err := data.Sync(); err != nil {
+		return err
+	}
+	synced := bm.unsynced
+	bm.unsynced = nil
+	for _, i := range synced {
+		bm.writeByte(i/8, nil)
+	}
+	return nil
+}
+
+// writeByte writes byte n of the bits to the bitmap file, leaving out the
+// bits of the given blocks.
+func (bm *blockBitmap) writeByte(n int, without []int) {
+	b := bm.bits[n]
+	for _, i := range without {
+		if i/8 == n {
+			b &^= 1 << uint(i%8)
+		}
+	}
+	bm.fd.WriteAt([]byte{b}, int64(bitmapHdrSize+n))
+}
+
+func (bm *blockBitmap) count() int {
+	var n int
+	for _, b := range bm.bits {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// consistent returns true if all the marked blocks are within the temporary
+// file of the given size, which in turn is no larger than the file.
+func (bm *blockBitmap) consistent(size int64, blocks []scanner.Block) bool {
+	if n := len(blocks); n > 0 && size > blocks[n-1].Offset+int64(blocks[n-1].Size) {
+		return false
+	}
+	for i, b := range blocks {
+		if bm.has(i) && b.Offset+int64(b.Size) > size {
+			return false
+		}
+	}
+	return true
+}
+
+// rehash rebuilds the bitmap from the blocks that are found intact in the
+// temporary file.
+func (bm *blockBitmap) rehash(fd *os.File, f scanner.File) error {
+	for i := range bm.bits {
+		bm.bits[i] = 0
+	}
+	bm.unsynced = nil
+	buf := make([]byte, scanner.StandardBlockSize)
+	for i, b := range f.Blocks {
+		if int(b.Size) > len(buf) {
+			buf = make([]byte, b.Size)
+		}
+		if _, err := fd.ReadAt(buf[:b.Size], b.Offset); err != nil {
+			// Past the end of the partial file
+			continue
+		}
+		if h := sha256.Sum256(buf[:b.Size]); bytes.Equal(h[:], b.Hash) {
+			bm.bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return bm.rewrite(bitmapHeader(f))
+}
+
+func (bm *blockBitmap) close() {
+	if bm != nil && bm.fd != nil {
+		bm.fd.Close()
+		bm.fd = nil
+	}
+}
+
+func (bm *blockBitmap) remove() {
+	if bm != nil && bm.fd != nil {
+		name := bm.fd.Name()
+		bm.close()
+		os.Remove(name)
+	}
+}
+
+// blockIndex returns the index of the block at offset, or -1 if there is
+// none.
+func blockIndex(blocks []scanner.Block, offset int64) int {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Offset >= offset
+	})
+	if i < len(blocks) && blocks[i].Offset == offset {
+		return i
+	}
+	return -1
+}
+
+// recordWritten marks the block at offset as complete, and as written in the
+// bitmap if the file has one. Blocks still held by the write buffer are
+// marked in the bitmap once it has been flushed.
+func (of openFile) recordWritten(blocks []scanner.Block, offset int64) {
+	i := blockIndex(blocks, offset)
+	setBlock(of.complete, i)
+	bm := of.bitmap
+	if bm == nil || bm.fd == nil {
+		return
+	}
+	if i >= 0 {
+		bm.pending = append(bm.pending, i)
+	}
+	keep := bm.pending[:0]
+	for _, i := range bm.pending {
+		if of.wb != nil && of.wb.holds(blocks[i].Offset, int(blocks[i].Size)) {
+			keep = append(keep, i)
+		} else {
+			bm.set(i)
+		}
+	}
+	bm.pending = keep
+}
+
+// persistBitmaps syncs the temporary files that have had blocks written to
+// them since the last time, and then records the blocks in their bitmaps.
+// A file that fails to sync is tried again the next time. Must be called
+// with p.mut held.
+func (p *puller) persistBitmaps() {
+	for _, of := range p.openFiles {
+		bm := of.bitmap
+		if of.err != nil || of.file == nil || bm == nil || bm.fd == nil || len(bm.unsynced) == 0 {
+			continue
+		}
+		if err := bm.persist(of.file); err != nil && debug {
+			l.Debugf("pull: %q: bitmap: %v", of.temp, err)
+		}
+	}
+}
+
+// haveWritten returns true if the block at offset was written to the
+// temporary file before the pull was interrupted.
+func (of openFile) haveWritten(blocks []scanner.Block, offset int64) bool {
+	return of.bitmap != nil && of.bitmap.has(blockIndex(blocks, offset))
+}
+
+// With IncrementalVerify, the blocks of a large file that have reached the
+// temporary file are read back and checked against their hashes while the
+// pull goes on. A block damaged on its way to the disk is then pulled again
+// right away, instead of failing the whole file when it is closed. To bound
+// the cost, at most incrementalVerifyBlocks blocks are checked per file every
+// incrementalVerifyInterval, going round the written blocks in order.
+var (
+	incrementalVerifyInterval = 30 * time.Second
+	incrementalVerifyBlocks   = 8
+)
+
+// verifyWritten checks the next few written blocks of the file, if it is
+// time to, and queues any that don't match to be pulled again. The queued
+// blocks are counted as outstanding, keeping the file open until they have
+// been handled.
+func (p *puller) verifyWritten(of *openFile, f scanner.File) {
+	if !p.repoCfg.IncrementalVerify || of.bitmap == nil || of.bitmap.fd == nil || of.file == nil {
+		return
+	}
+	if time.Since(of.verified) < incrementalVerifyInterval {
+		return
+	}
+	of.verified = time.Now()
+
+	var bad []scanner.Block
+	buf := make([]byte, scanner.StandardBlockSize)
+	checked := 0
+	for n := 0; n < len(f.Blocks) && checked < incrementalVerifyBlocks; n++ {
+		i := of.verifyNext
+		of.verifyNext = (i + 1) % len(f.Blocks)
+		if !of.bitmap.has(i) {
+			continue
+		}
+		checked++
+
+		b := f.Blocks[i]
+		if int(b.Size) > len(buf) {
+			buf = make([]byte, b.Size)
+		}
+		if _, err := of.file.ReadAt(buf[:b.Size], b.Offset); err == nil {
+			if h := sha256.Sum256(buf[:b.Size]); bytes.Equal(h[:], b.Hash) {
+				continue
+			}
+		}
+		l.Warnf("Block at offset %d of %q in repository %q is damaged after writing; pulling it again", b.Offset, f.Name, p.repoCfg.ID)
+		of.bitmap.clear(i)
+		clearBlock(of.complete, i)
+		bad = append(bad, b)
+	}
+
+	if len(bad) > 0 {
+		of.outstanding += len(bad)
+		p.bq.put(bqAdd{file: f, need: bad, repair: true, priority: filePriority(p.repoCfg.PriorityPatterns, f.Name)})
+	}
+}
+
+// removeTemp removes the temporary file along with its bitmap.
+func (of openFile) removeTemp() {
+	of.bitmap.close()
+	if of.temp == "" {
+		return
+	}
+	os.Remove(of.temp)
+	os.Remove(bitmapName(of.temp))
+}
+
+// resumeTemp reopens the temporary file left by an interrupted pull of f,
+// returning false if there is none to continue from. The bitmap is trusted
+// as long as it is consistent with the size of the temporary file, as its
+// bits are only written once their blocks have been synced; otherwise the
+// blocks are hashed to find out which are already there.
+func (p *puller) resumeTemp(of *openFile, f scanner.File) bool {
+	if len(f.Blocks) < resumeMinBlocks {
+		return false
+	}
+	bm, valid, err := openBitmap(of.temp, f)
+	if err != nil {
+		return false
+	}
+	fd, err := os.OpenFile(of.temp, os.O_RDWR, 0)
+	if err != nil {
+		bm.remove()
+		return false
+	}
+
+	fi, err := fd.Stat()
+	if err == nil && (!valid || !bm.consistent(fi.Size(), f.Blocks)) {
+		if debug {
+			l.Debugf("pull: %q / %q: bitmap does not match partial file, rehashing", p.repoCfg.ID, f.Name)
+		}
+		err = bm.rehash(fd, f)
+	}
+	if err != nil {
+		fd.Close()
+		bm.remove()
+		return false
+	}
+
+	of.file = fd
+	of.bitmap = bm
+	if debug {
+		l.Debugf("pull: %q / %q: resuming with %d of %d blocks", p.repoCfg.ID, f.Name, bm.count(), len(f.Blocks))
+	}
+	return true
+}
+
+// keepResumable returns true for the temporary files and bitmaps of
+// interrupted pulls that are recent enough to be resumed.
+func keepResumable(path string, info os.FileInfo) bool {
+	temp, bitmap := path, bitmapName(path)
+	if strings.HasSuffix(path, bitmapSuffix) {
+		temp, bitmap = strings.TrimSuffix(path, bitmapSuffix), path
+	}
+	if _, err := os.Stat(temp); err != nil {
+		return false
+	}
+	bi, err := os.Stat(bitmap)
+	return err == nil && time.Since(bi.ModTime()) < resumeMaxAge
+}
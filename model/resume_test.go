@@ -0,0 +1,333 @@
+package model
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumePull(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: block}, &requests}
+	m.AddConnection(fc, fc)
+
+	// Pull the first two blocks and stop once they are recorded in the
+	// bitmap, as if interrupted
+	p := newTestPuller(m, m.repoCfgs["default"])
+	for _, b := range f.Blocks[:2] {
+		p.handleBlock(bqBlock{file: f, block: b})
+		handleResult(t, p)
+	}
+	p.persistBitmaps()
+	of := p.openFiles["foo"]
+	of.file.Close()
+	of.bitmap.close()
+
+	for _, name := range []string{of.temp, bitmapName(of.temp)} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keepResumable(name, info) {
+			t.Errorf("%q should be kept for resuming", name)
+		}
+	}
+
+	// A new puller only requests the remaining blocks
+	requests = 0
+	p = newTestPuller(m, m.repoCfgs["default"])
+	pullFile(t, p, f)
+	if requests != 2 {
+		t.Errorf("Incorrect number of requests %d != 2", requests)
+	}
+
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after pull")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat(block, 4)) {
+		t.Error("Incorrect file contents after resumed pull")
+	}
+	for _, name := range []string{of.temp, bitmapName(of.temp)} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Unexpected %q remaining after pull", name)
+		}
+	}
+}
+
+// failingConnection fails every request.
+type failingConnection struct {
+	FakeConnection
+}
+
+func (c failingConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	return nil, errors.New("request failed")
+}
+
+func TestFailedRequestNotRecorded(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, _ := setupPull(t)
+	defer os.RemoveAll(dir)
+	fc := failingConnection{FakeConnection{id: "42"}}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.handleBlock(bqBlock{file: f, block: f.Blocks[0]})
+	handleResult(t, p)
+
+	of := p.openFiles["foo"]
+	if of.err != nil {
+		t.Fatalf("File failed: %v", of.err)
+	}
+	if hasBlock(of.complete, 0) || of.bitmap.has(0) {
+		t.Error("Failed block recorded as written")
+	}
+	if of.outstanding != 1 {
+		t.Errorf("%d blocks outstanding, expected the failed one", of.outstanding)
+	}
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b := p.bq.get(); b.file.Name != "foo" || b.block.Offset != 0 || !b.repair {
+		t.Errorf("Failed block not queued again: %v", b)
+	}
+}
+
+func TestResumeInconsistentBitmap(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	temp := filepath.Join(dir, defTempNamer.TempName("foo"))
+
+	// The partial file holds one intact and one damaged block, while the
+	// bitmap claims three blocks
+	partial := append(append([]byte{}, block...), block...)
+	partial[len(block)]++
+	if err := ioutil.WriteFile(temp, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bm, err := createBitmap(temp, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		bm.set(i)
+	}
+	fd, err := os.Open(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.persist(fd); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	bm.close()
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	of := openFile{temp: temp}
+	if !p.resumeTemp(&of, f) {
+		t.Fatal("Partial file not resumed")
+	}
+	defer of.file.Close()
+	defer of.bitmap.close()
+
+	for i := range f.Blocks {
+		if have := of.bitmap.has(i); have != (i == 0) {
+			t.Errorf("Block %d: incorrect state %v after rehash", i, have)
+		}
+	}
+
+	// The rehashed bitmap is written back
+	bm, valid, err := openBitmap(temp, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bm.close()
+	if !valid || bm.count() != 1 || !bm.has(0) {
+		t.Error("Rehashed bitmap not saved")
+	}
+}
+
+func TestBitmapPersist(t *testing.T) {
+	dir, _, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	temp := filepath.Join(dir, defTempNamer.TempName("foo"))
+
+	if err := ioutil.WriteFile(temp, block, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bm, err := createBitmap(temp, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bm.close()
+
+	saved := func() *blockBitmap {
+		sbm, valid, err := openBitmap(temp, f)
+		if err != nil || !valid {
+			t.Fatal("Bitmap not readable", err)
+		}
+		sbm.close()
+		return sbm
+	}
+
+	// Neither setting a block, nor clearing another one in the same byte,
+	// puts the bit on disk before the temporary file is synced
+	bm.set(0)
+	bm.set(1)
+	bm.clear(1)
+	if saved().count() != 0 {
+		t.Error("Bit written before the temporary file was synced")
+	}
+
+	fd, err := os.Open(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := bm.persist(fd); err != nil {
+		t.Fatal(err)
+	}
+	if sbm := saved(); sbm.count() != 1 || !sbm.has(0) {
+		t.Error("Bit not written after the temporary file was synced")
+	}
+}
+
+func TestResumeOtherVersion(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	temp := filepath.Join(dir, defTempNamer.TempName("foo"))
+
+	if err := ioutil.WriteFile(temp, block, 0644); err != nil {
+		t.Fatal(err)
+	}
+	of := f
+	of.Version--
+	bm, err := createBitmap(temp, of)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm.close()
+
+	// The bitmap is for another version, but the block in the partial
+	// file is still good
+	p := newTestPuller(m, m.repoCfgs["default"])
+	nf := openFile{temp: temp}
+	if !p.resumeTemp(&nf, f) {
+		t.Fatal("Partial file not resumed")
+	}
+	defer nf.file.Close()
+	defer nf.bitmap.close()
+	if nf.bitmap.count() != 1 || !nf.bitmap.has(0) {
+		t.Error("Intact block not found by rehash")
+	}
+}
+
+func TestKeepResumable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	temp := filepath.Join(dir, defTempNamer.TempName("foo"))
+	if err := ioutil.WriteFile(temp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(temp)
+	if keepResumable(temp, info) {
+		t.Error("Temporary file without bitmap should not be kept")
+	}
+
+	if err := ioutil.WriteFile(bitmapName(temp), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !keepResumable(temp, info) {
+		t.Error("Temporary file with bitmap should be kept")
+	}
+
+	old := time.Now().Add(-resumeMaxAge - time.Hour)
+	os.Chtimes(bitmapName(temp), old, old)
+	if keepResumable(temp, info) {
+		t.Error("Old temporary file should not be kept")
+	}
+}
+
+func TestIncrementalVerify(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	defer func(d time.Duration) { incrementalVerifyInterval = d }(incrementalVerifyInterval)
+	resumeMinBlocks = 1
+	incrementalVerifyInterval = 0
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	cfg := m.repoCfgs["default"]
+	cfg.IncrementalVerify = true
+	m.repoCfgs["default"] = cfg
+
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	pull := func(b bqBlock) {
+		if p.handleBlock(b) {
+			t.Fatalf("Block at offset %d not requested", b.block.Offset)
+		}
+		handleResult(t, p)
+	}
+
+	// The first block is damaged after it has been written, which is
+	// noticed once the next one arrives
+	pull(bqBlock{file: f, block: f.Blocks[0]})
+	p.openFiles["foo"].file.WriteAt([]byte("damage"), 0)
+	pull(bqBlock{file: f, block: f.Blocks[1]})
+
+	of := p.openFiles["foo"]
+	if of.bitmap.has(0) || of.outstanding != 1 {
+		t.Fatalf("Damaged block not queued again; written %v, outstanding %d", of.bitmap.has(0), of.outstanding)
+	}
+
+	// The file stays open until the block has been pulled again
+	pull(bqBlock{file: f, block: f.Blocks[2]})
+	pull(bqBlock{file: f, block: f.Blocks[3], last: true})
+	if _, ok := p.openFiles["foo"]; !ok {
+		t.Fatal("File closed with a block outstanding")
+	}
+	rb := p.bq.get()
+	if !rb.repair || rb.block.Offset != 0 {
+		t.Fatalf("Incorrect block %v queued", rb)
+	}
+	pull(rb)
+
+	if _, ok := p.openFiles["foo"]; ok {
+		t.Fatal("Unexpected open file after pull")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat(block, 4)) {
+		t.Error("Incorrect file contents after repair")
+	}
+}
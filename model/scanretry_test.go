@@ -0,0 +1,66 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestScanRetry(t *testing.T) {
+	defer func(d time.Duration) { scanRetryDelay = d }(scanRetryDelay)
+	scanRetryDelay = time.Millisecond
+	defer func() { scanModelRepo = (*Model).ScanRepo }()
+
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	m.cfg.Options.ScanRetries = 2
+	p := newTestPuller(m, m.repoCfgs["default"])
+
+	var scans int
+	failing := func(errs ...error) {
+		scans = 0
+		scanModelRepo = func(m *Model, repo string) error {
+			scans++
+			if scans <= len(errs) {
+				return errs[scans-1]
+			}
+			return m.ScanRepo(repo)
+		}
+	}
+	transient := &os.PathError{Op: "lstat", Path: dir, Err: syscall.EIO}
+
+	// Fails once, then succeeds
+	failing(transient)
+	if err := p.scanRepo(); err != nil {
+		t.Errorf("Unexpected error %v after a transient failure", err)
+	}
+	if scans != 2 {
+		t.Errorf("%d scans, expected 2", scans)
+	}
+
+	// Keeps failing
+	failing(transient, transient, transient)
+	if err := p.scanRepo(); err != transient {
+		t.Errorf("Unexpected error %v after running out of retries", err)
+	}
+	if scans != 3 {
+		t.Errorf("%d scans, expected 3", scans)
+	}
+
+	// Permanent errors are not retried
+	for _, err := range []error{
+		&os.PathError{Op: "lstat", Path: dir, Err: syscall.ENOENT},
+		&os.PathError{Op: "lstat", Path: dir, Err: syscall.EACCES},
+		errors.New(dir + ": not a directory"),
+	} {
+		failing(err)
+		if e := p.scanRepo(); e != err {
+			t.Errorf("Unexpected error %v, expected %v", e, err)
+		}
+		if scans != 1 {
+			t.Errorf("Permanent error %v retried", err)
+		}
+	}
+}
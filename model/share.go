@@ -0,0 +1,175 @@
+package model
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// With ShareBlocks, needed blocks that another local file already has are
+// copied from that file instead of being pulled, so that files moved or
+// reorganized elsewhere don't have to be transferred again. A file that is
+// to be deleted while copies from it are still queued is first linked, or
+// moved, into .stversions/.scratch, which the scanner skips along with the
+// rest of .stversions, and the copies read it there. It is removed from
+// there once the last copy depending on it is done. Whatever is left in the
+// scratch area when pulling is done, or after a crash, is removed.
+
+// A sharedCopy is a set of needed blocks of a file to copy from another
+// local file.
+type sharedCopy struct {
+	from   string // the name of the file to copy from
+	blocks []scanner.Block
+}
+
+// A scratchFile is a deleted copy source kept in the scratch area.
+type scratchFile struct {
+	path   string
+	blocks []scanner.Block // the blocks of the file when it was deleted
+}
+
+// scratchDir returns the directory deleted copy sources are kept in.
+func scratchDir(repoDir string) string {
+	return filepath.Join(repoDir, ".stversions", ".scratch")
+}
+
+// localBlocks returns the name of a local file holding each block of the
+// repository, by hash. Zero blocks are left out, as they are never copied.
+func (p *puller) localBlocks() map[string]string {
+	p.model.rmut.RLock()
+	rf := p.model.repoFiles[p.repoCfg.ID]
+	p.model.rmut.RUnlock()
+
+	srcs := make(map[string]string)
+	if rf == nil {
+		return srcs
+	}
+	for _, f := range rf.Have(cid.LocalID) {
+		if protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) || protocol.IsInvalid(f.Flags) {
+			continue
+		}
+		for _, b := range f.Blocks {
+			if _, ok := srcs[string(b.Hash)]; !ok && !scanner.IsZeroBlock(b) {
+				srcs[string(b.Hash)] = f.Name
+			}
+		}
+	}
+	return srcs
+}
+
+// shareBlocks moves the needed blocks of f that another local file has from
+// need to the returned copies, one per source file, and counts the copies as
+// users of their sources.
+func (p *puller) shareBlocks(f scanner.File, need []scanner.Block, srcs map[string]string) ([]scanner.Block, []sharedCopy) {
+	var rest []scanner.Block
+	var shared []sharedCopy
+	idx := make(map[string]int)
+	for _, b := range need {
+		from, ok := srcs[string(b.Hash)]
+		if !ok || from == f.Name {
+			rest = append(rest, b)
+			continue
+		}
+		i, ok := idx[from]
+		if !ok {
+			i = len(shared)
+			idx[from] = i
+			shared = append(shared, sharedCopy{from: from})
+		}
+		shared[i].blocks = append(shared[i].blocks, b)
+	}
+	if p.sourceUsers == nil && len(shared) > 0 {
+		p.sourceUsers = make(map[string]int)
+	}
+	for _, sc := range shared {
+		p.sourceUsers[sc.from]++
+	}
+	return rest, shared
+}
+
+// copySource returns where to copy the blocks of b from: the existing
+// version of the file itself, or the file shared from, which may have been
+// moved to the scratch area.
+func (p *puller) copySource(b bqBlock, of openFile) copySource {
+	if b.from == "" {
+		return copySource{path: of.filepath, blocks: p.model.CurrentRepoFile(p.repoCfg.ID, b.file.Name).Blocks}
+	}
+	if sf, ok := p.scratch[b.from]; ok {
+		return copySource{path: sf.path, blocks: sf.blocks, shared: true}
+	}
+	return copySource{
+		path:   filepath.Join(p.dir, b.from),
+		blocks: p.model.CurrentRepoFile(p.repoCfg.ID, b.from).Blocks,
+		shared: true,
+	}
+}
+
+// sourceDone records that a copy from the named file is done, removing the
+// file from the scratch area if it was the last one.
+func (p *puller) sourceDone(from string) {
+	if from == "" || p.sourceUsers[from] == 0 {
+		return
+	}
+	if p.sourceUsers[from]--; p.sourceUsers[from] > 0 {
+		return
+	}
+	delete(p.sourceUsers, from)
+	if sf, ok := p.scratch[from]; ok {
+		if debug {
+			l.Debugf("%q: removing %q from the scratch area", p.repoCfg.ID, from)
+		}
+		os.Remove(sf.path)
+		delete(p.scratch, from)
+	}
+}
+
+// keepSource keeps the named file, about to be deleted from path, in the
+// scratch area if copies from it are still queued. It is linked there, so
+// that it can still be archived as usual, or moved there if it can't be
+// linked and nothing else keeps it. Failing both, the copies fall back to
+// pulling the blocks.
+func (p *puller) keepSource(name, path string) {
+	if p.sourceUsers[name] == 0 {
+		return
+	}
+	dir := scratchDir(p.dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		l.Warnf("Keeping %q in repository %q for copying: %v", name, p.repoCfg.ID, err)
+		return
+	}
+	sp := filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum([]byte(name))))
+	os.Remove(sp)
+	err := os.Link(path, sp)
+	if err != nil && p.versioner == nil && p.trash == nil {
+		err = os.Rename(path, sp)
+	}
+	if err != nil {
+		l.Warnf("Keeping %q in repository %q for copying: %v", name, p.repoCfg.ID, err)
+		return
+	}
+	if debug {
+		l.Debugf("%q: keeping %q in the scratch area for %d copies", p.repoCfg.ID, name, p.sourceUsers[name])
+	}
+	if p.scratch == nil {
+		p.scratch = make(map[string]scratchFile)
+	}
+	p.scratch[name] = scratchFile{path: sp, blocks: p.model.CurrentRepoFile(p.repoCfg.ID, name).Blocks}
+}
+
+// clearScratch forgets the copy sources and removes the scratch area, once
+// nothing is queued or open that could still use it.
+func (p *puller) clearScratch() {
+	if len(p.sourceUsers) == 0 && len(p.scratch) == 0 {
+		return
+	}
+	p.sourceUsers = nil
+	p.scratch = nil
+	if err := os.RemoveAll(scratchDir(p.dir)); err != nil {
+		l.Infof("Removing the scratch area of repository %q: %v", p.repoCfg.ID, err)
+	}
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestShareBlocksFromDeleted(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	// The other node has moved foo to bar
+	data := bytes.Repeat(block, len(f.Blocks))
+	ioutil.WriteFile(filepath.Join(dir, "foo"), data, 0644)
+	m.ReplaceLocal("default", []scanner.File{f})
+	moved := f
+	moved.Name = "bar"
+	deleted := scanner.File{Name: "foo", Version: f.Version + 1, Flags: protocol.FlagDeleted, Modified: f.Modified}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{deleted, moved})
+
+	cfg := m.repoCfgs["default"]
+	cfg.ShareBlocks = true
+	p := newTestPuller(m, cfg)
+	need, shared := p.shareBlocks(moved, moved.Blocks, p.localBlocks())
+	if len(need) != 0 || len(shared) != 1 || shared[0].from != "foo" {
+		t.Fatalf("Incorrect shared blocks %v, still needed %v", shared, need)
+	}
+	p.bq.put(bqAdd{file: moved, shared: shared})
+
+	// The source is deleted before the copy runs
+	p.handleBlock(bqBlock{file: deleted, last: true})
+	if !gone(filepath.Join(dir, "foo")) {
+		t.Fatal("Source not deleted")
+	}
+	if len(p.scratch) != 1 {
+		t.Fatal("Source not kept in the scratch area")
+	}
+
+	for !p.bq.empty() {
+		if !p.handleBlock(p.bq.get()) {
+			t.Fatal("Unexpected block pending")
+		}
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Incorrect contents copied from the scratch area")
+	}
+	if len(p.scratch) != 0 || len(p.sourceUsers) != 0 {
+		t.Errorf("Source still kept after the copy: %v, %v", p.scratch, p.sourceUsers)
+	}
+	if names, _ := filepath.Glob(filepath.Join(scratchDir(dir), "*")); len(names) != 0 {
+		t.Errorf("Unexpected files left in the scratch area: %v", names)
+	}
+
+	// Whatever is left is removed once pulling is done
+	os.MkdirAll(scratchDir(dir), 0777)
+	ioutil.WriteFile(filepath.Join(scratchDir(dir), "left"), data, 0644)
+	p.sourceUsers = map[string]int{"foo": 1}
+	p.clearScratch()
+	if !gone(scratchDir(dir)) {
+		t.Error("Scratch area not removed")
+	}
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestPullSparseFile(t *testing.T) {
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	// One block of data followed by three of zeros
+	data := append(append([]byte{}, block...), make([]byte, 3*len(block))...)
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	f.Version++
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+
+	var requests int32
+	fc := countingConnection{FakeConnection{id: "42", requestData: block}, &requests}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	pullFile(t, p, f)
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d blocks requested, expected 1", n)
+	}
+	if n := p.stats.bytesSparse; n != int64(3*len(block)) {
+		t.Errorf("%d sparse bytes, expected %d", n, 3*len(block))
+	}
+	if lf := m.CurrentRepoFile("default", "foo"); lf.Version != f.Version {
+		t.Fatal("File not pulled")
+	}
+
+	path := filepath.Join(dir, "foo")
+	contents, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(contents, data) {
+		t.Error("Incorrect contents of sparse file")
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if holes, err := osutil.Holes(fd, f.Size); err == nil && len(holes) == 0 {
+		t.Log("No holes in pulled file; the filesystem may not support them")
+	} else if err == nil && holes[len(holes)-1].Offset+holes[len(holes)-1].Length != f.Size {
+		t.Errorf("Incorrect holes %v", holes)
+	}
+}
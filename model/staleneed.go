@@ -0,0 +1,92 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A needed file that no connected node can provide, cycle after cycle, is
+// often one that no longer exists anywhere; the index it was needed from is
+// out of date. Rather than retrying it forever, the repository is rescanned
+// and its index sent to the other nodes again once that has gone on for
+// longer than MaxNeedAgeS.
+
+type noSourceFile struct {
+	version uint64
+	since   time.Time // when pulling it first failed for lack of a source
+}
+
+// noSourceFailed records that pulling f failed as no node could provide it.
+func (p *puller) noSourceFailed(f scanner.File) {
+	if p.noSource == nil {
+		p.noSource = make(map[string]noSourceFile)
+	}
+	if ns, ok := p.noSource[f.Name]; !ok || ns.version != f.Version {
+		p.noSource[f.Name] = noSourceFile{f.Version, time.Now()}
+	}
+}
+
+// checkStaleNeed forgets the files without a source that are no longer
+// needed. If any of the remaining ones have lacked a source for longer than
+// allowed, the repository is rescanned and its index sent again, and true
+// is returned. The refresh waits for a directory fixup in progress.
+func (p *puller) checkStaleNeed(need []scanner.File) bool {
+	if len(p.noSource) == 0 {
+		return false
+	}
+	versions := make(map[string]uint64, len(need))
+	for _, f := range need {
+		versions[f.Name] = f.Version
+	}
+	var stale []string
+	maxAge := time.Duration(p.cfg.Options.MaxNeedAgeS) * time.Second
+	for name, ns := range p.noSource {
+		if v, ok := versions[name]; !ok || v != ns.version {
+			delete(p.noSource, name)
+		} else if maxAge > 0 && time.Since(ns.since) > maxAge {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) == 0 || p.fixup != nil {
+		return false
+	}
+	sort.Strings(stale)
+
+	l.Infof("Repository %q: %d needed files, including %q, have had no source for over %v; rescanning and sending the index again", p.repoCfg.ID, len(stale), stale[0], maxAge)
+	events.Default.Log(events.StaleNeed, map[string]string{
+		"repo":  p.repoCfg.ID,
+		"item":  stale[0],
+		"files": fmt.Sprint(len(stale)),
+	})
+	// Started over, so that the refresh isn't repeated every cycle
+	p.noSource = nil
+
+	if err := p.model.ScanRepo(p.repoCfg.ID); err != nil {
+		l.Warnf("Repository %q: rescan: %v", p.repoCfg.ID, err)
+		return false
+	}
+	p.model.sendIndex(p.repoCfg.ID)
+	return true
+}
+
+// sendIndex sends the full local index of the repo to the connected nodes
+// sharing it, regardless of whether it has changed.
+func (m *Model) sendIndex(repo string) {
+	m.pmut.RLock()
+	m.rmut.RLock()
+	idx := m.protocolIndex(repo)
+	for _, nodeID := range m.repoNodes[repo] {
+		if conn, ok := m.protoConn[nodeID]; ok {
+			if debug {
+				l.Debugf("IDX(out/refresh): %s: %d files", nodeID, len(idx))
+			}
+			go conn.Index(repo, idx)
+		}
+	}
+	m.rmut.RUnlock()
+	m.pmut.RUnlock()
+}
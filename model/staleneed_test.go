@@ -0,0 +1,83 @@
+package model
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// indexConnection passes on the indexes sent to it.
+type indexConnection struct {
+	FakeConnection
+	indexes chan []protocol.FileInfo
+}
+
+func (c indexConnection) Index(repo string, fs []protocol.FileInfo) {
+	c.indexes <- fs
+}
+
+func TestStaleNeed(t *testing.T) {
+	dir, m, f, _ := setupPull(t)
+	defer os.RemoveAll(dir)
+	m.cfg.Options.MaxNeedAgeS = 60
+
+	// Node 43 shares the repository but doesn't have the needed file. Node
+	// 42, which announced it, is gone without its index entry going with it.
+	m.repoNodes["default"] = []string{"43"}
+	ic := indexConnection{FakeConnection{id: "43"}, make(chan []protocol.FileInfo, 1)}
+	m.AddConnection(ic, ic)
+	m.cm.Clear("42")
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.handleBlock(bqBlock{file: f, block: f.Blocks[0], last: true})
+	if ns, ok := p.noSource["foo"]; !ok || ns.version != f.Version {
+		t.Fatalf("Missing source not recorded: %v", p.noSource)
+	}
+
+	sub := events.Default.Subscribe(events.StaleNeed)
+	defer events.Default.Unsubscribe(sub)
+
+	p.queueNeededBlocks()
+	if _, err := sub.Poll(50 * time.Millisecond); err != events.ErrTimeout {
+		t.Fatal("Need list refreshed too early")
+	}
+
+	ns := p.noSource["foo"]
+	ns.since = ns.since.Add(-2 * time.Minute)
+	p.noSource["foo"] = ns
+	p.queueNeededBlocks()
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["item"] != "foo" || data["files"] != "1" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	m.smut.RLock()
+	scanned := m.repoScanTime["default"]
+	m.smut.RUnlock()
+	if time.Since(scanned) > time.Second {
+		t.Error("Repository not rescanned")
+	}
+	select {
+	case <-ic.indexes:
+	case <-time.After(time.Second):
+		t.Error("Index not sent again")
+	}
+	if len(p.noSource) != 0 {
+		t.Errorf("Files without source not reset: %v", p.noSource)
+	}
+
+	// Once the file is no longer needed, it is forgotten
+	p.noSourceFailed(f)
+	m.repoFiles["default"].Replace(m.cm.Get("42"), nil)
+	m.cm.Clear("42")
+	p.queueNeededBlocks()
+	if len(p.noSource) != 0 {
+		t.Errorf("File no longer needed still recorded: %v", p.noSource)
+	}
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// Files matching the StaticPatterns of a repository are meant for large,
+// write-once data such as photo archives. They are hashed when first
+// scanned, and are from then on taken to be unchanged for as long as their
+// modification time and size are, both when rescanning and when auditing.
+// This saves reading them again, at the price of missing any change to
+// their contents that leaves both alone, such as silent corruption on disk.
+
+// isStatic returns true if the named file matches one of the static
+// patterns. The patterns match like those of filePriority.
+func isStatic(patterns []string, name string) bool {
+	return len(patterns) > 0 && filePriority(patterns, name) > 0
+}
+
+// auditStaticFile audits a static regular file by its size and metadata
+// only.
+func auditStaticFile(dir string, f scanner.File, ignorePerms, special bool, window time.Duration) AuditResult {
+	res := AuditResult{Name: f.Name, Status: AuditMatching}
+
+	info, err := os.Lstat(filepath.Join(dir, f.Name))
+	if os.IsNotExist(err) {
+		res.Status = AuditMissing
+		return res
+	} else if err != nil {
+		res.Status = AuditError
+		res.Detail = err.Error()
+		return res
+	}
+
+	if info.IsDir() {
+		res.Status = AuditChanged
+		res.Detail = "is a directory"
+		return res
+	}
+	if info.Size() != f.Size {
+		res.Status = AuditChanged
+		res.Detail = fmt.Sprintf("size %d, index has %d", info.Size(), f.Size)
+		return res
+	}
+
+	if detail := metadataDrift(info, f, ignorePerms, special, window); detail != "" {
+		res.Status = AuditDrifted
+		res.Detail = detail
+	} else {
+		res.Detail = "static, contents not checked"
+	}
+	return res
+}
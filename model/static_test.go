@@ -0,0 +1,83 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+)
+
+func TestStaticPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1400000000, 0)
+	write := func(name, data string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	static := filepath.Join("photos", "x.jpg")
+	write("photos/x.jpg", "original")
+	write("other", "original")
+
+	// The files are rewritten faster than the change suppressor allows
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{MaxChangeKbps: 1e6}}
+	m := NewModel("/tmp", cfg, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir, StaticPatterns: []string{"photos/*"}})
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	orig := m.CurrentRepoFile("default", static)
+	if len(orig.Blocks) == 0 {
+		t.Fatal("Static file not hashed on the first scan")
+	}
+
+	// Contents change without the modification time or size, and the
+	// permissions change
+	write("photos/x.jpg", "modified")
+	write("other", "modified")
+	os.Chmod(filepath.Join(dir, static), 0600)
+	os.Chmod(filepath.Join(dir, "other"), 0600)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	f := m.CurrentRepoFile("default", static)
+	if !bytes.Equal(f.Blocks[0].Hash, orig.Blocks[0].Hash) {
+		t.Error("Static file rehashed")
+	}
+	if f.Flags&0777 != 0600 || f.Version == orig.Version {
+		t.Errorf("Permission change of static file not picked up: %o, version %d", f.Flags&0777, f.Version)
+	}
+	if other := m.CurrentRepoFile("default", "other"); bytes.Equal(other.Blocks[0].Hash, orig.Blocks[0].Hash) {
+		t.Error("Other file not rehashed")
+	}
+
+	res := make(map[string]AuditResult)
+	m.AuditRepo("default", func(r AuditResult) {
+		res[r.Name] = r
+	})
+	if r := res[static]; r.Status != AuditMatching {
+		t.Errorf("Incorrect audit of static file %v", r)
+	}
+
+	// A change of size is noticed
+	write("photos/x.jpg", "modified again")
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if f := m.CurrentRepoFile("default", static); f.Size != 14 || bytes.Equal(f.Blocks[0].Hash, orig.Blocks[0].Hash) {
+		t.Error("Static file of changed size not rehashed")
+	}
+}
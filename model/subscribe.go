@@ -0,0 +1,35 @@
+package model
+
+import "github.com/calmh/syncthing/events"
+
+// SubscribeRepo returns a channel receiving the events that concern the
+// repository, such as its state changes and the files in it that couldn't
+// be synced, and a function that ends the subscription and closes the
+// channel. The channel is fed from the global event log; events are dropped
+// for a subscriber that doesn't keep up.
+func (m *Model) SubscribeRepo(repo string) (<-chan events.Event, func(), error) {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return nil, nil, ErrNoSuchRepo
+	}
+
+	sub := events.Default.SubscribeFilter(events.AllEvents, func(e events.Event) bool {
+		return eventRepo(e.Data) == repo
+	})
+	return sub.C(), func() { events.Default.Unsubscribe(sub) }, nil
+}
+
+// eventRepo returns the repository an event logged by the model concerns,
+// or the empty string for events about no repository in particular.
+func eventRepo(data interface{}) string {
+	switch data := data.(type) {
+	case map[string]string:
+		return data["repo"]
+	case map[string]interface{}:
+		repo, _ := data["repo"].(string)
+		return repo
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
+)
+
+func TestSubscribeRepo(t *testing.T) {
+	// Repository IDs of their own, as pullers left running by other tests
+	// log events for "default"
+	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "scoped", Directory: "testdata"})
+	m.AddRepo(config.RepositoryConfiguration{ID: "scoped-other", Directory: "testdata"})
+
+	if _, _, err := m.SubscribeRepo("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchRepo)
+	}
+
+	c, unsubscribe, err := m.SubscribeRepo("scoped")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.setState("scoped-other", RepoScanning)
+	events.Default.Log(events.ItemInUse, map[string]string{"repo": "scoped-other", "item": "foo"})
+	m.setState("scoped", RepoScanning)
+	events.Default.Log(events.PullVerifyFailed, map[string]interface{}{"repo": "scoped", "item": "foo"})
+
+	for _, exp := range []events.EventType{events.StateChanged, events.PullVerifyFailed} {
+		select {
+		case e := <-c:
+			if e.Type != exp || eventRepo(e.Data) != "scoped" {
+				t.Errorf("Unexpected event %v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No %v event", exp)
+		}
+	}
+	select {
+	case e := <-c:
+		t.Errorf("Unexpected event %v", e)
+	default:
+	}
+
+	unsubscribe()
+	if _, ok := <-c; ok {
+		t.Error("Channel not closed after unsubscribing")
+	}
+}
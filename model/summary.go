@@ -0,0 +1,135 @@
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/osutil"
+)
+
+// A RepoSummary is the state of a repository in brief, as shown in the GUI.
+type RepoSummary struct {
+	State       string
+	GlobalFiles int
+	GlobalBytes int64
+	NeedFiles   int
+	NeedBytes   int64
+	InSyncFiles int
+	InSyncBytes int64
+	LastScan    time.Time
+	Restored    bool // saved by the previous run, as the repository has not been scanned since
+}
+
+// Summary returns the summary of the repository. With RestoreSummaries set,
+// the summary saved when syncthing was last stopped is returned until the
+// repository has been scanned, as the counts are not meaningful before.
+func (m *Model) Summary(repo string) (RepoSummary, error) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if _, ok := m.repoCfgs[repo]; !ok {
+		return RepoSummary{}, ErrNoSuchRepo
+	}
+
+	m.smut.RLock()
+	s, restored := m.summaries[repo]
+	scanned := !m.repoScanTime[repo].IsZero()
+	m.smut.RUnlock()
+	if restored && !scanned {
+		s.Restored = true
+		return s, nil
+	}
+	return m.currentSummary(repo), nil
+}
+
+// currentSummary returns the summary of the repository as it is now. Must
+// be called with rmut held.
+func (m *Model) currentSummary(repo string) RepoSummary {
+	rf := m.repoFiles[repo]
+	globalFiles, _, globalBytes := sizeOf(rf.Global())
+	needFiles, needDeleted, needBytes := sizeOf(rf.Need(cid.LocalID))
+	needFiles += needDeleted
+
+	m.smut.RLock()
+	state := m.repoState[repo]
+	lastScan := m.repoScanTime[repo]
+	m.smut.RUnlock()
+
+	return RepoSummary{
+		State:       state.String(),
+		GlobalFiles: globalFiles,
+		GlobalBytes: globalBytes,
+		NeedFiles:   needFiles,
+		NeedBytes:   needBytes,
+		InSyncFiles: globalFiles - needFiles,
+		InSyncBytes: globalBytes - needBytes,
+		LastScan:    lastScan,
+	}
+}
+
+// summaryFile returns the name of the file holding the summary of the repo
+// in the given directory. Must be called with rmut held.
+func (m *Model) summaryFile(repo, dir string) string {
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoCfgs[repo].Directory)))
+	return filepath.Join(dir, id+".summary")
+}
+
+// saveSummary saves the summary of the repo next to the index, unless
+// RestoreSummaries is off. A repository that has not been scanned since the
+// start keeps the summary restored from before. Must be called with rmut
+// held.
+func (m *Model) saveSummary(repo, dir string) {
+	if !m.cfg.Options.RestoreSummaries {
+		return
+	}
+
+	m.smut.RLock()
+	s, restored := m.summaries[repo]
+	scanned := !m.repoScanTime[repo].IsZero()
+	m.smut.RUnlock()
+	if !restored || scanned {
+		s = m.currentSummary(repo)
+	}
+
+	name := m.summaryFile(repo, dir)
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return
+	}
+	err = json.NewEncoder(fd).Encode(s)
+	fd.Close()
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return
+	}
+	osutil.Rename(name+".tmp", name)
+}
+
+// loadSummary loads the summary saved for the repo, unless RestoreSummaries
+// is off. Must be called with rmut held.
+func (m *Model) loadSummary(repo, dir string) {
+	if !m.cfg.Options.RestoreSummaries {
+		return
+	}
+
+	fd, err := os.Open(m.summaryFile(repo, dir))
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	var s RepoSummary
+	if err := json.NewDecoder(fd).Decode(&s); err != nil {
+		if debug {
+			l.Debugf("load summary %q: %v", repo, err)
+		}
+		return
+	}
+	m.smut.Lock()
+	m.summaries[repo] = s
+	m.smut.Unlock()
+}
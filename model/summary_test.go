@@ -0,0 +1,84 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestRestoreSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idxDir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(idxDir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("contents"), 0644)
+
+	cfg := &config.Configuration{Options: config.OptionsConfiguration{RestoreSummaries: true}}
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m := NewModel(idxDir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	// Node 42 has a file that we need
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{
+		{Name: "b", Version: 1, Blocks: []scanner.Block{{Size: 16}}},
+	})
+	saved, err := m.Summary("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Restored || saved.NeedFiles != 1 || saved.InSyncFiles != 1 {
+		t.Fatalf("Incorrect summary before saving %+v", saved)
+	}
+	m.SaveIndexes(idxDir)
+
+	m = NewModel(idxDir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.LoadIndexes(idxDir)
+	restored, err := m.Summary("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Restored {
+		t.Fatal("Summary not restored")
+	}
+	if !restored.LastScan.Equal(saved.LastScan) {
+		t.Errorf("Incorrect last scan %v, expected %v", restored.LastScan, saved.LastScan)
+	}
+	restored.Restored = false
+	restored.LastScan = saved.LastScan
+	if restored != saved {
+		t.Errorf("Restored summary %+v differs from the saved %+v", restored, saved)
+	}
+
+	// Once scanned, the current state is returned
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := m.Summary("default"); s.Restored || s.NeedFiles != 0 {
+		t.Errorf("Restored summary returned after a scan: %+v", s)
+	}
+
+	// Without the option, nothing is restored
+	cfg.Options.RestoreSummaries = false
+	m = NewModel(idxDir, cfg, "syncthing", "dev")
+	m.AddRepo(repoCfg)
+	m.LoadIndexes(idxDir)
+	if s, _ := m.Summary("default"); s.Restored {
+		t.Error("Summary restored with the option off")
+	}
+	if _, err := m.Summary("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v for unknown repository", err)
+	}
+}
@@ -0,0 +1,160 @@
+package model
+
+import (
+	"errors"
+	"os"
+)
+
+var errTempChanged = errors.New("temporary file changed while suspended")
+
+// A suspendReq has the run loop stop pulling from outside. The done channel
+// is closed once the requests in flight have been handled and what has been
+// pulled so far is on disk.
+type suspendReq struct {
+	done chan struct{}
+}
+
+// A resumeReq has a suspended run loop continue pulling. The done channel is
+// closed once the open files have been checked.
+type resumeReq struct {
+	done chan struct{}
+}
+
+// Suspend prepares the repositories for the system going to sleep. The
+// pullers stop sending requests, wait for the ones in flight and write the
+// open temporary files, along with their bitmaps, to disk. A pull then goes
+// on where it left off after Resume, or after a restart if the system
+// doesn't wake up cleanly. Suspend returns once all pullers are quiet;
+// scanning is not affected.
+func (m *Model) Suspend() {
+	var ps []*puller
+	var reqs []suspendReq
+	for _, p := range m.setSuspended(true) {
+		req := suspendReq{done: make(chan struct{})}
+		select {
+		case p.suspendReqs <- req:
+			ps = append(ps, p)
+			reqs = append(reqs, req)
+		case <-p.stopped:
+			// Nothing left to suspend
+		}
+	}
+	for i, req := range reqs {
+		ps[i].wait(req.done)
+	}
+}
+
+// Resume has the pullers continue after Suspend. Files whose temporary file
+// was removed or cut short meanwhile are pulled again.
+func (m *Model) Resume() {
+	for _, p := range m.setSuspended(false) {
+		req := resumeReq{done: make(chan struct{})}
+		select {
+		case p.resumeReqs <- req:
+			p.wait(req.done)
+		case <-p.stopped:
+			// Nothing left to resume
+		}
+	}
+}
+
+// setSuspended records whether pullers started from now on begin suspended
+// and returns the read/write pullers already running.
+func (m *Model) setSuspended(v bool) []*puller {
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
+	m.suspended = v
+	var ps []*puller
+	for _, p := range m.pullers {
+		if cap(p.requestSlots) > 0 {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// quiesced returns true when no requests or copies are outstanding, so that
+// nothing more is written until new blocks are handled.
+func (p *puller) quiesced() bool {
+	return len(p.inFlight) == 0 && p.copying == 0
+}
+
+// checkpoint puts what has been pulled so far on disk. Batched renames and
+// syncs are done, and the temporary files are flushed and synced along with
+// their bitmaps. A file that can't be written fails. Must be called with
+// p.mut held.
+func (p *puller) checkpoint() {
+	p.releaseDirs()
+	if len(p.renameBatch) > 0 {
+		p.flushRenameBatch()
+	}
+	if len(p.syncBatch) > 0 {
+		p.flushSyncBatch()
+	}
+	for name, of := range p.openFiles {
+		if of.err != nil || of.file == nil {
+			continue
+		}
+		err := of.flush()
+		if err == nil {
+			// Blocks held by the write buffer are now in the file
+			of.recordWritten(of.blocks, -1)
+			if of.bitmap != nil && of.bitmap.fd != nil {
+				err = of.bitmap.persist(of.file)
+			} else {
+				err = of.file.Sync()
+			}
+		}
+		if err == nil && of.bitmap != nil && of.bitmap.fd != nil {
+			err = of.bitmap.fd.Sync()
+		}
+		if err != nil {
+			l.Warnf("Suspend: %q: %v", of.temp, err)
+			of.err = err
+			p.openFiles[name] = of
+		}
+	}
+}
+
+// checkTemps makes sure the temporary files are still the ones written to
+// before suspending, and still hold the blocks recorded as written. Any
+// other file fails and is pulled again once its remaining blocks have been
+// handled, continuing from whatever is intact in the temporary file. Must be
+// called with p.mut held.
+func (p *puller) checkTemps() {
+	for name, of := range p.openFiles {
+		if of.err != nil || of.file == nil || of.journal != nil {
+			continue
+		}
+		if p.tempIntact(of) {
+			continue
+		}
+		l.Infof("Temporary file of %q in repository %q changed while suspended; pulling it again", name, p.repoCfg.ID)
+		of.file.Close()
+		of.file = nil
+		of.bitmap.close()
+		of.err = errTempChanged
+		p.openFiles[name] = of
+		if of.done && of.outstanding <= 0 {
+			p.forgetFailed(name)
+		}
+	}
+}
+
+// tempIntact returns true if the temporary file of of is the one that is
+// open and is consistent with its bitmap.
+func (p *puller) tempIntact(of openFile) bool {
+	info, err := os.Stat(of.temp)
+	if err != nil {
+		return false
+	}
+	open, err := of.file.Stat()
+	if err != nil || !os.SameFile(info, open) {
+		return false
+	}
+	if of.cz != nil || of.bitmap == nil {
+		// Verified when closed, as usual
+		return true
+	}
+	return of.bitmap.consistent(info.Size(), of.blocks)
+}
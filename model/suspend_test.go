@@ -0,0 +1,148 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedConnection answers each request once it is let through the gate.
+type gatedConnection struct {
+	FakeConnection
+	gate     chan struct{}
+	requests *int32
+}
+
+func (c gatedConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	atomic.AddInt32(c.requests, 1)
+	<-c.gate
+	return c.FakeConnection.Request(repo, name, offset, size)
+}
+
+func TestSuspendResume(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	gate := make(chan struct{})
+	fc := gatedConnection{FakeConnection{id: "42", requestData: block}, gate, &requests}
+	m.AddConnection(fc, fc)
+	m.StartRepoRW("default", 1)
+
+	for i := 0; atomic.LoadInt32(&requests) == 0; i++ {
+		if i == 100 {
+			t.Fatal("No request sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	suspended := make(chan struct{})
+	go func() {
+		m.Suspend()
+		close(suspended)
+	}()
+	select {
+	case <-suspended:
+		t.Fatal("Suspended with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gate <- struct{}{}
+	select {
+	case <-suspended:
+	case <-time.After(time.Second):
+		t.Fatal("Not suspended once the request was answered")
+	}
+	if s := m.State("default"); s != "suspended" {
+		t.Errorf("Repository %s while suspended", s)
+	}
+
+	// The received block is on disk and recorded in the bitmap
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests while suspended", n)
+	}
+	temp := filepath.Join(dir, defTempNamer.TempName("foo"))
+	if info, err := os.Stat(temp); err != nil || info.Size() != int64(len(block)) {
+		t.Errorf("Temporary file not written: %v", err)
+	}
+	if bits, err := ioutil.ReadFile(bitmapName(temp)); err != nil || len(bits) <= bitmapHdrSize || bits[bitmapHdrSize] != 1 {
+		t.Errorf("Incorrect bitmap %v: %v", bits, err)
+	}
+
+	m.Resume()
+	close(gate)
+	path := filepath.Join(dir, "foo")
+	for i := 0; ; i++ {
+		if data, err := ioutil.ReadFile(path); err == nil && bytes.Equal(data, bytes.Repeat(block, len(f.Blocks))) {
+			break
+		}
+		if i == 100 {
+			t.Fatal("File not pulled after resuming")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&requests); int(n) != len(f.Blocks) {
+		t.Errorf("%d requests for %d blocks", n, len(f.Blocks))
+	}
+}
+
+func TestSuspendTempRemoved(t *testing.T) {
+	defer func(n int) { resumeMinBlocks = n }(resumeMinBlocks)
+	resumeMinBlocks = 1
+
+	dir, m, f, block := setupPull(t)
+	defer os.RemoveAll(dir)
+	m.cfg.Options.WriteBufferKiB = 1024
+
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	for _, b := range f.Blocks[:2] {
+		p.handleBlock(bqBlock{file: f, block: b})
+		handleResult(t, p)
+	}
+	// The buffered blocks reach the disk
+	p.checkpoint()
+	of := p.openFiles["foo"]
+	if info, err := os.Stat(of.temp); err != nil || info.Size() != 2*int64(len(block)) {
+		t.Errorf("Temporary file not flushed: %v", err)
+	}
+	if n := of.bitmap.count(); n != 2 {
+		t.Errorf("%d blocks recorded as written", n)
+	}
+
+	os.Remove(of.temp)
+	p.checkTemps()
+	if err := p.openFiles["foo"].err; err != errTempChanged {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// Once the remaining blocks are handled, the whole file is queued again
+	for i, b := range f.Blocks[2:] {
+		p.handleBlock(bqBlock{file: f, block: b, last: i == 1})
+	}
+	queued := make(chan bqBlock)
+	for i := range f.Blocks {
+		go func() { queued <- p.bq.get() }()
+		select {
+		case b := <-queued:
+			if p.handleBlock(b) {
+				t.Fatalf("Block %d handled without a request", i)
+			}
+			handleResult(t, p)
+		case <-time.After(time.Second):
+			t.Fatalf("Block %d not queued again", i)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "foo")); !bytes.Equal(data, bytes.Repeat(block, len(f.Blocks))) {
+		t.Error("Incorrect contents of pulled file")
+	}
+}
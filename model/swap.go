@@ -0,0 +1,149 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+)
+
+// With AtomicSwap, a repository is scanned and pulled in a working tree next
+// to its directory, and the directory itself is a symbolic link to a
+// snapshot of the working tree. Each time the repository has been brought
+// in sync, a new snapshot is copied from the working tree and the link is
+// replaced by one pointing at it, so that the directory goes from one
+// consistent state to the next in a single rename. The previous snapshot is
+// removed once the link has been replaced. If anything fails before that,
+// the new snapshot is removed instead and the directory stays as it was.
+//
+// Changes made through the directory are not scanned, and are gone with the
+// next swap.
+
+const swapSuffix = ".stswap"
+
+var errSwapMove = errors.New("a repository with atomic swap can't be moved")
+
+// swapWorkDir returns the working tree of the repository directory dir.
+func swapWorkDir(dir string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+swapSuffix)
+}
+
+// swapLinkDir returns the repository directory of the working tree work.
+func swapLinkDir(work string) string {
+	base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(work), "."), swapSuffix)
+	return filepath.Join(filepath.Dir(work), base)
+}
+
+// workDir returns the directory the repository is scanned and pulled in:
+// the working tree with AtomicSwap, otherwise the repository directory.
+func workDir(cfg config.RepositoryConfiguration) string {
+	if cfg.AtomicSwap && !cfg.ReadOnly {
+		return swapWorkDir(filepath.Clean(cfg.Directory))
+	}
+	return cfg.Directory
+}
+
+// isSnapshot returns true if path is a snapshot of the working tree work.
+func isSnapshot(work, path string) bool {
+	return filepath.Dir(path) == filepath.Dir(work) && strings.HasPrefix(filepath.Base(path), filepath.Base(work)+"-")
+}
+
+// prepareSwap sets up the working tree of the repository directory dir and
+// returns it. An existing directory becomes the working tree, and a
+// snapshot of it is linked in its place right away.
+func prepareSwap(dir string) (string, error) {
+	work := swapWorkDir(dir)
+	info, err := os.Lstat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(work, 0777); err != nil {
+			return "", err
+		}
+		return work, swapIn(dir, work)
+
+	case err != nil:
+		return "", err
+
+	case info.Mode()&os.ModeSymlink != 0:
+		return work, os.MkdirAll(work, 0777)
+
+	case info.IsDir():
+		if _, err := os.Lstat(work); err == nil {
+			return "", fmt.Errorf("%s: both the directory and its working tree %s exist", dir, work)
+		}
+		if err := os.Rename(dir, work); err != nil {
+			return "", err
+		}
+		if err := swapIn(dir, work); err != nil {
+			os.Rename(work, dir)
+			return "", err
+		}
+		return work, nil
+
+	default:
+		return "", fmt.Errorf("%s: not a directory", dir)
+	}
+}
+
+// swapIn copies the working tree to a new snapshot and points the link at
+// dir to it, replacing any earlier snapshot.
+func swapIn(dir, work string) error {
+	snap := fmt.Sprintf("%s-%d", work, time.Now().UnixNano())
+	err := copyDir(work, snap, func(rel string, info os.FileInfo) bool {
+		return rel == ".stversions" || defTempNamer.IsTemporary(rel)
+	})
+	if err != nil {
+		os.RemoveAll(snap)
+		return err
+	}
+
+	// The link is relative, so that the whole arrangement can be moved
+	tmp := filepath.Join(filepath.Dir(work), "."+filepath.Base(dir)+swapSuffix+".link")
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(snap), tmp); err != nil {
+		os.RemoveAll(snap)
+		return err
+	}
+	old, _ := os.Readlink(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Remove(tmp)
+		os.RemoveAll(snap)
+		return err
+	}
+
+	if old != "" {
+		if !filepath.IsAbs(old) {
+			old = filepath.Join(filepath.Dir(dir), old)
+		}
+		// Only ever remove snapshots of our own
+		if isSnapshot(work, old) {
+			os.RemoveAll(old)
+		}
+	}
+	return nil
+}
+
+// swapRepo swaps the working tree in as the repository directory, if the
+// repository is in sync. Otherwise it is left for a later cycle.
+func (p *puller) swapRepo() {
+	if need := p.model.NeedFilesRepo(p.repoCfg.ID); len(need) > 0 {
+		if debug {
+			l.Debugf("%q: not swapping; %d files needed", p.repoCfg.ID, len(need))
+		}
+		return
+	}
+
+	dir := swapLinkDir(p.dir)
+	if err := swapIn(dir, p.dir); err != nil {
+		l.Warnf("Repository %q: swapping in the synced files: %v", p.repoCfg.ID, err)
+		return
+	}
+	if debug {
+		l.Debugf("%q: swapped in %q", p.repoCfg.ID, dir)
+	}
+	p.swapDue = false
+}
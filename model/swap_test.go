@@ -0,0 +1,203 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// snapshots returns the snapshots of the working tree work.
+func snapshots(t *testing.T, work string) []string {
+	names, err := filepath.Glob(work + "-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestPrepareSwap(t *testing.T) {
+	parent, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "site")
+	os.Mkdir(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("old"), 0644)
+
+	work, err := prepareSwap(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work != filepath.Join(parent, ".site.stswap") || swapLinkDir(work) != dir {
+		t.Errorf("Unexpected working tree %q for %q", work, dir)
+	}
+	if info, err := os.Lstat(dir); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("%q is not a link: %v", dir, err)
+	}
+	for _, d := range []string{dir, work} {
+		if data, _ := ioutil.ReadFile(filepath.Join(d, "index.html")); string(data) != "old" {
+			t.Errorf("Incorrect contents %q in %q", data, d)
+		}
+	}
+
+	// Set up already
+	if w, err := prepareSwap(dir); err != nil || w != work {
+		t.Errorf("Unexpected result %q, %v", w, err)
+	}
+	if s := snapshots(t, work); len(s) != 1 {
+		t.Errorf("Unexpected snapshots %v", s)
+	}
+
+	// A new directory starts out empty
+	empty := filepath.Join(parent, "empty")
+	if _, err := prepareSwap(empty); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := ioutil.ReadDir(empty); err != nil || len(names) != 0 {
+		t.Errorf("Unexpected contents %v, %v", names, err)
+	}
+}
+
+func TestSwapRollback(t *testing.T) {
+	parent, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "site")
+	work, err := prepareSwap(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(work, "index.html"), []byte("new"), 0644)
+
+	// The link can't replace a directory someone put in its place
+	os.Remove(dir)
+	os.Mkdir(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("theirs"), 0644)
+	if err := swapIn(dir, work); err == nil {
+		t.Fatal("Unexpected nil error")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "index.html")); string(data) != "theirs" {
+		t.Errorf("Directory changed by failed swap: %q", data)
+	}
+	if s := snapshots(t, work); len(s) != 1 {
+		t.Errorf("Snapshots %v left by failed swap", s)
+	}
+	if _, err := os.Lstat(filepath.Join(parent, ".site.stswap.link")); !os.IsNotExist(err) {
+		t.Error("Temporary link left by failed swap")
+	}
+}
+
+func setupSwap(t *testing.T) (parent string, m *Model, f scanner.File, block []byte) {
+	parent, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block = bytes.Repeat([]byte("0123456789abcdef"), scanner.StandardBlockSize/16)
+	data := bytes.Repeat(block, 4)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	f = scanner.File{Name: "foo", Version: 3, Size: int64(len(data)), Modified: time.Now().Unix(), Blocks: blocks}
+
+	m = NewModel("/tmp", &config.Configuration{}, "syncthing", "dev")
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: filepath.Join(parent, "site"), IgnorePerms: true, AtomicSwap: true})
+	m.ReplaceLocal("default", nil)
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{f})
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+	return
+}
+
+func TestAtomicSwap(t *testing.T) {
+	parent, m, f, _ := setupSwap(t)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "site")
+	if cfg, _ := m.GetRepoConfig("default"); cfg.Directory != dir {
+		t.Fatalf("Configured directory replaced by %q", cfg.Directory)
+	}
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	work := p.dir
+	if work != swapWorkDir(dir) {
+		t.Fatalf("Repository running in %q", work)
+	}
+	p.swapDue = true
+	for _, b := range f.Blocks[:2] {
+		p.handleBlock(bqBlock{file: f, block: b})
+		handleResult(t, p)
+	}
+	p.swapRepo()
+	if !p.swapDue {
+		t.Error("Swapped before the repository is in sync")
+	}
+
+	for i, b := range f.Blocks[2:] {
+		if p.handleBlock(bqBlock{file: f, block: b, last: i == 1}) {
+			continue
+		}
+		handleResult(t, p)
+	}
+	if _, err := os.Stat(filepath.Join(work, "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo")); !os.IsNotExist(err) {
+		t.Errorf("Pulled file visible before swapping: %v", err)
+	}
+
+	p.swapRepo()
+	if p.swapDue {
+		t.Error("Not swapped in sync")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "foo")); err != nil || info.Size() != f.Size {
+		t.Errorf("Pulled file not swapped in: %v", err)
+	}
+	if s := snapshots(t, work); len(s) != 1 {
+		t.Errorf("Unexpected snapshots %v", s)
+	}
+}
+
+func TestAtomicSwapAfterSync(t *testing.T) {
+	parent, m, f, block := setupSwap(t)
+	defer os.RemoveAll(parent)
+
+	m.StartRepoRW("default", 1)
+	path := filepath.Join(parent, "site", "foo")
+	for i := 0; ; i++ {
+		if data, err := ioutil.ReadFile(path); err == nil && bytes.Equal(data, bytes.Repeat(block, len(f.Blocks))) {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Pulled file not swapped in")
+		}
+		// Lets the run loop go around without waiting for its timeout
+		m.ScanAndSync("default")
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAtomicSwapUpdateConfig(t *testing.T) {
+	parent, m, _, _ := setupSwap(t)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "site")
+
+	// The configuration as given is accepted back unchanged
+	cfg, err := m.GetRepoConfig("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MinConnectedPeers = 1
+	if err := m.UpdateRepoConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, _ := m.GetRepoConfig("default"); cfg.Directory != dir || cfg.MinConnectedPeers != 1 {
+		t.Errorf("Incorrect configuration after update: %q, %d", cfg.Directory, cfg.MinConnectedPeers)
+	}
+}
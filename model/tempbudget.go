@@ -0,0 +1,75 @@
+package model
+
+// With MaxTempBytes set, no new file is opened for pulling while its
+// temporary file and those already open would together take up more than
+// that many bytes once complete. The blocks of the file wait, in the order
+// they were handed out, until enough of the open files are done, and are
+// then queued again. A file larger than the budget is still pulled once it
+// is the only one.
+
+// A tempWaitingFile holds the blocks of a file that waits for room for its
+// temporary file.
+type tempWaitingFile struct {
+	name   string
+	blocks []bqBlock
+}
+
+// openTempBytes returns the size of the temporary files of the open files,
+// once complete.
+func (p *puller) openTempBytes() int64 {
+	var n int64
+	for _, of := range p.openFiles {
+		n += of.tempSize
+	}
+	return n
+}
+
+// deferForTemp returns true if the file of b, which is not open, must wait
+// for room for its temporary file. The block is then kept until it is
+// queued again.
+func (p *puller) deferForTemp(b bqBlock) bool {
+	for i := range p.tempWaiting {
+		if w := &p.tempWaiting[i]; w.name == b.file.Name {
+			// Earlier blocks of the file are waiting already
+			w.blocks = append(w.blocks, b)
+			return true
+		}
+	}
+
+	max := p.repoCfg.MaxTempBytes
+	if max <= 0 || b.file.Size == 0 {
+		return false
+	}
+	used := p.openTempBytes()
+	if used == 0 || used+b.file.Size <= max || p.canUpdateInPlace(b) {
+		return false
+	}
+	if debug {
+		l.Debugf("pull: %q / %q: %d bytes of temporary files open, waiting", p.repoCfg.ID, b.file.Name, used)
+	}
+	p.tempWaiting = append(p.tempWaiting, tempWaitingFile{b.file.Name, []bqBlock{b}})
+	return true
+}
+
+// queueTempWaiting queues the blocks of the waiting files again, in order,
+// for as long as their temporary files fit in the budget along with those
+// of the open files.
+func (p *puller) queueTempWaiting() {
+	if len(p.tempWaiting) == 0 {
+		return
+	}
+
+	max := p.repoCfg.MaxTempBytes
+	used := p.openTempBytes()
+	n := 0
+	for _, w := range p.tempWaiting {
+		f := w.blocks[0].file
+		if max > 0 && used > 0 && used+f.Size > max {
+			break
+		}
+		used += f.Size
+		p.bq.put(bqAdd{file: f, again: w.blocks})
+		n++
+	}
+	p.tempWaiting = p.tempWaiting[n:]
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestMaxTempBytes(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.MaxTempBytes = 1500
+	m.repoCfgs["default"] = repoCfg
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+	var fs []scanner.File
+	for _, name := range []string{"x1", "x2", "x3"} {
+		fs = append(fs, scanner.File{Name: name, Version: 1, Size: int64(len(data)), Blocks: blocks})
+	}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), fs)
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	for _, f := range fs {
+		p.handleBlock(bqBlock{file: f, block: f.Blocks[0], last: true})
+	}
+	if len(p.openFiles) != 1 {
+		t.Fatalf("%d files open, expected one within the budget", len(p.openFiles))
+	}
+	if n := p.openTempBytes(); n > repoCfg.MaxTempBytes {
+		t.Errorf("%d bytes of temporary files exceed the budget", n)
+	}
+	if len(p.tempWaiting) != 2 {
+		t.Fatalf("%d files waiting, expected 2", len(p.tempWaiting))
+	}
+	p.queueTempWaiting()
+	if len(p.tempWaiting) != 2 {
+		t.Fatalf("Waiting files queued without room")
+	}
+
+	handleResult(t, p)
+	if len(p.openFiles) != 0 {
+		t.Fatal("File not closed")
+	}
+
+	// There is room for one of the waiting files again
+	p.queueTempWaiting()
+	if len(p.tempWaiting) != 1 || p.tempWaiting[0].name != "x3" {
+		t.Errorf("Incorrect waiting files %v", p.tempWaiting)
+	}
+	for i := 0; i < 100 && p.bq.size() == 0; i++ {
+		// The block queue picks up additions asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names := p.bq.fileNames(); !reflect.DeepEqual(names, []string{"x2"}) {
+		t.Errorf("Incorrect queued files %v", names)
+	}
+	if b := p.bq.get(); b.file.Name != "x2" || !b.last {
+		t.Errorf("Incorrect block queued again %v", b)
+	}
+}
@@ -1,8 +1,10 @@
 package model
 
 import (
+	"bytes"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
@@ -63,6 +65,21 @@ func cmMap(cm protocol.ClusterConfigMessage) map[string]map[string]uint32 {
 	return m
 }
 
+// cmChunkers returns the announced chunker type per repository. Repositories
+// without an announcement use the fixed size chunker.
+func cmChunkers(cm protocol.ClusterConfigMessage) map[string]string {
+	m := make(map[string]string)
+	for _, opt := range cm.Options {
+		if opt.Key != "chunker" {
+			continue
+		}
+		if i := strings.LastIndex(opt.Value, ":"); i > 0 {
+			m[opt.Value[:i]] = opt.Value[i+1:]
+		}
+	}
+	return m
+}
+
 type ClusterConfigMismatch error
 
 // compareClusterConfig returns nil for two equivalent configurations,
@@ -70,10 +87,15 @@ type ClusterConfigMismatch error
 func compareClusterConfig(local, remote protocol.ClusterConfigMessage) error {
 	lm := cmMap(local)
 	rm := cmMap(remote)
+	lc := cmChunkers(local)
+	rc := cmChunkers(remote)
 
 	for repo, lnodes := range lm {
 		_ = lnodes
 		if rnodes, ok := rm[repo]; ok {
+			if lc[repo] != rc[repo] {
+				return ClusterConfigMismatch(fmt.Errorf("remote uses a different chunker type for repository %q", repo))
+			}
 			for node, lflags := range lnodes {
 				if rflags, ok := rnodes[node]; ok {
 					if lflags&protocol.FlagShareBits != rflags&protocol.FlagShareBits {
@@ -95,3 +117,39 @@ func compareClusterConfig(local, remote protocol.ClusterConfigMessage) error {
 
 	return nil
 }
+
+// underAny returns true if name is equal to, or inside a directory named by,
+// any of the paths.
+func underAny(name string, paths []string) bool {
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocksEqual returns true if the two block lists have the same hashes in
+// the same order.
+// oversizedBlock returns the first block of f that is larger than max bytes,
+// if there is one.
+func oversizedBlock(f scanner.File, max int) (scanner.Block, bool) {
+	for _, b := range f.Blocks {
+		if int64(b.Size) > int64(max) {
+			return b, true
+		}
+	}
+	return scanner.Block{}, false
+}
+
+func blocksEqual(a, b []scanner.Block) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if bytes.Compare(a[i].Hash, b[i].Hash) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
 )
 
 var testcases = []struct {
@@ -164,6 +165,43 @@ var testcases = []struct {
 		},
 		err: `remote has different sharing flags for node "a" in repository "foo"`,
 	},
+
+	{
+		local: protocol.ClusterConfigMessage{
+			Repositories: []protocol.Repository{
+				{ID: "foo"},
+			},
+			Options: []protocol.Option{
+				{Key: "chunker", Value: "foo:cdc"},
+			},
+		},
+		remote: protocol.ClusterConfigMessage{
+			Repositories: []protocol.Repository{
+				{ID: "foo"},
+			},
+			Options: []protocol.Option{
+				{Key: "chunker", Value: "foo:cdc"},
+			},
+		},
+		err: "",
+	},
+
+	{
+		local: protocol.ClusterConfigMessage{
+			Repositories: []protocol.Repository{
+				{ID: "foo"},
+			},
+			Options: []protocol.Option{
+				{Key: "chunker", Value: "foo:cdc"},
+			},
+		},
+		remote: protocol.ClusterConfigMessage{
+			Repositories: []protocol.Repository{
+				{ID: "foo"},
+			},
+		},
+		err: `remote uses a different chunker type for repository "foo"`,
+	},
 }
 
 func TestCompareClusterConfig(t *testing.T) {
@@ -181,3 +219,38 @@ func TestCompareClusterConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestCopyRuns(t *testing.T) {
+	blocks := []scanner.Block{
+		{Offset: 0, Size: 10, Hash: []byte("a")},
+		{Offset: 10, Size: 10, Hash: []byte("b")},
+		{Offset: 20, Size: 10, Hash: []byte("c")},
+		{Offset: 40, Size: 5, Hash: []byte("e")},
+		{Offset: 45, Size: 10, Hash: []byte("f")},
+	}
+	srcOffsets := map[string]int64{
+		"a": 0,
+		"b": 10,
+		"c": 100,
+		"e": 50,
+	}
+
+	runs := copyRuns(blocks, srcOffsets)
+	expected := []struct {
+		srcOffset int64
+		nblocks   int
+	}{
+		{0, 2},
+		{100, 1},
+		{50, 1},
+		{45, 1},
+	}
+	if len(runs) != len(expected) {
+		t.Fatalf("Incorrect number of runs %d != %d", len(runs), len(expected))
+	}
+	for i, r := range runs {
+		if r.srcOffset != expected[i].srcOffset || len(r.blocks) != expected[i].nblocks {
+			t.Errorf("%d: incorrect run %d/%d != %d/%d", i, r.srcOffset, len(r.blocks), expected[i].srcOffset, expected[i].nblocks)
+		}
+	}
+}
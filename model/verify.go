@@ -0,0 +1,151 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// When VerifyAfterSync is set, the puller checks that the files on disk agree
+// with the local index whenever it becomes idle after pulling. Only whether
+// each file exists, its type and its size are compared; the contents are
+// left to the audit. The files updated during the cycle are always checked.
+// Of the rest of the index, verifyBatch files are checked per cycle, picking
+// up in name order where the previous check stopped, so that the whole
+// repository is covered over time without walking it every cycle.
+var verifyBatch = 1000
+
+// At most this many names are included in an IndexDiverged event.
+const maxDivergedNames = 100
+
+type verifyState struct {
+	touched map[string]bool // files updated since the last check
+	cursor  string          // the last file checked by the rotating batch
+}
+
+// updateLocal records f in the local index and the recent changes, noting
+// it for the next check and swap.
+func (p *puller) updateLocal(f scanner.File) {
+	if p.cfg.Options.VerifyAfterSync {
+		if p.verify.touched == nil {
+			p.verify.touched = make(map[string]bool)
+		}
+		p.verify.touched[f.Name] = true
+	}
+	p.swapDue = p.repoCfg.AtomicSwap
+	op := changeOp(p.model.CurrentRepoFile(p.repoCfg.ID, f.Name), f)
+	p.model.updateLocal(p.repoCfg.ID, f)
+	p.model.recordChange(p.repoCfg.ID, f, op)
+}
+
+// verifyLocal checks the touched files and the next batch of the local index
+// against the disk, and returns the names of the files that differ.
+func (p *puller) verifyLocal() (checked int, diverged []string) {
+	p.model.rmut.RLock()
+	rf := p.model.repoFiles[p.repoCfg.ID]
+	p.model.rmut.RUnlock()
+
+	names := make([]string, 0, len(p.verify.touched)+verifyBatch)
+	for name := range p.verify.touched {
+		names = append(names, name)
+	}
+	p.verify.touched = nil
+
+	var rest []string
+	for _, f := range rf.Have(cid.LocalID) {
+		rest = append(rest, f.Name)
+	}
+	sort.Strings(rest)
+	i := sort.SearchStrings(rest, p.verify.cursor)
+	if i < len(rest) && rest[i] == p.verify.cursor {
+		i++
+	}
+	for n := 0; n < verifyBatch && n < len(rest); n++ {
+		if i == len(rest) {
+			i = 0
+		}
+		names = append(names, rest[i])
+		p.verify.cursor = rest[i]
+		i++
+	}
+
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		f := rf.Get(cid.LocalID, name)
+		if f.Name != name || f.Suppressed {
+			continue
+		}
+		checked++
+		if reason := checkOnDisk(p.dir, f); reason != "" {
+			if debug {
+				l.Debugf("verify: %q / %q: %s", p.repoCfg.ID, name, reason)
+			}
+			diverged = append(diverged, name)
+		}
+	}
+	sort.Strings(diverged)
+	return checked, diverged
+}
+
+// verifyAfterSync runs the check and reports any divergence.
+func (p *puller) verifyAfterSync() {
+	checked, diverged := p.verifyLocal()
+	if debug {
+		l.Debugf("verify: %q: %d files checked, %d diverged", p.repoCfg.ID, checked, len(diverged))
+	}
+	if len(diverged) == 0 {
+		return
+	}
+
+	l.Warnf("Repository %q: %d of %d checked files differ from the index, including %q", p.repoCfg.ID, len(diverged), checked, diverged[0])
+	data := map[string]interface{}{
+		"repo":     p.repoCfg.ID,
+		"checked":  checked,
+		"diverged": len(diverged),
+	}
+	if len(diverged) > maxDivergedNames {
+		diverged = diverged[:maxDivergedNames]
+	}
+	data["files"] = diverged
+	events.Default.Log(events.IndexDiverged, data)
+}
+
+// checkOnDisk returns a description of how the file on disk differs from f,
+// or the empty string if it matches as far as can be told without reading
+// it.
+func checkOnDisk(dir string, f scanner.File) string {
+	info, err := os.Lstat(filepath.Join(dir, f.Name))
+	if protocol.IsDeleted(f.Flags) {
+		if err == nil {
+			return "deleted in index but exists"
+		}
+		return ""
+	}
+	if os.IsNotExist(err) {
+		return "missing"
+	} else if err != nil {
+		return err.Error()
+	}
+
+	if isDir := protocol.IsDirectory(f.Flags); isDir != info.IsDir() {
+		if isDir {
+			return "not a directory"
+		}
+		return "is a directory"
+	}
+	if !info.IsDir() && info.Size() != f.Size {
+		return fmt.Sprintf("size %d, index has %d", info.Size(), f.Size)
+	}
+	return ""
+}
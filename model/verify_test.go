@@ -0,0 +1,83 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+)
+
+func newVerifyPuller(m *Model) *puller {
+	m.cfg.Options.VerifyAfterSync = true
+	return newTestPuller(m, m.repoCfgs["default"])
+}
+
+func TestVerifyLocal(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	p := newVerifyPuller(m)
+
+	if checked, diverged := p.verifyLocal(); checked != 6 || len(diverged) != 0 {
+		t.Fatalf("Unexpected result %d, %v for unchanged repository", checked, diverged)
+	}
+
+	os.Remove(filepath.Join(dir, "f"))
+	fd, err := os.OpenFile(filepath.Join(dir, "a", "e"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte("more"))
+	fd.Close()
+
+	expected := []string{filepath.Join("a", "e"), "f"}
+	if _, diverged := p.verifyLocal(); !reflect.DeepEqual(diverged, expected) {
+		t.Errorf("Incorrect diverged files %v != %v", diverged, expected)
+	}
+}
+
+func TestVerifyLocalBatches(t *testing.T) {
+	defer func(n int) { verifyBatch = n }(verifyBatch)
+	verifyBatch = 2
+
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	p := newVerifyPuller(m)
+
+	// The files are checked two at a time in name order, wrapping around
+	os.Remove(filepath.Join(dir, "f"))
+	for i, exp := range []int{0, 0, 1, 0} {
+		if _, diverged := p.verifyLocal(); len(diverged) != exp {
+			t.Errorf("Check %d: incorrect number of diverged files %d != %d", i, len(diverged), exp)
+		}
+	}
+
+	// Files updated by the puller are checked right away
+	p.updateLocal(m.CurrentRepoFile("default", "f"))
+	if checked, diverged := p.verifyLocal(); checked != 3 || len(diverged) != 1 {
+		t.Errorf("Unexpected result %d, %v after update", checked, diverged)
+	}
+}
+
+func TestVerifyAfterSyncEvent(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	p := newVerifyPuller(m)
+
+	sub := events.Default.Subscribe(events.IndexDiverged)
+	defer events.Default.Unsubscribe(sub)
+
+	os.RemoveAll(filepath.Join(dir, "a"))
+	p.verifyAfterSync()
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ev.Data.(map[string]interface{})
+	if data["repo"] != "default" || data["checked"] != 6 || data["diverged"] != 5 {
+		t.Errorf("Unexpected event data %v", data)
+	}
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// With VerifyOnly set, the first pull cycle after the puller starts only
+// verifies the needed files that already exist in the repository, as they
+// do when it has been seeded with a copy of the data made by other means.
+// An existing file with the blocks of the needed version is taken to be
+// that version without anything being written to it but its modification
+// time and permissions. One that differs is logged for review and left
+// alone for as long as that version is the global one. Files that don't
+// exist are pulled as usual, as is everything once the first cycle is over.
+
+// verifyExisting verifies f against the existing file during the
+// verify-only pass, and returns true if f must not be pulled.
+func (p *puller) verifyExisting(f scanner.File) bool {
+	if v, ok := p.differing[f.Name]; ok {
+		if v == f.Version {
+			return true
+		}
+		delete(p.differing, f.Name)
+	}
+	if !p.repoCfg.VerifyOnly || p.verifyPassDone || protocol.IsDirectory(f.Flags) {
+		return false
+	}
+
+	path := filepath.Join(p.dir, f.Name)
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if protocol.IsDeleted(f.Flags) {
+		p.verifyDiffers(f, "it has been deleted elsewhere")
+		return true
+	}
+	if info.Size() != f.Size {
+		p.verifyDiffers(f, "its size differs")
+		return true
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		l.Infof("Cannot verify existing %q in repository %q, leaving it alone: %v", f.Name, p.repoCfg.ID, err)
+		return true
+	}
+	blocks, err := scanner.BlocksWith(fd, scanner.StandardBlockSize, p.repoCfg.ChunkerType)
+	fd.Close()
+	if err != nil {
+		l.Infof("Cannot verify existing %q in repository %q, leaving it alone: %v", f.Name, p.repoCfg.ID, err)
+		return true
+	}
+	if !blocksEqual(blocks, f.Blocks) {
+		p.verifyDiffers(f, "its contents differ")
+		return true
+	}
+
+	if debug {
+		l.Debugf("%q: existing %q matches version %d", p.repoCfg.ID, f.Name, f.Version)
+	}
+	if err := p.setMetadata(f, path); err != nil {
+		p.metadataFailed(f, err)
+		return true
+	}
+	p.updateLocal(f)
+	return true
+}
+
+// verifyDiffers records that the existing file differs from the needed
+// version f, so that it is not overwritten.
+func (p *puller) verifyDiffers(f scanner.File, reason string) {
+	l.Warnf("Existing %q in repository %q does not match the version on the other nodes, as %s; leaving it alone", f.Name, p.repoCfg.ID, reason)
+	if p.differing == nil {
+		p.differing = make(map[string]uint64)
+	}
+	p.differing[f.Name] = f.Version
+}
+
+// finishVerifyPass ends the verify-only pass after the first cycle.
+func (p *puller) finishVerifyPass() {
+	if !p.repoCfg.VerifyOnly || p.verifyPassDone {
+		return
+	}
+	p.verifyPassDone = true
+	l.Infof("Verified the existing files in repository %q; %d differ and are left alone", p.repoCfg.ID, len(p.differing))
+}
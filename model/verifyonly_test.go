@@ -0,0 +1,79 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestVerifyOnly(t *testing.T) {
+	m, dir := setupRescanRepo(t)
+	defer os.RemoveAll(dir)
+	repoCfg := m.repoCfgs["default"]
+	repoCfg.VerifyOnly = true
+	m.repoCfgs["default"] = repoCfg
+
+	// Node 42 has the same contents for f, other contents of the same size
+	// for a/e and a file g that we don't have at all.
+	same := m.CurrentRepoFile("default", "f")
+	same.Version += 100
+	same.Modified -= 3600
+	other := bytes.Repeat([]byte("x"), len(filepath.Join(dir, "a", "e")))
+	otherBlocks, _ := scanner.Blocks(bytes.NewReader(other), scanner.StandardBlockSize)
+	differ := scanner.File{Name: filepath.Join("a", "e"), Version: same.Version, Modified: same.Modified, Size: int64(len(other)), Blocks: otherBlocks}
+	missing := scanner.File{Name: "g", Version: same.Version, Modified: same.Modified, Size: int64(len(other)), Blocks: otherBlocks}
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{same, differ, missing})
+
+	p := newTestPuller(m, m.repoCfgs["default"])
+	p.queueNeededBlocks()
+
+	if lf := m.CurrentRepoFile("default", "f"); lf.Version != same.Version {
+		t.Errorf("Matching file has local version %d, expected %d", lf.Version, same.Version)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "f")); info.ModTime().Unix() != same.Modified {
+		t.Errorf("Modification time of matching file not set")
+	}
+	if lf := m.CurrentRepoFile("default", differ.Name); lf.Version == differ.Version {
+		t.Error("Differing file taken as the global version")
+	}
+	if bs, _ := ioutil.ReadFile(filepath.Join(dir, differ.Name)); bytes.Equal(bs, other) {
+		t.Error("Differing file overwritten")
+	}
+
+	queued := func() []string {
+		for i := 0; i < 100 && p.bq.size() == 0; i++ {
+			// The block queue picks up additions asynchronously
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		return p.bq.fileNames()
+	}
+	if names := queued(); !reflect.DeepEqual(names, []string{"g"}) {
+		t.Errorf("Incorrect queued files %v, expected the missing one only", names)
+	}
+	if !p.verifyPassDone {
+		t.Fatal("Verify pass not done after the first cycle")
+	}
+
+	// Normal sync resumes, still leaving the differing file alone
+	p.bq = newBlockQueue()
+	p.queueNeededBlocks()
+	if names := queued(); !reflect.DeepEqual(names, []string{"g"}) {
+		t.Errorf("Incorrect queued files %v after the verify pass", names)
+	}
+
+	// A newer version is pulled as usual
+	differ.Version++
+	m.repoFiles["default"].Replace(m.cm.Get("42"), []scanner.File{same, differ})
+	p.bq = newBlockQueue()
+	p.queueNeededBlocks()
+	if names := queued(); !reflect.DeepEqual(names, []string{differ.Name}) {
+		t.Errorf("Incorrect queued files %v, expected the newer version", names)
+	}
+}
@@ -0,0 +1,60 @@
+package model
+
+import "io"
+
+// A writeBuffer coalesces consecutive WriteAt calls into larger writes to the
+// underlying WriterAt. A write that doesn't continue where the previous one
+// ended causes the buffered data to be flushed first, so writes may still
+// arrive in any order.
+type writeBuffer struct {
+	w      io.WriterAt
+	buf    []byte
+	offset int64 // file offset of buf[0]
+}
+
+func newWriteBuffer(w io.WriterAt, size int) *writeBuffer {
+	return &writeBuffer{
+		w:   w,
+		buf: make([]byte, 0, size),
+	}
+}
+
+func (b *writeBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if len(b.buf) > 0 && off != b.offset+int64(len(b.buf)) {
+		// Not contiguous with what we have buffered
+		if err := b.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(b.buf)+len(p) > cap(b.buf) {
+		if err := b.Flush(); err != nil {
+			return 0, err
+		}
+		if len(p) >= cap(b.buf) {
+			// Wouldn't benefit from buffering anyway
+			return b.w.WriteAt(p, off)
+		}
+	}
+
+	if len(b.buf) == 0 {
+		b.offset = off
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// Flush writes any buffered data to the underlying WriterAt.
+func (b *writeBuffer) Flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	_, err := b.w.WriteAt(b.buf, b.offset)
+	b.buf = b.buf[:0]
+	return err
+}
+
+// holds returns true if any part of the given range is still buffered.
+func (b *writeBuffer) holds(off int64, size int) bool {
+	return len(b.buf) > 0 && off < b.offset+int64(len(b.buf)) && off+int64(size) > b.offset
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type countingWriterAt struct {
+	data   []byte
+	writes int
+}
+
+func (w *countingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.writes++
+	if end := int(off) + len(p); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+	copy(w.data[off:], p)
+	return len(p), nil
+}
+
+func TestWriteBuffer(t *testing.T) {
+	var expected []byte
+	for i := 0; i < 64; i++ {
+		expected = append(expected, bytes.Repeat([]byte{byte(i)}, 16)...)
+	}
+
+	// Write the blocks mostly in order, with a few jumps
+	order := make([]int, 0, 64)
+	for i := 0; i < 64; i++ {
+		order = append(order, i)
+	}
+	order[10], order[40] = order[40], order[10]
+
+	cw := &countingWriterAt{}
+	wb := newWriteBuffer(cw, 256)
+	for _, i := range order {
+		if _, err := wb.WriteAt(expected[i*16:(i+1)*16], int64(i*16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(cw.data, expected) != 0 {
+		t.Error("Incorrect data written")
+	}
+	if cw.writes > 10 {
+		t.Errorf("Too many writes to the underlying writer: %d", cw.writes)
+	}
+}
+
+func TestWriteBufferLarge(t *testing.T) {
+	cw := &countingWriterAt{}
+	wb := newWriteBuffer(cw, 16)
+	wb.WriteAt([]byte("abc"), 0)
+	wb.WriteAt(bytes.Repeat([]byte("x"), 32), 3)
+	wb.Flush()
+
+	if cw.writes != 2 {
+		t.Errorf("Incorrect number of writes %d != 2", cw.writes)
+	}
+	if len(cw.data) != 35 {
+		t.Errorf("Incorrect length %d != 35", len(cw.data))
+	}
+}
+
+func benchmarkSmallWrites(b *testing.B, bufSize int) {
+	fd, err := ioutil.TempFile("", "syncthing")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	block := make([]byte, 1024)
+	b.SetBytes(int64(len(block)))
+	b.ResetTimer()
+
+	var w interface {
+		WriteAt([]byte, int64) (int, error)
+	} = fd
+	var wb *writeBuffer
+	if bufSize > 0 {
+		wb = newWriteBuffer(fd, bufSize)
+		w = wb
+	}
+
+	for i := 0; i < b.N; i++ {
+		w.WriteAt(block, int64(i%4096)*int64(len(block)))
+	}
+	if wb != nil {
+		wb.Flush()
+	}
+}
+
+func BenchmarkSmallWritesDirect(b *testing.B) {
+	benchmarkSmallWrites(b, 0)
+}
+
+func BenchmarkSmallWritesBuffered(b *testing.B) {
+	benchmarkSmallWrites(b, 1024*1024)
+}
@@ -0,0 +1,7 @@
+package osutil
+
+import "errors"
+
+// ErrCloneUnsupported is returned by CloneRange when the files are not on a
+// filesystem that supports cloning, or not on the same filesystem.
+var ErrCloneUnsupported = errors.New("cloning not supported")
@@ -0,0 +1,43 @@
+package osutil
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// FICLONERANGE from linux/fs.h
+const ficlonerange = 0x4020940d
+
+type fileCloneRange struct {
+	srcFd      int64
+	srcOffset  uint64
+	srcLength  uint64
+	destOffset uint64
+}
+
+// CloneRange makes the size bytes at dstOffset in dst share storage with the
+// size bytes at srcOffset in src (a reflink), on filesystems that support it.
+// Offsets and size generally need to be aligned to the filesystem block size,
+// except for a range ending at the end of src.
+func CloneRange(dst, src *os.File, dstOffset, srcOffset, size int64) error {
+	if size <= 0 {
+		// A zero length means "to the end of the file" to the kernel
+		return nil
+	}
+	arg := fileCloneRange{
+		srcFd:      int64(src.Fd()),
+		srcOffset:  uint64(srcOffset),
+		srcLength:  uint64(size),
+		destOffset: uint64(dstOffset),
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlonerange, uintptr(unsafe.Pointer(&arg)))
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.EXDEV, syscall.ENOTTY, syscall.ENOSYS:
+		return ErrCloneUnsupported
+	default:
+		return &os.PathError{Op: "clone", Path: dst.Name(), Err: errno}
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package osutil
+
+import "os"
+
+// CloneRange is only supported on Linux; elsewhere it always returns
+// ErrCloneUnsupported.
+func CloneRange(dst, src *os.File, dstOffset, srcOffset, size int64) error {
+	return ErrCloneUnsupported
+}
@@ -0,0 +1,96 @@
+package osutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func tempFiles(t testing.TB, size int) (src, dst *os.File) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	src, err := ioutil.TempFile("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Write(data)
+	dst, err = ioutil.TempFile("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, dst
+}
+
+func removeFiles(fds ...*os.File) {
+	for _, fd := range fds {
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+}
+
+func TestCloneRange(t *testing.T) {
+	src, dst := tempFiles(t, 1<<20)
+	defer removeFiles(src, dst)
+
+	err := CloneRange(dst, src, 0, 65536, 1<<20-65536)
+	if err == ErrCloneUnsupported {
+		t.Skip("cloning not supported on the temporary directory filesystem")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := make([]byte, 1<<20-65536)
+	src.ReadAt(exp, 65536)
+	act := make([]byte, len(exp))
+	if _, err := dst.ReadAt(act, 0); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(exp, act) != 0 {
+		t.Error("Cloned data differs from source")
+	}
+}
+
+// A large file where all but the last block are unchanged and copied from the
+// existing version.
+
+const benchFileSize = 64 << 20
+
+func BenchmarkCopyUnchangedClone(b *testing.B) {
+	src, dst := tempFiles(b, benchFileSize)
+	defer removeFiles(src, dst)
+
+	if CloneRange(dst, src, 0, 0, benchFileSize-131072) == ErrCloneUnsupported {
+		b.Skip("cloning not supported on the temporary directory filesystem")
+	}
+	b.SetBytes(benchFileSize - 131072)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := CloneRange(dst, src, 0, 0, benchFileSize-131072); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyUnchangedReadWrite(b *testing.B) {
+	src, dst := tempFiles(b, benchFileSize)
+	defer removeFiles(src, dst)
+
+	buf := make([]byte, 131072)
+	b.SetBytes(benchFileSize - 131072)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := int64(0); off < benchFileSize-131072; off += 131072 {
+			if _, err := src.ReadAt(buf, off); err != nil && err != io.EOF {
+				b.Fatal(err)
+			}
+			if _, err := dst.WriteAt(buf, off); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package osutil
+
+import "errors"
+
+// ErrDiskBusyUnsupported is returned by DiskBusyTime when the time spent on
+// I/O can't be found for the disk, either on this platform or because the
+// path isn't on a block device.
+var ErrDiskBusyUnsupported = errors.New("disk utilization not available")
@@ -0,0 +1,48 @@
+package osutil
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DiskBusyTime returns the time the disk holding path has spent doing I/O
+// since boot, according to /proc/diskstats. The utilization of the disk
+// over an interval is the difference between two calls divided by the
+// length of the interval.
+func DiskBusyTime(path string) (time.Duration, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile("/proc/diskstats")
+	if err != nil {
+		return 0, ErrDiskBusyUnsupported
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return parseDiskStats(string(data), major, minor)
+}
+
+// parseDiskStats returns the milliseconds spent doing I/O, the tenth
+// statistics field, for the device with the given numbers.
+func parseDiskStats(data string, major, minor uint64) (time.Duration, error) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 13 {
+			continue
+		}
+		if fields[0] != strconv.FormatUint(major, 10) || fields[1] != strconv.FormatUint(minor, 10) {
+			continue
+		}
+		ms, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, ErrDiskBusyUnsupported
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return 0, ErrDiskBusyUnsupported
+}
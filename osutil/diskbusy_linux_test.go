@@ -0,0 +1,37 @@
+package osutil
+
+import (
+	"testing"
+	"time"
+)
+
+const testDiskStats = `   8       0 sda 43563 12041 2766834 21893 60522 61830 4362128 94416 0 54020 116296
+   8       1 sda1 43348 12041 2761706 21833 60522 61830 4362128 94416 0 53976 116236
+ 253       0 dm-0 1204 0 43520 1236 30 0 240 88 0 1252 1324
+`
+
+func TestParseDiskStats(t *testing.T) {
+	cases := []struct {
+		major, minor uint64
+		busy         time.Duration
+		err          error
+	}{
+		{8, 0, 54020 * time.Millisecond, nil},
+		{8, 1, 53976 * time.Millisecond, nil},
+		{253, 0, 1252 * time.Millisecond, nil},
+		{0, 45, 0, ErrDiskBusyUnsupported},
+	}
+
+	for i, tc := range cases {
+		busy, err := parseDiskStats(testDiskStats, tc.major, tc.minor)
+		if busy != tc.busy || err != tc.err {
+			t.Errorf("%d: parseDiskStats(%d, %d) = %v, %v; expected %v, %v", i, tc.major, tc.minor, busy, err, tc.busy, tc.err)
+		}
+	}
+}
+
+func TestDiskBusyTime(t *testing.T) {
+	if _, err := DiskBusyTime("."); err != nil && err != ErrDiskBusyUnsupported {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package osutil
+
+import "time"
+
+// DiskBusyTime is only supported on Linux; elsewhere it always returns
+// ErrDiskBusyUnsupported.
+func DiskBusyTime(path string) (time.Duration, error) {
+	return 0, ErrDiskBusyUnsupported
+}
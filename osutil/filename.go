@@ -0,0 +1,43 @@
+package osutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names reserved for devices on Windows, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+const windowsDisallowedChars = `<>:"|?*`
+
+// checkWindowsFilename returns an error if any component of name can't be
+// used on Windows.
+func checkWindowsFilename(name string) error {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+	for _, part := range parts {
+		base := part
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			base = base[:i]
+		}
+		if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+			return fmt.Errorf("%q is a reserved name", part)
+		}
+		for _, r := range part {
+			if r < 32 || strings.ContainsRune(windowsDisallowedChars, r) {
+				return fmt.Errorf("%q contains the character %q", part, r)
+			}
+		}
+		if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+			return fmt.Errorf("%q ends with a dot or space", part)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package osutil
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCheckWindowsFilename(t *testing.T) {
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"foo", true},
+		{`foo\bar.txt`, true},
+		{"a/b/.hidden", true},
+		{"console", true},
+		{"COM10", true},
+		{"CON", false},
+		{"con.txt", false},
+		{`dir\nul`, false},
+		{"Lpt1 .log", false},
+		{"what?", false},
+		{"a:b", false},
+		{`say "hi"`, false},
+		{"tab\there", false},
+		{"trailing.", false},
+		{"trailing ", false},
+		{`dir.\foo`, false},
+	}
+
+	for _, tc := range cases {
+		if err := checkWindowsFilename(tc.name); (err == nil) != tc.valid {
+			t.Errorf("checkWindowsFilename(%q) = %v, expected valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestCheckFilename(t *testing.T) {
+	if err := CheckFilename("foo/bar"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckFilename("foo\x00bar"); err == nil {
+		t.Error("Unexpected nil error for a name containing NUL")
+	}
+
+	err := CheckFilename("aux.c")
+	if runtime.GOOS == "windows" && err == nil {
+		t.Error("Unexpected nil error for a reserved name on Windows")
+	} else if runtime.GOOS != "windows" && err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package osutil
+
+import (
+	"errors"
+	"strings"
+)
+
+// CheckFilename returns an error describing why name, a path relative to a
+// repository, cannot be created on this platform. Only the NUL character is
+// off limits on Unix.
+func CheckFilename(name string) error {
+	if strings.IndexByte(name, 0) >= 0 {
+		return errors.New("contains a NUL character")
+	}
+	return nil
+}
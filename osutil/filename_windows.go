@@ -0,0 +1,9 @@
+package osutil
+
+// CheckFilename returns an error describing why name, a path relative to a
+// repository, cannot be created on this platform. Windows reserves device
+// names such as CON and NUL, a number of punctuation characters, and names
+// ending in a dot or space.
+func CheckFilename(name string) error {
+	return checkWindowsFilename(name)
+}
@@ -0,0 +1,33 @@
+package osutil
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestIsInUse(t *testing.T) {
+	inUse := syscall.ETXTBSY
+	if runtime.GOOS == "windows" {
+		inUse = syscall.Errno(32) // ERROR_SHARING_VIOLATION
+	}
+
+	cases := []struct {
+		err   error
+		inUse bool
+	}{
+		{&os.PathError{Op: "remove", Path: "foo", Err: inUse}, true},
+		{&os.LinkError{Op: "rename", Old: "foo", New: "bar", Err: inUse}, true},
+		{&os.PathError{Op: "remove", Path: "foo", Err: syscall.ENOENT}, false},
+		{errors.New("something else"), false},
+		{nil, false},
+	}
+
+	for i, tc := range cases {
+		if res := IsInUse(tc.err); res != tc.inUse {
+			t.Errorf("%d: IsInUse(%v) = %v, expected %v", i, tc.err, res, tc.inUse)
+		}
+	}
+}
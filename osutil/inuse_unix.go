@@ -0,0 +1,13 @@
+// +build !windows
+
+package osutil
+
+import "syscall"
+
+// IsInUse returns true if err indicates that the file could not be accessed
+// because it is open or locked by another process. On Unix files can be
+// replaced regardless of whether they are open, except for running
+// executables on some systems.
+func IsInUse(err error) bool {
+	return underlyingErr(err) == syscall.ETXTBSY
+}
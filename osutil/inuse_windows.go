@@ -0,0 +1,18 @@
+package osutil
+
+import "syscall"
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// IsInUse returns true if err indicates that the file could not be accessed
+// because it is open or locked by another process.
+func IsInUse(err error) bool {
+	switch underlyingErr(err) {
+	case errorSharingViolation, errorLockViolation:
+		return true
+	}
+	return false
+}
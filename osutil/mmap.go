@@ -0,0 +1,7 @@
+package osutil
+
+import "errors"
+
+// ErrMmapUnsupported is returned by Mmap when files can't be mapped on this
+// platform, or the file is too large to map.
+var ErrMmapUnsupported = errors.New("memory mapping not supported")
@@ -0,0 +1,30 @@
+package osutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	src, dst := tempFiles(t, 1<<20)
+	defer removeFiles(src, dst)
+
+	data, err := Mmap(src, 1<<20)
+	if err == ErrMmapUnsupported {
+		t.Skip("memory mapping not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Munmap(data)
+
+	exp, _ := ioutil.ReadFile(src.Name())
+	if !bytes.Equal(data, exp) {
+		t.Error("Mapped data differs from file")
+	}
+
+	if _, err := Mmap(src, 0); err != ErrMmapUnsupported {
+		t.Errorf("Unexpected error %v mapping nothing", err)
+	}
+}
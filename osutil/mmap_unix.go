@@ -0,0 +1,27 @@
+// +build !windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// Mmap maps the first size bytes of fd read only into memory. The mapping
+// stays valid after fd is closed and must be released with Munmap. Reading
+// past the end of a file that has been truncated since it was mapped faults.
+func Mmap(fd *os.File, size int64) ([]byte, error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, ErrMmapUnsupported
+	}
+	data, err := syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: fd.Name(), Err: err}
+	}
+	return data, nil
+}
+
+// Munmap releases a mapping returned by Mmap.
+func Munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
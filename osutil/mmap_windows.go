@@ -0,0 +1,13 @@
+package osutil
+
+import "os"
+
+// Mmap is not supported on Windows; it always returns ErrMmapUnsupported.
+func Mmap(fd *os.File, size int64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+// Munmap does nothing on Windows, as nothing can be mapped.
+func Munmap(data []byte) error {
+	return nil
+}
@@ -16,3 +16,17 @@ func Rename(from, to string) error {
 	defer os.Remove(from) // Don't leave a dangling temp file in case of rename error
 	return os.Rename(from, to)
 }
+
+// underlyingErr returns the error from the system call behind err, if it is
+// one of the wrapped error types returned by the os package.
+func underlyingErr(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return err
+}
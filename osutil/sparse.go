@@ -0,0 +1,13 @@
+package osutil
+
+import "errors"
+
+// An Extent is a range of bytes in a file.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// ErrSparseUnsupported is returned by Holes when there is no way to tell
+// where the holes in a file are.
+var ErrSparseUnsupported = errors.New("finding holes not supported")
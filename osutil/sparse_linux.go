@@ -0,0 +1,49 @@
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// Whence values for lseek from linux/fs.h
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Holes returns the holes in the first size bytes of fd, in order. A
+// filesystem that doesn't keep track of holes reports none. The file offset
+// of fd is left at the start of the file.
+func Holes(fd *os.File, size int64) ([]Extent, error) {
+	defer fd.Seek(0, os.SEEK_SET)
+
+	var holes []Extent
+	for offset := int64(0); offset < size; {
+		data, err := syscall.Seek(int(fd.Fd()), offset, seekData)
+		switch err {
+		case nil:
+		case syscall.ENXIO:
+			// Nothing but hole up to the end of the file
+			data = size
+		case syscall.EINVAL:
+			return nil, ErrSparseUnsupported
+		default:
+			return nil, &os.PathError{Op: "seek", Path: fd.Name(), Err: err}
+		}
+		if data > size {
+			data = size
+		}
+		if data > offset {
+			holes = append(holes, Extent{offset, data - offset})
+		}
+		if data == size {
+			break
+		}
+
+		offset, err = syscall.Seek(int(fd.Fd()), data, seekHole)
+		if err != nil {
+			return nil, &os.PathError{Op: "seek", Path: fd.Name(), Err: err}
+		}
+	}
+	return holes, nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package osutil
+
+import "os"
+
+// Holes is only supported on Linux; elsewhere it always returns
+// ErrSparseUnsupported.
+func Holes(fd *os.File, size int64) ([]Extent, error) {
+	return nil, ErrSparseUnsupported
+}
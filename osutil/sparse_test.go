@@ -0,0 +1,52 @@
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHoles(t *testing.T) {
+	fd, err := ioutil.TempFile("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeFiles(fd)
+
+	// Data in the second and fourth MiB, holes around it
+	const mib = 1 << 20
+	data := make([]byte, mib)
+	for i := range data {
+		data[i] = 1
+	}
+	fd.WriteAt(data, mib)
+	fd.WriteAt(data, 3*mib)
+	fd.Truncate(5 * mib)
+
+	holes, err := Holes(fd, 5*mib)
+	if err == ErrSparseUnsupported || err == nil && len(holes) == 0 {
+		t.Skip("no holes reported on this platform or filesystem")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Extent{{0, mib}, {2 * mib, mib}, {4 * mib, mib}}
+	if len(holes) != len(expected) {
+		t.Fatalf("Incorrect holes %v != %v", holes, expected)
+	}
+	for i := range holes {
+		if holes[i] != expected[i] {
+			t.Errorf("Incorrect hole %d: %v != %v", i, holes[i], expected[i])
+		}
+	}
+
+	// Only holes within the size are reported
+	holes, _ = Holes(fd, mib+mib/2)
+	if len(holes) != 1 || holes[0] != (Extent{0, mib}) {
+		t.Errorf("Incorrect holes %v for partial size", holes)
+	}
+	if pos, _ := fd.Seek(0, os.SEEK_CUR); pos != 0 {
+		t.Errorf("File offset left at %d", pos)
+	}
+}
@@ -0,0 +1,37 @@
+package osutil
+
+import (
+	"os"
+	"runtime"
+)
+
+// SyncFile flushes the contents of the named file to stable storage.
+func SyncFile(path string) error {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SyncDir flushes the directory entries of the named directory to stable
+// storage, making renames into it durable. It does nothing on Windows, where
+// directories cannot be synced.
+func SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
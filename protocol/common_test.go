@@ -7,15 +7,21 @@ import (
 
 type TestModel struct {
 	data     []byte
+	files    []FileInfo
+	after    string
 	repo     string
 	name     string
 	offset   int64
 	size     int
+	version  uint64
+	blocks   []byte
+	availCh  chan bool
 	closedCh chan bool
 }
 
 func newTestModel() *TestModel {
 	return &TestModel{
+		availCh:  make(chan bool, 1),
 		closedCh: make(chan bool),
 	}
 }
@@ -34,6 +40,23 @@ func (t *TestModel) Request(nodeID, repo, name string, offset int64, size int) (
 	return t.data, nil
 }
 
+func (t *TestModel) List(nodeID, repo, after string, max int) ([]FileInfo, int) {
+	t.repo = repo
+	t.after = after
+	if len(t.files) <= max {
+		return t.files, 0
+	}
+	return t.files[:max], len(t.files) - max
+}
+
+func (t *TestModel) Availability(nodeID, repo, name string, version uint64, blocks []byte) {
+	t.repo = repo
+	t.name = name
+	t.version = version
+	t.blocks = blocks
+	t.availCh <- true
+}
+
 func (t *TestModel) Close(nodeID string, err error) {
 	close(t.closedCh)
 }
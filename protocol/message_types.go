@@ -46,3 +46,21 @@ type Option struct {
 	Key   string // max:64
 	Value string // max:1024
 }
+
+type ListRequestMessage struct {
+	Repository string // max:64
+	After      string // max:1024
+	MaxFiles   uint32
+}
+
+type ListResponseMessage struct {
+	Files     []FileInfo // max:1000
+	Remaining uint32
+}
+
+type AvailabilityMessage struct {
+	Repository string // max:64
+	Name       string // max:1024
+	Version    uint64
+	Blocks     []byte // max:12500
+}
@@ -20,6 +20,18 @@ func (m nativeModel) Request(nodeID, repo string, name string, offset int64, siz
 	return m.next.Request(nodeID, repo, name, offset, size)
 }
 
+func (m nativeModel) List(nodeID, repo, after string, max int) ([]FileInfo, int) {
+	files, remaining := m.next.List(nodeID, repo, after, max)
+	for i := range files {
+		files[i].Name = wireName(files[i].Name)
+	}
+	return files, remaining
+}
+
+func (m nativeModel) Availability(nodeID, repo, name string, version uint64, blocks []byte) {
+	m.next.Availability(nodeID, repo, name, version, blocks)
+}
+
 func (m nativeModel) ClusterConfig(nodeID string, config ClusterConfigMessage) {
 	m.next.ClusterConfig(nodeID, config)
 }
@@ -27,3 +39,7 @@ func (m nativeModel) ClusterConfig(nodeID string, config ClusterConfigMessage) {
 func (m nativeModel) Close(nodeID string, err error) {
 	m.next.Close(nodeID, err)
 }
+
+func nativeName(name string) string {
+	return name
+}
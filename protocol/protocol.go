@@ -22,13 +22,21 @@ const (
 	messageTypePing          = 4
 	messageTypePong          = 5
 	messageTypeIndexUpdate   = 6
+	messageTypeListRequest   = 7
+	messageTypeListResponse  = 8
+	messageTypeAvailability  = 9
 )
 
+// MaxListFiles is the largest number of files returned by a single List
+// request.
+const MaxListFiles = 1000
+
 const (
 	FlagDeleted    uint32 = 1 << 12
 	FlagInvalid           = 1 << 13
 	FlagDirectory         = 1 << 14
 	FlagNoPermBits        = 1 << 15
+	FlagHardlink          = 1 << 16
 )
 
 const (
@@ -40,6 +48,7 @@ const (
 var (
 	ErrClusterHash = fmt.Errorf("configuration error: mismatched cluster hash")
 	ErrClosed      = errors.New("connection closed")
+	ErrNoListing   = errors.New("peer returned no listing")
 )
 
 type Model interface {
@@ -51,6 +60,13 @@ type Model interface {
 	Request(nodeID string, repo string, name string, offset int64, size int) ([]byte, error)
 	// A cluster configuration message was received
 	ClusterConfig(nodeID string, config ClusterConfigMessage)
+	// A file listing was requested by the peer node. Returns at most max
+	// files sorted by name, starting after the named file, and the number
+	// of files remaining after those.
+	List(nodeID string, repo string, after string, max int) ([]FileInfo, int)
+	// The peer node holds the marked blocks of the given version of a file
+	// it is still pulling
+	Availability(nodeID string, repo string, name string, version uint64, blocks []byte)
 	// The peer node closed the connection
 	Close(nodeID string, err error)
 }
@@ -60,6 +76,8 @@ type Connection interface {
 	Index(repo string, files []FileInfo)
 	Request(repo string, name string, offset int64, size int) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
+	List(repo string, after string, max int) ([]FileInfo, int, error)
+	Availability(repo string, name string, version uint64, blocks []byte)
 	Statistics() Statistics
 }
 
@@ -87,8 +105,9 @@ type rawConnection struct {
 }
 
 type asyncResult struct {
-	val []byte
-	err error
+	val  []byte
+	list *ListResponseMessage
+	err  error
 }
 
 const (
@@ -195,6 +214,52 @@ func (c *rawConnection) Request(repo string, name string, offset int64, size int
 	return res.val, res.err
 }
 
+// List returns a page of the peer's file listing for the repository, without
+// the files becoming part of any index. At most max files, and never more
+// than MaxListFiles, are returned, starting after the named file. The number
+// of files remaining after the page is returned as well.
+func (c *rawConnection) List(repo string, after string, max int) ([]FileInfo, int, error) {
+	var id int
+	select {
+	case id = <-c.nextID:
+	case <-c.closed:
+		return nil, 0, ErrClosed
+	}
+
+	c.imut.Lock()
+	if ch := c.awaiting[id]; ch != nil {
+		panic("id taken")
+	}
+	rc := make(chan asyncResult)
+	c.awaiting[id] = rc
+	c.imut.Unlock()
+
+	if max <= 0 || max > MaxListFiles {
+		max = MaxListFiles
+	}
+	ok := c.send(header{0, id, messageTypeListRequest},
+		ListRequestMessage{repo, after, uint32(max)})
+	if !ok {
+		return nil, 0, ErrClosed
+	}
+
+	res, ok := <-rc
+	if !ok {
+		return nil, 0, ErrClosed
+	}
+	if res.list == nil {
+		return nil, 0, ErrNoListing
+	}
+	return res.list.Files, int(res.list.Remaining), nil
+}
+
+// Availability tells the peer which blocks of a file that is still being
+// pulled we hold, as a bitmap with one bit per block, lowest bit first. An
+// empty bitmap withdraws an earlier announcement.
+func (c *rawConnection) Availability(repo string, name string, version uint64, blocks []byte) {
+	c.send(header{0, -1, messageTypeAvailability}, AvailabilityMessage{repo, name, version, blocks})
+}
+
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.send(header{0, -1, messageTypeClusterConfig}, config)
@@ -264,6 +329,21 @@ func (c *rawConnection) readerLoop() (err error) {
 				return err
 			}
 
+		case messageTypeListRequest:
+			if err := c.handleListRequest(hdr); err != nil {
+				return err
+			}
+
+		case messageTypeListResponse:
+			if err := c.handleListResponse(hdr); err != nil {
+				return err
+			}
+
+		case messageTypeAvailability:
+			if err := c.handleAvailability(); err != nil {
+				return err
+			}
+
 		case messageTypePing:
 			c.send(header{0, hdr.msgID, messageTypePong})
 
@@ -335,7 +415,7 @@ func (c *rawConnection) handleResponse(hdr header) error {
 		c.imut.Unlock()
 
 		if rc != nil {
-			rc <- asyncResult{data, err}
+			rc <- asyncResult{val: data, err: err}
 			close(rc)
 		}
 	}(hdr, c.xr.Error())
@@ -343,6 +423,48 @@ func (c *rawConnection) handleResponse(hdr header) error {
 	return nil
 }
 
+func (c *rawConnection) handleListRequest(hdr header) error {
+	var req ListRequestMessage
+	req.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+	go c.processListRequest(hdr.msgID, req)
+	return nil
+}
+
+func (c *rawConnection) handleAvailability() error {
+	var am AvailabilityMessage
+	am.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+	go c.receiver.Availability(c.id, am.Repository, am.Name, am.Version, am.Blocks)
+	return nil
+}
+
+func (c *rawConnection) handleListResponse(hdr header) error {
+	var res ListResponseMessage
+	res.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+
+	go func() {
+		c.imut.Lock()
+		rc := c.awaiting[hdr.msgID]
+		c.awaiting[hdr.msgID] = nil
+		c.imut.Unlock()
+
+		if rc != nil {
+			rc <- asyncResult{list: &res}
+			close(rc)
+		}
+	}()
+
+	return nil
+}
+
 func (c *rawConnection) handlePong(hdr header) {
 	c.imut.Lock()
 	if rc := c.awaiting[hdr.msgID]; rc != nil {
@@ -503,6 +625,21 @@ func (c *rawConnection) processRequest(msgID int, req RequestMessage) {
 		encodableBytes(data))
 }
 
+func (c *rawConnection) processListRequest(msgID int, req ListRequestMessage) {
+	max := int(req.MaxFiles)
+	if max <= 0 || max > MaxListFiles {
+		max = MaxListFiles
+	}
+	files, remaining := c.receiver.List(c.id, req.Repository, req.After, max)
+	if len(files) > max {
+		remaining += len(files) - max
+		files = files[:max]
+	}
+
+	c.send(header{0, msgID, messageTypeListResponse},
+		ListResponseMessage{files, uint32(remaining)})
+}
+
 type Statistics struct {
 	At            time.Time
 	InBytesTotal  int
@@ -529,6 +666,10 @@ func IsDirectory(bits uint32) bool {
 	return bits&FlagDirectory != 0
 }
 
+func IsHardlink(bits uint32) bool {
+	return bits&FlagHardlink != 0
+}
+
 func HasPermissionBits(bits uint32) bool {
 	return bits&FlagNoPermBits == 0
 }
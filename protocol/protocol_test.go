@@ -1,10 +1,13 @@
 package protocol
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"path/filepath"
 	"testing"
 	"testing/quick"
+	"time"
 )
 
 func TestHeaderFunctions(t *testing.T) {
@@ -191,4 +194,65 @@ func TestClose(t *testing.T) {
 	if _, err := c0.Request("default", "foo", 0, 0); err == nil {
 		t.Error("Request should return an error")
 	}
+	if _, _, err := c0.List("default", "", 10); err == nil {
+		t.Error("List should return an error")
+	}
+}
+
+func TestList(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.files = []FileInfo{
+		{Name: "a", Modified: 1, Version: 2, Blocks: []BlockInfo{{Size: 3, Hash: []byte("hash")}}},
+		{Name: "b/c"},
+		{Name: "d"},
+	}
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	NewConnection("c1", br, aw, m1)
+
+	files, remaining, err := c0.List("default", "0", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.repo != "default" || m1.after != "0" {
+		t.Errorf("Incorrect request %q, %q", m1.repo, m1.after)
+	}
+	if len(files) != 2 || remaining != 1 {
+		t.Fatalf("Incorrect listing %v, %d remaining", files, remaining)
+	}
+	if f := files[0]; f.Name != "a" || f.Modified != 1 || f.Version != 2 || len(f.Blocks) != 1 || string(f.Blocks[0].Hash) != "hash" {
+		t.Errorf("Incorrect file %v", f)
+	}
+	if files[1].Name != filepath.FromSlash("b/c") {
+		t.Errorf("Name %q not in native format", files[1].Name)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	NewConnection("c1", br, aw, m1)
+
+	c0.Availability("default", "a/b", 3, []byte{0x05, 0x80})
+
+	select {
+	case <-m1.availCh:
+	case <-time.After(time.Second):
+		t.Fatal("No availability message received")
+	}
+	if m1.repo != "default" || m1.name != filepath.FromSlash("a/b") || m1.version != 3 {
+		t.Errorf("Incorrect message %q, %q, %d", m1.repo, m1.name, m1.version)
+	}
+	if !bytes.Equal(m1.blocks, []byte{0x05, 0x80}) {
+		t.Errorf("Incorrect bitmap %x", m1.blocks)
+	}
 }
@@ -30,6 +30,19 @@ func (c wireFormatConnection) Request(repo, name string, offset int64, size int)
 	return c.next.Request(repo, name, offset, size)
 }
 
+func (c wireFormatConnection) List(repo, after string, max int) ([]FileInfo, int, error) {
+	after = wireName(after)
+	files, remaining, err := c.next.List(repo, after, max)
+	for i := range files {
+		files[i].Name = nativeName(files[i].Name)
+	}
+	return files, remaining, err
+}
+
+func (c wireFormatConnection) Availability(repo, name string, version uint64, blocks []byte) {
+	c.next.Availability(repo, wireName(name), version, blocks)
+}
+
 func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
@@ -37,3 +50,8 @@ func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
+
+// wireName converts a native file name to the wire format.
+func wireName(name string) string {
+	return norm.NFC.String(filepath.ToSlash(name))
+}
@@ -1,17 +1,31 @@
 package scanner
 
 import (
-	"bytes"
 	"crypto/sha256"
+	"hash/adler32"
 	"io"
+	"sync"
 )
 
 const StandardBlockSize = 128 * 1024
 
+// The SHA-256 of zero bytes, used as the single block hash of empty files.
+var emptyBlockHash = []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55}
+
 type Block struct {
-	Offset int64
-	Size   uint32
-	Hash   []byte
+	Offset   int64
+	Size     uint32
+	Hash     []byte
+	WeakHash uint32 // see WeakHash; zero if not known
+}
+
+// WeakHash returns the weak hash of the data of a block, an Adler-32
+// checksum. It is much cheaper to compute than the strong hash and tells most
+// differing blocks apart, but blocks with the same weak hash may still
+// differ. Only the blocks of local files have it; it is not sent to other
+// nodes or kept in a disk index.
+func WeakHash(data []byte) uint32 {
+	return adler32.Checksum(data)
 }
 
 // Blocks returns the blockwise hash of the reader.
@@ -21,7 +35,8 @@ func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 	for {
 		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
 		hf := sha256.New()
-		n, err := io.Copy(hf, lr)
+		wf := adler32.New()
+		n, err := io.Copy(io.MultiWriter(hf, wf), lr)
 		if err != nil {
 			return nil, err
 		}
@@ -31,9 +46,10 @@ func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 		}
 
 		b := Block{
-			Offset: offset,
-			Size:   uint32(n),
-			Hash:   hf.Sum(nil),
+			Offset:   offset,
+			Size:     uint32(n),
+			Hash:     hf.Sum(nil),
+			WeakHash: wf.Sum32(),
 		}
 		blocks = append(blocks, b)
 		offset += int64(n)
@@ -44,15 +60,70 @@ func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 		blocks = append(blocks, Block{
 			Offset: 0,
 			Size:   0,
-			Hash:   []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55},
+			Hash:   emptyBlockHash,
 		})
 	}
 
 	return blocks, nil
 }
 
+// ParallelBlocks returns the same blocks as Blocks does for the first size
+// bytes of r, hashing consecutive parts of them in up to workers goroutines.
+func ParallelBlocks(r io.ReaderAt, size int64, blocksize, workers int) ([]Block, error) {
+	if size == 0 {
+		return []Block{{Offset: 0, Size: 0, Hash: emptyBlockHash}}, nil
+	}
+
+	n := int((size + int64(blocksize) - 1) / int64(blocksize))
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	blocks := make([]Block, n)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			buf := make([]byte, blocksize)
+			for i := w * n / workers; i < (w+1)*n/workers; i++ {
+				offset := int64(i) * int64(blocksize)
+				bs := blocksize
+				if rem := size - offset; rem < int64(bs) {
+					bs = int(rem)
+				}
+				if read, err := r.ReadAt(buf[:bs], offset); read < bs {
+					errs[w] = err
+					return
+				}
+				hash := sha256.Sum256(buf[:bs])
+				blocks[i] = Block{
+					Offset:   offset,
+					Size:     uint32(bs),
+					Hash:     hash[:],
+					WeakHash: WeakHash(buf[:bs]),
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
 // BlockDiff returns lists of common and missing (to transform src into tgt)
-// blocks. Both block lists must have been created with the same block size.
+// blocks. A target block is common if a block with the same hash exists
+// anywhere in src, not necessarily at the same offset. Both block lists must
+// have been created with the same block size and chunker type.
 func BlockDiff(src, tgt []Block) (have, need []Block) {
 	if len(tgt) == 0 && len(src) != 0 {
 		return nil, nil
@@ -63,12 +134,17 @@ func BlockDiff(src, tgt []Block) (have, need []Block) {
 		return nil, tgt
 	}
 
+	var srcHashes = make(map[string]struct{}, len(src))
+	for _, b := range src {
+		srcHashes[string(b.Hash)] = struct{}{}
+	}
+
 	for i := range tgt {
-		if i >= len(src) || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
+		if _, ok := srcHashes[string(tgt[i].Hash)]; ok {
+			have = append(have, tgt[i])
+		} else {
 			// Copy differing block
 			need = append(need, tgt[i])
-		} else {
-			have = append(have, tgt[i])
 		}
 	}
 
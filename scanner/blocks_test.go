@@ -3,6 +3,7 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -75,6 +76,51 @@ func TestBlocks(t *testing.T) {
 	}
 }
 
+func TestParallelBlocks(t *testing.T) {
+	data := chunkerTestData(1<<20 + 12345)
+	for _, size := range []int{0, 1, 1024, 1025, 100000, len(data)} {
+		serial, err := Blocks(bytes.NewReader(data[:size]), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{0, 1, 3, 8, 2000} {
+			parallel, err := ParallelBlocks(bytes.NewReader(data[:size]), int64(size), 1024, workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parallel, serial) {
+				t.Errorf("Size %d, %d workers: blocks differ from serial hashing", size, workers)
+			}
+		}
+	}
+
+	// A reader shorter than the size is an error
+	if _, err := ParallelBlocks(bytes.NewReader(data[:100]), 5000, 1024, 2); err == nil {
+		t.Error("Unexpected nil error for short reader")
+	}
+}
+
+func benchmarkVerify(b *testing.B, workers int) {
+	data := chunkerTestData(64 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if workers == 0 {
+			Blocks(bytes.NewReader(data), StandardBlockSize)
+		} else {
+			ParallelBlocks(bytes.NewReader(data), int64(len(data)), StandardBlockSize, workers)
+		}
+	}
+}
+
+func BenchmarkVerifySerial(b *testing.B) {
+	benchmarkVerify(b, 0)
+}
+
+func BenchmarkVerifyParallel4(b *testing.B) {
+	benchmarkVerify(b, 4)
+}
+
 var diffTestData = []struct {
 	a string
 	b string
@@ -84,15 +130,15 @@ var diffTestData = []struct {
 	{"contents", "contents", 1024, []Block{}},
 	{"", "", 1024, []Block{}},
 	{"contents", "contents", 3, []Block{}},
-	{"contents", "cantents", 3, []Block{{0, 3, nil}}},
-	{"contents", "contants", 3, []Block{{3, 3, nil}}},
-	{"contents", "cantants", 3, []Block{{0, 3, nil}, {3, 3, nil}}},
-	{"contents", "", 3, []Block{{0, 0, nil}}},
-	{"", "contents", 3, []Block{{0, 3, nil}, {3, 3, nil}, {6, 2, nil}}},
-	{"con", "contents", 3, []Block{{3, 3, nil}, {6, 2, nil}}},
+	{"contents", "cantents", 3, []Block{{0, 3, nil, 0}}},
+	{"contents", "contants", 3, []Block{{3, 3, nil, 0}}},
+	{"contents", "cantants", 3, []Block{{0, 3, nil, 0}, {3, 3, nil, 0}}},
+	{"contents", "", 3, []Block{{0, 0, nil, 0}}},
+	{"", "contents", 3, []Block{{0, 3, nil, 0}, {3, 3, nil, 0}, {6, 2, nil, 0}}},
+	{"con", "contents", 3, []Block{{3, 3, nil, 0}, {6, 2, nil, 0}}},
 	{"contents", "con", 3, nil},
-	{"contents", "cont", 3, []Block{{3, 1, nil}}},
-	{"cont", "contents", 3, []Block{{3, 3, nil}, {6, 2, nil}}},
+	{"contents", "cont", 3, []Block{{3, 1, nil, 0}}},
+	{"cont", "contents", 3, []Block{{3, 3, nil, 0}, {6, 2, nil, 0}}},
 }
 
 func TestDiff(t *testing.T) {
@@ -0,0 +1,117 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// ChunkerFixed splits files into blocks of a fixed size.
+	ChunkerFixed = "fixed"
+	// ChunkerCDC splits files into variable size blocks at content defined
+	// boundaries, so that inserting or removing data only affects the blocks
+	// around the change.
+	ChunkerCDC = "cdc"
+)
+
+// Content defined blocks are never smaller than cdcMinBlockSize (except at
+// the end of the file) or larger than cdcMaxBlockSize. The maximum must not
+// exceed the largest response the protocol accepts.
+const (
+	cdcMinBlockSize = StandardBlockSize / 4
+	cdcMaxBlockSize = StandardBlockSize * 2
+	cdcMaskBits     = 17
+	cdcMask         = uint64(1<<cdcMaskBits-1) << (64 - cdcMaskBits)
+)
+
+// gear maps each byte value to a pseudo random value for the rolling hash.
+// It is derived from SHA-256 so that it is identical on all nodes.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		h := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(h[:])
+	}
+}
+
+// ValidChunker returns true if the named chunker type is supported. The
+// empty string is equivalent to ChunkerFixed.
+func ValidChunker(chunker string) bool {
+	switch chunker {
+	case "", ChunkerFixed, ChunkerCDC:
+		return true
+	default:
+		return false
+	}
+}
+
+// BlocksWith returns the blockwise hash of the reader using the named chunker
+// type. The block size is only used by the fixed size chunker.
+func BlocksWith(r io.Reader, blocksize int, chunker string) ([]Block, error) {
+	if chunker == ChunkerCDC {
+		return ChunkedBlocks(r)
+	}
+	return Blocks(r, blocksize)
+}
+
+// ChunkedBlocks returns the blockwise hash of the reader, using content
+// defined block boundaries.
+func ChunkedBlocks(r io.Reader) ([]Block, error) {
+	var blocks []Block
+	var offset int64
+	var buf = make([]byte, cdcMaxBlockSize)
+	var fill int
+
+	for {
+		n, err := io.ReadFull(r, buf[fill:])
+		fill += n
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if fill == 0 {
+			break
+		}
+
+		cut := cutPoint(buf[:fill])
+		hash := sha256.Sum256(buf[:cut])
+		blocks = append(blocks, Block{
+			Offset:   offset,
+			Size:     uint32(cut),
+			Hash:     hash[:],
+			WeakHash: WeakHash(buf[:cut]),
+		})
+		offset += int64(cut)
+
+		fill = copy(buf, buf[cut:fill])
+	}
+
+	if len(blocks) == 0 {
+		// Empty file
+		blocks = append(blocks, Block{
+			Offset: 0,
+			Size:   0,
+			Hash:   emptyBlockHash,
+		})
+	}
+
+	return blocks, nil
+}
+
+// cutPoint returns the length of the first block in data. The data is
+// expected to be cdcMaxBlockSize long unless it is the end of the file.
+func cutPoint(data []byte) int {
+	if len(data) <= cdcMinBlockSize {
+		return len(data)
+	}
+
+	var h uint64
+	for i := cdcMinBlockSize; i < len(data); i++ {
+		h = h<<1 + gear[data[i]]
+		if h&cdcMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
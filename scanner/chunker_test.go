@@ -0,0 +1,68 @@
+package scanner
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func chunkerTestData(n int) []byte {
+	bs := make([]byte, n)
+	rand.New(rand.NewSource(42)).Read(bs)
+	return bs
+}
+
+func TestChunkedBlocks(t *testing.T) {
+	data := chunkerTestData(4 << 20)
+
+	blocks, err := ChunkedBlocks(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offset int64
+	for i, b := range blocks {
+		if b.Offset != offset {
+			t.Errorf("Incorrect offset for block %d: %d != %d", i, b.Offset, offset)
+		}
+		if b.Size > cdcMaxBlockSize || b.Size < cdcMinBlockSize && i != len(blocks)-1 {
+			t.Errorf("Block %d size %d out of bounds", i, b.Size)
+		}
+		offset += int64(b.Size)
+	}
+	if offset != int64(len(data)) {
+		t.Errorf("Blocks cover %d bytes != %d", offset, len(data))
+	}
+}
+
+func TestChunkedBlocksEmpty(t *testing.T) {
+	blocks, err := ChunkedBlocks(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Size != 0 || bytes.Compare(blocks[0].Hash, emptyBlockHash) != 0 {
+		t.Errorf("Incorrect blocks for empty file: %v", blocks)
+	}
+}
+
+func TestChunkedBlocksShift(t *testing.T) {
+	data := chunkerTestData(4 << 20)
+	shifted := append([]byte("some inserted data"), data...)
+
+	a, _ := ChunkedBlocks(bytes.NewReader(data))
+	b, _ := ChunkedBlocks(bytes.NewReader(shifted))
+
+	// Only the first block should be affected by the insertion.
+	_, need := BlockDiff(a, b)
+	if len(need) != 1 {
+		t.Errorf("Need %d of %d content defined blocks after insertion", len(need), len(b))
+	}
+
+	// Fixed size blocks share nothing after the insertion.
+	a, _ = Blocks(bytes.NewReader(data), StandardBlockSize)
+	b, _ = Blocks(bytes.NewReader(shifted), StandardBlockSize)
+	_, need = BlockDiff(a, b)
+	if len(need) != len(b) {
+		t.Errorf("Need %d of %d fixed blocks after insertion", len(need), len(b))
+	}
+}
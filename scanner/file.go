@@ -1,6 +1,9 @@
 package scanner
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type File struct {
 	Name       string
@@ -24,3 +27,13 @@ func (f File) Equals(o File) bool {
 func (f File) NewerThan(o File) bool {
 	return f.Modified > o.Modified || (f.Modified == o.Modified && f.Version > o.Version)
 }
+
+// ModTimeEqual returns true if the modification times a and b, in seconds,
+// are at most window apart.
+func ModTimeEqual(a, b int64, window time.Duration) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return time.Duration(d)*time.Second <= window
+}
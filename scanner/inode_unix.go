@@ -0,0 +1,32 @@
+// +build !windows
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns an identifier for the underlying file, shared by all hard
+// links to it, and whether there are multiple links at all.
+func fileID(info os.FileInfo) (inode, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// hashKey returns the key under which the blocks of the file are cached.
+func hashKey(info os.FileInfo) (HashKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return HashKey{}, false
+	}
+	return HashKey{
+		Dev:      uint64(st.Dev),
+		Ino:      uint64(st.Ino),
+		Modified: info.ModTime().UnixNano(),
+		Size:     info.Size(),
+	}, true
+}
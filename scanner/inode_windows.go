@@ -0,0 +1,16 @@
+// +build windows
+
+package scanner
+
+import "os"
+
+// fileID always returns false on Windows, as the file index is not available
+// from the FileInfo returned by Lstat.
+func fileID(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+// hashKey always returns false on Windows, for the same reason as fileID.
+func hashKey(info os.FileInfo) (HashKey, bool) {
+	return HashKey{}, false
+}
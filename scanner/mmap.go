@@ -0,0 +1,65 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	rdebug "runtime/debug"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+// mmapBlocks returns the blocks of the first size bytes of fd like
+// BlocksWith, hashing them straight from a memory mapping of the file rather
+// than reading them into buffers first. An error means that the file can't
+// be mapped, or changed size while it was hashed; it can be read instead. The
+// mapping is released before returning.
+func mmapBlocks(fd *os.File, size int64, blocksize int, chunker string) ([]Block, error) {
+	data, err := osutil.Mmap(fd, size)
+	if err != nil {
+		return nil, err
+	}
+	defer osutil.Munmap(data)
+	return mappedBlocks(data, blocksize, chunker)
+}
+
+// mappedBlocks returns the blocks of the mapped data. Where the file has
+// been truncated by someone else since it was mapped, reading the data
+// faults; that is returned as an error instead of crashing.
+func mappedBlocks(data []byte, blocksize int, chunker string) (blocks []Block, err error) {
+	defer rdebug.SetPanicOnFault(rdebug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			blocks, err = nil, fmt.Errorf("file changed while hashing: %v", r)
+		}
+	}()
+
+	if chunker == ChunkerCDC {
+		return ChunkedBlocks(bytes.NewReader(data))
+	}
+	return sliceBlocks(data, blocksize), nil
+}
+
+// sliceBlocks returns the same blocks as Blocks does for a reader of data,
+// without copying it.
+func sliceBlocks(data []byte, blocksize int) []Block {
+	if len(data) == 0 {
+		return []Block{{Offset: 0, Size: 0, Hash: emptyBlockHash}}
+	}
+	blocks := make([]Block, 0, (len(data)+blocksize-1)/blocksize)
+	for offset := 0; offset < len(data); offset += blocksize {
+		end := offset + blocksize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha256.Sum256(data[offset:end])
+		blocks = append(blocks, Block{
+			Offset:   int64(offset),
+			Size:     uint32(end - offset),
+			Hash:     hash[:],
+			WeakHash: WeakHash(data[offset:end]),
+		})
+	}
+	return blocks
+}
@@ -0,0 +1,148 @@
+package scanner
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+func TestSliceBlocks(t *testing.T) {
+	data := chunkerTestData(10000)
+	for _, size := range []int{0, 1, 999, 1000, 1001, 10000} {
+		expected, _ := Blocks(bytes.NewReader(data[:size]), 1000)
+		if blocks := sliceBlocks(data[:size], 1000); !reflect.DeepEqual(blocks, expected) {
+			t.Errorf("Size %d: incorrect blocks", size)
+		}
+	}
+}
+
+// mmapTestFile returns an open file with data in it, skipping the test where
+// files can't be mapped.
+func mmapTestFile(t *testing.T, data []byte) *os.File {
+	fd, err := ioutil.TempFile("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(fd.Name())
+	if _, err := fd.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := osutil.Mmap(fd, int64(len(data)))
+	if err == osutil.ErrMmapUnsupported {
+		fd.Close()
+		t.Skip("mmap not supported on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	osutil.Munmap(m)
+	return fd
+}
+
+func TestMmapBlocks(t *testing.T) {
+	data := chunkerTestData(3<<20 + 1234)
+	fd := mmapTestFile(t, data)
+	defer fd.Close()
+
+	for _, chunker := range []string{ChunkerFixed, ChunkerCDC} {
+		blocks, err := mmapBlocks(fd, int64(len(data)), StandardBlockSize, chunker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := BlocksWith(bytes.NewReader(data), StandardBlockSize, chunker)
+		if !reflect.DeepEqual(blocks, expected) {
+			t.Errorf("Chunker %q: incorrect blocks", chunker)
+		}
+	}
+}
+
+func TestMmapBlocksTruncated(t *testing.T) {
+	data := chunkerTestData(1 << 20)
+	fd := mmapTestFile(t, data)
+	defer fd.Close()
+
+	m, err := osutil.Mmap(fd, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer osutil.Munmap(m)
+
+	// Pages beyond the end of the file can no longer be read
+	fd.Truncate(0)
+	if _, err := mappedBlocks(m, StandardBlockSize, ChunkerFixed); err == nil {
+		t.Error("No error hashing truncated file")
+	}
+}
+
+func TestWalkMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "small"), chunkerTestData(1000), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "large"), chunkerTestData(1<<20+1), 0644)
+
+	w := Walker{Dir: dir, BlockSize: StandardBlockSize}
+	expected, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.MmapMinSize = 1 << 20
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("%d files, expected %d", len(files), len(expected))
+	}
+	for i := range files {
+		if !reflect.DeepEqual(files[i].Blocks, expected[i].Blocks) {
+			t.Errorf("Blocks of %q hashed through a mapping differ from those read", files[i].Name)
+		}
+	}
+}
+
+// The number and size of the files scanned by the scan benchmarks; raise the
+// size to benchmark a repository of multi-GB files.
+const (
+	benchScanFiles    = 4
+	benchScanFileSize = 64 << 20
+)
+
+func benchmarkScan(b *testing.B, mmapMinSize int64) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := chunkerTestData(benchScanFileSize)
+	for i := 0; i < benchScanFiles; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprint("file", i)), data, 0644)
+	}
+
+	w := Walker{Dir: dir, BlockSize: StandardBlockSize, MmapMinSize: mmapMinSize}
+	b.SetBytes(benchScanFiles * benchScanFileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := w.Walk(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanRead(b *testing.B) {
+	benchmarkScan(b, 0)
+}
+
+func BenchmarkScanMmap(b *testing.B) {
+	benchmarkScan(b, 1)
+}
@@ -0,0 +1,86 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sync"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+// The hashes of blocks of zeros, by size. Only the few sizes in use are
+// expected, but the cache is bounded all the same.
+var (
+	zeroHashes    = make(map[uint32][]byte)
+	zeroHashesMut sync.Mutex
+)
+
+const maxZeroHashes = 64
+
+func zeroHash(size uint32) []byte {
+	zeroHashesMut.Lock()
+	defer zeroHashesMut.Unlock()
+	if h, ok := zeroHashes[size]; ok {
+		return h
+	}
+	h := sha256.Sum256(make([]byte, size))
+	if len(zeroHashes) < maxZeroHashes {
+		zeroHashes[size] = h[:]
+	}
+	return h[:]
+}
+
+// zeroWeakHash returns the weak hash of size zero bytes. Adler-32 starts
+// from one and sums the bytes, and a sum of the running sums, modulo 65521.
+func zeroWeakHash(size uint32) uint32 {
+	return size%65521<<16 | 1
+}
+
+// IsZeroBlock returns true if b, going by its hash, holds nothing but zeros.
+// Such a block need not be transferred, and can be left as a hole in a file.
+func IsZeroBlock(b Block) bool {
+	return b.Size > 0 && bytes.Equal(b.Hash, zeroHash(b.Size))
+}
+
+// sparseBlocks returns the same blocks as Blocks does for the first size
+// bytes of r, without reading the blocks that lie entirely within one of the
+// holes.
+func sparseBlocks(r io.ReaderAt, size int64, blocksize int, holes []osutil.Extent) ([]Block, error) {
+	if size == 0 {
+		return []Block{{Offset: 0, Size: 0, Hash: emptyBlockHash}}, nil
+	}
+
+	var blocks []Block
+	buf := make([]byte, blocksize)
+	for offset := int64(0); offset < size; offset += int64(blocksize) {
+		bs := blocksize
+		if rem := size - offset; rem < int64(bs) {
+			bs = int(rem)
+		}
+		for len(holes) > 0 && holes[0].Offset+holes[0].Length <= offset {
+			holes = holes[1:]
+		}
+
+		var hash []byte
+		var weak uint32
+		if len(holes) > 0 && holes[0].Offset <= offset && holes[0].Offset+holes[0].Length >= offset+int64(bs) {
+			hash = zeroHash(uint32(bs))
+			weak = zeroWeakHash(uint32(bs))
+		} else {
+			if _, err := r.ReadAt(buf[:bs], offset); err != nil && err != io.EOF {
+				return nil, err
+			}
+			h := sha256.Sum256(buf[:bs])
+			hash = h[:]
+			weak = WeakHash(buf[:bs])
+		}
+		blocks = append(blocks, Block{
+			Offset:   offset,
+			Size:     uint32(bs),
+			Hash:     hash,
+			WeakHash: weak,
+		})
+	}
+	return blocks, nil
+}
@@ -0,0 +1,106 @@
+package scanner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+func TestIsZeroBlock(t *testing.T) {
+	blocks, _ := Blocks(bytes.NewReader(append(make([]byte, 2500), 1)), 1000)
+	for i, exp := range []bool{true, true, false} {
+		if IsZeroBlock(blocks[i]) != exp {
+			t.Errorf("Block %d: IsZeroBlock != %v", i, exp)
+		}
+	}
+
+	empty, _ := Blocks(bytes.NewReader(nil), 1000)
+	if IsZeroBlock(empty[0]) {
+		t.Error("Empty block reported as zeros")
+	}
+}
+
+func TestSparseBlocks(t *testing.T) {
+	data := chunkerTestData(10000)
+	zeroed := append([]byte{}, data...)
+	holes := []osutil.Extent{{Offset: 0, Length: 2500}, {Offset: 4000, Length: 1000}, {Offset: 6000, Length: 4000}}
+	for _, h := range holes {
+		copy(zeroed[h.Offset:], make([]byte, h.Length))
+	}
+
+	// The reader has data where the holes are, so the blocks within
+	// them only come out as zeros if they are not read.
+	for _, size := range []int64{0, 900, 2500, 4500, 10000} {
+		blocks, err := sparseBlocks(bytes.NewReader(data), size, 1000, holes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := Blocks(bytes.NewReader(data[:size]), 1000)
+		withHoles, _ := Blocks(bytes.NewReader(zeroed[:size]), 1000)
+		for i, b := range expected {
+			if inHole(holes, b.Offset, int64(b.Size)) {
+				expected[i] = withHoles[i]
+			}
+		}
+		if !reflect.DeepEqual(blocks, expected) {
+			t.Errorf("Size %d: incorrect blocks", size)
+		}
+	}
+}
+
+func inHole(holes []osutil.Extent, offset, size int64) bool {
+	for _, h := range holes {
+		if h.Offset <= offset && h.Offset+h.Length >= offset+size {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWalkSparseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A MiB of data between two holes of two MiB
+	path := filepath.Join(dir, "sparse")
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := chunkerTestData(1 << 20)
+	fd.WriteAt(data, 2<<20)
+	fd.Truncate(5 << 20)
+	holes, err := osutil.Holes(fd, 5<<20)
+	fd.Close()
+	if err != nil || len(holes) == 0 {
+		t.Skip("no holes reported on this platform or filesystem")
+	}
+
+	w := Walker{Dir: dir, BlockSize: StandardBlockSize}
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(path)
+	expected, _ := Blocks(bytes.NewReader(contents), StandardBlockSize)
+	if len(files) != 1 || !reflect.DeepEqual(files[0].Blocks, expected) {
+		t.Fatal("Blocks of sparse file differ from those of its contents")
+	}
+	zeros := 0
+	for _, b := range files[0].Blocks {
+		if IsZeroBlock(b) {
+			zeros++
+		}
+	}
+	if zeros != 32 {
+		t.Errorf("%d blocks of zeros, expected 32", zeros)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
 )
 
@@ -19,10 +20,16 @@ type Walker struct {
 	Dir string
 	// BlockSize controls the size of the block used when hashing.
 	BlockSize int
+	// Chunker is the type of chunker used to split files into blocks. The
+	// empty string means fixed size blocks of BlockSize bytes.
+	Chunker string
 	// If IgnoreFile is not empty, it is the name used for the file that holds ignore patterns.
 	IgnoreFile string
 	// If TempNamer is not nil, it is used to ignore tempory files when walking.
 	TempNamer TempNamer
+	// IgnoreTemp holds patterns matching temporary files of other programs.
+	// Files whose base name matches are ignored when walking.
+	IgnoreTemp []string
 	// If CurrentFiler is not nil, it is queried for the current file before rescanning.
 	CurrentFiler CurrentFiler
 	// If Suppressor is not nil, it is queried for supression of modified files.
@@ -33,6 +40,52 @@ type Walker struct {
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+	// If SpecialPermBits is true, the setuid, setgid and sticky bits are
+	// recorded and compared along with the permission bits. On platforms
+	// without them, the bits of the current file are kept instead.
+	SpecialPermBits bool
+	// If Unreadable is not nil, it is called with the name of each file or
+	// directory that exists but could not be read during the walk. Such
+	// entries are missing from the result even though they were not
+	// deleted.
+	Unreadable func(name string, err error)
+	// If Hardlinks is true, regular files that are hard linked to each other
+	// get the Hardlink flag set.
+	Hardlinks bool
+	// If Placeholder is not nil, it is called for each regular file. Files
+	// for which it returns true are placeholders without real content and
+	// are left out of the result.
+	Placeholder func(name string, info os.FileInfo) bool
+	// If KeepTemp is not nil, CleanTempFiles leaves the temporary files for
+	// which it returns true in place.
+	KeepTemp func(path string, info os.FileInfo) bool
+	// If HashCache is not nil, it is queried for the blocks of a regular
+	// file before hashing it, and given the blocks of the files that had to
+	// be hashed. It is not used on platforms where the inode of a file is
+	// unknown.
+	HashCache HashCache
+	// Modification times of directories at most ModTimeWindow apart are
+	// considered equal. A regular file with its modification time within
+	// the window of that of the current file, and the same size, is
+	// rehashed and only seen as changed if its contents differ.
+	ModTimeWindow time.Duration
+	// If MmapMinSize is positive, files of at least this many bytes are
+	// hashed through a memory mapping instead of being read, on platforms
+	// that support it.
+	MmapMinSize int64
+	// If Static is not nil, regular files for which it returns true are
+	// taken to be unchanged for as long as their modification time and size
+	// are, and keep the blocks of the current file when only their
+	// permissions change. Changes to their contents that leave both alone
+	// go unnoticed.
+	Static func(name string) bool
+}
+
+// An inode identifies a file on disk, regardless of which name it is reached
+// through.
+type inode struct {
+	dev uint64
+	ino uint64
 }
 
 type TempNamer interface {
@@ -47,6 +100,28 @@ type Suppressor interface {
 	Suppress(name string, fi os.FileInfo) (bool, bool)
 }
 
+type HashCache interface {
+	// Get returns the blocks of the file with the given key, if known.
+	Get(key HashKey) ([]Block, bool)
+	// Put records the blocks of the file with the given key.
+	Put(key HashKey, blocks []Block)
+}
+
+// A HashKey identifies the contents of a file by its inode, modification time
+// and size. A change to the contents is assumed to change at least one of
+// them.
+type HashKey struct {
+	Dev      uint64
+	Ino      uint64
+	Modified int64 // nanoseconds
+	Size     int64
+}
+
+// Files modified more recently than this are not added to the hash cache, as
+// a further change within the resolution of the modification time would go
+// unnoticed.
+var hashCacheMinAge = 2 * time.Second
+
 type CurrentFiler interface {
 	// CurrentFile returns the file as seen at last scan.
 	CurrentFile(name string) File
@@ -67,10 +142,12 @@ func (w *Walker) Walk() (files []File, ignore map[string][]string, err error) {
 	t0 := time.Now()
 
 	ignore = make(map[string][]string)
-	hashFiles := w.walkAndHashFiles(&files, ignore)
+	links := make(map[inode][]int)
+	hashFiles := w.walkAndHashFiles(&files, ignore, links)
 
 	filepath.Walk(w.Dir, w.loadIgnoreFiles(w.Dir, ignore))
 	filepath.Walk(w.Dir, hashFiles)
+	markHardlinks(files, links)
 
 	if debug {
 		t1 := time.Now()
@@ -115,12 +192,13 @@ func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.W
 	}
 }
 
-func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath.WalkFunc {
+func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string, links map[inode][]int) filepath.WalkFunc {
 	return func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			if debug {
 				l.Debugln("error:", p, info, err)
 			}
+			w.unreadable(p, err)
 			return nil
 		}
 
@@ -144,6 +222,14 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 			return nil
 		}
 
+		if !info.IsDir() && w.ignoreTemp(rn) {
+			// A temporary file belonging to some other program
+			if debug {
+				l.Debugln("other temporary:", rn)
+			}
+			return nil
+		}
+
 		if sn := filepath.Base(rn); sn == w.IgnoreFile || sn == ".stversions" || w.ignoreFile(ign, rn) {
 			// An ignored file
 			if debug {
@@ -158,8 +244,8 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 		if info.Mode().IsDir() {
 			if w.CurrentFiler != nil {
 				cf := w.CurrentFiler.CurrentFile(rn)
-				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if cf.Modified == info.ModTime().Unix() && protocol.IsDirectory(cf.Flags) && permUnchanged {
+				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, PermBits(info.Mode(), w.SpecialPermBits), w.SpecialPermBits)
+				if ModTimeEqual(cf.Modified, info.ModTime().Unix(), w.ModTimeWindow) && protocol.IsDirectory(cf.Flags) && permUnchanged {
 					if debug {
 						l.Debugln("unchanged:", cf)
 					}
@@ -169,7 +255,7 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 					if w.IgnorePerms {
 						flags |= protocol.FlagNoPermBits | 0777
 					} else {
-						flags |= uint32(info.Mode() & os.ModePerm)
+						flags |= w.permBits(info, cf)
 					}
 					f := File{
 						Name:     rn,
@@ -187,10 +273,41 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 		}
 
 		if info.Mode().IsRegular() {
+			if w.Placeholder != nil && w.Placeholder(rn, info) {
+				if debug {
+					l.Debugln("placeholder:", rn)
+				}
+				return nil
+			}
+
+			if id, ok := fileID(info); ok && w.Hardlinks {
+				// Remember the index of the file, if it makes it into the
+				// result.
+				n := len(*res)
+				defer func() {
+					if len(*res) > n {
+						links[id] = append(links[id], n)
+					}
+				}()
+			}
+
+			var cf File
+			var static, withinWindow, permUnchanged bool
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
-				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if !protocol.IsDeleted(cf.Flags) && cf.Modified == info.ModTime().Unix() && permUnchanged {
+				cf = w.CurrentFiler.CurrentFile(rn)
+				permUnchanged = w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, PermBits(info.Mode(), w.SpecialPermBits), w.SpecialPermBits)
+				sameSize := !protocol.IsDeleted(cf.Flags) && !protocol.IsDirectory(cf.Flags) && cf.Size == info.Size()
+				mtime := info.ModTime().Unix()
+				unchanged := sameSize && cf.Modified == mtime
+				// A modification time within the window may have been
+				// rounded by the filesystem, or may be a quick edit; the
+				// contents tell which.
+				withinWindow = sameSize && !unchanged && ModTimeEqual(cf.Modified, mtime, w.ModTimeWindow)
+				if w.Static != nil && w.Static(rn) {
+					static = unchanged || withinWindow
+					unchanged = static
+				}
+				if unchanged && permUnchanged {
 					if debug {
 						l.Debugln("unchanged:", cf)
 					}
@@ -198,7 +315,9 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 					return nil
 				}
 
-				if w.Suppressor != nil {
+				// A static file that gets here has only had its
+				// permissions changed, which is not worth suppressing
+				if w.Suppressor != nil && !static && !withinWindow {
 					if cur, prev := w.Suppressor.Suppress(rn, info); cur && !prev {
 						l.Infof("Changes to %q are being temporarily suppressed because it changes too frequently.", p)
 						cf.Suppressed = true
@@ -218,29 +337,43 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 				}
 			}
 
-			fd, err := os.Open(p)
-			if err != nil {
+			key, cacheable := hashKey(info)
+			cacheable = cacheable && w.HashCache != nil && !static
+			var blocks []Block
+			var cached bool
+			if cacheable {
+				blocks, cached = w.HashCache.Get(key)
+			}
+			if static {
+				// Only the permissions have changed
+				blocks = cf.Blocks
 				if debug {
-					l.Debugln("open:", p, err)
+					l.Debugln("static:", rn, ";", len(blocks), "blocks")
+				}
+			} else if cached {
+				if debug {
+					l.Debugln("cached:", rn, ";", len(blocks), "blocks")
+				}
+			} else {
+				blocks, err = w.hashFile(p, rn, info)
+				if err != nil {
+					w.unreadable(p, err)
+					return nil
+				}
+				if cacheable && time.Since(info.ModTime()) > hashCacheMinAge {
+					w.HashCache.Put(key, blocks)
 				}
-				return nil
 			}
-			defer fd.Close()
-
-			t0 := time.Now()
-			blocks, err := Blocks(fd, w.BlockSize)
-			if err != nil {
+			if withinWindow && permUnchanged && blocksEqual(blocks, cf.Blocks) {
+				// Only the resolution of the modification time differs
 				if debug {
-					l.Debugln("hash error:", rn, err)
+					l.Debugln("unchanged within window:", cf)
 				}
+				*res = append(*res, cf)
 				return nil
 			}
-			if debug {
-				t1 := time.Now()
-				l.Debugln("hashed:", rn, ";", len(blocks), "blocks;", info.Size(), "bytes;", int(float64(info.Size())/1024/t1.Sub(t0).Seconds()), "KB/s")
-			}
 
-			var flags = uint32(info.Mode() & os.ModePerm)
+			var flags = w.permBits(info, cf)
 			if w.IgnorePerms {
 				flags = protocol.FlagNoPermBits | 0666
 			}
@@ -259,11 +392,111 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 	}
 }
 
+// blocksEqual returns true if the block lists a and b have the same hashes.
+func blocksEqual(a, b []Block) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Hash, b[i].Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashFile returns the blocks of the file at path p.
+func (w *Walker) hashFile(p, rn string, info os.FileInfo) ([]Block, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		if debug {
+			l.Debugln("open:", p, err)
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	t0 := time.Now()
+	var blocks []Block
+	var holes []osutil.Extent
+	if w.Chunker != ChunkerCDC {
+		// Holes in a sparse file needn't be read to know they are zeros
+		holes, _ = osutil.Holes(fd, info.Size())
+	}
+	switch {
+	case len(holes) > 0:
+		blocks, err = sparseBlocks(fd, info.Size(), w.BlockSize, holes)
+	case w.MmapMinSize > 0 && info.Size() >= w.MmapMinSize:
+		if blocks, err = mmapBlocks(fd, info.Size(), w.BlockSize, w.Chunker); err != nil {
+			if debug {
+				l.Debugln("mmap:", rn, err)
+			}
+			// Read whatever is there now instead
+			blocks, err = BlocksWith(fd, w.BlockSize, w.Chunker)
+		}
+	default:
+		blocks, err = BlocksWith(fd, w.BlockSize, w.Chunker)
+	}
+	if err != nil {
+		if debug {
+			l.Debugln("hash error:", rn, err)
+		}
+		return nil, err
+	}
+	if debug {
+		t1 := time.Now()
+		l.Debugln("hashed:", rn, ";", len(blocks), "blocks;", info.Size(), "bytes;", int(float64(info.Size())/1024/t1.Sub(t0).Seconds()), "KB/s")
+	}
+	return blocks, nil
+}
+
+// markHardlinks sets the Hardlink flag on the files that share an inode with
+// some other file in the result, and clears it on all others. Files for which
+// the flag changes get a new version, since the unchanged files are returned
+// as they were at the last scan.
+func markHardlinks(files []File, links map[inode][]int) {
+	linked := make(map[int]bool)
+	for _, idxs := range links {
+		if len(idxs) > 1 {
+			for _, i := range idxs {
+				linked[i] = true
+			}
+		}
+	}
+
+	for i := range files {
+		f := &files[i]
+		if protocol.IsDirectory(f.Flags) || protocol.IsDeleted(f.Flags) {
+			continue
+		}
+		if linked[i] != protocol.IsHardlink(f.Flags) {
+			f.Flags ^= protocol.FlagHardlink
+			f.Version = lamport.Default.Tick(f.Version)
+		}
+	}
+}
+
+// unreadable reports the path p to the Unreadable callback, unless the error
+// is due to the file no longer existing.
+func (w *Walker) unreadable(p string, err error) {
+	if w.Unreadable == nil || os.IsNotExist(err) {
+		return
+	}
+	rn, rerr := filepath.Rel(w.Dir, p)
+	if rerr != nil || rn == "." {
+		return
+	}
+	w.Unreadable(rn, err)
+}
+
 func (w *Walker) cleanTempFile(path string, info os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
 	if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) {
+		if w.KeepTemp != nil && w.KeepTemp(path, info) {
+			return nil
+		}
 		os.Remove(path)
 	}
 	return nil
@@ -283,6 +516,16 @@ func (w *Walker) ignoreFile(patterns map[string][]string, file string) bool {
 	return false
 }
 
+func (w *Walker) ignoreTemp(file string) bool {
+	base := filepath.Base(file)
+	for _, pattern := range w.IgnoreTemp {
+		if match, _ := filepath.Match(pattern, base); match {
+			return true
+		}
+	}
+	return false
+}
+
 func checkDir(dir string) error {
 	if info, err := os.Stat(dir); err != nil {
 		return err
@@ -292,14 +535,71 @@ func checkDir(dir string) error {
 	return nil
 }
 
-func PermsEqual(a, b uint32) bool {
-	switch runtime.GOOS {
-	case "windows":
+// The setuid, setgid and sticky bits, as stored in the file flags.
+const specialPermBits = 07000
+
+// Whether the platform has setuid, setgid and sticky bits.
+var hasSpecialPermBits = runtime.GOOS != "windows"
+
+// PermsEqual returns true if the permission bits of the flags a and b are
+// equal, as far as they can be represented on this platform. The setuid,
+// setgid and sticky bits are only compared if special is true.
+func PermsEqual(a, b uint32, special bool) bool {
+	switch {
+	case !hasSpecialPermBits:
 		// There is only writeable and read only, represented for user, group
 		// and other equally. We only compare against user.
 		return a&0600 == b&0600
+	case special:
+		return a&(specialPermBits|0777) == b&(specialPermBits|0777)
 	default:
-		// All bits count
 		return a&0777 == b&0777
 	}
 }
+
+// PermBits returns the permission bits of mode as stored in the file flags,
+// including the setuid, setgid and sticky bits if special is true.
+func PermBits(mode os.FileMode, special bool) uint32 {
+	bits := uint32(mode & os.ModePerm)
+	if special {
+		if mode&os.ModeSetuid != 0 {
+			bits |= 04000
+		}
+		if mode&os.ModeSetgid != 0 {
+			bits |= 02000
+		}
+		if mode&os.ModeSticky != 0 {
+			bits |= 01000
+		}
+	}
+	return bits
+}
+
+// FileMode returns the mode to set for the permission bits of the flags,
+// the reverse of PermBits. The setuid, setgid and sticky bits are only
+// included if special is true and the platform has them.
+func FileMode(flags uint32, special bool) os.FileMode {
+	mode := os.FileMode(flags & 0777)
+	if special && hasSpecialPermBits {
+		if flags&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if flags&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if flags&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+	}
+	return mode
+}
+
+// permBits returns the permission bits to record for the file, keeping the
+// special bits of the current file cf where they can't be represented.
+func (w *Walker) permBits(info os.FileInfo, cf File) uint32 {
+	bits := PermBits(info.Mode(), w.SpecialPermBits)
+	if w.SpecialPermBits && !hasSpecialPermBits && protocol.HasPermissionBits(cf.Flags) {
+		bits |= cf.Flags & specialPermBits
+	}
+	return bits
+}
@@ -1,10 +1,17 @@
 package scanner
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
+
+	"github.com/calmh/syncthing/protocol"
 )
 
 var testdata = []struct {
@@ -114,3 +121,301 @@ func TestIgnore(t *testing.T) {
 		}
 	}
 }
+
+func TestIgnoreTemp(t *testing.T) {
+	var tests = []struct {
+		f string
+		r bool
+	}{
+		{"file.part", true},
+		{"dir/file.part", true},
+		{"file.partx", false},
+		{"~$report.doc", true},
+		{"dir/.report.txt.swp", true},
+		{"report.txt", false},
+		{"~report.txt", false},
+	}
+
+	w := Walker{IgnoreTemp: []string{"*.part", "~$*", ".*.swp"}}
+	for i, tc := range tests {
+		if r := w.ignoreTemp(tc.f); r != tc.r {
+			t.Errorf("Incorrect ignoreTemp() #%d; E: %v, A: %v", i, tc.r, r)
+		}
+	}
+}
+
+func TestWalkHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not detected on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("linked"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "c"), []byte("single"), 0644)
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Skip(err)
+	}
+
+	expected := map[string]bool{"a": true, "b": true, "c": false}
+	for _, hardlinks := range []bool{true, false} {
+		w := Walker{Dir: dir, BlockSize: 128 * 1024, Hardlinks: hardlinks}
+		files, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if linked := protocol.IsHardlink(f.Flags); linked != (hardlinks && expected[f.Name]) {
+				t.Errorf("Incorrect hard link flag %v for %q (enabled %v)", linked, f.Name, hardlinks)
+			}
+		}
+	}
+}
+
+// mapCache is a HashCache counting the blocks it has been asked for.
+type mapCache struct {
+	entries map[HashKey][]Block
+	hits    int
+}
+
+func (c *mapCache) Get(key HashKey) ([]Block, bool) {
+	blocks, ok := c.entries[key]
+	if ok {
+		c.hits++
+	}
+	return blocks, ok
+}
+
+func (c *mapCache) Put(key HashKey, blocks []Block) {
+	c.entries[key] = blocks
+}
+
+func TestWalkHashCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hash cache is not used on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "f")
+	mod := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ioutil.WriteFile(path, []byte("contents"), 0644)
+	os.Chtimes(path, mod, mod)
+
+	cache := &mapCache{entries: make(map[HashKey][]Block)}
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, HashCache: cache}
+	walk := func() File {
+		files, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("Incorrect number of files %d != 1", len(files))
+		}
+		return files[0]
+	}
+
+	first := walk()
+	if cache.hits != 0 || len(cache.entries) != 1 {
+		t.Fatalf("Unexpected cache state after first walk, %d hits, %d entries", cache.hits, len(cache.entries))
+	}
+
+	// Unchanged files are not hashed again
+	if f := walk(); cache.hits != 1 || !reflect.DeepEqual(f.Blocks, first.Blocks) {
+		t.Errorf("Unchanged file not taken from the cache, %d hits", cache.hits)
+	}
+
+	// New contents of the same size, with a new modification time
+	ioutil.WriteFile(path, []byte("CONTENTS"), 0644)
+	mod = mod.Add(time.Second)
+	os.Chtimes(path, mod, mod)
+	f := walk()
+	if cache.hits != 1 {
+		t.Error("Cached blocks used for file with changed modification time")
+	}
+	if reflect.DeepEqual(f.Blocks, first.Blocks) {
+		t.Error("Blocks not updated after change")
+	}
+	fd, _ := os.Open(path)
+	expected, _ := Blocks(fd, 128*1024)
+	fd.Close()
+	if !reflect.DeepEqual(f.Blocks, expected) {
+		t.Error("Incorrect blocks after change")
+	}
+
+	// Recently modified files are not cached
+	ioutil.WriteFile(path, []byte("recent"), 0644)
+	entries := len(cache.entries)
+	walk()
+	if len(cache.entries) != entries {
+		t.Error("Recently modified file added to the cache")
+	}
+}
+
+// fileMap is a CurrentFiler returning the files in the map.
+type fileMap map[string]File
+
+func (m fileMap) CurrentFile(name string) File {
+	return m[name]
+}
+
+func TestPermBits(t *testing.T) {
+	mode := os.ModeSetuid | os.ModeSticky | 0755
+	if bits := PermBits(mode, false); bits != 0755 {
+		t.Errorf("Incorrect bits %o without special bits", bits)
+	}
+	if bits := PermBits(mode, true); bits != 05755 {
+		t.Errorf("Incorrect bits %o with special bits", bits)
+	}
+	if m := FileMode(05755, false); m != 0755 {
+		t.Errorf("Incorrect mode %v without special bits", m)
+	}
+	if m := FileMode(05755, true); hasSpecialPermBits && m != mode {
+		t.Errorf("Incorrect mode %v with special bits", m)
+	}
+
+	if !PermsEqual(04755, 0755, false) {
+		t.Error("Special bits compared when not enabled")
+	}
+	if hasSpecialPermBits && PermsEqual(04755, 0755, true) {
+		t.Error("Special bits not compared when enabled")
+	}
+}
+
+func TestWalkSpecialPermBits(t *testing.T) {
+	if !hasSpecialPermBits {
+		t.Skip("no special permission bits on this platform")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f")
+	ioutil.WriteFile(path, []byte("contents"), 0644)
+	if err := os.Chmod(path, os.ModeSetgid|0755); err != nil {
+		t.Skip(err)
+	}
+	if info, _ := os.Stat(path); info.Mode()&os.ModeSetgid == 0 {
+		t.Skip("setgid bit can't be set in the temporary directory")
+	}
+
+	for _, special := range []bool{false, true} {
+		expected := uint32(0755)
+		if special {
+			expected = 02755
+		}
+
+		// The bits are recorded only when enabled, and a file indexed
+		// with the bits that are masked out is not seen as changed.
+		cf := File{Name: "f", Flags: 02755 | 01000, Modified: 1}
+		w := Walker{Dir: dir, BlockSize: 128 * 1024, SpecialPermBits: special, CurrentFiler: fileMap{"f": cf}}
+		files, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Flags&07777 != expected {
+			t.Errorf("Incorrect files %v (special bits %v)", files, special)
+		}
+
+		info, _ := os.Stat(path)
+		cf.Flags, cf.Modified, cf.Size = 02755, info.ModTime().Unix(), info.Size()
+		w.CurrentFiler = fileMap{"f": cf}
+		if files, _, _ = w.Walk(); len(files) != 1 || files[0].Version != 0 {
+			t.Errorf("File with the same bits seen as changed (special bits %v): %v", special, files)
+		}
+	}
+}
+
+func TestWalkKeepsUnrepresentableBits(t *testing.T) {
+	defer func(v bool) { hasSpecialPermBits = v }(hasSpecialPermBits)
+	hasSpecialPermBits = false
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "f"), []byte("contents"), 0644)
+	info, _ := os.Stat(filepath.Join(dir, "f"))
+
+	// A setuid file synced from elsewhere, changed here where the bit can't
+	// be represented, keeps it for the other nodes.
+	cf := File{Name: "f", Flags: 04644, Modified: info.ModTime().Unix() - 1}
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, SpecialPermBits: true, CurrentFiler: fileMap{"f": cf}}
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Flags&04000 == 0 {
+		t.Errorf("Setuid bit lost: %v", files)
+	}
+
+	// Only the bits that can be represented are compared
+	cf.Modified, cf.Size = info.ModTime().Unix(), info.Size()
+	w.CurrentFiler = fileMap{"f": cf}
+	if files, _, _ = w.Walk(); len(files) != 1 || files[0].Version != 0 {
+		t.Errorf("File seen as changed: %v", files)
+	}
+}
+
+func TestWalkModTimeWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "f"), []byte("contents"), 0644)
+	info, _ := os.Stat(filepath.Join(dir, "f"))
+
+	// As when the file was indexed on a filesystem with two second
+	// resolution
+	blocks, _ := Blocks(bytes.NewReader([]byte("contents")), 128*1024)
+	cf := File{Name: "f", Flags: 0644, Modified: info.ModTime().Unix() - 1, Size: info.Size(), Blocks: blocks}
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, CurrentFiler: fileMap{"f": cf}, ModTimeWindow: 2 * time.Second}
+	if files, _, _ := w.Walk(); len(files) != 1 || files[0].Version != 0 {
+		t.Errorf("File within the window seen as changed: %v", files)
+	}
+
+	// An edit within the window that keeps the size is still seen
+	ioutil.WriteFile(filepath.Join(dir, "f"), []byte("modified"), 0644)
+	os.Chtimes(filepath.Join(dir, "f"), info.ModTime(), info.ModTime())
+	if files, _, _ := w.Walk(); len(files) != 1 || files[0].Version == 0 || blocksEqual(files[0].Blocks, blocks) {
+		t.Errorf("Edit within the window not seen as a change: %v", files)
+	}
+
+	cf.Modified -= 2
+	w.CurrentFiler = fileMap{"f": cf}
+	if files, _, _ := w.Walk(); len(files) != 1 || files[0].Version == 0 {
+		t.Errorf("File outside the window not seen as changed: %v", files)
+	}
+}
+
+func TestModTimeEqual(t *testing.T) {
+	cases := []struct {
+		a, b   int64
+		window time.Duration
+		equal  bool
+	}{
+		{10, 10, 0, true},
+		{10, 11, 0, false},
+		{10, 11, 2 * time.Second, true},
+		{12, 10, 2 * time.Second, true},
+		{13, 10, 2 * time.Second, false},
+		{10, 11, 500 * time.Millisecond, false},
+	}
+	for i, tc := range cases {
+		if eq := ModTimeEqual(tc.a, tc.b, tc.window); eq != tc.equal {
+			t.Errorf("%d: ModTimeEqual(%d, %d, %v) = %v", i, tc.a, tc.b, tc.window, eq)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package versioner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// A ParamType is the kind of value a versioner parameter takes.
+type ParamType int
+
+const (
+	StringParam ParamType = iota // any string
+	CountParam                   // a non-negative integer
+)
+
+// Params holds the parameters accepted by each type of versioner, registered
+// along with its factory.
+var Params = map[string]map[string]ParamType{}
+
+// ValidateParams returns an error describing the first parameter of params,
+// in name order, that the type of versioner doesn't accept or whose value is
+// malformed. Any parameters are accepted without versioning, as they are
+// then unused.
+func ValidateParams(typ string, params map[string]string) error {
+	if typ == "" {
+		return nil
+	}
+	if _, ok := Factories[typ]; !ok {
+		return fmt.Errorf("unknown versioning type %q", typ)
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	schema := Params[typ]
+	for _, name := range names {
+		t, ok := schema[name]
+		if !ok {
+			return fmt.Errorf("%s versioning: unknown parameter %q", typ, name)
+		}
+		if t == CountParam {
+			if n, err := strconv.Atoi(params[name]); err != nil || n < 0 {
+				return fmt.Errorf("%s versioning: parameter %q must be a non-negative integer, got %q", typ, name, params[name])
+			}
+		}
+	}
+	return nil
+}
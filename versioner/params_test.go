@@ -0,0 +1,40 @@
+package versioner
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateParams(t *testing.T) {
+	cases := []struct {
+		typ    string
+		params map[string]string
+		err    string
+	}{
+		{"", map[string]string{"anything": "goes"}, ""},
+		{"nonexistent", nil, "unknown versioning type"},
+		{"simple", nil, ""},
+		{"simple", map[string]string{"keep": "10"}, ""},
+		{"simple", map[string]string{"keep": "0"}, ""},
+		{"simple", map[string]string{"keep": "ten"}, `"keep" must be a non-negative integer, got "ten"`},
+		{"simple", map[string]string{"keep": "-1"}, `"keep" must be a non-negative integer`},
+		{"simple", map[string]string{"keep": ""}, `"keep" must be a non-negative integer`},
+		{"simple", map[string]string{"keepVersions": "10"}, `unknown parameter "keepVersions"`},
+		{"simple", map[string]string{"keep": "10", "maxAge": "1d"}, `unknown parameter "maxAge"`},
+	}
+
+	for i, tc := range cases {
+		err := ValidateParams(tc.typ, tc.params)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%d: unexpected error %v, expected %q", i, err, tc.err)
+		}
+	}
+}
+
+func TestFactoriesHaveParams(t *testing.T) {
+	for typ := range Factories {
+		if _, ok := Params[typ]; !ok {
+			t.Errorf("Versioner %q has no parameter schema", typ)
+		}
+	}
+}
@@ -13,6 +13,9 @@ import (
 func init() {
 	// Register the constructor for this type of versioner with the name "simple"
 	Factories["simple"] = NewSimple
+	Params["simple"] = map[string]ParamType{
+		"keep": CountParam, // the number of old versions to keep
+	}
 }
 
 // The type holds our configuration
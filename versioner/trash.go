@@ -0,0 +1,147 @@
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+const trashTimeFormat = "20060102-150405"
+
+// Trash is a simple recycle bin for deleted files, available without
+// configuring versioning. Deleted files are moved to .stversions/.trash at
+// the top of the repository, keeping their relative path, with the time of
+// deletion appended to the name. Old files are removed by Prune.
+type Trash struct {
+	repoDir  string
+	dir      string
+	maxAge   time.Duration // zero means no limit
+	maxBytes int64         // zero means no limit
+}
+
+// NewTrash returns a Trash for the repository at repoDir, keeping deleted
+// files for at most maxAgeDays days and maxSizeMiB MiB in total. Zero means
+// no limit.
+func NewTrash(repoDir string, maxAgeDays, maxSizeMiB int) *Trash {
+	t := &Trash{
+		repoDir:  repoDir,
+		dir:      filepath.Join(repoDir, ".stversions", ".trash"),
+		maxAge:   time.Duration(maxAgeDays) * 24 * time.Hour,
+		maxBytes: int64(maxSizeMiB) << 20,
+	}
+	if debug {
+		l.Debugf("instantiated %#v", t)
+	}
+	return t
+}
+
+// Archive moves the file at path, which must be within the repository, to
+// the trash. If this function returns nil, the named file does not exist any
+// more.
+func (t *Trash) Archive(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	rel, err := filepath.Rel(t.repoDir, path)
+	if err != nil {
+		return err
+	}
+
+	if debug {
+		l.Debugln("moving to trash", path)
+	}
+
+	dst := filepath.Join(t.dir, rel+"~"+time.Now().Format(trashTimeFormat))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	osutil.HideFile(filepath.Dir(t.dir))
+	return osutil.Rename(path, dst)
+}
+
+type trashEntry struct {
+	path    string
+	deleted time.Time
+	size    int64
+}
+
+// Prune removes the files that have been in the trash for longer than the
+// maximum age, then the oldest files until the trash is within the maximum
+// size.
+func (t *Trash) Prune() error {
+	if t.maxAge == 0 && t.maxBytes == 0 {
+		return nil
+	}
+
+	var entries []trashEntry
+	var total int64
+	err := filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		i := strings.LastIndex(path, "~")
+		if i < 0 {
+			return nil
+		}
+		deleted, err := time.ParseInLocation(trashTimeFormat, path[i+1:], time.Local)
+		if err != nil {
+			// Not put there by us
+			return nil
+		}
+		entries = append(entries, trashEntry{path, deleted, info.Size()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(byDeleted(entries))
+	now := time.Now()
+	for _, e := range entries {
+		expired := t.maxAge > 0 && now.Sub(e.deleted) > t.maxAge
+		tooLarge := t.maxBytes > 0 && total > t.maxBytes
+		if !expired && !tooLarge {
+			// Entries are sorted oldest first, so neither applies to the
+			// rest.
+			break
+		}
+		if debug {
+			l.Debugln("pruning from trash", e.path)
+		}
+		if err := os.Remove(e.path); err != nil {
+			l.Warnln(err)
+			continue
+		}
+		total -= e.size
+		t.removeEmptyDirs(filepath.Dir(e.path))
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents within the trash, as long as
+// they are empty.
+func (t *Trash) removeEmptyDirs(dir string) {
+	for dir != t.dir && strings.HasPrefix(dir, t.dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+type byDeleted []trashEntry
+
+func (s byDeleted) Len() int           { return len(s) }
+func (s byDeleted) Less(a, b int) bool { return s[a].deleted.Before(s[b].deleted) }
+func (s byDeleted) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
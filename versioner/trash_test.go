@@ -0,0 +1,95 @@
+package versioner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrashArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	path := filepath.Join(dir, "a", "b", "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTrash(dir, 0, 0)
+	if err := tr.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("File remains after archiving")
+	}
+
+	trashed, _ := filepath.Glob(filepath.Join(dir, ".stversions", ".trash", "a", "b", "file~*"))
+	if len(trashed) != 1 {
+		t.Fatalf("Incorrect files in trash %v", trashed)
+	}
+	if data, _ := ioutil.ReadFile(trashed[0]); string(data) != "data" {
+		t.Errorf("Incorrect trashed contents %q", data)
+	}
+
+	// Archiving a file that does not exist is not an error
+	if err := tr.Archive(filepath.Join(dir, "nonexistent")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrashPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := NewTrash(dir, 7, 1)
+	now := time.Now()
+	files := map[string]time.Time{
+		"old":         now.Add(-8 * 24 * time.Hour),
+		"sub/older":   now.Add(-30 * 24 * time.Hour),
+		"large":       now.Add(-2 * 24 * time.Hour),
+		"recent":      now.Add(-time.Hour),
+		"not-ours":    time.Time{},
+		"sub/deleted": now.Add(-time.Minute),
+	}
+	for name, deleted := range files {
+		path := filepath.Join(tr.dir, name)
+		if !deleted.IsZero() {
+			path += "~" + deleted.Format(trashTimeFormat)
+		}
+		os.MkdirAll(filepath.Dir(path), 0755)
+		size := 1024
+		if name == "large" || name == "recent" {
+			size = 600 << 10
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tr.Prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old files are expired, then the oldest of the large files is
+	// removed to get below 1 MiB.
+	for name, deleted := range files {
+		path := filepath.Join(tr.dir, name)
+		if !deleted.IsZero() {
+			path += "~" + deleted.Format(trashTimeFormat)
+		}
+		_, err := os.Stat(path)
+		shouldExist := name == "recent" || name == "not-ours" || name == "sub/deleted"
+		if exists := err == nil; exists != shouldExist {
+			t.Errorf("%q: exists %v, should be %v", name, exists, shouldExist)
+		}
+	}
+}